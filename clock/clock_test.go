@@ -0,0 +1,32 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	c := NewFake(start)
+	ticker := c.NewTicker(time.Second)
+	after := c.After(2 * time.Second)
+
+	c.Advance(time.Second / 2)
+	assert.Equal(t, start.Add(time.Second/2), c.Now())
+	assert.Len(t, ticker.C(), 0)
+
+	c.Advance(time.Second / 2)
+	assert.Equal(t, start.Add(time.Second), <-ticker.C())
+	assert.Len(t, after, 0)
+
+	// Ticks are dropped when not received
+	c.Advance(time.Second)
+	c.Advance(time.Second)
+	assert.Len(t, ticker.C(), 1)
+	assert.Equal(t, start.Add(2*time.Second), <-after)
+
+	ticker.Stop()
+	assert.Equal(t, 0, c.Tickers())
+}
@@ -1,26 +1,513 @@
 package config
 
+import (
+	"math"
+	"time"
+)
+
 type Listener struct {
-	Addr     string
+	Addr string
+	// Addrs binds more addresses to the same upstream with the same settings e.g. IPv4 and IPv6 or several ports.
+	// Each address gets its own listener. Addr may be left empty when Addrs is set.
+	Addrs    []string
+	Upstream string
+	// FD is a listening socket inherited from a parent process to use instead of binding Addr.
+	// 0 binds Addr as normal since stdio is never an inherited socket.
+	FD int
+	// ReusePort sets SO_REUSEPORT so multiple processes can bind the same address.
+	// Only supported on Linux and the BSDs, other platforms bind without it.
+	ReusePort bool
+	// FailurePolicy overrides Config.ListenerFailurePolicy for this listener when set
+	FailurePolicy *ListenerFailurePolicy
+	// Tags overrides the tags of the upstream when authorizing clients of this listener.
+	// This allows e.g. an external listener to require a stricter OU than an internal one for the same upstream.
+	// The override applies to every upstream the listener routes to.
+	Tags []string
+	// RateLimit overrides Config.RateLimit for clients of this listener. Each listener with an override
+	// has its own token bucket per client so the same client can have different limits on different listeners.
+	RateLimit *RateLimit
+	// BackendTag only sends clients of this listener to backends with the tag e.g. a canary port.
+	// Upstreams without a backend with the tag reject the connection.
+	BackendTag string
+	// ALPN routes clients to an upstream by the protocol negotiated with ALPN e.g. "h2" or "postgresql".
+	// The protocols are advertised during the handshake in this order, most preferred first, and clients that
+	// don't negotiate one of them go to Upstream.
+	ALPN []ALPNRoute
+}
+
+// ALPNRoute sends clients that negotiate Protocol with ALPN to Upstream
+type ALPNRoute struct {
+	Protocol string
 	Upstream string
 }
 
+// ListenAddrs returns every address the listener binds, Addr followed by Addrs
+func (l *Listener) ListenAddrs() []string {
+	if l.Addr == "" && len(l.Addrs) > 0 {
+		return l.Addrs
+	}
+	return append([]string{l.Addr}, l.Addrs...)
+}
+
 type Upstream struct {
 	Name     string
 	Tags     []string
 	Backends []string
+	// CircuitBreaker is optional and disabled when nil
+	CircuitBreaker *CircuitBreaker
+	// DialFailurePenalty skips a backend for a short time after a dial to it fails so connections arriving
+	// together don't all pick it, unless no other backend is available. 0 disables it.
+	DialFailurePenalty time.Duration
+	// BackendTLS enables TLS for connections to the backends when set
+	BackendTLS *BackendTLS
+	// RequiredCertExtension additionally requires clients to present a certificate extension e.g. a clearance level
+	RequiredCertExtension *CertExtension
+	// MaxClientCertAge overrides Config.MaxClientCertAge for clients of this upstream when set
+	MaxClientCertAge time.Duration
+	// MaxConnsPerBackend caps the active connections of each backend. Connections are rejected once every
+	// backend is at the cap. 0 is unlimited.
+	MaxConnsPerBackend int
+	// MaxConns caps the active connections across every backend of the upstream, e.g. to protect a database the
+	// backends share. Connections over the cap are rejected or wait in Queue when it is set. 0 is unlimited.
+	MaxConns int
+	// MinHealthyBackends is how many backends must be healthy before the upstream takes connections, so one
+	// backend isn't overloaded while the rest recover. Defaults to 1.
+	MinHealthyBackends int
+	// UnhealthyPolicy defaults to cancelling the active connections of a backend when it fails its health checks
+	UnhealthyPolicy UnhealthyPolicy
+	// FailFastWhenNotReady rejects connections to an upstream that isn't ready straight away instead of giving
+	// it up to a second to become ready
+	FailFastWhenNotReady bool
+	// HealthCheckConcurrency caps the number of in-flight health probes. 0 is unlimited.
+	HealthCheckConcurrency int
+	// WarmupProbes is how many consecutive health probes a backend added to a running upstream must pass before
+	// it takes connections, so a backend that has only just started isn't sent a burst of traffic. It only applies
+	// to the first time the backend becomes healthy. 0 or 1 admits it after its first successful probe.
+	WarmupProbes int
+	// CopyBufferSize overrides the global copy buffer size for this upstream
+	CopyBufferSize int
+	// ZeroCopy skips the copy buffer so splice(2) can be used between raw TCP connections
+	ZeroCopy bool
+	// LingerAfterClientClose keeps forwarding from the backend for up to this long once the client has closed
+	// its side cleanly, e.g. so the backend can send a final error message. The backend's side is half closed so it
+	// sees the client is done. A client that goes away with an error, e.g. a reset, isn't lingered for.
+	// 0 closes both sides straight away.
+	LingerAfterClientClose time.Duration
+	// ClientDisconnectGrace gives the backend up to this long to finish its in-flight work when the client
+	// disconnects abruptly. Its response is discarded. Only safe for idempotent protocols. 0 closes straight away.
+	ClientDisconnectGrace time.Duration
+	// BackendWriteTimeout closes a connection when a write to its backend makes no progress for this long, i.e. the
+	// backend accepted the connection but stopped reading it, so the client isn't left waiting on a wedged backend.
+	// Connections with a timeout are never zero copy. 0 waits forever.
+	BackendWriteTimeout time.Duration
+	// BackendResponseTimeout closes a connection when the backend hasn't sent its first byte this long after the
+	// client's first bytes were forwarded to it, for request/response protocols where a backend can take the
+	// request and hang. Unlike an idle timeout it stops applying once the backend has responded. Connections with
+	// a timeout are never zero copy. 0 waits forever.
+	BackendResponseTimeout time.Duration
+	// Preamble is written to the backend as soon as each connection is dialed, before anything the client sends,
+	// for backends expecting a fixed banner or prologue. It is base64 in JSON configs. Nothing is sent when empty.
+	Preamble []byte
+	// LatencyWeighting sends more traffic to backends with faster health checks. Disabled when nil.
+	LatencyWeighting *LatencyWeighting
+	// HealthCheck replaces the connect only health check with a send/expect exchange when set
+	HealthCheck *HealthCheck
+	// HealthCheckAddrs maps a backend address to the address its health checks go to instead, e.g. for a backend
+	// serving traffic on :8080 and its health endpoint on :8081. Backends that aren't listed are checked on
+	// the address connections are forwarded to.
+	HealthCheckAddrs map[string]string
+	// Proxy overrides the global Proxy for this upstream
+	Proxy string
+	// BackendTags tags backends by address so connections asking for a tag only go to backends with it,
+	// e.g. a canary pool within the upstream. Tags are unrelated to Tags which authorize clients.
+	BackendTags map[string][]string
+	// BackendTagFallback defaults to rejecting connections whose tag no healthy backend has
+	BackendTagFallback BackendTagFallback
+	// DialRetries is how many other backends a connection is tried on when dialing its backend fails.
+	// Retries are limited by RetryBudget. 0 doesn't retry.
+	DialRetries int
+	// RetryBudget caps dial retries to a share of the connections to the upstream. Defaults to 10% when nil.
+	RetryBudget *RetryBudget
+	// Queue holds connections that arrive while every backend is at MaxConnsPerBackend, the upstream is at
+	// MaxConns or it isn't ready instead of rejecting them straight away. Disabled when nil.
+	Queue *ConnQueue
+	// RecoveryRamp caps the rate of new connections to a backend that has just recovered from being unhealthy.
+	// Disabled when nil.
+	RecoveryRamp *RecoveryRamp
+	// Affinity sends a client that reconnects soon after its last connection back to the same backend.
+	// Disabled when nil.
+	Affinity *Affinity
+}
+
+// Affinity keeps a client that reconnects often on one backend, e.g. so backend side caches stay warm. A client
+// that connects again within Window of its last connection is sent to the backend that connection went to if it
+// is still healthy and has room, and by least connections otherwise. It is softer than consistent hashing as
+// clients are spread by load and only stay put while they keep reconnecting.
+type Affinity struct {
+	// Window is how long after a connection the client is sent back to its backend. 0 disables affinity.
+	Window time.Duration
+	// Key defaults to recognising a reconnecting client by its identity
+	Key AffinityKey
+}
+
+// AffinityKey decides how a reconnecting client is recognised for Affinity
+type AffinityKey int
+
+const (
+	// AffinityByUser recognises a client by the identity of its certificate
+	AffinityByUser AffinityKey = iota
+	// AffinityBySourceIP recognises a client by its IP address, e.g. for clients sharing a certificate
+	AffinityBySourceIP
+)
+
+// RecoveryRamp eases a backend back in after an outage by capping the rate it is sent new connections, e.g. so a
+// backend that is slow to warm its caches or connection pools isn't overwhelmed. The cap rises linearly from
+// zero when the backend recovers to Rate at the end of Window and is then lifted. Connections the cap turns
+// away go to the other backends or fail with ErrBackendsAtCapacity like MaxConnsPerBackend.
+type RecoveryRamp struct {
+	// Rate is the new connections per second the backend is allowed by the end of the ramp
+	Rate float64
+	// Window is how long the ramp lasts. Defaults to 30s.
+	Window time.Duration
+}
+
+// ConnQueue is a FIFO queue of connections waiting for room on an upstream, e.g. to ride out a brief capacity
+// crunch or a rolling restart
+type ConnQueue struct {
+	// MaxQueued caps the waiting connections. Connections arriving while it is full are rejected straight away.
+	MaxQueued int
+	// Timeout is how long a connection waits before it is rejected. Defaults to 1s.
+	Timeout time.Duration
+}
+
+// Debug is an mTLS protected HTTP listener serving pprof and a dump of the load balancer state.
+// It is authorized like an upstream so only clients whose primary OU is in Tags are allowed.
+type Debug struct {
+	Addr string
+	Tags []string
+}
+
+// CertExtension is a client certificate extension that must be present with one of the allowed values
+type CertExtension struct {
+	// OID of the extension in dotted form e.g. 1.3.6.1.4.1.99999.1
+	OID string
+	// Values are the allowed values. Extensions holding an ASN.1 string are compared by the string
+	// and anything else by its raw DER bytes.
+	Values []string
+}
+
+// HealthCheck sends bytes to each backend and checks the response, e.g. a Redis PING expecting +PONG
+type HealthCheck struct {
+	Send []byte
+	// Expect is a substring the response must contain
+	Expect string
+	// ExpectRegexp is a regular expression the response must match and takes precedence over Expect
+	ExpectRegexp string
+	// MaxRead caps how much of the response is read. Defaults to 512 bytes.
+	MaxRead int
+}
+
+// LatencyWeighting weights backends by the smoothed latency of their health checks
+type LatencyWeighting struct {
+	// Smoothing is the EWMA factor in (0, 1] given to each new latency sample. Defaults to 0.3.
+	Smoothing float64
+	// MinWeight floors the weight of a backend as a fraction of the fastest backend so a single slow
+	// probe can't starve it of traffic. Defaults to 0.1.
+	MinWeight float64
+}
+
+// BackendTLS configures TLS for connections from the load balancer to the backends
+type BackendTLS struct {
+	// RootCA is a PEM encoded CA used to verify the backends. The system pool is used if empty.
+	RootCA []byte
+	// ClientCrt and ClientKey are an optional PEM encoded key pair used for mTLS to the backends
+	ClientCrt []byte
+	ClientKey []byte
+	// ServerName overrides the name used for SNI and verification, defaults to the backend host
+	ServerName string
+}
+
+// CircuitBreaker skips a backend after consecutive connection failures
+type CircuitBreaker struct {
+	// FailureThreshold is the number of consecutive failures before the breaker opens
+	FailureThreshold int
+	// Cooldown is how long the breaker stays open before allowing a probe connection
+	Cooldown time.Duration
+	// MinConnLifetime counts connections that close within it of being dialed as failures.
+	// Successes are only reported once a connection outlives it. 0 reports success on dial.
+	MinConnLifetime time.Duration
+	// MinRequests is how many connections a backend must have had within SampleWindow before failures can
+	// open the breaker, so a quiet backend isn't ejected for a single failed connection. 0 disables the minimum.
+	MinRequests int
+	// SampleWindow is how far back connections count towards MinRequests. Defaults to a minute.
+	SampleWindow time.Duration
+}
+
+// RetryBudget is a token bucket shared by every connection to an upstream that throttles retries during a
+// widespread outage so they don't multiply the load on backends that are already failing.
+// Each connection adds Ratio tokens and each retry takes one. Connections fail fast once it is empty.
+type RetryBudget struct {
+	// Ratio is the retries allowed per connection e.g. 0.1 allows up to 10% of connections to be retried. Defaults to 0.1.
+	Ratio float64
+	// MaxTokens caps the retries saved up while backends are healthy. Defaults to 10.
+	MaxTokens int
 }
 
 type RateLimit struct {
+	// Disabled allows every connection through without rate limiting.
+	// Setting TokenRefillPerSecond to math.MaxFloat64 has the same effect but is kept only for compatibility.
+	Disabled             bool
 	TokenRefillPerSecond float64
-	MaxTokens            int
+	// Refill takes precedence over TokenRefillPerSecond when set and can be read from text like "100/m"
+	Refill Rate
+	// MaxTokens is the burst a client can use at once after being idle. Every connection takes a token so it
+	// must be at least 1 unless BurstSeconds derives it from the refill rate.
+	MaxTokens int
+	// BurstSeconds derives MaxTokens from the refill rate when MaxTokens isn't set, e.g. 10/m with a
+	// BurstSeconds of 60 lets a client use a whole minute's worth of connections at once. Partial tokens
+	// are rounded up.
+	BurstSeconds float64
+	// Shape makes connections wait for a token instead of being rejected when the client is over its limit
+	Shape bool
+	// MaxWaitersPerClient caps the connections a single client can have waiting while shaping so a greedy
+	// client can't queue ahead of everyone else. Connections over the cap are rejected. 0 is unlimited.
+	MaxWaitersPerClient int
+	// GlobalTokensPerSecond caps the total rate of shaped connections across all clients. 0 is unlimited.
+	GlobalTokensPerSecond float64
+	// GlobalMaxTokens is the burst of the global limit
+	GlobalMaxTokens int
 }
 
+// RateLimitTiers maps a certificate attribute to a tier with its own rate limit. The attribute is the value of
+// the certificate extension OID when set, read the same way as RequiredCertExtension, and the primary OU otherwise.
+// A tier's limit takes precedence over Config.RateLimit and any listener override and each tier has its own token
+// bucket per client. Clients whose attribute isn't a tier keep the limit they would otherwise have.
+type RateLimitTiers struct {
+	// OID of the extension holding the tier in dotted form e.g. 1.3.6.1.4.1.99999.2. The primary OU is used when empty.
+	OID string
+	// Tiers maps an attribute value to the rate limit of its tier
+	Tiers map[string]*RateLimit
+}
+
+// ConnRecords writes a JSON record of each connection with its client, backend, identity, bytes copied each way
+// and start and end times once it closes. Exactly one destination must be set.
+type ConnRecords struct {
+	// File is a path the records are appended to one per line
+	File string
+	// UDPAddr is a collector each record is sent to as one datagram
+	UDPAddr string
+}
+
+// StatusFile is a JSON snapshot of every upstream and its backends' health and active connections that is
+// periodically rewritten for tools that read a file rather than scrape an endpoint
+type StatusFile struct {
+	// Path is replaced atomically on each update so readers never see a partial file
+	Path string
+	// Interval is how often the file is updated. Defaults to 10s.
+	Interval time.Duration
+}
+
+// RefillPerSecond is the rate tokens are refilled at from Refill or TokenRefillPerSecond
+func (r *RateLimit) RefillPerSecond() float64 {
+	if r.Refill > 0 {
+		return float64(r.Refill)
+	}
+	return r.TokenRefillPerSecond
+}
+
+// Burst is the bucket size of each client from MaxTokens or BurstSeconds
+func (r *RateLimit) Burst() int {
+	if r.MaxTokens > 0 || r.BurstSeconds <= 0 {
+		return r.MaxTokens
+	}
+	// Rounding error shouldn't add a token e.g. 100/m for 60 seconds is 100.00000000000001
+	burst := math.Ceil(r.RefillPerSecond()*r.BurstSeconds - 1e-9)
+	if burst >= math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return max(int(burst), 0)
+}
+
+// HandshakeRateLimit caps the rate of TLS handshakes across all listeners
+type HandshakeRateLimit struct {
+	HandshakesPerSecond float64
+	// Burst defaults to HandshakesPerSecond rounded up when below 1
+	Burst int
+}
+
+// HandshakeErrorLog samples the logs of failed TLS handshakes so internet scanners don't drown out everything else.
+// Every failure is still counted in the handshake_failed rejections.
+type HandshakeErrorLog struct {
+	// PerSecond caps the failed handshakes logged per second across all listeners
+	PerSecond float64
+	// Burst defaults to PerSecond rounded up when below 1
+	Burst int
+	// SummaryInterval is how often the number of failures that weren't logged is reported while failures keep
+	// being dropped. Defaults to 10s.
+	SummaryInterval time.Duration
+}
+
+// QueuedConnPolicy decides what happens on shutdown to connections that were accepted but not yet handled
+type QueuedConnPolicy int
+
+const (
+	// CloseQueued closes queued connections without serving them
+	CloseQueued QueuedConnPolicy = iota
+	// ServeQueued finishes the handshake and forwards queued connections
+	ServeQueued
+)
+
+// ListenerFailurePolicy decides what happens when a listener fails to accept connections
+type ListenerFailurePolicy int
+
+const (
+	// FailServer stops the whole server when any listener fails
+	FailServer ListenerFailurePolicy = iota
+	// RestartListener logs the failure and re-binds the failed listener while the others keep serving.
+	// Restarts are counted per upstream as listener_restarts in the upstreams expvar.
+	RestartListener
+	// IsolateListener logs the failure and stops only the failed listener while the others keep serving
+	IsolateListener
+)
+
+// MaxConnectionsPolicy decides what happens to new connections while Config.MaxConnections are open
+type MaxConnectionsPolicy int
+
+const (
+	// RejectOverMaxConnections closes new connections straight away
+	RejectOverMaxConnections MaxConnectionsPolicy = iota
+	// PauseAtMaxConnections stops accepting until a connection closes leaving new ones in the listen backlog
+	PauseAtMaxConnections
+)
+
+// BackendTagFallback decides what happens to a connection asking for a backend tag that no healthy backend has
+type BackendTagFallback int
+
+const (
+	// RejectWithoutTaggedBackend fails the connection with ErrNoTaggedBackend
+	RejectWithoutTaggedBackend BackendTagFallback = iota
+	// FallbackToAnyBackend sends the connection to any healthy backend of the upstream as if it had no tag,
+	// e.g. canary traffic goes to the stable backends while no canary is healthy
+	FallbackToAnyBackend
+)
+
+// UnhealthyPolicy decides what happens to the active connections of a backend that fails its health checks.
+// New connections stop going to the backend either way.
+type UnhealthyPolicy int
+
+const (
+	// CancelOnUnhealthy cancels the active connections with ErrBackendUnhealthy
+	CancelOnUnhealthy UnhealthyPolicy = iota
+	// DrainOnUnhealthy leaves the active connections alone until they close by themselves, e.g. for a backend
+	// whose health port is down while its traffic port still serves. They are counted against the backend again
+	// if it recovers and cancelled if it is removed.
+	DrainOnUnhealthy
+)
+
+// EmptyCommonNamePolicy decides how a client presenting a certificate without a CommonName is identified.
+// The identity keys the client's rate limit and is logged for auditing so it must not be shared.
+// Fallback identities start with serial: or email: and CommonNames starting with those are refused under a fallback.
+type EmptyCommonNamePolicy int
+
+const (
+	// RejectEmptyCommonName refuses clients without a CommonName
+	RejectEmptyCommonName EmptyCommonNamePolicy = iota
+	// FallbackToSerialNumber identifies clients without a CommonName by their certificate serial number
+	FallbackToSerialNumber
+	// FallbackToEmail identifies clients without a CommonName by the first email address SAN.
+	// Clients without one are refused.
+	FallbackToEmail
+)
+
+// RateLimitKey decides what a client's token bucket is keyed by
+type RateLimitKey int
+
+const (
+	// RateLimitByUser keys the bucket by the identity of the client
+	RateLimitByUser RateLimitKey = iota
+	// RateLimitByUserAndSNI gives a client a bucket per SNI hostname as "<sni>/<user>", e.g. for clients
+	// multiplexing several logical hostnames over one certificate. Connections without SNI are keyed "/<user>".
+	RateLimitByUserAndSNI
+)
+
 type Config struct {
+	// RootCA is the PEM encoded CA used to verify clients. It may be a chain of a root followed by intermediates.
+	// Only self-signed roots are trusted, intermediates must chain to one of them.
 	RootCA    []byte
 	ServerCrt []byte
 	ServerKey []byte
 	Listeners []*Listener
 	Upstreams []*Upstream
 	RateLimit *RateLimit
+	// RateLimitTiers gives clients the rate limit of the tier their certificate puts them in, e.g. gold clients
+	// a larger burst than bronze ones. Disabled when nil.
+	RateLimitTiers *RateLimitTiers
+	// RateLimitKey defaults to giving each client one token bucket whichever hostname it asks for
+	RateLimitKey RateLimitKey
+	// QueuedConnPolicy defaults to closing queued connections on shutdown
+	QueuedConnPolicy QueuedConnPolicy
+	// ListenerFailurePolicy defaults to stopping the server when a listener fails
+	ListenerFailurePolicy ListenerFailurePolicy
+	// EmptyCommonNamePolicy defaults to refusing clients whose certificate has no CommonName
+	EmptyCommonNamePolicy EmptyCommonNamePolicy
+	// QueuedDrainTimeout bounds how long connections served by ServeQueued may run after shutdown. Defaults to 30s.
+	QueuedDrainTimeout time.Duration
+	// MaxClientCertAge denies clients whose certificate was issued longer ago than this even if it hasn't expired,
+	// e.g. to force certificates to be reissued. 0 only checks expiry.
+	MaxClientCertAge time.Duration
+	// DisableTLSResumption makes every client do a full handshake instead of resuming a session with a ticket,
+	// so every connection presents its certificate again. Defaults to allowing resumption.
+	// It has nothing to do with TLS 1.3 0-RTT early data, which the listeners always refuse.
+	DisableTLSResumption bool
+	// HandshakeTimeout bounds the TLS handshake of each connection independently of how long the connection
+	// may last once forwarded. Defaults to 5s.
+	HandshakeTimeout time.Duration
+	// MaxConnections caps the connections being handshaken or forwarded across all listeners e.g. to stay within
+	// the file descriptor limit when many listeners are each under their own limits. 0 is unlimited.
+	MaxConnections int
+	// MaxConnectionsPolicy defaults to rejecting connections over MaxConnections
+	MaxConnectionsPolicy MaxConnectionsPolicy
+	// HandshakeRateLimit protects the CPU from excessive TLS handshakes and is disabled when nil
+	HandshakeRateLimit *HandshakeRateLimit
+	// HandshakeErrorLog caps how many failed handshakes are logged. Every failure is logged when nil.
+	HandshakeErrorLog *HandshakeErrorLog
+	// LogCertFingerprints adds the SHA-256 fingerprint of each client's leaf certificate to the audit log and the
+	// connection_established event, identifying the exact certificate used even after its CN has been reissued.
+	// Off by default as it hashes every certificate and lengthens every line.
+	LogCertFingerprints bool
+	// AuthorizerFailOpen allows connections when a custom authorizer returns an error instead of a decision.
+	// Explicit denials and errors from the built-in tag policy are always enforced. Defaults to failing closed.
+	AuthorizerFailOpen bool
+	// CopyBufferSize is the default size of buffers used to copy between connections. Defaults to 32KiB.
+	CopyBufferSize int
+	// Limits caps the size of the config and uses generous defaults when nil
+	Limits *Limits
+	// LogConnections logs when each forwarded connection is established and closed with a shared conn_id.
+	// Useful for long lived connections that a single log line on close says little about.
+	LogConnections bool
+	// ClassifyContent samples the first bytes each backend sends to classify them e.g. as gzip or TLS and counts
+	// connections per upstream and class in the content_classes metric. It is best effort and never changes the
+	// stream. Classified connections are never zero copy.
+	ClassifyContent bool
+	// Debug serves diagnostics over mTLS and is disabled when nil
+	Debug *Debug
+	// ControlSocket is the path of a Unix socket that accepts the drain, reload and stats commands one per line.
+	// The socket is created with mode 0600 so only the user running the load balancer can use it. Disabled when empty.
+	ControlSocket string
+	// DialLocalAddr is the local IP address connections to backends originate from.
+	// It must be assigned to this host. Defaults to letting the OS choose.
+	DialLocalAddr string
+	// ConnRecords emits a record of every connection when it closes for network accounting. Disabled when nil.
+	ConnRecords *ConnRecords
+	// AccountingTag is a template for the tag each forwarded connection is attributed to for billing e.g.
+	// "{ou}/{upstream}". The placeholders are {user}, {ou} (the primary OU), {upstream} and {sni} (the SNI the
+	// client sent). The tag is added to connection records and connections and bytes are counted per tag.
+	// Disabled when empty.
+	AccountingTag string
+	// StatusFile writes the health of every upstream to a file for external tooling. Disabled when nil.
+	StatusFile *StatusFile
+	// Proxy is the URL of a proxy backends and their health checks are reached through e.g. for locked down
+	// networks. http proxies are tunneled through with CONNECT, socks5 and socks5h with SOCKS5. Credentials
+	// in the URL authenticate to the proxy. Empty dials backends directly.
+	Proxy string
 }
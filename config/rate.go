@@ -0,0 +1,59 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate is a number of tokens per second. It is parsed from text like "100/m" so config files can use
+// the unit operators think in, and a plain number is per second.
+type Rate float64
+
+var rateUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+// ParseRate parses a rate of the form <count>/<unit> where unit is s, m or h e.g. "10/s", "100/m" or "5000/h"
+func ParseRate(s string) (Rate, error) {
+	count, unit, found := strings.Cut(strings.TrimSpace(s), "/")
+	per := time.Second
+	if found {
+		var ok bool
+		if per, ok = rateUnits[strings.TrimSpace(unit)]; !ok {
+			return 0, fmt.Errorf("invalid rate %q: unit must be s, m or h", s)
+		}
+	}
+	// Counts out of range parse as ±Inf or 0 and are rejected below
+	n, err := strconv.ParseFloat(strings.TrimSpace(count), 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return 0, fmt.Errorf("invalid rate %q: expected <count>/<unit> e.g. 100/m", s)
+	}
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("invalid rate %q: count must be a finite number", s)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("invalid rate %q: count can't be negative", s)
+	}
+	// A zero Refill is the same as not setting it so a zero rate would silently fall back to TokenRefillPerSecond
+	rate := n / per.Seconds()
+	if rate == 0 {
+		return 0, fmt.Errorf("invalid rate %q: must be more than 0, disable the rate limit instead", s)
+	}
+	return Rate(rate), nil
+}
+
+// UnmarshalText parses the rate with ParseRate
+func (r *Rate) UnmarshalText(text []byte) error {
+	rate, err := ParseRate(string(text))
+	if err != nil {
+		return err
+	}
+	*r = rate
+	return nil
+}
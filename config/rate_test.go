@@ -0,0 +1,68 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := map[string]struct {
+		rate   string
+		expect Rate
+		err    string
+	}{
+		"per second":       {rate: "10/s", expect: 10},
+		"per minute":       {rate: "120/m", expect: 2},
+		"per hour":         {rate: "5400/h", expect: 1.5},
+		"plain number":     {rate: "2.5", expect: 2.5},
+		"spaces":           {rate: " 60 / m ", expect: 1},
+		"unknown unit":     {rate: "100/d", err: "unit must be s, m or h"},
+		"missing count":    {rate: "/m", err: "expected <count>/<unit>"},
+		"not a number":     {rate: "lots/m", err: "expected <count>/<unit>"},
+		"negative":         {rate: "-1/s", err: "can't be negative"},
+		"empty":            {rate: "", err: "expected <count>/<unit>"},
+		"fractional count": {rate: "0.5/s", expect: 0.5},
+		"NaN":              {rate: "NaN/s", err: "must be a finite number"},
+		"infinite":         {rate: "Inf/m", err: "must be a finite number"},
+		"overflows":        {rate: "1e999/h", err: "must be a finite number"},
+		"zero":             {rate: "0/m", err: "must be more than 0"},
+		"underflows":       {rate: "1e-999/s", err: "must be more than 0"},
+		"rounds to zero":   {rate: "5e-324/h", err: "must be more than 0"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			rate, err := ParseRate(test.rate)
+			if test.err != "" {
+				assert.ErrorContains(t, err, test.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.InDelta(t, float64(test.expect), float64(rate), 1e-9)
+		})
+	}
+}
+
+func TestRateLimitRefill(t *testing.T) {
+	var rl RateLimit
+	assert.NoError(t, json.Unmarshal([]byte(`{"Refill": "100/m", "MaxTokens": 10}`), &rl))
+	assert.InDelta(t, 100.0/60, rl.RefillPerSecond(), 1e-9)
+
+	// The raw float is still used when Refill isn't set
+	assert.Equal(t, 3.0, (&RateLimit{TokenRefillPerSecond: 3}).RefillPerSecond())
+
+	assert.ErrorContains(t, json.Unmarshal([]byte(`{"Refill": "100/week"}`), &rl), "unit must be s, m or h")
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	// MaxTokens is used as is
+	assert.Equal(t, 10, (&RateLimit{Refill: 2, MaxTokens: 10}).Burst())
+	// A minute's worth of 100/m
+	assert.Equal(t, 100, (&RateLimit{Refill: 100.0 / 60, BurstSeconds: 60}).Burst())
+	// Partial tokens are rounded up and there is always at least one
+	assert.Equal(t, 2, (&RateLimit{Refill: 1, BurstSeconds: 1.5}).Burst())
+	assert.Equal(t, 1, (&RateLimit{Refill: 1.0 / 3600, BurstSeconds: 1}).Burst())
+	// Without a rate there is nothing to derive from
+	assert.Equal(t, 0, (&RateLimit{BurstSeconds: 60}).Burst())
+}
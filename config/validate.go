@@ -0,0 +1,246 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+)
+
+var (
+	// ErrLimitExceeded is returned by Validate when the config is larger than its Limits allow
+	ErrLimitExceeded = errors.New("config limit exceeded")
+	// ErrInvalidListener is returned by Validate for a listener address that can't be bound
+	ErrInvalidListener = errors.New("invalid listener")
+	// ErrInvalidRateLimit is returned by Validate for a rate limit that would reject every connection
+	ErrInvalidRateLimit = errors.New("invalid rate limit")
+	// ErrInvalidALPN is returned by Validate for an ALPN route that can't be negotiated or has no upstream
+	ErrInvalidALPN = errors.New("invalid ALPN route")
+)
+
+// Limits guards against pathological configs that would exhaust file descriptors or memory at startup.
+// Zero values use the defaults.
+type Limits struct {
+	MaxListeners           int
+	MaxUpstreams           int
+	MaxBackendsPerUpstream int
+	// MaxPEMBytes caps the size of each PEM encoded certificate and key e.g. RootCA, so a huge file from an
+	// untrusted location can't use up memory while it is parsed
+	MaxPEMBytes int
+}
+
+const (
+	DefaultMaxListeners           = 1024
+	DefaultMaxUpstreams           = 1024
+	DefaultMaxBackendsPerUpstream = 4096
+	DefaultMaxPEMBytes            = 4 << 20
+)
+
+// withDefaults returns the limits with any unset limit replaced by its default
+func (l *Limits) withDefaults() Limits {
+	out := Limits{}
+	if l != nil {
+		out = *l
+	}
+	if out.MaxListeners <= 0 {
+		out.MaxListeners = DefaultMaxListeners
+	}
+	if out.MaxUpstreams <= 0 {
+		out.MaxUpstreams = DefaultMaxUpstreams
+	}
+	if out.MaxBackendsPerUpstream <= 0 {
+		out.MaxBackendsPerUpstream = DefaultMaxBackendsPerUpstream
+	}
+	if out.MaxPEMBytes <= 0 {
+		out.MaxPEMBytes = DefaultMaxPEMBytes
+	}
+	return out
+}
+
+// Validate checks the config against its Limits and returns an error naming the limit that was exceeded
+func (c *Config) Validate() error {
+	limits := c.Limits.withDefaults()
+	// Every address of a listener is bound by its own socket
+	listeners := 0
+	for _, l := range c.Listeners {
+		listeners += len(l.ListenAddrs())
+	}
+	if listeners > limits.MaxListeners {
+		return fmt.Errorf("%w: %d listeners configured but MaxListeners is %d", ErrLimitExceeded, listeners, limits.MaxListeners)
+	}
+	if len(c.Upstreams) > limits.MaxUpstreams {
+		return fmt.Errorf("%w: %d upstreams configured but MaxUpstreams is %d", ErrLimitExceeded, len(c.Upstreams), limits.MaxUpstreams)
+	}
+	for _, up := range c.Upstreams {
+		if len(up.Backends) > limits.MaxBackendsPerUpstream {
+			return fmt.Errorf("%w: upstream %s has %d backends but MaxBackendsPerUpstream is %d", ErrLimitExceeded, up.Name, len(up.Backends), limits.MaxBackendsPerUpstream)
+		}
+	}
+	for _, f := range c.pemFields() {
+		if len(f.data) > limits.MaxPEMBytes {
+			return fmt.Errorf("%w: %s is %d bytes but MaxPEMBytes is %d", ErrLimitExceeded, f.name, len(f.data), limits.MaxPEMBytes)
+		}
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidRateLimit, err)
+	}
+	for _, l := range c.Listeners {
+		if err := l.RateLimit.validate(); err != nil {
+			return fmt.Errorf("%w: listener for upstream %s: %w", ErrInvalidRateLimit, l.Upstream, err)
+		}
+	}
+	if c.RateLimitTiers != nil {
+		for tier, rl := range c.RateLimitTiers.Tiers {
+			if rl == nil {
+				return fmt.Errorf("%w: tier %s has no rate limit", ErrInvalidRateLimit, tier)
+			}
+			if err := rl.validate(); err != nil {
+				return fmt.Errorf("%w: tier %s: %w", ErrInvalidRateLimit, tier, err)
+			}
+		}
+	}
+	if err := c.validateALPN(); err != nil {
+		return err
+	}
+	return c.validateListenerAddrs()
+}
+
+// validateALPN checks every ALPN route names a protocol once and goes to a configured upstream
+func (c *Config) validateALPN() error {
+	upstreams := map[string]bool{}
+	for _, up := range c.Upstreams {
+		upstreams[up.Name] = true
+	}
+	for _, l := range c.Listeners {
+		protocols := map[string]bool{}
+		for _, route := range l.ALPN {
+			switch {
+			case route.Protocol == "":
+				return fmt.Errorf("%w: listener for upstream %s has a route without a protocol", ErrInvalidALPN, l.Upstream)
+			case protocols[route.Protocol]:
+				return fmt.Errorf("%w: listener for upstream %s routes protocol %s twice", ErrInvalidALPN, l.Upstream, route.Protocol)
+			case !upstreams[route.Upstream]:
+				return fmt.Errorf("%w: listener for upstream %s routes protocol %s to unknown upstream %q", ErrInvalidALPN, l.Upstream, route.Protocol, route.Upstream)
+			}
+			protocols[route.Protocol] = true
+		}
+	}
+	return nil
+}
+
+// pemField is a PEM encoded certificate or key in the config with a name to report it by
+type pemField struct {
+	name string
+	data []byte
+}
+
+// pemFields returns every PEM encoded certificate and key in the config
+func (c *Config) pemFields() []pemField {
+	fields := []pemField{{"RootCA", c.RootCA}, {"ServerCrt", c.ServerCrt}, {"ServerKey", c.ServerKey}}
+	for _, up := range c.Upstreams {
+		if tlsCfg := up.BackendTLS; tlsCfg != nil {
+			fields = append(fields,
+				pemField{"upstream " + up.Name + " BackendTLS.RootCA", tlsCfg.RootCA},
+				pemField{"upstream " + up.Name + " BackendTLS.ClientCrt", tlsCfg.ClientCrt},
+				pemField{"upstream " + up.Name + " BackendTLS.ClientKey", tlsCfg.ClientKey},
+			)
+		}
+	}
+	return fields
+}
+
+// validate checks the burst and refill rate make sense together. A nil or disabled rate limit is always valid.
+func (r *RateLimit) validate() error {
+	if r == nil || r.Disabled {
+		return nil
+	}
+	refill := r.RefillPerSecond()
+	switch {
+	case refill < 0 || r.MaxTokens < 0 || r.BurstSeconds < 0:
+		return errors.New("refill, MaxTokens and BurstSeconds can't be negative")
+	case r.MaxTokens > 0 && r.BurstSeconds > 0:
+		return errors.New("set either MaxTokens or BurstSeconds, not both")
+	// The MaxFloat64 refill convention allows everything without any tokens
+	case refill == math.MaxFloat64:
+	case r.Burst() == 0:
+		return errors.New("MaxTokens is 0 so every connection would be rejected, set MaxTokens or BurstSeconds or use Disabled")
+	}
+	if r.GlobalTokensPerSecond > 0 && r.GlobalMaxTokens <= 0 {
+		return errors.New("GlobalMaxTokens must be at least 1 with GlobalTokensPerSecond or every shaped connection would be rejected")
+	}
+	return nil
+}
+
+// validateListenerAddrs checks every listener address can be bound and that no two listeners bind the same one.
+// A wildcard address binds its port on every host so it also overlaps any other address on its port.
+// Listeners that take over an inherited socket have nothing to check. Ephemeral ports and listeners that
+// all set ReusePort may share an address.
+func (c *Config) validateListenerAddrs() error {
+	// boundAddr is an address bound by a listener, keyed by port below
+	type boundAddr struct {
+		host string
+		addr string
+		l    *Listener
+	}
+	bound := map[string][]boundAddr{}
+	for _, l := range c.Listeners {
+		if l.FD != 0 {
+			if len(l.Addrs) > 0 {
+				return fmt.Errorf("%w: listener for upstream %s can't set Addrs with an inherited FD", ErrInvalidListener, l.Upstream)
+			}
+			continue
+		}
+		for _, listenAddr := range l.ListenAddrs() {
+			addr, err := normalizeListenAddr(listenAddr)
+			if err != nil {
+				return fmt.Errorf("%w: listener for upstream %s: %w", ErrInvalidListener, l.Upstream, err)
+			}
+			if addr == "" {
+				continue
+			}
+			host, port, _ := net.SplitHostPort(addr)
+			for _, other := range bound[port] {
+				if other.l.ReusePort && l.ReusePort {
+					continue
+				}
+				if other.host == host {
+					return fmt.Errorf("%w: listeners for upstreams %s and %s both bind %s", ErrInvalidListener, other.l.Upstream, l.Upstream, listenAddr)
+				}
+				if other.host == "" || host == "" {
+					return fmt.Errorf("%w: listeners for upstreams %s and %s bind overlapping addresses %s and %s", ErrInvalidListener, other.l.Upstream, l.Upstream, other.addr, listenAddr)
+				}
+			}
+			bound[port] = append(bound[port], boundAddr{host: host, addr: listenAddr, l: l})
+		}
+	}
+	return nil
+}
+
+// normalizeListenAddr returns addr in a form where equal addresses compare equal, or "" for an ephemeral port
+// which can be bound any number of times. Wildcard addresses such as :9000, 0.0.0.0:9000 and [::]:9000 all have
+// an empty host. Hostnames must resolve.
+func normalizeListenAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	portNum, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return "", fmt.Errorf("invalid port in address %s: %w", addr, err)
+	}
+	if portNum == 0 {
+		return "", nil
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		host = ip.Unmap().String()
+		if ip.IsUnspecified() {
+			host = ""
+		}
+	} else if host != "" {
+		if _, err := net.LookupHost(host); err != nil {
+			return "", fmt.Errorf("address %s does not resolve: %w", addr, err)
+		}
+	}
+	return net.JoinHostPort(host, fmt.Sprint(portNum)), nil
+}
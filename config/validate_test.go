@@ -0,0 +1,256 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newSizedConfig(listeners, upstreams, backends int) *Config {
+	cfg := &Config{}
+	for i := range listeners {
+		cfg.Listeners = append(cfg.Listeners, &Listener{Addr: fmt.Sprintf("127.0.0.1:%d", 9000+i), Upstream: "up0"})
+	}
+	for i := range upstreams {
+		up := &Upstream{Name: fmt.Sprintf("up%d", i)}
+		for j := range backends {
+			up.Backends = append(up.Backends, fmt.Sprintf("127.0.0.1:%d", 8000+j))
+		}
+		cfg.Upstreams = append(cfg.Upstreams, up)
+	}
+	return cfg
+}
+
+func TestValidateLimits(t *testing.T) {
+	limits := &Limits{MaxListeners: 2, MaxUpstreams: 3, MaxBackendsPerUpstream: 4}
+	tests := map[string]struct {
+		cfg    *Config
+		expect string
+	}{
+		"at the limits":           {cfg: newSizedConfig(2, 3, 4)},
+		"too many listeners":      {cfg: newSizedConfig(3, 3, 4), expect: "MaxListeners"},
+		"too many upstreams":      {cfg: newSizedConfig(2, 4, 4), expect: "MaxUpstreams"},
+		"too many backends":       {cfg: newSizedConfig(2, 3, 5), expect: "MaxBackendsPerUpstream"},
+		"empty config is allowed": {cfg: newSizedConfig(0, 0, 0)},
+		"every address counts": {cfg: &Config{Listeners: []*Listener{
+			{Addrs: []string{"127.0.0.1:9000", "127.0.0.1:9001", "127.0.0.1:9002"}, Upstream: "up0"},
+		}}, expect: "MaxListeners"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test.cfg.Limits = limits
+			err := test.cfg.Validate()
+			if test.expect == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrLimitExceeded)
+			assert.ErrorContains(t, err, test.expect)
+		})
+	}
+}
+
+func TestValidateDefaultLimits(t *testing.T) {
+	assert.NoError(t, newSizedConfig(DefaultMaxListeners, 1, DefaultMaxBackendsPerUpstream).Validate())
+	assert.ErrorIs(t, newSizedConfig(DefaultMaxListeners+1, 1, 0).Validate(), ErrLimitExceeded)
+	assert.ErrorIs(t, newSizedConfig(0, DefaultMaxUpstreams+1, 0).Validate(), ErrLimitExceeded)
+	assert.ErrorIs(t, newSizedConfig(0, 1, DefaultMaxBackendsPerUpstream+1).Validate(), ErrLimitExceeded)
+}
+
+func TestValidatePEMSize(t *testing.T) {
+	limits := &Limits{MaxPEMBytes: 16}
+	blob := func(n int) []byte { return bytes.Repeat([]byte("A"), n) }
+	tests := map[string]struct {
+		cfg    *Config
+		expect string
+	}{
+		"at the limit":     {cfg: &Config{RootCA: blob(16), ServerCrt: blob(16), ServerKey: blob(16)}},
+		"oversized RootCA": {cfg: &Config{RootCA: blob(17)}, expect: "RootCA is 17 bytes but MaxPEMBytes is 16"},
+		"oversized key":    {cfg: &Config{ServerKey: blob(17)}, expect: "ServerKey is 17 bytes"},
+		"oversized backend CA": {cfg: &Config{Upstreams: []*Upstream{{Name: "db", BackendTLS: &BackendTLS{RootCA: blob(17)}}}},
+			expect: "upstream db BackendTLS.RootCA is 17 bytes"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test.cfg.Limits = limits
+			err := test.cfg.Validate()
+			if test.expect == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrLimitExceeded)
+			assert.ErrorContains(t, err, test.expect)
+		})
+	}
+	// The default is generous enough for a long chain but bounded
+	assert.NoError(t, (&Config{RootCA: blob(DefaultMaxPEMBytes)}).Validate())
+	assert.ErrorIs(t, (&Config{RootCA: blob(DefaultMaxPEMBytes + 1)}).Validate(), ErrLimitExceeded)
+}
+
+func TestValidateListenerAddrs(t *testing.T) {
+	tests := map[string]struct {
+		listeners []*Listener
+		expect    string
+	}{
+		"distinct addresses": {listeners: []*Listener{
+			{Addr: "127.0.0.1:9000", Upstream: "web"},
+			{Addr: "127.0.0.1:9001", Upstream: "db"},
+		}},
+		"ephemeral ports can repeat": {listeners: []*Listener{
+			{Addr: "127.0.0.1:0", Upstream: "web"},
+			{Addr: "127.0.0.1:0", Upstream: "db"},
+		}},
+		"reuse port can repeat": {listeners: []*Listener{
+			{Addr: "127.0.0.1:9000", Upstream: "web", ReusePort: true},
+			{Addr: "127.0.0.1:9000", Upstream: "web", ReusePort: true},
+		}},
+		"inherited sockets are skipped": {listeners: []*Listener{
+			{FD: 3, Upstream: "web"},
+			{FD: 4, Upstream: "db"},
+		}},
+		"duplicate address": {listeners: []*Listener{
+			{Addr: "127.0.0.1:9000", Upstream: "web"},
+			{Addr: "127.0.0.1:9000", Upstream: "db"},
+		}, expect: "listeners for upstreams web and db both bind 127.0.0.1:9000"},
+		"duplicate address written differently": {listeners: []*Listener{
+			{Addr: "[::ffff:127.0.0.1]:9000", Upstream: "web"},
+			{Addr: "127.0.0.1:9000", Upstream: "db"},
+		}, expect: "both bind"},
+		"wildcard overlaps a specific host": {listeners: []*Listener{
+			{Addr: ":9000", Upstream: "web"},
+			{Addr: "127.0.0.1:9000", Upstream: "db"},
+		}, expect: "listeners for upstreams web and db bind overlapping addresses :9000 and 127.0.0.1:9000"},
+		"specific host overlaps a later wildcard": {listeners: []*Listener{
+			{Addr: "127.0.0.1:9000", Upstream: "web"},
+			{Addr: "0.0.0.0:9000", Upstream: "db"},
+		}, expect: "overlapping addresses"},
+		"IPv6 wildcard overlaps a specific host": {listeners: []*Listener{
+			{Addr: "[::]:9000", Upstream: "web"},
+			{Addr: "[::1]:9000", Upstream: "db"},
+		}, expect: "overlapping addresses"},
+		"wildcards written differently": {listeners: []*Listener{
+			{Addr: ":9000", Upstream: "web"},
+			{Addr: "[::]:9000", Upstream: "db"},
+		}, expect: "both bind"},
+		"wildcard on another port": {listeners: []*Listener{
+			{Addr: ":9000", Upstream: "web"},
+			{Addr: "127.0.0.1:9001", Upstream: "db"},
+		}},
+		"wildcard and specific host with reuse port": {listeners: []*Listener{
+			{Addr: ":9000", Upstream: "web", ReusePort: true},
+			{Addr: "127.0.0.1:9000", Upstream: "web", ReusePort: true},
+		}},
+		"wildcard and specific host with reuse port on one": {listeners: []*Listener{
+			{Addr: ":9000", Upstream: "web", ReusePort: true},
+			{Addr: "127.0.0.1:9000", Upstream: "web"},
+		}, expect: "overlapping addresses"},
+		"missing port": {listeners: []*Listener{
+			{Addr: "127.0.0.1", Upstream: "web"},
+		}, expect: "listener for upstream web"},
+		"invalid port": {listeners: []*Listener{
+			{Addr: "127.0.0.1:99999", Upstream: "web"},
+		}, expect: "invalid port"},
+		"unresolvable host": {listeners: []*Listener{
+			{Addr: "gobalancer.invalid:9000", Upstream: "web"},
+		}, expect: "does not resolve"},
+		"several addresses": {listeners: []*Listener{
+			{Addr: "127.0.0.1:9000", Addrs: []string{"[::1]:9000", "127.0.0.1:9001"}, Upstream: "web"},
+		}},
+		"duplicate of another listener's addresses": {listeners: []*Listener{
+			{Addrs: []string{"127.0.0.1:9000", "127.0.0.1:9001"}, Upstream: "web"},
+			{Addr: "127.0.0.1:9001", Upstream: "db"},
+		}, expect: "listeners for upstreams web and db both bind 127.0.0.1:9001"},
+		"duplicate within one listener": {listeners: []*Listener{
+			{Addr: "127.0.0.1:9000", Addrs: []string{"127.0.0.1:9000"}, Upstream: "web"},
+		}, expect: "both bind"},
+		"invalid address among several": {listeners: []*Listener{
+			{Addrs: []string{"127.0.0.1:9000", "127.0.0.1"}, Upstream: "web"},
+		}, expect: "listener for upstream web"},
+		"addresses with an inherited socket": {listeners: []*Listener{
+			{FD: 3, Addrs: []string{"127.0.0.1:9000"}, Upstream: "web"},
+		}, expect: "inherited FD"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := (&Config{Listeners: test.listeners}).Validate()
+			if test.expect == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrInvalidListener)
+			assert.ErrorContains(t, err, test.expect)
+		})
+	}
+}
+
+func TestValidateALPN(t *testing.T) {
+	tests := map[string]struct {
+		routes []ALPNRoute
+		expect string
+	}{
+		"routes to known upstreams": {routes: []ALPNRoute{{Protocol: "postgresql", Upstream: "db"}, {Protocol: "h2", Upstream: "web"}}},
+		"no routes":                 {},
+		"unknown upstream":          {routes: []ALPNRoute{{Protocol: "postgresql", Upstream: "dbb"}}, expect: `routes protocol postgresql to unknown upstream "dbb"`},
+		"missing upstream":          {routes: []ALPNRoute{{Protocol: "postgresql"}}, expect: "unknown upstream"},
+		"missing protocol":          {routes: []ALPNRoute{{Upstream: "db"}}, expect: "route without a protocol"},
+		"protocol routed twice":     {routes: []ALPNRoute{{Protocol: "h2", Upstream: "web"}, {Protocol: "h2", Upstream: "db"}}, expect: "routes protocol h2 twice"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := (&Config{
+				Listeners: []*Listener{{Addr: "127.0.0.1:0", Upstream: "web", ALPN: test.routes}},
+				Upstreams: []*Upstream{{Name: "web"}, {Name: "db"}},
+			}).Validate()
+			if test.expect == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrInvalidALPN)
+			assert.ErrorContains(t, err, test.expect)
+		})
+	}
+}
+
+func TestValidateRateLimit(t *testing.T) {
+	tests := map[string]struct {
+		rl     *RateLimit
+		expect string
+	}{
+		"burst and refill":           {rl: &RateLimit{TokenRefillPerSecond: 1, MaxTokens: 10}},
+		"burst without refill":       {rl: &RateLimit{MaxTokens: 10}},
+		"burst derived from refill":  {rl: &RateLimit{Refill: 2, BurstSeconds: 30}},
+		"disabled needs no burst":    {rl: &RateLimit{Disabled: true}},
+		"max float refill":           {rl: &RateLimit{TokenRefillPerSecond: math.MaxFloat64}},
+		"no burst":                   {rl: &RateLimit{TokenRefillPerSecond: 1}, expect: "every connection would be rejected"},
+		"nothing set":                {rl: &RateLimit{}, expect: "every connection would be rejected"},
+		"burst derived without rate": {rl: &RateLimit{BurstSeconds: 30}, expect: "every connection would be rejected"},
+		"burst set twice":            {rl: &RateLimit{Refill: 2, MaxTokens: 10, BurstSeconds: 30}, expect: "not both"},
+		"negative burst":             {rl: &RateLimit{TokenRefillPerSecond: 1, MaxTokens: -1}, expect: "negative"},
+		"global rate without burst": {rl: &RateLimit{MaxTokens: 10, Shape: true, GlobalTokensPerSecond: 5},
+			expect: "GlobalMaxTokens"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := (&Config{RateLimit: test.rl}).Validate()
+			if test.expect == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrInvalidRateLimit)
+			assert.ErrorContains(t, err, test.expect)
+		})
+	}
+
+	// Listener overrides are checked too
+	err := (&Config{Listeners: []*Listener{{Addr: "127.0.0.1:0", Upstream: "web", RateLimit: &RateLimit{}}}}).Validate()
+	assert.ErrorIs(t, err, ErrInvalidRateLimit)
+	assert.ErrorContains(t, err, "listener for upstream web")
+
+	// And so are tiers
+	err = (&Config{RateLimitTiers: &RateLimitTiers{Tiers: map[string]*RateLimit{"gold": {TokenRefillPerSecond: 1}}}}).Validate()
+	assert.ErrorIs(t, err, ErrInvalidRateLimit)
+	assert.ErrorContains(t, err, "tier gold")
+}
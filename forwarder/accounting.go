@@ -0,0 +1,48 @@
+package forwarder
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// accountingFields are the placeholders an accounting tag template may use
+var accountingFields = []string{"user", "ou", "upstream", "sni"}
+
+// accountingTag renders the accounting tag of a connection from the config template e.g. "{ou}/{upstream}"
+type accountingTag struct {
+	template string
+}
+
+// parseAccountingTag checks the template only uses known placeholders. An empty template disables tagging.
+func parseAccountingTag(template string) (*accountingTag, error) {
+	if template == "" {
+		return nil, nil
+	}
+	rest := template
+	for {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("AccountingTag %q has an unopened }", template)
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("AccountingTag %q has an unclosed {", template)
+		}
+		field := rest[open+1 : open+end]
+		if !slices.Contains(accountingFields, field) {
+			return nil, fmt.Errorf("AccountingTag %q has unknown placeholder {%s}, expected one of %v", template, field, accountingFields)
+		}
+		rest = rest[open+end+1:]
+	}
+	return &accountingTag{template: template}, nil
+}
+
+// render fills in the template for a connection. ou is the primary OU of the client and sni the SNI it sent,
+// both empty without an identity.
+func (a *accountingTag) render(user string, ou string, upstream string, sni string) string {
+	return strings.NewReplacer("{user}", user, "{ou}", ou, "{upstream}", upstream, "{sni}", sni).Replace(a.template)
+}
@@ -0,0 +1,83 @@
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"expvar"
+	"io"
+	"testing"
+
+	"github.com/doggydogworld/gobalancer/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAccountingTag(t *testing.T) {
+	tests := map[string]struct {
+		template string
+		expect   string
+	}{
+		"every placeholder":    {template: "{user}@{ou}/{upstream}/{sni}"},
+		"no placeholders":      {template: "flat-rate"},
+		"unknown placeholder":  {template: "{ou}/{backend}", expect: "unknown placeholder {backend}"},
+		"brace in placeholder": {template: "{ou/{upstream}", expect: "unknown placeholder {ou/{upstream}"},
+		"unclosed at the end":  {template: "{ou}/{upstream", expect: "unclosed {"},
+		"unopened":             {template: "ou}/{upstream}", expect: "unopened }"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseAccountingTag(test.template)
+			if test.expect == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, test.expect)
+		})
+	}
+	// The template is checked before anything is started
+	_, err := NewLeastConnectionsFromConfig(context.Background(), &config.Config{AccountingTag: "{backend}"})
+	assert.ErrorContains(t, err, "AccountingTag")
+}
+
+func TestAccountingTag(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := newHoldingBackend(t)
+	defer backend.Close()
+	fwdr := newSingleBackendForwarder(t, ctx, backend.Addr().String())
+	var err error
+	fwdr.accounting, err = parseAccountingTag("{ou}/{upstream}/{sni}")
+	assert.NoError(t, err)
+	rec := &memoryRecorder{records: make(chan ConnRecord, 1)}
+	fwdr.SetConnRecorder(rec)
+
+	identities := []*Identity{
+		{User: "alice", OUs: []string{"sre", "oncall"}},
+		{User: "bob", OUs: []string{"sre"}},
+		{User: "carol", OUs: []string{"dba"}, ServerName: "db.internal"},
+	}
+	var tags []string
+	for _, id := range identities {
+		client, errc := forwardOne(t, WithIdentity(ctx, id), fwdr, "test")
+		// The backend sends hello\n and the client sends ping\n
+		if _, err := bufio.NewReader(client).ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(client, "ping\n")
+		client.Close()
+		assert.NoError(t, <-errc)
+		tags = append(tags, (<-rec.records).AccountingTag)
+	}
+	assert.Equal(t, []string{"sre/test/", "sre/test/", "dba/test/db.internal"}, tags)
+
+	counters := func(tag string) map[string]string {
+		m, ok := fwdr.manager.Metrics.Accounting.Get(tag).(*expvar.Map)
+		if !ok {
+			return nil
+		}
+		out := map[string]string{}
+		m.Do(func(kv expvar.KeyValue) { out[kv.Key] = kv.Value.String() })
+		return out
+	}
+	assert.Equal(t, map[string]string{"connections": "2", "bytes_sent": "10", "bytes_received": "12"}, counters("sre/test/"))
+	assert.Equal(t, map[string]string{"connections": "1", "bytes_sent": "5", "bytes_received": "6"}, counters("dba/test/db.internal"))
+}
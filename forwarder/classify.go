@@ -0,0 +1,72 @@
+package forwarder
+
+import (
+	"bytes"
+	"io"
+)
+
+// sniffLen is how many bytes from the start of what the backend sends are used to classify it
+const sniffLen = 8
+
+// Content classes counted by the content_classes metric
+const (
+	ContentTLS    = "tls"
+	ContentGzip   = "gzip"
+	ContentZstd   = "zstd"
+	ContentHTTP   = "http"
+	ContentText   = "text"
+	ContentBinary = "binary"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// classifyContent guesses what a stream is from its first bytes. It is best effort, e.g. a binary protocol
+// that happens to start with printable bytes is classed as text.
+func classifyContent(p []byte) string {
+	switch {
+	// A TLS record starts with its content type, 20 to 23, and a major version of 3
+	case len(p) >= 3 && p[0] >= 0x14 && p[0] <= 0x17 && p[1] == 0x03:
+		return ContentTLS
+	case bytes.HasPrefix(p, gzipMagic):
+		return ContentGzip
+	case bytes.HasPrefix(p, zstdMagic):
+		return ContentZstd
+	case bytes.HasPrefix(p, []byte("HTTP/")):
+		return ContentHTTP
+	}
+	for _, b := range p {
+		if (b < 0x20 || b > 0x7e) && b != '\t' && b != '\r' && b != '\n' {
+			return ContentBinary
+		}
+	}
+	return ContentText
+}
+
+// classifyingReader classifies a stream from its first sniffLen bytes as they are read, or from fewer if the
+// stream ends first, and passes the class to classified once. What is read is left untouched.
+type classifyingReader struct {
+	io.Reader
+	sniffed    []byte
+	done       bool
+	classified func(class string)
+}
+
+func (r *classifyingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if r.done {
+		return n, err
+	}
+	r.sniffed = append(r.sniffed, p[:min(n, sniffLen-len(r.sniffed))]...)
+	if len(r.sniffed) == sniffLen || err != nil {
+		r.done = true
+		// A backend that sent nothing isn't counted
+		if len(r.sniffed) > 0 {
+			r.classified(classifyContent(r.sniffed))
+		}
+		r.sniffed = nil
+	}
+	return n, err
+}
@@ -0,0 +1,77 @@
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"expvar"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.WriteString(zw, s)
+	assert.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestClassifyContent(t *testing.T) {
+	tests := map[string]struct {
+		stream []byte
+		expect string
+	}{
+		"gzip":           {stream: gzipped(t, "hello world"), expect: ContentGzip},
+		"plaintext":      {stream: []byte("+OK ready\r\n"), expect: ContentText},
+		"http":           {stream: []byte("HTTP/1.1 200 OK\r\n"), expect: ContentHTTP},
+		"tls":            {stream: []byte{0x16, 0x03, 0x03, 0x00, 0x7a, 0x02}, expect: ContentTLS},
+		"zstd":           {stream: []byte{0x28, 0xb5, 0x2f, 0xfd, 0x04, 0x00}, expect: ContentZstd},
+		"binary":         {stream: []byte{0x00, 0x00, 0x00, 0x0c, 'h', 'i'}, expect: ContentBinary},
+		"short text":     {stream: []byte("hi\n"), expect: ContentText},
+		"nothing counts": {stream: nil},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var classes []string
+			// One byte at a time so the first bytes are split across reads
+			r := &classifyingReader{Reader: iotest.OneByteReader(bytes.NewReader(test.stream)), classified: func(class string) {
+				classes = append(classes, class)
+			}}
+			out, err := io.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, string(test.stream), string(out), "the stream must not be changed")
+			if test.expect == "" {
+				assert.Empty(t, classes)
+				return
+			}
+			assert.Equal(t, []string{test.expect}, classes)
+		})
+	}
+}
+
+func TestClassifyContentMetric(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := newHoldingBackend(t)
+	defer backend.Close()
+	fwdr := newSingleBackendForwarder(t, ctx, backend.Addr().String())
+	fwdr.classify = true
+
+	client, errc := forwardOne(t, ctx, fwdr, "test")
+	line, err := bufio.NewReader(client).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", line)
+	client.Close()
+	assert.NoError(t, <-errc)
+
+	classes, ok := fwdr.manager.Metrics.ContentClasses.Get("test").(*expvar.Map)
+	if !ok {
+		t.Fatal("no content classes were counted for the upstream")
+	}
+	assert.Equal(t, "1", classes.Get(ContentText).String())
+}
@@ -0,0 +1,138 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo is a point in time snapshot of a forwarded connection
+type ConnInfo struct {
+	// ID correlates the connection with its lifecycle logs and is available from ConnIDFromContext
+	ID string
+	// User is the authenticated client or the rate limiter key when no identity was provided
+	User     string
+	Client   string
+	Upstream string
+	Backend  string
+	Started  time.Time
+	// BytesSent is copied from the client to the backend and BytesReceived from the backend to the client.
+	// Upstreams using ZeroCopy only count the bytes of a direction once it has finished.
+	BytesSent     int64
+	BytesReceived int64
+	// TLSVersion and CipherSuite are the names of what the client negotiated, empty without an identity
+	TLSVersion  string
+	CipherSuite string
+	// TLSResumed is set when the client resumed an earlier TLS session
+	TLSResumed bool
+	// ServerName is the SNI the client sent, empty when it didn't send one or without an identity
+	ServerName string `json:",omitempty"`
+	// AccountingTag is rendered from the AccountingTag template, empty when it isn't configured
+	AccountingTag string `json:",omitempty"`
+}
+
+type connIDKey struct{}
+
+// WithConnID returns a copy of ctx carrying the ID of the connection it belongs to.
+// Forward uses the ID it finds in ctx and otherwise generates one.
+func WithConnID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, connIDKey{}, id)
+}
+
+// ConnIDFromContext returns the ID of the connection carried by ctx if there is one
+func ConnIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(connIDKey{}).(string)
+	return id, ok
+}
+
+// newConnID generates a random connection ID
+func newConnID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logConnClosed logs the closing of a connection that was logged when it was established
+func logConnClosed(logger *slog.Logger, rec *connRecord, reason CloseReason, err error) {
+	attrs := []any{
+		"conn_id", rec.info.ID,
+		"upstream", rec.info.Upstream,
+		"backend", rec.info.Backend,
+		"client", rec.info.Client,
+		"duration", rec.info.Age(),
+		"bytes_sent", rec.sent.Load(),
+		"bytes_received", rec.received.Load(),
+		"reason", string(reason),
+	}
+	if err != nil {
+		attrs = append(attrs, "error", err.Error())
+	}
+	logger.Info("connection_closed", attrs...)
+}
+
+// Age is how long the connection has been open
+func (c ConnInfo) Age() time.Duration {
+	return time.Since(c.Started)
+}
+
+type connRecord struct {
+	info     ConnInfo
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+// connRegistry holds a record of every connection that is currently being forwarded
+type connRegistry struct {
+	conns map[*connRecord]struct{}
+	mu    sync.Mutex
+}
+
+func (r *connRegistry) add(info ConnInfo) *connRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns == nil {
+		r.conns = map[*connRecord]struct{}{}
+	}
+	rec := &connRecord{info: info}
+	r.conns[rec] = struct{}{}
+	return rec
+}
+
+func (r *connRegistry) remove(rec *connRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, rec)
+}
+
+// snapshot returns all active connections, oldest first
+func (r *connRegistry) snapshot() []ConnInfo {
+	r.mu.Lock()
+	infos := make([]ConnInfo, 0, len(r.conns))
+	for rec := range r.conns {
+		info := rec.info
+		info.BytesSent = rec.sent.Load()
+		info.BytesReceived = rec.received.Load()
+		infos = append(infos, info)
+	}
+	r.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Started.Before(infos[j].Started) })
+	return infos
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	io.Writer
+	n *atomic.Int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,64 @@
+package forwarder
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultCopyBufferSize = 32 * 1024
+
+// bufferPools holds a *sync.Pool of copy buffers per buffer size
+var bufferPools sync.Map
+
+func getBuffer(size int) *[]byte {
+	p, ok := bufferPools.Load(size)
+	if !ok {
+		p, _ = bufferPools.LoadOrStore(size, &sync.Pool{
+			New: func() any {
+				b := make([]byte, size)
+				return &b
+			},
+		})
+	}
+	return p.(*sync.Pool).Get().(*[]byte)
+}
+
+func putBuffer(size int, b *[]byte) {
+	if p, ok := bufferPools.Load(size); ok {
+		p.(*sync.Pool).Put(b)
+	}
+}
+
+// hide the ReaderFrom/WriterTo implementations of connections so io.CopyBuffer uses the buffer it is given
+type onlyWriter struct{ io.Writer }
+type onlyReader struct{ io.Reader }
+
+// copyConn copies from src to dst using a pooled buffer of the given size.
+//
+// With zeroCopy the buffer is skipped and io.Copy is left to use ReaderFrom/WriterTo which uses splice(2)
+// on Linux. That only kicks in when both sides are raw TCP connections so it doesn't apply to client
+// connections that were accepted through a TLS listener (*tls.Conn).
+func copyConn(dst io.Writer, src io.Reader, size int, zeroCopy bool) (int64, error) {
+	if zeroCopy {
+		return io.Copy(dst, src)
+	}
+	if size <= 0 {
+		size = defaultCopyBufferSize
+	}
+	buf := getBuffer(size)
+	defer putBuffer(size, buf)
+	return io.CopyBuffer(onlyWriter{dst}, onlyReader{src}, *buf)
+}
+
+// copyCounted is copyConn that adds the bytes copied to n as they are written
+func copyCounted(dst io.Writer, src io.Reader, size int, zeroCopy bool, n *atomic.Int64) error {
+	if zeroCopy {
+		// Wrapping dst would hide its ReaderFrom and rule out splice(2) so count once the copy has finished
+		copied, err := copyConn(dst, src, size, true)
+		n.Add(copied)
+		return err
+	}
+	_, err := copyConn(countingWriter{Writer: dst, n: n}, src, size, false)
+	return err
+}
@@ -0,0 +1,210 @@
+package forwarder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyConn(t *testing.T) {
+	data := bytes.Repeat([]byte("gobalancer"), 10000)
+	for _, zeroCopy := range []bool{false, true} {
+		dst := &bytes.Buffer{}
+		n, err := copyConn(dst, bytes.NewReader(data), 1024, zeroCopy)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(data)), n)
+		assert.Equal(t, data, dst.Bytes())
+	}
+	// Buffers are reused from a pool per size
+	buf := getBuffer(1024)
+	assert.Len(t, *buf, 1024)
+	putBuffer(1024, buf)
+}
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(b testing.TB) (net.Conn, net.Conn) {
+	l := mustListen(b)
+	defer l.Close()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := l.Accept()
+		accepted <- result{conn, err}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := <-accepted
+	if r.err != nil {
+		conn.Close()
+		b.Fatal(r.err)
+	}
+	return conn, r.conn
+}
+
+// BenchmarkCopyBufferSize copies 1MiB from one TCP connection to another through copyConn
+func BenchmarkCopyBufferSize(b *testing.B) {
+	payload := bytes.Repeat([]byte{'x'}, 1<<20)
+	cases := []struct {
+		size     int
+		zeroCopy bool
+	}{
+		{size: 4 << 10},
+		{size: 32 << 10},
+		{size: 256 << 10},
+		{zeroCopy: true},
+	}
+	for _, c := range cases {
+		name := fmt.Sprintf("buffer=%dKiB", c.size>>10)
+		if c.zeroCopy {
+			name = "zerocopy"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				// Only the copy is timed, not setting up the connections
+				b.StopTimer()
+				srcW, srcR := tcpPair(b)
+				dstW, dstR := tcpPair(b)
+				b.StartTimer()
+
+				go func() {
+					srcW.Write(payload)
+					srcW.Close()
+				}()
+				type result struct {
+					n   int64
+					err error
+				}
+				copied := make(chan result, 1)
+				go func() {
+					n, err := copyConn(dstW, srcR, c.size, c.zeroCopy)
+					dstW.Close()
+					copied <- result{n, err}
+				}()
+				io.Copy(io.Discard, dstR)
+				r := <-copied
+
+				b.StopTimer()
+				srcR.Close()
+				dstR.Close()
+				if r.err != nil {
+					b.Fatal(r.err)
+				}
+				if r.n != int64(len(payload)) {
+					b.Fatalf("expected to copy %d bytes got %d", len(payload), r.n)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// spawnBoth relays a connection the way fwd used to, copying each direction on its own goroutine
+// while the caller waits for both
+func spawnBoth(client net.Conn, backend net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		copyConn(client, backend, defaultCopyBufferSize, false)
+		client.Close()
+		done <- struct{}{}
+	}()
+	go func() {
+		copyConn(backend, client, defaultCopyBufferSize, false)
+		backend.Close()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// spawnOne relays a connection the way fwd does, copying from the client on the caller's goroutine
+func spawnOne(client net.Conn, backend net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		copyConn(client, backend, defaultCopyBufferSize, false)
+		client.Close()
+	}()
+	copyConn(backend, client, defaultCopyBufferSize, false)
+	backend.Close()
+	<-done
+}
+
+// BenchmarkRelay keeps conns connections open through a relay to an echo backend and round trips
+// a message over each of them per op. stack-bytes/conn is the goroutine stack held by each relayed connection.
+func BenchmarkRelay(b *testing.B) {
+	relays := []struct {
+		name  string
+		relay func(client net.Conn, backend net.Conn)
+	}{
+		{name: "spawn=2", relay: spawnBoth},
+		{name: "spawn=1", relay: spawnOne},
+	}
+	msg := bytes.Repeat([]byte{'x'}, 512)
+	for _, conns := range []int{100, 1000} {
+		for _, r := range relays {
+			b.Run(fmt.Sprintf("conns=%d/%s", conns, r.name), func(b *testing.B) {
+				clients := make([]net.Conn, conns)
+				var relayed sync.WaitGroup
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				for i := range clients {
+					client, in := tcpPair(b)
+					out, backend := tcpPair(b)
+					go func() {
+						io.Copy(backend, backend)
+						backend.Close()
+					}()
+					relayed.Add(1)
+					go func() {
+						defer relayed.Done()
+						// The caller of the relay is a goroutine per connection too e.g. the listener's handler
+						r.relay(in, out)
+					}()
+					clients[i] = client
+				}
+				// Every relay has to be blocked reading before its stack is counted
+				for _, client := range clients {
+					client.Write(msg)
+					io.ReadFull(client, make([]byte, len(msg)))
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+
+				buf := make([]byte, len(msg))
+				b.SetBytes(int64(len(msg) * conns))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					for _, client := range clients {
+						if _, err := client.Write(msg); err != nil {
+							b.Fatal(err)
+						}
+					}
+					for _, client := range clients {
+						if _, err := io.ReadFull(client, buf); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+				b.StopTimer()
+				b.ReportMetric(float64(after.StackInuse-before.StackInuse)/float64(conns), "stack-bytes/conn")
+				for _, client := range clients {
+					client.Close()
+				}
+				relayed.Wait()
+			})
+		}
+	}
+}
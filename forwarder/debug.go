@@ -0,0 +1,56 @@
+package forwarder
+
+import (
+	"slices"
+
+	"github.com/doggydogworld/gobalancer/forwarder/upstream"
+)
+
+// DebugState is a point in time dump of the forwarder for diagnostics
+type DebugState struct {
+	// Upstreams holds the backends of every upstream with their health and active connections
+	Upstreams map[string][]upstream.BackendInfo
+	// Paused lists the upstreams that are rejecting new connections
+	Paused      []string
+	RateLimiter RateLimiterState
+	Connections []ConnInfo
+}
+
+// RateLimiterState holds the sizes of the rate limiter maps which grow with the number of clients.
+// Clients of listeners with their own rate limit are counted once per limiter.
+type RateLimiterState struct {
+	// Clients is the number of clients with a token bucket
+	Clients int
+	// Waiters is the number of clients with connections waiting for a token
+	Waiters int
+	// Evicted counts the token buckets that have been dropped since the forwarder started, which is the
+	// buckets forgotten by ResetRateLimit and ResetAllRateLimits. Together with Clients it shows whether
+	// the number of buckets keeps growing with the number of distinct clients.
+	Evicted int64
+}
+
+// DebugState dumps the state of the upstreams, rate limiter and active connections.
+// Each part is read under its own lock so they may be slightly out of step with each other.
+func (l *LeastConnections) DebugState() DebugState {
+	state := DebugState{
+		Upstreams:   map[string][]upstream.BackendInfo{},
+		Connections: l.ActiveConnections(),
+	}
+	l.manager.Upstreams.Range(func(key, value any) bool {
+		up := value.(*upstream.Upstream)
+		state.Upstreams[up.Name] = up.Backends()
+		if up.Paused() {
+			state.Paused = append(state.Paused, up.Name)
+		}
+		return true
+	})
+	slices.Sort(state.Paused)
+	l.eachRateLimiter(func(rl *perClientRateLimiter) {
+		rl.mu.Lock()
+		state.RateLimiter.Clients += len(rl.clientRL)
+		state.RateLimiter.Waiters += len(rl.waiters)
+		state.RateLimiter.Evicted += rl.evicted
+		rl.mu.Unlock()
+	})
+	return state
+}
@@ -2,95 +2,725 @@ package forwarder
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/doggydogworld/gobalancer/config"
 	"github.com/doggydogworld/gobalancer/forwarder/upstream"
-	"golang.org/x/time/rate"
 )
 
+// ErrBackendNotReading is returned by Forward for a connection closed because its backend stopped reading it
+// for longer than the upstream's BackendWriteTimeout
+var ErrBackendNotReading = errors.New("backend not reading")
+
+// ErrBackendNoResponse is returned by Forward for a connection closed because its backend sent nothing for longer
+// than the upstream's BackendResponseTimeout after the client's first bytes
+var ErrBackendNoResponse = errors.New("backend sent no response")
+
 type FwdInfo struct {
 	Upstream       string
 	Conn           net.Conn
 	RateLimiterKey string
+	// RateLimit overrides the rate limit of the forwarder e.g. for connections from one listener.
+	// Connections passing the same *RateLimit share a limiter per client separate from the default one.
+	RateLimit *config.RateLimit
+	// RateLimitID names the owner of RateLimit e.g. the listener, so connections with the same ID share a limiter
+	// even when the *RateLimit is rebuilt with the same settings, e.g. by restarting the listener. Clients keep
+	// their token buckets until the settings change. Overrides without an ID are told apart by the pointer.
+	RateLimitID string
+	// BackendTag only sends the connection to backends of the upstream with the tag when set
+	BackendTag string
+	// Metadata carries extra per connection data for custom forwarders. The server sets the Metadata keys below
+	// and embedders wrapping the server can add their own. LeastConnections doesn't use it.
+	Metadata map[string]any
 }
 
+// Metadata keys set by the server on every forwarded connection
+const (
+	// MetadataListener is the address of the listener that accepted the connection as a string
+	MetadataListener = "listener"
+	// MetadataALPN is the protocol negotiated with ALPN as a string, empty when none was
+	MetadataALPN = "alpn"
+	// MetadataSNI is the server name requested by the client as a string, empty when it didn't send one
+	MetadataSNI = "sni"
+	// MetadataIdentity is the *Identity of the client, the same one IdentityFromContext returns
+	MetadataIdentity = "identity"
+)
+
 type LeastConnections struct {
 	ratelimit *perClientRateLimiter
+	// limiter replaces the built in limiters for every connection when set
+	limiter RateLimiter
+	// overrides holds an *overrideLimiter per FwdInfo.RateLimitID, or per *config.RateLimit without an ID
+	overrides sync.Map
 	d         net.Dialer
 	manager   *upstream.Manager
+	// copyBufferSize is the default for upstreams that don't set their own
+	copyBufferSize int
+	// conns records every connection that is being forwarded
+	conns connRegistry
+	// logConns logs when each connection is established and closed
+	logConns bool
+	// recorder receives a record of each connection when it closes
+	recorder ConnRecorder
+	// observer is given the bytes of each connection when set
+	observer StreamObserver
+	// accounting tags each connection for billing when set
+	accounting *accountingTag
+	// classify counts connections by what their backend sends first
+	classify bool
+	// closeRecorder closes the recorder created from ConnRecords when set
+	closeRecorder func() error
+	// closed is closed by the first call to stop
+	closed    chan struct{}
+	closeOnce sync.Once
+	logger    *slog.Logger
 }
 
 func NewLeastConnectionsFromConfig(ctx context.Context, cfg *config.Config) (*LeastConnections, error) {
+	localAddr, err := dialLocalAddr(cfg.DialLocalAddr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.StatusFile != nil && cfg.StatusFile.Path == "" {
+		return nil, errors.New("StatusFile must set a Path")
+	}
+	accounting, err := parseAccountingTag(cfg.AccountingTag)
+	if err != nil {
+		return nil, err
+	}
 	m := upstream.NewManager()
+	m.DefaultProxy = cfg.Proxy
+	if cfg.StatusFile != nil {
+		m.StatusFile = cfg.StatusFile.Path
+		m.StatusInterval = cfg.StatusFile.Interval
+	}
+	m.PublishMetrics()
 	go m.Start()
+	for _, up := range cfg.Upstreams {
+		if err := m.LoadUpstreamFromConfig(up); err != nil {
+			// Stop the heartbeats of the upstreams that were already loaded
+			m.Stop()
+			return nil, err
+		}
+	}
+	l := &LeastConnections{
+		manager:        m,
+		copyBufferSize: cfg.CopyBufferSize,
+		ratelimit:      newPerClientRateLimiter(cfg.RateLimit),
+		logConns:       cfg.LogConnections,
+		recorder:       nopRecorder{},
+		accounting:     accounting,
+		classify:       cfg.ClassifyContent,
+		closed:         make(chan struct{}),
+		logger:         slog.Default(),
+	}
+	if cfg.ConnRecords != nil {
+		rec, err := newConnRecorderFromConfig(cfg.ConnRecords)
+		if err != nil {
+			m.Stop()
+			return nil, err
+		}
+		l.recorder = rec
+		l.closeRecorder = rec.Close
+	}
+	if localAddr != nil {
+		l.d.LocalAddr = localAddr
+	}
 	go func() {
-		<-ctx.Done()
-		m.Stop()
+		select {
+		case <-ctx.Done():
+			l.stop()
+		case <-l.closed:
+		}
 	}()
-	for _, up := range cfg.Upstreams {
-		m.LoadUpstreamFromConfig(up)
-	}
-	return &LeastConnections{
-		manager: m,
-		ratelimit: &perClientRateLimiter{
-			maxTokens:            cfg.RateLimit.MaxTokens,
-			tokenRefillPerSecond: cfg.RateLimit.TokenRefillPerSecond,
-			clientRL:             make(map[string]*rate.Limiter),
-		},
-	}, nil
-}
-
-// fwd forwards a connection that was inflight completing its journey
-func (l *LeastConnections) fwd(ctx context.Context, in FwdInfo, backend string) error {
-	errc := make(chan error)
-	upConn, err := l.d.DialContext(ctx, "tcp", backend)
+	return l, nil
+}
+
+// stop stops the manager and closes the recorder opened from the config. It is safe to call more than once.
+func (l *LeastConnections) stop() {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.manager.Stop()
+		if l.closeRecorder != nil {
+			l.closeRecorder()
+		}
+	})
+}
+
+// Close stops the forwarder as cancelling the ctx it was created with does, then waits until every health
+// check and the upstream manager's event loop have finished. It returns the ctx error if ctx is done first.
+// Connections that are still being forwarded aren't closed, that is left to Server.Shutdown.
+func (l *LeastConnections) Close(ctx context.Context) error {
+	l.stop()
+	return l.manager.Shutdown(ctx)
+}
+
+// dialLocalAddr parses the local address backend connections originate from.
+// Binding to it up front catches addresses that aren't assigned to this host at startup
+// rather than on the first dial.
+func dialLocalAddr(addr string) (*net.TCPAddr, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("DialLocalAddr %q is not a valid IP address", addr)
+	}
+	local := &net.TCPAddr{IP: ip}
+	l, err := net.ListenTCP("tcp", local)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("DialLocalAddr %q is not a local address: %w", addr, err)
+	}
+	l.Close()
+	return local, nil
+}
+
+// readyWait is how long a connection waits for a cold upstream to become ready
+const readyWait = time.Second
+
+// waitForReady gives a cold upstream a moment to become ready but stops waiting if the client goes away.
+// An upstream that is ready, which is nearly every connection, only costs an atomic load.
+// Upstreams set to fail fast are never waited for.
+func waitForReady(ctx context.Context, up *upstream.Upstream) {
+	if up.Status.Load() == int32(upstream.READY) || up.FailFast() {
+		return
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, readyWait)
+	defer cancel()
+	up.WaitForReadyCtx(waitCtx)
+}
+
+// closeOnDone closes the connections once ctx is done.
+// io.Copy blocks on the network and ignores ctx so closing the connections is the only way
+// to make a blocked Read/Write return e.g. for an idle connection to a removed backend.
+// The returned func stops the watcher and should be called once copying has finished.
+func closeOnDone(ctx context.Context, conns ...net.Conn) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+}
+
+// lingerAfterClientClose half closes the backend connection so the backend sees the client is done
+// and then waits for up to linger for the backend to finish sending e.g. a final error message.
+func lingerAfterClientClose(upConn net.Conn, backendDone <-chan struct{}, linger time.Duration) {
+	if cw, ok := upConn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	t := time.NewTimer(linger)
+	defer t.Stop()
+	select {
+	case <-backendDone:
+	case <-t.C:
+	}
+}
+
+// discardOnError passes writes through until one fails and then discards the rest.
+// It lets the backend finish writing a response after the client it was meant for is gone.
+type discardOnError struct {
+	io.Writer
+	failed bool
+}
+
+func (w *discardOnError) Write(p []byte) (int, error) {
+	if !w.failed {
+		if _, err := w.Writer.Write(p); err == nil {
+			return len(p), nil
+		}
+		w.failed = true
+	}
+	return len(p), nil
+}
+
+// writeTimeoutWriter fails a write to the backend that doesn't complete within timeout.
+// A write only blocks once the socket buffers are full so it times out when the backend has stopped reading.
+type writeTimeoutWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w writeTimeoutWriter) Write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	n, err := w.conn.Write(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = fmt.Errorf("%w: no progress writing to it for %s", ErrBackendNotReading, w.timeout)
+	}
+	return n, err
+}
+
+// responseTimer closes the backend's side of a connection that sends nothing for timeout after the client's
+// first bytes were written to it. It is started by the first write to the backend and stopped by the first
+// byte read from it. Expiring sets a read deadline in the past so the blocked read from the backend fails.
+type responseTimer struct {
+	conn    net.Conn
+	timeout time.Duration
+
+	mu        sync.Mutex
+	timer     *time.Timer
+	responded bool
+	expired   bool
+}
+
+func (r *responseTimer) start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer == nil && !r.responded {
+		r.timer = time.AfterFunc(r.timeout, r.expire)
+	}
+}
+
+func (r *responseTimer) expire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.responded {
+		r.expired = true
+		r.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// received stops the timer once the backend has responded. A response racing the timer wins and the deadline
+// is lifted again.
+func (r *responseTimer) received() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.responded {
+		return
+	}
+	r.responded = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if r.expired {
+		r.expired = false
+		r.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func (r *responseTimer) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+}
+
+// timedOut reports if err is the read from the backend failing because the timer expired
+func (r *responseTimer) timedOut(err error) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.expired && errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// responseWriter starts the response timer on the first write to the backend
+type responseWriter struct {
+	io.Writer
+	timer *responseTimer
+}
+
+func (w responseWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if n > 0 {
+		w.timer.start()
+	}
+	return n, err
+}
+
+// responseReader stops the response timer on the first byte read from the backend
+type responseReader struct {
+	io.Reader
+	timer *responseTimer
+}
+
+func (r responseReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.timer.received()
+	} else if r.timer.timedOut(err) {
+		err = fmt.Errorf("%w: nothing received for %s", ErrBackendNoResponse, r.timer.timeout)
+	}
+	return n, err
+}
+
+// affinityClient returns what the client of a connection is recognised by for the affinity of up, empty when up
+// has no affinity. Clients without an identity fall back to their rate limiter key.
+func affinityClient(ctx context.Context, info FwdInfo, up *upstream.Upstream) string {
+	key, ok := up.AffinityKey()
+	if !ok {
+		return ""
+	}
+	if key == config.AffinityBySourceIP {
+		remote := info.Conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(remote); err == nil {
+			return host
+		}
+		return remote
+	}
+	if id, ok := IdentityFromContext(ctx); ok {
+		return id.User
+	}
+	return info.RateLimiterKey
+}
+
+// fwd forwards a connection that was inflight completing its journey and reports why it ended
+func (l *LeastConnections) fwd(ctx context.Context, in FwdInfo, up *upstream.Upstream, backend string, upConn net.Conn) (CloseReason, error) {
+	errc := make(chan error, 1)
+	// ended receives each direction as soon as its copy finishes, before any lingering, so the first is the side that closed
+	ended := make(chan copyResult, 2)
+	var err error
+	// A backend that accepts and then drops connections straight away is just as broken as one that refuses them
+	// so success is only reported once the connection has outlived the minimum lifetime.
+	var lived *time.Timer
+	if minLifetime := up.MinConnLifetime(); minLifetime > 0 {
+		lived = time.AfterFunc(minLifetime, func() {
+			up.ReportSuccess(backend)
+		})
+		defer lived.Stop()
+	} else {
+		up.ReportSuccess(backend)
+	}
+
+	stop := closeOnDone(ctx, upConn, in.Conn)
+	defer stop()
+
+	bufSize := l.copyBufferSize
+	if size := up.CopyBufferSize(); size > 0 {
+		bufSize = size
+	}
+	zeroCopy := up.ZeroCopy()
+
+	info := ConnInfo{
+		User:     in.RateLimiterKey,
+		Client:   in.Conn.RemoteAddr().String(),
+		Upstream: in.Upstream,
+		Backend:  backend,
+		Started:  time.Now(),
+	}
+	var ou, fingerprint string
+	if id, ok := IdentityFromContext(ctx); ok {
+		info.User = id.User
+		fingerprint = id.CertFingerprint
+		if len(id.OUs) > 0 {
+			ou = id.OUs[0]
+		}
+		// Identities that weren't created from a TLS connection have no version
+		if id.TLSVersion != 0 {
+			info.TLSVersion = tls.VersionName(id.TLSVersion)
+			info.CipherSuite = tls.CipherSuiteName(id.CipherSuite)
+			info.TLSResumed = id.Resumed
+		}
+		info.ServerName = id.ServerName
+	}
+	if l.accounting != nil {
+		info.AccountingTag = l.accounting.render(info.User, ou, in.Upstream, info.ServerName)
+	}
+	// Forward made sure ctx carries an ID
+	info.ID, _ = ConnIDFromContext(ctx)
+	rec := l.conns.add(info)
+	defer l.conns.remove(rec)
+	if l.logConns {
+		attrs := []any{"conn_id", info.ID, "upstream", in.Upstream, "backend", backend,
+			"client", info.Client, "user", info.User, "tls_version", info.TLSVersion, "cipher_suite", info.CipherSuite,
+			"tls_resumed", info.TLSResumed}
+		if fingerprint != "" {
+			attrs = append(attrs, "cert_fingerprint", fingerprint)
+		}
+		if info.ServerName != "" {
+			attrs = append(attrs, "sni", info.ServerName)
+		}
+		l.logger.Info("connection_established", attrs...)
+	}
+
+	linger := up.LingerAfterClientClose()
+	grace := up.ClientDisconnectGrace()
+	backendDone := make(chan struct{})
+	var toClient io.Writer = in.Conn
+	if grace > 0 {
+		// Keep reading from the backend once the client is gone so it isn't cut off mid response
+		toClient = &discardOnError{Writer: in.Conn}
+	}
+	var toBackend io.Writer = upConn
+	if timeout := up.BackendWriteTimeout(); timeout > 0 {
+		toBackend = writeTimeoutWriter{conn: upConn, timeout: timeout}
+		// Splicing would write to the backend without the deadline
+		zeroCopy = false
+	}
+	var fromBackend io.Reader = upConn
+	if timeout := up.BackendResponseTimeout(); timeout > 0 {
+		timer := &responseTimer{conn: upConn, timeout: timeout}
+		defer timer.stop()
+		fromBackend = responseReader{Reader: upConn, timer: timer}
+		toBackend = responseWriter{Writer: toBackend, timer: timer}
+		// Both directions have to be watched so neither can be spliced
+		zeroCopy = false
+	}
+	if l.classify {
+		fromBackend = &classifyingReader{Reader: fromBackend, classified: func(class string) {
+			l.manager.Metrics.AddContentClass(in.Upstream, class)
+		}}
+		// The first bytes have to pass through userspace to be classified
+		zeroCopy = false
+	}
+	if l.observer != nil {
+		if observe := l.observer(info); observe != nil {
+			toClient = observingWriter{Writer: toClient, dir: BackendToClient, observe: observe}
+			toBackend = observingWriter{Writer: toBackend, dir: ClientToBackend, observe: observe}
+			// The observer has to see the bytes so they can't be spliced between the sockets
+			zeroCopy = false
+		}
 	}
 
-	// Connect both connections by copying in both connections
+	// Connect both connections by copying in both directions. The backend to client direction gets its own
+	// goroutine while the client to backend direction is copied on this one, which saves a goroutine
+	// stack per connection and adds up with many open connections. See BenchmarkRelay.
 	go func() {
+		defer close(backendDone)
 		defer upConn.Close()
 		defer in.Conn.Close()
-		_, err := io.Copy(in.Conn, upConn)
+		err := copyCounted(toClient, fromBackend, bufSize, zeroCopy, &rec.received)
+		ended <- copyResult{fromBackend: true, err: err}
 		errc <- err
 	}()
-	go func() {
+	err = func() error {
 		defer upConn.Close()
 		defer in.Conn.Close()
-		_, err := io.Copy(upConn, in.Conn)
-		errc <- err
+		err := copyCounted(toBackend, in.Conn, bufSize, zeroCopy, &rec.sent)
+		ended <- copyResult{err: err}
+		switch {
+		case err == nil && linger > 0:
+			lingerAfterClientClose(upConn, backendDone, linger)
+		case grace > 0:
+			lingerAfterClientClose(upConn, backendDone, grace)
+		}
+		// The error is from the direction that finished first. Until the connections are closed
+		// the backend direction can only have finished on its own.
+		select {
+		case backendErr := <-errc:
+			return backendErr
+		default:
+			return err
+		}
 	}()
-
-	err = <-errc
-	errors.Join(err, <-errc)
+	<-backendDone
+	reason := closeReason(ctx, <-ended)
+	// Connections cancelled by us e.g. a removed backend or shutdown say nothing about the backend
+	if ctx.Err() != nil {
+		err = context.Cause(ctx)
+	} else if diedEarly := lived != nil && lived.Stop(); diedEarly || err != nil {
+		up.ReportFailure(backend)
+	}
+	if l.logConns {
+		logConnClosed(l.logger, rec, reason, err)
+	}
+	record := ConnRecord{ConnInfo: rec.info, Ended: time.Now(), Reason: reason}
+	record.BytesSent = rec.sent.Load()
+	record.BytesReceived = rec.received.Load()
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if record.AccountingTag != "" {
+		l.manager.Metrics.AddAccounting(record.AccountingTag, record.BytesSent, record.BytesReceived)
+	}
+	l.recorder.Record(record)
 	if err != nil {
 		err = fmt.Errorf("failed to forward connection: %w", err)
 	}
-	return err
+	return reason, err
+}
+
+// SetStreamObserver installs an observer that is given the bytes of each forwarded connection as they are copied.
+// Connections it observes are never zero copy. It must be called before connections are forwarded. nil removes it.
+func (l *LeastConnections) SetStreamObserver(o StreamObserver) {
+	l.observer = o
+}
+
+// SetDialer replaces the dialer used to connect to backends, e.g. to set a timeout or a Control function, including
+// the local address from DialLocalAddr. It must be called before connections are forwarded.
+func (l *LeastConnections) SetDialer(d *net.Dialer) {
+	l.d = *d
+}
+
+// SetConnRecorder replaces the recorder that receives a record of each connection when it closes.
+// It must be called before connections are forwarded. nil stops recording.
+func (l *LeastConnections) SetConnRecorder(r ConnRecorder) {
+	if r == nil {
+		r = nopRecorder{}
+	}
+	l.recorder = r
+}
+
+// ActiveConnections returns a snapshot of every connection that is currently being forwarded, oldest first
+func (l *LeastConnections) ActiveConnections() []ConnInfo {
+	return l.conns.snapshot()
+}
+
+// ResetRateLimit gives a client a full token bucket straight away instead of waiting for it to refill
+func (l *LeastConnections) ResetRateLimit(key string) {
+	l.eachRateLimiter(func(rl *perClientRateLimiter) { rl.Reset(key) })
+}
+
+// ResetAllRateLimits gives every client a full token bucket
+func (l *LeastConnections) ResetAllRateLimits() {
+	l.eachRateLimiter((*perClientRateLimiter).ResetAll)
+}
+
+// PauseUpstream rejects new connections to the upstream with upstream.ErrUpstreamPaused until it is resumed
+func (l *LeastConnections) PauseUpstream(name string) error {
+	return l.manager.PauseUpstream(name)
+}
+
+// ResumeUpstream lets new connections through to a paused upstream
+func (l *LeastConnections) ResumeUpstream(name string) error {
+	return l.manager.ResumeUpstream(name)
+}
+
+// LoadUpstream adds an upstream or applies a new config to an existing one, e.g. from a reload or service
+// discovery. See upstream.Manager.LoadUpstreamFromConfig.
+func (l *LeastConnections) LoadUpstream(cfg *config.Upstream) error {
+	return l.manager.LoadUpstreamFromConfig(cfg)
+}
+
+// UpstreamConfigs returns the config every upstream is running with, including changes loaded since the forwarder
+// was created
+func (l *LeastConnections) UpstreamConfigs() []*config.Upstream {
+	return l.manager.UpstreamConfigs()
+}
+
+// SetRateLimiter replaces the token buckets built from the config with rl for every connection, including those
+// with a RateLimit override. ResetRateLimit and the debug state only cover the built in limiters.
+// It must be called before connections are forwarded. nil goes back to the built in limiters.
+func (l *LeastConnections) SetRateLimiter(rl RateLimiter) {
+	l.limiter = rl
+}
+
+// overrideLimiter is the limiter of a rate limit override with the settings it was built from
+type overrideLimiter struct {
+	cfg config.RateLimit
+	rl  *perClientRateLimiter
+}
+
+// rateLimiter returns the limiter for a connection. That is the one set with SetRateLimiter, otherwise the
+// default one unless it is overridden.
+func (l *LeastConnections) rateLimiter(override *config.RateLimit, id string) RateLimiter {
+	if l.limiter != nil {
+		return l.limiter
+	}
+	if override == nil {
+		return l.ratelimit
+	}
+	var key any = override
+	if id != "" {
+		key = id
+	}
+	if o, ok := l.overrides.Load(key); ok && o.(*overrideLimiter).cfg == *override {
+		return o.(*overrideLimiter).rl
+	}
+	next := &overrideLimiter{cfg: *override, rl: newPerClientRateLimiter(override)}
+	for {
+		o, loaded := l.overrides.LoadOrStore(key, next)
+		if !loaded || o.(*overrideLimiter).cfg == *override {
+			return o.(*overrideLimiter).rl
+		}
+		// The settings changed so the old buckets no longer apply
+		l.overrides.CompareAndDelete(key, o)
+	}
+}
+
+// RecordListenerRestart counts a listener for upstream that was bound again after failing
+func (l *LeastConnections) RecordListenerRestart(upstream string) {
+	l.manager.Metrics.ListenerRestarts.Add(upstream, 1)
+}
+
+// ForgetRateLimit drops the limiter of the rate limit override with the id, e.g. once the listener it belonged
+// to no longer overrides the rate limit, so its token buckets don't stay in memory
+func (l *LeastConnections) ForgetRateLimit(id string) {
+	l.overrides.Delete(id)
+}
+
+// eachRateLimiter calls f with the default limiter and every override
+func (l *LeastConnections) eachRateLimiter(f func(rl *perClientRateLimiter)) {
+	f(l.ratelimit)
+	l.overrides.Range(func(_, o any) bool {
+		f(o.(*overrideLimiter).rl)
+		return true
+	})
 }
 
 func (l *LeastConnections) Forward(ctx context.Context, info FwdInfo) error {
-	if err := l.ratelimit.rateLimit(info.RateLimiterKey); err != nil {
-		return err
+	if _, ok := ConnIDFromContext(ctx); !ok {
+		ctx = WithConnID(ctx, newConnID())
+	}
+	reason, err := l.forward(ctx, info)
+	l.manager.Metrics.AddCloseReason(info.Upstream, string(reason))
+	return err
+}
+
+// forward is Forward returning why the connection ended
+func (l *LeastConnections) forward(ctx context.Context, info FwdInfo) (CloseReason, error) {
+	err := l.rateLimiter(info.RateLimit, info.RateLimitID).Allow(ctx, info.RateLimiterKey)
+	if err != nil {
+		return RateLimited, err
 	}
 	fmt.Println("Getting upstream")
 	up, err := l.manager.GetUpstream(info.Upstream)
 	if err != nil {
-		return err
+		return NoBackend, err
 	}
-	up.WaitForReady(time.Second)
+	waitForReady(ctx, up)
 	fmt.Println("Getting ctx")
-	backend, ctx, cancel, err := up.NextWithContext(ctx)
-	if err != nil {
-		return err
+	up.AddRetryCredit()
+	var tried []string
+	var dialErr error
+	client := affinityClient(ctx, info, up)
+	for {
+		backend, backendCtx, cancel, err := up.NextQueued(ctx, upstream.Selection{Exclude: tried, Tag: info.BackendTag, Client: client})
+		if errors.Is(err, upstream.ErrUpstreamNotReady) {
+			l.manager.Metrics.NotReadyRejections.Add(info.Upstream, 1)
+		}
+		if errors.Is(err, upstream.ErrUpstreamAtCapacity) {
+			l.manager.Metrics.CapacityRejections.Add(info.Upstream, 1)
+		}
+		if err != nil {
+			// Retries only go to backends that haven't been tried so running out of them ends the retries
+			if dialErr != nil {
+				return DialFailed, dialErr
+			}
+			return NoBackend, err
+		}
+		upConn, err := up.Dial(backendCtx, &l.d, backend)
+		if preamble := up.Preamble(); err == nil && len(preamble) > 0 {
+			// A backend that can't take the preamble is treated like one that couldn't be dialed
+			if _, err = upConn.Write(preamble); err != nil {
+				upConn.Close()
+				err = fmt.Errorf("failed to write preamble to backend %s: %w", backend, err)
+			}
+		}
+		if err == nil {
+			defer cancel()
+			fmt.Println("Forwarding")
+			return l.fwd(backendCtx, info, up, backend, upConn)
+		}
+		cancel()
+		up.ReportDialFailure(backend)
+		dialErr = err
+		tried = append(tried, backend)
+		if len(tried) > up.DialRetries() || ctx.Err() != nil {
+			return DialFailed, dialErr
+		}
+		// A shared budget keeps retries from piling onto an upstream that is failing as a whole
+		if !up.SpendRetry() {
+			l.manager.Metrics.RetryBudgetExhausted.Add(info.Upstream, 1)
+			return DialFailed, dialErr
+		}
+		l.manager.Metrics.DialRetries.Add(info.Upstream, 1)
+		l.logger.Warn("dial_retry", "upstream", info.Upstream, "backend", backend, "error", err.Error())
 	}
-	defer cancel()
-	fmt.Println("Forwarding")
-	return l.fwd(ctx, info, backend)
 }
@@ -1,17 +1,32 @@
 package forwarder
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
-	"math"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/doggydogworld/gobalancer/config"
+	"github.com/doggydogworld/gobalancer/forwarder/upstream"
+	"github.com/stretchr/testify/assert"
 	"go.uber.org/goleak"
 	"golang.org/x/sync/errgroup"
 )
@@ -47,9 +62,7 @@ func setupServersAndConfig() (*config.Config, map[string][]*httptest.Server, err
 	addrs["telemetry"] = telemetry
 	return &config.Config{
 		RateLimit: &config.RateLimit{
-			// Setting to maxfloat64 disables the rate limiter for testing
-			TokenRefillPerSecond: math.MaxFloat64,
-			MaxTokens:            0,
+			Disabled: true,
 		},
 		Upstreams: []*config.Upstream{
 			{
@@ -199,7 +212,6 @@ func BenchmarkForwarder(b *testing.B) {
 		b.Fatalf("could not start test servers")
 	}
 	fwdr, err := NewLeastConnectionsFromConfig(ctx, cfg)
-	fwdr.ratelimit.tokenRefillPerSecond = math.MaxFloat64
 	if err != nil {
 		b.Fatalf("could not start forwarder")
 	}
@@ -248,3 +260,1378 @@ func BenchmarkForwarder(b *testing.B) {
 		wg.Wait()
 	}
 }
+
+func TestForwarderBackendTLS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Backend only speaks TLS
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "secure")
+	}))
+	defer backend.Close()
+	rootCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+
+	cfg := &config.Config{
+		RateLimit: &config.RateLimit{
+			Disabled: true,
+		},
+		Upstreams: []*config.Upstream{
+			{
+				Name:     "secure",
+				Backends: []string{backend.Listener.Addr().String()},
+				BackendTLS: &config.BackendTLS{
+					RootCA: rootCA,
+				},
+			},
+		},
+	}
+	fwdr, err := NewLeastConnectionsFromConfig(ctx, cfg)
+	if err != nil {
+		t.Fatalf("could not start forwarder: %v", err)
+	}
+	l := mustListen(t)
+	defer l.Close()
+	go acceptAndFwd(fwdr, "secure", l)
+
+	// The client speaks plaintext to the load balancer which re-encrypts to the backend
+	if err := doRequests(5, l.Addr().String(), "secure"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestForwarderBackendTLSInvalidCA(t *testing.T) {
+	cfg := &config.Config{
+		RateLimit: &config.RateLimit{},
+		Upstreams: []*config.Upstream{
+			{
+				Name:       "secure",
+				BackendTLS: &config.BackendTLS{RootCA: []byte("not a cert")},
+			},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := NewLeastConnectionsFromConfig(ctx, cfg); err == nil {
+		t.Fatal("expected invalid backend CA to fail")
+	}
+}
+
+// newHoldingBackend accepts connections, greets them and holds them open until the client closes
+func newHoldingBackend(t testing.TB) net.Listener {
+	l := mustListen(t)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fmt.Fprintln(conn, "hello")
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// newSingleBackendForwarder starts a forwarder with one upstream named "test" and waits for it to be ready
+func newSingleBackendForwarder(t testing.TB, ctx context.Context, backend string) *LeastConnections {
+	return newUpstreamForwarder(t, ctx, &config.Upstream{
+		Name:     "test",
+		Backends: []string{backend},
+	})
+}
+
+// newUpstreamForwarder starts a forwarder with a single upstream and waits for it to be ready
+func newUpstreamForwarder(t testing.TB, ctx context.Context, upCfg *config.Upstream) *LeastConnections {
+	cfg := &config.Config{
+		RateLimit: &config.RateLimit{
+			Disabled: true,
+		},
+		Upstreams: []*config.Upstream{upCfg},
+	}
+	fwdr, err := NewLeastConnectionsFromConfig(ctx, cfg)
+	if err != nil {
+		t.Fatalf("could not start forwarder: %v", err)
+	}
+	up, err := fwdr.manager.GetUpstream(upCfg.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.WaitForReady(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	return fwdr
+}
+
+// forwardOne forwards a single connection from a new client and returns the client side of it
+func forwardOne(t testing.TB, ctx context.Context, fwdr *LeastConnections, upstream string) (net.Conn, <-chan error) {
+	client, server := net.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- fwdr.Forward(ctx, FwdInfo{
+			Upstream:       upstream,
+			Conn:           server,
+			RateLimiterKey: "user",
+		})
+	}()
+	return client, errc
+}
+
+func TestForwarderConfigErrorStopsManager(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	backend := newHoldingBackend(t)
+	defer backend.Close()
+	_, err := NewLeastConnectionsFromConfig(ctx, &config.Config{
+		RateLimit: &config.RateLimit{},
+		Upstreams: []*config.Upstream{
+			{Name: "ok", Backends: []string{backend.Addr().String()}},
+			{Name: "bad", BackendTLS: &config.BackendTLS{RootCA: []byte("not a pem")}},
+		},
+	})
+	if err == nil {
+		t.Fatal("expected an invalid backend TLS config to fail")
+	}
+	// Stopping again on cancel must not block, goleak catches it if it does
+	cancel()
+}
+
+func TestClose(t *testing.T) {
+	// Goroutines of other tests that are still winding down aren't this test's concern
+	ignore := goleak.IgnoreCurrent()
+	backend := newHoldingBackend(t)
+	// The ctx is never cancelled so only Close can stop the forwarder
+	fwdr, err := NewLeastConnectionsFromConfig(context.Background(), &config.Config{
+		RateLimit:   &config.RateLimit{Disabled: true},
+		Upstreams:   []*config.Upstream{{Name: "test", Backends: []string{backend.Addr().String()}}},
+		ConnRecords: &config.ConnRecords{File: filepath.Join(t.TempDir(), "records.json")},
+		StatusFile:  &config.StatusFile{Path: filepath.Join(t.TempDir(), "status.json"), Interval: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, err := fwdr.manager.GetUpstream("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.WaitForReady(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	client, errc := forwardOne(t, context.Background(), fwdr, "test")
+	bufio.NewReader(client).ReadString('\n')
+	client.Close()
+	<-errc
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, fwdr.Close(ctx))
+	// Closing again is harmless
+	assert.NoError(t, fwdr.Close(ctx))
+	backend.Close()
+	goleak.VerifyNone(t, ignore)
+}
+
+func TestDialLocalAddr(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Any address in 127.0.0.0/8 is local on Linux so the source differs from the default of 127.0.0.1
+	const source = "127.0.0.2"
+	backend := mustListen(t)
+	defer backend.Close()
+	remotes := make(chan net.Addr, 16)
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			select {
+			case remotes <- conn.RemoteAddr():
+			default:
+			}
+			conn.Close()
+		}
+	}()
+	fwdr, err := NewLeastConnectionsFromConfig(ctx, &config.Config{
+		RateLimit:     &config.RateLimit{Disabled: true},
+		DialLocalAddr: source,
+		Upstreams:     []*config.Upstream{{Name: "test", Backends: []string{backend.Addr().String()}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, err := fwdr.manager.GetUpstream("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := up.WaitForReady(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	client, errc := forwardOne(t, ctx, fwdr, "test")
+	defer client.Close()
+	// Health checks don't use the forwarder's dialer and come from the default address
+	timeout := time.After(time.Second)
+	for found := false; !found; {
+		select {
+		case addr := <-remotes:
+			found = addr.(*net.TCPAddr).IP.String() == source
+		case <-timeout:
+			t.Fatalf("no connection reached the backend from %s", source)
+		}
+	}
+	client.Close()
+	<-errc
+}
+
+func TestDialLocalAddrInvalid(t *testing.T) {
+	for name, addr := range map[string]string{
+		"not an ip":     "backend.example",
+		"not local":     "192.0.2.1",
+		"includes port": "127.0.0.1:80",
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			_, err := NewLeastConnectionsFromConfig(ctx, &config.Config{
+				RateLimit:     &config.RateLimit{},
+				DialLocalAddr: addr,
+			})
+			assert.ErrorContains(t, err, "DialLocalAddr")
+		})
+	}
+}
+
+func TestRemovedBackendDrainsConnections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := newHoldingBackend(t)
+	defer backend.Close()
+	fwdr := newSingleBackendForwarder(t, ctx, backend.Addr().String())
+
+	client, errc := forwardOne(t, ctx, fwdr, "test")
+	defer client.Close()
+	greeting, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil || greeting != "hello\n" {
+		t.Fatalf("expected greeting got %q %v", greeting, err)
+	}
+
+	// Removing the backend mid transfer closes the forwarded connection
+	if err := fwdr.manager.RemoveBackend("test", backend.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected connection to be closed got %v", err)
+	}
+	if err := <-errc; !errors.Is(err, upstream.ErrBackendRemoved) {
+		t.Fatalf("expected backend removed error got %v", err)
+	}
+}
+
+func TestCancelIdleForwardedConnection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := newHoldingBackend(t)
+	defer backend.Close()
+	fwdr := newSingleBackendForwarder(t, ctx, backend.Addr().String())
+
+	connCtx, connCancel := context.WithCancel(ctx)
+	client, errc := forwardOne(t, connCtx, fwdr, "test")
+	defer client.Close()
+	if _, err := bufio.NewReader(client).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is sent in either direction so only the cancellation can end the connection
+	connCancel()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected cancelled error got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("forwarded connection was not closed after cancellation")
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected connection to be closed got %v", err)
+	}
+}
+
+func TestDroppedConnectionsOpenCircuitBreaker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The backend passes health checks but drops every connection straight away
+	backend := mustListen(t)
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	fwdr := newUpstreamForwarder(t, ctx, &config.Upstream{
+		Name:     "test",
+		Backends: []string{backend.Addr().String()},
+		CircuitBreaker: &config.CircuitBreaker{
+			FailureThreshold: 1,
+			Cooldown:         time.Minute,
+			MinConnLifetime:  time.Second,
+		},
+	})
+
+	client, errc := forwardOne(t, ctx, fwdr, "test")
+	defer client.Close()
+	if err := <-errc; err != nil {
+		t.Fatalf("expected the dropped connection to end cleanly got %v", err)
+	}
+
+	client, errc = forwardOne(t, ctx, fwdr, "test")
+	defer client.Close()
+	if err := <-errc; !errors.Is(err, upstream.ErrCircuitOpen) {
+		t.Fatalf("expected circuit open error got %v", err)
+	}
+}
+
+func TestActiveConnections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := newHoldingBackend(t)
+	defer backend.Close()
+	fwdr := newSingleBackendForwarder(t, ctx, backend.Addr().String())
+
+	connCtx, connCancel := context.WithCancel(WithIdentity(ctx, &Identity{User: "sean"}))
+	client, errc := forwardOne(t, connCtx, fwdr, "test")
+	defer client.Close()
+	if _, err := bufio.NewReader(client).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	var conns []ConnInfo
+	assert.Eventually(t, func() bool {
+		conns = fwdr.ActiveConnections()
+		return len(conns) == 1 && conns[0].BytesSent == 4
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, "sean", conns[0].User)
+	assert.Equal(t, "test", conns[0].Upstream)
+	assert.Equal(t, backend.Addr().String(), conns[0].Backend)
+	assert.Equal(t, int64(len("hello\n")), conns[0].BytesReceived)
+	assert.False(t, conns[0].Started.IsZero())
+
+	// The record is removed once the connection ends
+	connCancel()
+	<-errc
+	assert.Empty(t, fwdr.ActiveConnections())
+}
+
+func TestPauseUpstream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := newHoldingBackend(t)
+	defer backend.Close()
+	fwdr := newSingleBackendForwarder(t, ctx, backend.Addr().String())
+
+	active, activeErrc := forwardOne(t, ctx, fwdr, "test")
+	defer active.Close()
+	if _, err := bufio.NewReader(active).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, fwdr.PauseUpstream("test"))
+	assert.Equal(t, []string{"test"}, fwdr.DebugState().Paused)
+	paused, errc := forwardOne(t, ctx, fwdr, "test")
+	defer paused.Close()
+	assert.ErrorIs(t, <-errc, upstream.ErrUpstreamPaused)
+	// The connection made before the pause is still forwarded
+	assert.Len(t, fwdr.ActiveConnections(), 1)
+
+	assert.NoError(t, fwdr.ResumeUpstream("test"))
+	assert.Empty(t, fwdr.DebugState().Paused)
+	resumed, resumedErrc := forwardOne(t, ctx, fwdr, "test")
+	defer resumed.Close()
+	if _, err := bufio.NewReader(resumed).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	active.Close()
+	resumed.Close()
+	<-activeErrc
+	<-resumedErrc
+}
+
+func TestNotReadyRejections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Nothing listens on the backend so the upstream never becomes ready
+	l := mustListen(t)
+	down := l.Addr().String()
+	l.Close()
+	backend := newHoldingBackend(t)
+	defer backend.Close()
+	fwdr, err := NewLeastConnectionsFromConfig(ctx, &config.Config{
+		RateLimit: &config.RateLimit{Disabled: true},
+		Upstreams: []*config.Upstream{
+			{Name: "down", Backends: []string{down}},
+			{Name: "up", Backends: []string{backend.Addr().String()}},
+		},
+	})
+	assert.NoError(t, err)
+	up, err := fwdr.manager.GetUpstream("up")
+	assert.NoError(t, err)
+	assert.NoError(t, up.WaitForReady(time.Second))
+
+	client, errc := forwardOne(t, ctx, fwdr, "down")
+	defer client.Close()
+	assert.ErrorIs(t, <-errc, upstream.ErrUpstreamNotReady)
+
+	// Paused upstreams are rejected for a different reason and aren't counted
+	assert.NoError(t, fwdr.PauseUpstream("up"))
+	paused, errc := forwardOne(t, ctx, fwdr, "up")
+	defer paused.Close()
+	assert.ErrorIs(t, <-errc, upstream.ErrUpstreamPaused)
+
+	rejections := fwdr.manager.Metrics.NotReadyRejections
+	assert.Equal(t, "1", rejections.Get("down").String())
+	assert.Nil(t, rejections.Get("up"))
+}
+
+func TestUpstreamMaxConns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Each backend only has one connection so only the upstream wide cap is reached
+	first, second := newHoldingBackend(t), newHoldingBackend(t)
+	defer first.Close()
+	defer second.Close()
+	fwdr := newUpstreamForwarder(t, ctx, &config.Upstream{
+		Name:     "test",
+		Backends: []string{first.Addr().String(), second.Addr().String()},
+		MaxConns: 2,
+		Queue:    &config.ConnQueue{MaxQueued: 1, Timeout: 50 * time.Millisecond},
+	})
+	metrics := fwdr.manager.Metrics
+
+	var clients []net.Conn
+	for range 2 {
+		client, _ := forwardOne(t, ctx, fwdr, "test")
+		defer client.Close()
+		if _, err := bufio.NewReader(client).ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+	}
+	assert.Equal(t, "2", metrics.Concurrency.Get("test").String())
+
+	// The third waits in the queue and gives up as nothing closes
+	client, errc := forwardOne(t, ctx, fwdr, "test")
+	defer client.Close()
+	err := <-errc
+	assert.ErrorIs(t, err, upstream.ErrQueueTimeout)
+	assert.ErrorIs(t, err, upstream.ErrUpstreamAtCapacity)
+	assert.Equal(t, "1", metrics.CapacityRejections.Get("test").String())
+	assert.Equal(t, "0", metrics.QueueDepth.Get("test").String())
+	assert.Equal(t, "1", metrics.MaxQueueDepth.Get("test").String())
+	assert.Equal(t, "2", metrics.Concurrency.Get("test").String())
+
+	// Closing a connection makes room again
+	clients[0].Close()
+	assert.Eventually(t, func() bool { return metrics.Concurrency.Get("test").String() == "1" }, time.Second, time.Millisecond)
+	client, _ = forwardOne(t, ctx, fwdr, "test")
+	defer client.Close()
+	_, err = bufio.NewReader(client).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "1", metrics.CapacityRejections.Get("test").String())
+}
+
+func TestFailFastWhenNotReady(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Nothing listens on the backend so the upstream never becomes ready
+	l := mustListen(t)
+	down := l.Addr().String()
+	l.Close()
+	fwdr, err := NewLeastConnectionsFromConfig(ctx, &config.Config{
+		RateLimit: &config.RateLimit{Disabled: true},
+		Upstreams: []*config.Upstream{
+			{Name: "down", Backends: []string{down}, FailFastWhenNotReady: true},
+		},
+	})
+	assert.NoError(t, err)
+
+	start := time.Now()
+	client, errc := forwardOne(t, ctx, fwdr, "down")
+	defer client.Close()
+	assert.ErrorIs(t, <-errc, upstream.ErrUpstreamNotReady)
+	assert.Less(t, time.Since(start), readyWait/2)
+}
+
+// BenchmarkWaitForReady compares the readiness check of each connection to a ready upstream with always setting
+// up a timeout to wait with
+func BenchmarkWaitForReady(b *testing.B) {
+	up := upstream.NewUpstream("test")
+	up.TrackBackend("127.0.0.1:8000")
+	up.Status.Store(int32(upstream.READY))
+	ctx := context.Background()
+	b.Run("timeout", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			waitCtx, cancel := context.WithTimeout(ctx, readyWait)
+			up.WaitForReadyCtx(waitCtx)
+			cancel()
+		}
+	})
+	b.Run("ready", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			waitForReady(ctx, up)
+		}
+	})
+}
+
+func TestForwardStopsWaitingForReadyOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Nothing listens on the backend so the upstream stays cold
+	l := mustListen(t)
+	down := l.Addr().String()
+	l.Close()
+	fwdr, err := NewLeastConnectionsFromConfig(ctx, &config.Config{
+		RateLimit: &config.RateLimit{Disabled: true},
+		Upstreams: []*config.Upstream{{Name: "down", Backends: []string{down}}},
+	})
+	assert.NoError(t, err)
+
+	connCtx, connCancel := context.WithCancel(ctx)
+	client, errc := forwardOne(t, connCtx, fwdr, "down")
+	defer client.Close()
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	connCancel()
+	assert.ErrorIs(t, <-errc, upstream.ErrUpstreamNotReady)
+	// The wait would otherwise last a full second
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+// refuseDials makes the forwarder fail to dial the backends in refused without affecting health checks
+// and counts every dial attempt
+func refuseDials(fwdr *LeastConnections, refused ...string) *atomic.Int64 {
+	var attempts atomic.Int64
+	fwdr.d.Control = func(network, address string, c syscall.RawConn) error {
+		attempts.Add(1)
+		if slices.Contains(refused, address) {
+			return syscall.ECONNREFUSED
+		}
+		return nil
+	}
+	return &attempts
+}
+
+// allHealthy reports if every backend of the upstream passed its health check
+func allHealthy(up *upstream.Upstream) bool {
+	for _, b := range up.Backends() {
+		if b.Status != upstream.HEALTHY {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDialRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	down := newHoldingBackend(t)
+	defer down.Close()
+	backend := newHoldingBackend(t)
+	defer backend.Close()
+	fwdr := newUpstreamForwarder(t, ctx, &config.Upstream{
+		Name:        "test",
+		Backends:    []string{down.Addr().String(), backend.Addr().String()},
+		DialRetries: 1,
+	})
+	up, err := fwdr.manager.GetUpstream("test")
+	assert.NoError(t, err)
+	// Wait for both backends so the retry has somewhere to go
+	assert.Eventually(t, func() bool { return allHealthy(up) }, time.Second, time.Millisecond)
+	refuseDials(fwdr, down.Addr().String())
+
+	// Whichever backend is picked first the connection ends up on the one that accepts it
+	for range 4 {
+		client, errc := forwardOne(t, ctx, fwdr, "test")
+		greeting, err := bufio.NewReader(client).ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "hello\n", greeting)
+		client.Close()
+		assert.NoError(t, <-errc)
+	}
+}
+
+func TestRetryBudgetCapsRetries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var backends []string
+	for range 3 {
+		b := newHoldingBackend(t)
+		defer b.Close()
+		backends = append(backends, b.Addr().String())
+	}
+	fwdr := newUpstreamForwarder(t, ctx, &config.Upstream{
+		Name:        "test",
+		Backends:    backends,
+		DialRetries: 2,
+		RetryBudget: &config.RetryBudget{Ratio: 0.1, MaxTokens: 5},
+	})
+	up, err := fwdr.manager.GetUpstream("test")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return allHealthy(up) }, time.Second, time.Millisecond)
+	// Every backend passes its health checks but refuses the forwarded connections
+	attempts := refuseDials(fwdr, backends...)
+
+	const conns = 200
+	for range conns {
+		client, errc := forwardOne(t, ctx, fwdr, "test")
+		assert.ErrorIs(t, <-errc, syscall.ECONNREFUSED)
+		client.Close()
+	}
+	// Without the budget every connection would be tried on all 3 backends
+	retries := attempts.Load() - conns
+	assert.LessOrEqual(t, retries, int64(5+conns*0.1))
+	assert.Greater(t, retries, int64(0))
+	metrics := fwdr.manager.Metrics
+	assert.Equal(t, fmt.Sprint(retries), metrics.DialRetries.Get("test").String())
+	assert.NotNil(t, metrics.RetryBudgetExhausted.Get("test"))
+}
+
+func TestBackendTagRouting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stable := newHoldingBackend(t)
+	defer stable.Close()
+	canary := newHoldingBackend(t)
+	defer canary.Close()
+	fwdr := newUpstreamForwarder(t, ctx, &config.Upstream{
+		Name:        "test",
+		Backends:    []string{stable.Addr().String(), canary.Addr().String()},
+		BackendTags: map[string][]string{canary.Addr().String(): {"canary"}},
+	})
+	up, err := fwdr.manager.GetUpstream("test")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return allHealthy(up) }, time.Second, time.Millisecond)
+
+	forwardTagged := func(tag string) (net.Conn, <-chan error) {
+		client, server := net.Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- fwdr.Forward(ctx, FwdInfo{Upstream: "test", Conn: server, RateLimiterKey: "user", BackendTag: tag})
+		}()
+		return client, errc
+	}
+	for range 3 {
+		client, _ := forwardTagged("canary")
+		defer client.Close()
+		if _, err := bufio.NewReader(client).ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, conn := range fwdr.ActiveConnections() {
+		assert.Equal(t, canary.Addr().String(), conn.Backend)
+	}
+	assert.Len(t, fwdr.ActiveConnections(), 3)
+
+	client, errc := forwardTagged("blue")
+	defer client.Close()
+	assert.ErrorIs(t, <-errc, upstream.ErrNoTaggedBackend)
+}
+
+func TestAffinity(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first := newHoldingBackend(t)
+	defer first.Close()
+	second := newHoldingBackend(t)
+	defer second.Close()
+	fwdr := newUpstreamForwarder(t, ctx, &config.Upstream{
+		Name:     "test",
+		Backends: []string{first.Addr().String(), second.Addr().String()},
+		Affinity: &config.Affinity{Window: time.Minute},
+	})
+	up, err := fwdr.manager.GetUpstream("test")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return allHealthy(up) }, time.Second, time.Millisecond)
+
+	// connect forwards a connection for user and returns the backend it went to
+	connect := func(user string) string {
+		client, _ := forwardOne(t, WithIdentity(ctx, &Identity{User: user}), fwdr, "test")
+		t.Cleanup(func() { client.Close() })
+		if _, err := bufio.NewReader(client).ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+		conns := fwdr.ActiveConnections()
+		return conns[len(conns)-1].Backend
+	}
+	alice := connect("alice")
+	// Least connections would send the next connection to the idle backend but alice goes back to hers
+	assert.Equal(t, alice, connect("alice"))
+	// while other clients are still balanced
+	assert.NotEqual(t, alice, connect("bob"))
+}
+
+func TestLingerAfterClientClose(t *testing.T) {
+	tests := map[string]struct {
+		linger time.Duration
+		expect string
+	}{
+		"closes immediately by default": {linger: 0, expect: ""},
+		"forwards the trailing message": {linger: time.Second, expect: "bye\n"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			// The backend only replies once the client has finished sending
+			backend := mustListen(t)
+			defer backend.Close()
+			go func() {
+				for {
+					conn, err := backend.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer conn.Close()
+						io.Copy(io.Discard, conn)
+						fmt.Fprintln(conn, "bye")
+					}()
+				}
+			}()
+			fwdr := newUpstreamForwarder(t, ctx, &config.Upstream{
+				Name:                   "test",
+				Backends:               []string{backend.Addr().String()},
+				LingerAfterClientClose: test.linger,
+			})
+
+			client, server := tcpPair(t)
+			defer client.Close()
+			errc := make(chan error, 1)
+			go func() {
+				errc <- fwdr.Forward(ctx, FwdInfo{Upstream: "test", Conn: server, RateLimiterKey: "user"})
+			}()
+			if _, err := client.Write([]byte("hi")); err != nil {
+				t.Fatal(err)
+			}
+			client.(*net.TCPConn).CloseWrite()
+			client.SetReadDeadline(time.Now().Add(2 * time.Second))
+			got, _ := io.ReadAll(client)
+			assert.Equal(t, test.expect, string(got))
+			<-errc
+		})
+	}
+}
+
+func TestLingerOnlyAfterCleanClientClose(t *testing.T) {
+	tests := map[string]struct {
+		// reset closes the client abruptly instead of half closing it
+		reset     bool
+		completes bool
+		reason    CloseReason
+	}{
+		"clean close drains the backend": {reset: false, completes: true, reason: ClientClosed},
+		"reset closes the backend":       {reset: true, completes: false, reason: ClientError},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			// The backend only starts its response in parts once the client has finished sending.
+			// A later write fails if the load balancer closed the connection instead of draining it.
+			backend := mustListen(t)
+			defer backend.Close()
+			completed := make(chan error, 1)
+			go func() {
+				for {
+					conn, err := backend.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer conn.Close()
+						// Health checks connect without sending anything
+						if n, _ := io.Copy(io.Discard, conn); n == 0 {
+							return
+						}
+						time.Sleep(50 * time.Millisecond)
+						var err error
+						for i := 0; i < 5 && err == nil; i++ {
+							_, err = fmt.Fprintf(conn, "part %d\n", i)
+							time.Sleep(20 * time.Millisecond)
+						}
+						completed <- err
+					}()
+				}
+			}()
+			fwdr := newUpstreamForwarder(t, ctx, &config.Upstream{
+				Name:                   "test",
+				Backends:               []string{backend.Addr().String()},
+				LingerAfterClientClose: time.Second,
+			})
+			rec := &memoryRecorder{records: make(chan ConnRecord, 1)}
+			fwdr.SetConnRecorder(rec)
+
+			client, server := tcpPair(t)
+			defer client.Close()
+			errc := make(chan error, 1)
+			go func() {
+				errc <- fwdr.Forward(ctx, FwdInfo{Upstream: "test", Conn: server, RateLimiterKey: "user"})
+			}()
+			if _, err := fmt.Fprintln(client, "request"); err != nil {
+				t.Fatal(err)
+			}
+			// Give the request time to reach the backend before the client goes away
+			time.Sleep(20 * time.Millisecond)
+			if test.reset {
+				// Closing with a zero linger sends a RST
+				client.(*net.TCPConn).SetLinger(0)
+				client.Close()
+			} else {
+				client.(*net.TCPConn).CloseWrite()
+			}
+
+			select {
+			case err := <-completed:
+				if test.completes {
+					assert.NoError(t, err)
+				} else {
+					assert.Error(t, err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("backend never finished its response")
+			}
+			<-errc
+			assert.Equal(t, test.reason, (<-rec.records).Reason)
+		})
+	}
+}
+
+func TestClientDisconnectGrace(t *testing.T) {
+	tests := map[string]struct {
+		grace     time.Duration
+		completes bool
+	}{
+		"closes immediately by default": {grace: 0, completes: false},
+		"backend finishes within grace": {grace: time.Second, completes: true},
+		"backend slower than grace":     {grace: 10 * time.Millisecond, completes: false},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			// The backend takes a while to work on a request and then writes its response in parts.
+			// A later write fails if the load balancer closed the connection before the work was done.
+			backend := mustListen(t)
+			defer backend.Close()
+			completed := make(chan error, 1)
+			go func() {
+				for {
+					conn, err := backend.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer conn.Close()
+						// Health checks connect without sending a request
+						if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+							return
+						}
+						time.Sleep(100 * time.Millisecond)
+						var err error
+						for i := 0; i < 5 && err == nil; i++ {
+							_, err = fmt.Fprintf(conn, "part %d\n", i)
+							time.Sleep(20 * time.Millisecond)
+						}
+						completed <- err
+					}()
+				}
+			}()
+			fwdr := newUpstreamForwarder(t, ctx, &config.Upstream{
+				Name:                  "test",
+				Backends:              []string{backend.Addr().String()},
+				ClientDisconnectGrace: test.grace,
+			})
+
+			client, server := tcpPair(t)
+			errc := make(chan error, 1)
+			go func() {
+				errc <- fwdr.Forward(ctx, FwdInfo{Upstream: "test", Conn: server, RateLimiterKey: "user"})
+			}()
+			// The client sends a request and disconnects before the response
+			if _, err := fmt.Fprintln(client, "work"); err != nil {
+				t.Fatal(err)
+			}
+			client.Close()
+
+			select {
+			case err := <-completed:
+				if test.completes {
+					assert.NoError(t, err)
+				} else {
+					assert.Error(t, err)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("backend never finished its request")
+			}
+			<-errc
+		})
+	}
+}
+
+func TestBackendWriteTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The backend accepts connections and then never reads from them
+	backend := mustListen(t)
+	defer backend.Close()
+	var held []net.Conn
+	var mu sync.Mutex
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range held {
+			conn.Close()
+		}
+	}()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			held = append(held, conn)
+			mu.Unlock()
+		}
+	}()
+	fwdr := newUpstreamForwarder(t, ctx, &config.Upstream{
+		Name:                "test",
+		Backends:            []string{backend.Addr().String()},
+		BackendWriteTimeout: 100 * time.Millisecond,
+	})
+	rec := &memoryRecorder{records: make(chan ConnRecord, 1)}
+	fwdr.SetConnRecorder(rec)
+
+	client, server := tcpPair(t)
+	defer client.Close()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- fwdr.Forward(ctx, FwdInfo{Upstream: "test", Conn: server, RateLimiterKey: "user"})
+	}()
+	// The client keeps sending until the socket buffers on the way to the backend are full
+	go func() {
+		chunk := make([]byte, 64*1024)
+		for {
+			if _, err := client.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		assert.ErrorIs(t, err, ErrBackendNotReading)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection to a backend that doesn't read was never closed")
+	}
+	assert.Equal(t, BackendNotReading, (<-rec.records).Reason)
+}
+
+func TestBackendResponseTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The backend reads requests and only answers those starting with "ping"
+	backend := mustListen(t)
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if strings.HasPrefix(line, "ping") {
+						io.WriteString(conn, "pong\n")
+					}
+				}
+			}()
+		}
+	}()
+	fwdr := newUpstreamForwarder(t, ctx, &config.Upstream{
+		Name:                   "test",
+		Backends:               []string{backend.Addr().String()},
+		BackendResponseTimeout: 100 * time.Millisecond,
+	})
+	rec := &memoryRecorder{records: make(chan ConnRecord, 1)}
+	fwdr.SetConnRecorder(rec)
+
+	forward := func() (net.Conn, chan error) {
+		client, server := tcpPair(t)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- fwdr.Forward(ctx, FwdInfo{Upstream: "test", Conn: server, RateLimiterKey: "user"})
+		}()
+		return client, errc
+	}
+
+	t.Run("no response", func(t *testing.T) {
+		client, errc := forward()
+		defer client.Close()
+		// Connections aren't timed until the client has sent something
+		time.Sleep(200 * time.Millisecond)
+		select {
+		case err := <-errc:
+			t.Fatalf("connection closed before the client sent anything: %v", err)
+		default:
+		}
+		io.WriteString(client, "hang\n")
+		select {
+		case err := <-errc:
+			assert.ErrorIs(t, err, ErrBackendNoResponse)
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection to a backend that never responds was never closed")
+		}
+		assert.Equal(t, BackendNoResponse, (<-rec.records).Reason)
+	})
+
+	t.Run("responded", func(t *testing.T) {
+		client, errc := forward()
+		io.WriteString(client, "ping\n")
+		r := bufio.NewReader(client)
+		line, err := r.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "pong\n", line)
+		// Once the backend has responded the timeout no longer applies, even to requests it ignores
+		io.WriteString(client, "hang\n")
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(client, "ping\n")
+		line, err = r.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, "pong\n", line)
+		client.Close()
+		assert.NoError(t, <-errc)
+		assert.Equal(t, ClientClosed, (<-rec.records).Reason)
+	})
+}
+
+func TestPreamble(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The backend reports everything it received on each connection
+	backend := mustListen(t)
+	defer backend.Close()
+	received := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, _ := io.ReadAll(conn)
+				// Health checks connect without sending anything
+				if len(data) > 0 {
+					received <- string(data)
+				}
+			}()
+		}
+	}()
+	fwdr := newUpstreamForwarder(t, ctx, &config.Upstream{
+		Name:     "test",
+		Backends: []string{backend.Addr().String()},
+		Preamble: []byte("HELLO v1\n"),
+	})
+
+	client, errc := forwardOne(t, ctx, fwdr, "test")
+	if _, err := io.WriteString(client, "ping\n"); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	select {
+	case got := <-received:
+		assert.Equal(t, "HELLO v1\nping\n", got)
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend never received the connection")
+	}
+	<-errc
+}
+
+// lockedBuffer is a bytes.Buffer that can be written to by concurrent loggers
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// events decodes the JSON log lines with the given message
+func (b *lockedBuffer) events(t *testing.T, msg string) []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var found []map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace(b.buf.Bytes()), []byte("\n")) {
+		var event map[string]any
+		if err := json.Unmarshal(line, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event["msg"] == msg {
+			found = append(found, event)
+		}
+	}
+	return found
+}
+
+func TestConnectionLifecycleLogs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := newHoldingBackend(t)
+	defer backend.Close()
+	fwdr := newSingleBackendForwarder(t, ctx, backend.Addr().String())
+	logs := &lockedBuffer{}
+	fwdr.logConns = true
+	fwdr.logger = slog.New(slog.NewJSONHandler(logs, nil))
+
+	id := &Identity{User: "sean", TLSVersion: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256, Resumed: true,
+		CertFingerprint: "9f86d081884c7d65", ServerName: "api.internal"}
+	client, errc := forwardOne(t, WithIdentity(ctx, id), fwdr, "test")
+	defer client.Close()
+	if _, err := bufio.NewReader(client).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	established := logs.events(t, "connection_established")
+	if assert.Len(t, established, 1) {
+		assert.Equal(t, backend.Addr().String(), established[0]["backend"])
+		assert.Equal(t, "test", established[0]["upstream"])
+		assert.Equal(t, "TLS 1.3", established[0]["tls_version"])
+		assert.Equal(t, "TLS_AES_128_GCM_SHA256", established[0]["cipher_suite"])
+		assert.Equal(t, true, established[0]["tls_resumed"])
+		assert.Equal(t, "9f86d081884c7d65", established[0]["cert_fingerprint"])
+		assert.Equal(t, "api.internal", established[0]["sni"])
+	}
+	assert.Empty(t, logs.events(t, "connection_closed"))
+	conns := fwdr.ActiveConnections()
+	if assert.Len(t, conns, 1) {
+		assert.Equal(t, established[0]["conn_id"], conns[0].ID)
+		assert.Equal(t, "TLS 1.3", conns[0].TLSVersion)
+		assert.Equal(t, "api.internal", conns[0].ServerName)
+	}
+
+	client.Close()
+	<-errc
+	closed := logs.events(t, "connection_closed")
+	if assert.Len(t, closed, 1) {
+		assert.NotEmpty(t, closed[0]["conn_id"])
+		assert.Equal(t, established[0]["conn_id"], closed[0]["conn_id"])
+		assert.Equal(t, float64(len("hello\n")), closed[0]["bytes_received"])
+		assert.Contains(t, closed[0], "duration")
+	}
+}
+
+func TestConnIDFromContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := newHoldingBackend(t)
+	defer backend.Close()
+	fwdr := newSingleBackendForwarder(t, ctx, backend.Addr().String())
+
+	// An ID set by the caller is used for the connection
+	client, errc := forwardOne(t, WithConnID(ctx, "abc123"), fwdr, "test")
+	defer client.Close()
+	if _, err := bufio.NewReader(client).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	conns := fwdr.ActiveConnections()
+	if assert.Len(t, conns, 1) {
+		assert.Equal(t, "abc123", conns[0].ID)
+	}
+	client.Close()
+	<-errc
+}
+
+// memoryRecorder keeps the records of closed connections
+type memoryRecorder struct {
+	records chan ConnRecord
+}
+
+func (r *memoryRecorder) Record(rec ConnRecord) {
+	r.records <- rec
+}
+
+func TestConnRecorder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := newHoldingBackend(t)
+	defer backend.Close()
+	fwdr := newSingleBackendForwarder(t, ctx, backend.Addr().String())
+	rec := &memoryRecorder{records: make(chan ConnRecord, 1)}
+	fwdr.SetConnRecorder(rec)
+
+	start := time.Now()
+	client, errc := forwardOne(t, WithIdentity(ctx, &Identity{User: "sean"}), fwdr, "test")
+	if _, err := bufio.NewReader(client).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(client, "ping")
+	client.Close()
+	assert.NoError(t, <-errc)
+
+	record := <-rec.records
+	assert.Equal(t, "sean", record.User)
+	assert.Equal(t, "test", record.Upstream)
+	assert.Equal(t, backend.Addr().String(), record.Backend)
+	assert.NotEmpty(t, record.Client)
+	assert.Equal(t, int64(len("ping")), record.BytesSent)
+	assert.Equal(t, int64(len("hello\n")), record.BytesReceived)
+	assert.False(t, record.Started.Before(start))
+	assert.False(t, record.Ended.Before(record.Started))
+	assert.Empty(t, record.Error)
+}
+
+func TestCloseReason(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	holding := newHoldingBackend(t)
+	defer holding.Close()
+	// closing greets each connection and then closes it
+	closing := mustListen(t)
+	defer closing.Close()
+	go func() {
+		for {
+			conn, err := closing.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintln(conn, "bye")
+			conn.Close()
+		}
+	}()
+
+	tests := map[string]struct {
+		backend string
+		// clientCloses closes the client once it has been greeted instead of waiting for the backend
+		clientCloses bool
+		expected     CloseReason
+	}{
+		"client closes":  {backend: holding.Addr().String(), clientCloses: true, expected: ClientClosed},
+		"backend closes": {backend: closing.Addr().String(), expected: BackendClosed},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			fwdr := newSingleBackendForwarder(t, ctx, test.backend)
+			rec := &memoryRecorder{records: make(chan ConnRecord, 1)}
+			fwdr.SetConnRecorder(rec)
+
+			client, errc := forwardOne(t, ctx, fwdr, "test")
+			r := bufio.NewReader(client)
+			if _, err := r.ReadString('\n'); err != nil {
+				t.Fatal(err)
+			}
+			if test.clientCloses {
+				client.Close()
+			} else {
+				_, err := r.ReadString('\n')
+				assert.ErrorIs(t, err, io.EOF)
+			}
+			assert.NoError(t, <-errc)
+			client.Close()
+
+			assert.Equal(t, test.expected, (<-rec.records).Reason)
+			reasons := fwdr.manager.Metrics.CloseReasons.Get("test").(*expvar.Map)
+			assert.Equal(t, "1", reasons.Get(string(test.expected)).String())
+		})
+	}
+}
+
+func TestCloseReasonBeforeForwarding(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := newHoldingBackend(t)
+	defer backend.Close()
+	fwdr := newSingleBackendForwarder(t, ctx, backend.Addr().String())
+	refuseDials(fwdr, backend.Addr().String())
+
+	client, errc := forwardOne(t, ctx, fwdr, "test")
+	defer client.Close()
+	assert.Error(t, <-errc)
+	client, errc = forwardOne(t, ctx, fwdr, "missing")
+	defer client.Close()
+	assert.Error(t, <-errc)
+
+	metrics := fwdr.manager.Metrics
+	assert.Equal(t, "1", metrics.CloseReasons.Get("test").(*expvar.Map).Get(string(DialFailed)).String())
+	assert.Equal(t, "1", metrics.CloseReasons.Get("missing").(*expvar.Map).Get(string(NoBackend)).String())
+}
+
+// byteCounter is a StreamObserver counting the bytes observed in each direction
+type byteCounter struct {
+	mu    sync.Mutex
+	conns []ConnInfo
+	bytes map[Direction]int
+}
+
+func (c *byteCounter) observe(info ConnInfo) ObserveFunc {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conns = append(c.conns, info)
+	return func(dir Direction, p []byte) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.bytes[dir] += len(p)
+	}
+}
+
+func TestStreamObserver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := newHoldingBackend(t)
+	defer backend.Close()
+	// Observers see the bytes even when the upstream would otherwise splice them
+	fwdr := newUpstreamForwarder(t, ctx, &config.Upstream{
+		Name:     "test",
+		Backends: []string{backend.Addr().String()},
+		ZeroCopy: true,
+	})
+	counter := &byteCounter{bytes: map[Direction]int{}}
+	fwdr.SetStreamObserver(counter.observe)
+
+	client, errc := forwardOne(t, ctx, fwdr, "test")
+	if _, err := bufio.NewReader(client).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(client, "ping")
+	io.WriteString(client, "pong!")
+	client.Close()
+	assert.NoError(t, <-errc)
+
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	assert.Len(t, counter.conns, 1)
+	assert.Equal(t, "test", counter.conns[0].Upstream)
+	assert.Equal(t, len("pingpong!"), counter.bytes[ClientToBackend])
+	assert.Equal(t, len("hello\n"), counter.bytes[BackendToClient])
+}
@@ -1,10 +1,13 @@
 package health
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net"
+	"regexp"
 )
 
 type Status int
@@ -19,8 +22,13 @@ type HealthChecker interface {
 	Check(ctx context.Context) (stat Status, changed bool, err error)
 }
 
+// DialFunc replaces the direct dial of a check e.g. to reach the backend through a proxy
+type DialFunc func(ctx context.Context, network string, addr string) (net.Conn, error)
+
 type TCP struct {
 	Addr string
+	// Dial is used instead of a direct dial when set
+	Dial DialFunc
 
 	status Status
 	d      net.Dialer
@@ -29,9 +37,12 @@ type TCP struct {
 
 func (h *TCP) Check(ctx context.Context) (stat Status, changed bool, err error) {
 	stat = SUCCESS
-	changed = true
 	// Attempt a dial
-	conn, err := h.d.DialContext(ctx, "tcp", h.Addr)
+	dial := h.d.DialContext
+	if h.Dial != nil {
+		dial = h.Dial
+	}
+	conn, err := dial(ctx, "tcp", h.Addr)
 	if err != nil {
 		stat = FAILED
 	} else {
@@ -42,12 +53,102 @@ func (h *TCP) Check(ctx context.Context) (stat Status, changed bool, err error)
 		err = nil
 	}
 
-	// Check if changed
-	if h.status == stat {
-		changed = false
-	}
-	// Store new result
-	h.status = stat
+	changed = h.status.record(stat)
+	return
+}
+
+// record stores the new status and reports if it changed
+func (s *Status) record(stat Status) bool {
+	changed := *s != stat
+	*s = stat
+	return changed
+}
+
+// DefaultMaxRead is the most a SendExpect check reads from a backend when MaxRead isn't set
+const DefaultMaxRead = 512
+
+// SendExpect writes Send to the backend and checks the response matches, e.g. a Redis PING and PONG.
+// This catches backends that still accept connections but whose application is wedged.
+// The response is read until it matches, MaxRead bytes were read, the backend closes or ctx is done.
+type SendExpect struct {
+	Addr string
+	// Dial is used instead of a direct dial when set. It's expected to complete any TLS handshake itself.
+	Dial DialFunc
+	Send []byte
+	// Expect is a substring the response must contain. Ignored when ExpectRegexp is set.
+	Expect       string
+	ExpectRegexp *regexp.Regexp
+	// MaxRead caps how much of the response is read. Defaults to DefaultMaxRead.
+	MaxRead int
+
+	status Status
+	d      net.Dialer
+}
 
+func (h *SendExpect) Check(ctx context.Context) (stat Status, changed bool, err error) {
+	stat = SUCCESS
+	if err = h.exchange(ctx); err != nil {
+		stat = FAILED
+	}
+	if errors.Is(err, context.Canceled) {
+		err = nil
+	}
+	changed = h.status.record(stat)
 	return
 }
+
+func (h *SendExpect) exchange(ctx context.Context) error {
+	var conn net.Conn
+	var err error
+	switch {
+	case h.Dial != nil:
+		conn, err = h.Dial(ctx, "tcp", h.Addr)
+	default:
+		conn, err = h.d.DialContext(ctx, "tcp", h.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Reads and writes ignore ctx so close the connection to unblock them
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if len(h.Send) > 0 {
+		if _, err := conn.Write(h.Send); err != nil {
+			return h.ctxErr(ctx, err)
+		}
+	}
+	maxRead := h.MaxRead
+	if maxRead <= 0 {
+		maxRead = DefaultMaxRead
+	}
+	buf := make([]byte, 0, maxRead)
+	for len(buf) < maxRead {
+		n, err := conn.Read(buf[len(buf):maxRead])
+		buf = buf[:len(buf)+n]
+		// A backend has to respond with something, even when any response is expected
+		if len(buf) > 0 && h.matches(buf) {
+			return nil
+		}
+		if err != nil {
+			return h.ctxErr(ctx, err)
+		}
+	}
+	return fmt.Errorf("response from %s did not match after reading %d bytes", h.Addr, len(buf))
+}
+
+func (h *SendExpect) matches(resp []byte) bool {
+	if h.ExpectRegexp != nil {
+		return h.ExpectRegexp.Match(resp)
+	}
+	return bytes.Contains(resp, []byte(h.Expect))
+}
+
+// ctxErr prefers the ctx error over the error from the connection being closed by ctx
+func (h *SendExpect) ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
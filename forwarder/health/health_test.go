@@ -2,8 +2,10 @@ package health
 
 import (
 	"context"
+	"io"
 	"log/slog"
 	"net"
+	"regexp"
 	"testing"
 	"time"
 
@@ -58,3 +60,93 @@ func TestRunUnealthy(t *testing.T) {
 	assert.True(t, changed)
 	assert.NotNil(t, err)
 }
+
+// runRespondingListener serves connections with respond until ctx is done
+func runRespondingListener(t testing.TB, ctx context.Context, respond func(conn net.Conn)) string {
+	l, err := nettest.NewLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				respond(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func echo(conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+func TestSendExpect(t *testing.T) {
+	tests := map[string]struct {
+		respond func(conn net.Conn)
+		check   SendExpect
+		expect  Status
+	}{
+		"echo substring": {
+			respond: echo,
+			check:   SendExpect{Send: []byte("PING\r\n"), Expect: "PING"},
+			expect:  SUCCESS,
+		},
+		"regexp": {
+			respond: func(conn net.Conn) {
+				conn.Read(make([]byte, 16))
+				conn.Write([]byte("+PONG\r\n"))
+			},
+			check:  SendExpect{Send: []byte("PING\r\n"), ExpectRegexp: regexp.MustCompile(`^\+PONG`)},
+			expect: SUCCESS,
+		},
+		"wrong response": {
+			respond: echo,
+			check:   SendExpect{Send: []byte("PING\r\n"), Expect: "PONG"},
+			expect:  FAILED,
+		},
+		"response larger than max read": {
+			respond: echo,
+			check:   SendExpect{Send: []byte("xxxxPONG"), Expect: "PONG", MaxRead: 4},
+			expect:  FAILED,
+		},
+		"silent": {
+			respond: func(conn net.Conn) { io.Copy(io.Discard, conn) },
+			check:   SendExpect{Send: []byte("PING\r\n"), Expect: "PONG"},
+			expect:  FAILED,
+		},
+		"silent with any response expected": {
+			respond: func(conn net.Conn) { io.Copy(io.Discard, conn) },
+			check:   SendExpect{Send: []byte("PING\r\n")},
+			expect:  FAILED,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			check := test.check
+			check.Addr = runRespondingListener(t, ctx, test.respond)
+			start := time.Now()
+			stat, changed, err := check.Check(ctx)
+			assert.Equal(t, test.expect, stat)
+			assert.True(t, changed)
+			if test.expect == SUCCESS {
+				assert.Nil(t, err)
+			} else {
+				assert.NotNil(t, err)
+			}
+			// The check must give up by the ctx deadline
+			assert.Less(t, time.Since(start), time.Second)
+		})
+	}
+}
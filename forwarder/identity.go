@@ -0,0 +1,40 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/x509"
+)
+
+// Identity is the authenticated identity of a client
+type Identity struct {
+	// User is the CN of the client certificate
+	User string
+	// OUs are the organizational units of the client certificate
+	OUs []string
+	// Certificate is the verified leaf certificate presented by the client
+	Certificate *x509.Certificate
+	// TLSVersion and CipherSuite were negotiated by the client, see tls.VersionName and tls.CipherSuiteName
+	TLSVersion  uint16
+	CipherSuite uint16
+	// Resumed is set when the client resumed an earlier TLS session rather than doing a full handshake
+	Resumed bool
+	// ServerName is the SNI the client asked for, empty when it didn't send one. Clients multiplexing several
+	// hostnames over one certificate can be told apart by it.
+	ServerName string
+	// CertFingerprint is the hex SHA-256 fingerprint of Certificate, set by the server when LogCertFingerprints
+	// is enabled and logged with connection_established when present
+	CertFingerprint string
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying the authenticated identity
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFromContext returns the authenticated identity carried by ctx if there is one
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
@@ -0,0 +1,42 @@
+package forwarder
+
+import "io"
+
+// Direction is the way bytes are copied through a forwarded connection
+type Direction int
+
+const (
+	// ClientToBackend is what the client sends, counted as BytesSent
+	ClientToBackend Direction = iota
+	// BackendToClient is what the backend sends, counted as BytesReceived
+	BackendToClient
+)
+
+func (d Direction) String() string {
+	if d == BackendToClient {
+		return "backend_to_client"
+	}
+	return "client_to_backend"
+}
+
+// ObserveFunc is called with each chunk of a connection as it is copied in dir.
+// It runs on the goroutine doing the copy so it should be quick, and p must not be modified or kept
+// after it returns. The chunks are whatever each read returned, they don't line up with any protocol messages.
+type ObserveFunc func(dir Direction, p []byte)
+
+// StreamObserver is called when a connection is forwarded and returns the ObserveFunc that sees its bytes,
+// or nil to leave the connection alone. The balancer works at L4 so interpreting the stream e.g. counting
+// HTTP requests or detecting the protocol is left entirely to the observer.
+type StreamObserver func(info ConnInfo) ObserveFunc
+
+// observingWriter passes each write to the ObserveFunc before writing it
+type observingWriter struct {
+	io.Writer
+	dir     Direction
+	observe ObserveFunc
+}
+
+func (w observingWriter) Write(p []byte) (int, error) {
+	w.observe(w.dir, p)
+	return w.Writer.Write(p)
+}
@@ -1,29 +1,79 @@
 package forwarder
 
 import (
+	"context"
 	"fmt"
 	"sync"
 
+	"github.com/doggydogworld/gobalancer/clock"
+	"github.com/doggydogworld/gobalancer/config"
 	"golang.org/x/time/rate"
 )
 
+// RateLimiter decides whether a client may open a connection. LeastConnections uses a token bucket per client
+// from the config by default. Embedders can install their own e.g. a limiter shared by several balancers
+// through Redis so a client gets the same limit whichever instance it connects to.
+type RateLimiter interface {
+	// Allow is called before a connection from the client identified by key is forwarded and returns an error
+	// to reject it. It may block to shape connections instead but must return once ctx is done.
+	Allow(ctx context.Context, key string) error
+}
+
 // perClientRateLimiter provides a token bucket rate limiter per client
 //
-// TODO: This is a rate limiter in that it drops connections that exceed the limit.
-// This could be modified fairly easily to be a traffic shaper by running a goroutine
-// to wait for a reservation.
+// By default it drops connections that exceed the limit. In shaping mode connections wait for a token instead.
+// Waiting connections are capped per client and an optional global limiter divides the total rate between them.
 type perClientRateLimiter struct {
+	// disabled allows all events without tracking a limiter per client
+	disabled  bool
 	maxTokens int
-	// Set to Math.MaxFloat64 to allow all events regardless of maxTokens
+	// Setting to Math.MaxFloat64 also allows all events regardless of maxTokens. Prefer disabled.
 	tokenRefillPerSecond float64
 	// Rate limit per client
 	clientRL map[string]*rate.Limiter
-	mu       sync.Mutex
+	// evicted counts the limiters removed from clientRL
+	evicted int64
+	// clock defaults to the real clock when nil
+	clock clock.Clock
+
+	// shaping waits for tokens rather than rejecting
+	shaping bool
+	// maxWaiters caps the waiting connections per client when shaping. 0 is unlimited.
+	maxWaiters int
+	// waiters counts the waiting connections per client
+	waiters map[string]int
+	// global limits the total rate across clients when shaping. A nil limiter is unlimited.
+	global *rate.Limiter
+	mu     sync.Mutex
+}
+
+// newPerClientRateLimiter creates the rate limiter from config
+func newPerClientRateLimiter(cfg *config.RateLimit) *perClientRateLimiter {
+	rl := &perClientRateLimiter{
+		disabled:             cfg.Disabled,
+		maxTokens:            cfg.Burst(),
+		tokenRefillPerSecond: cfg.RefillPerSecond(),
+		clientRL:             make(map[string]*rate.Limiter),
+		shaping:              cfg.Shape,
+		maxWaiters:           cfg.MaxWaitersPerClient,
+		waiters:              make(map[string]int),
+	}
+	if cfg.GlobalTokensPerSecond > 0 {
+		rl.global = rate.NewLimiter(rate.Limit(cfg.GlobalTokensPerSecond), cfg.GlobalMaxTokens)
+	}
+	return rl
 }
 
+// unlimited is shared by all clients while rate limiting is disabled
+var unlimited = rate.NewLimiter(rate.Inf, 0)
+
 // getRL returns a rate limiter for the given key.
 // If an existing rate limiter exists for that client it is returned otherwise a new one is created and returned.
+// A no-op limiter is returned when rate limiting is disabled.
 func (rl *perClientRateLimiter) getRL(key string) *rate.Limiter {
+	if rl.disabled {
+		return unlimited
+	}
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 	var cl *rate.Limiter
@@ -36,10 +86,78 @@ func (rl *perClientRateLimiter) getRL(key string) *rate.Limiter {
 	return cl
 }
 
+// Reset forgets the limiter of a client so its next connection starts with a full bucket.
+// Connections already waiting for a token while shaping keep waiting on the old limiter.
+func (rl *perClientRateLimiter) Reset(key string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if _, ok := rl.clientRL[key]; ok {
+		delete(rl.clientRL, key)
+		rl.evicted++
+	}
+}
+
+// ResetAll forgets the limiters of all clients e.g. to recover from an incident that throttled everyone
+func (rl *perClientRateLimiter) ResetAll() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.evicted += int64(len(rl.clientRL))
+	clear(rl.clientRL)
+}
+
+// Allow waits for a token when shaping and otherwise rejects the connection straight away
+func (rl *perClientRateLimiter) Allow(ctx context.Context, key string) error {
+	if rl.shaping {
+		return rl.shape(ctx, key)
+	}
+	return rl.rateLimit(key)
+}
+
 func (rl *perClientRateLimiter) rateLimit(key string) error {
 	limiter := rl.getRL(key)
-	if allowed := limiter.Allow(); !allowed {
+	if allowed := limiter.AllowN(clock.Or(rl.clock).Now(), 1); !allowed {
 		return fmt.Errorf("user with key '%s' has exceeded maximum rate limit %d", key, rl.maxTokens)
 	}
 	return nil
 }
+
+// addWaiter takes a waiting slot for the client and reports false if it already has the maximum waiting
+func (rl *perClientRateLimiter) addWaiter(key string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.maxWaiters > 0 && rl.waiters[key] >= rl.maxWaiters {
+		return false
+	}
+	rl.waiters[key] += 1
+	return true
+}
+
+func (rl *perClientRateLimiter) removeWaiter(key string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.waiters[key] -= 1
+	if rl.waiters[key] <= 0 {
+		delete(rl.waiters, key)
+	}
+}
+
+// shape waits until the client has a token and then for the global limit if there is one.
+// Waiting is abandoned if ctx is done.
+func (rl *perClientRateLimiter) shape(ctx context.Context, key string) error {
+	if rl.disabled {
+		return nil
+	}
+	if !rl.addWaiter(key) {
+		return fmt.Errorf("user with key '%s' has exceeded maximum waiting connections %d", key, rl.maxWaiters)
+	}
+	defer rl.removeWaiter(key)
+	if err := rl.getRL(key).Wait(ctx); err != nil {
+		return fmt.Errorf("user with key '%s' could not be shaped: %w", key, err)
+	}
+	if rl.global != nil {
+		if err := rl.global.Wait(ctx); err != nil {
+			return fmt.Errorf("user with key '%s' could not be shaped: %w", key, err)
+		}
+	}
+	return nil
+}
@@ -1,8 +1,18 @@
 package forwarder
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/doggydogworld/gobalancer/clock"
+	"github.com/doggydogworld/gobalancer/config"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/time/rate"
 )
@@ -22,3 +32,277 @@ func TestPerClientRateLimiter(t *testing.T) {
 	assert.Error(t, rl.rateLimit("bob"))
 	assert.NoError(t, rl.rateLimit("wendy"))
 }
+
+func TestPerClientRateLimiterRefill(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	rl := &perClientRateLimiter{
+		maxTokens:            2,
+		tokenRefillPerSecond: 1,
+		clientRL:             make(map[string]*rate.Limiter),
+		clock:                clk,
+	}
+
+	for range 2 {
+		assert.NoError(t, rl.rateLimit("bob"))
+	}
+	assert.Error(t, rl.rateLimit("bob"))
+
+	// Half a token isn't enough
+	clk.Advance(time.Second / 2)
+	assert.Error(t, rl.rateLimit("bob"))
+
+	// A full token has been refilled
+	clk.Advance(time.Second / 2)
+	assert.NoError(t, rl.rateLimit("bob"))
+	assert.Error(t, rl.rateLimit("bob"))
+}
+
+func TestPerClientRateLimiterBurstSeconds(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	rl := newPerClientRateLimiter(&config.RateLimit{Refill: 2, BurstSeconds: 1.5})
+	rl.clock = clk
+
+	// Each client can use a second and a half of refill at once
+	for range 3 {
+		assert.NoError(t, rl.rateLimit("bob"))
+	}
+	assert.Error(t, rl.rateLimit("bob"))
+
+	clk.Advance(time.Second / 2)
+	assert.NoError(t, rl.rateLimit("bob"))
+	assert.Error(t, rl.rateLimit("bob"))
+}
+
+func TestPerClientRateLimiterDisabled(t *testing.T) {
+	rl := &perClientRateLimiter{
+		disabled:  true,
+		maxTokens: 0,
+		clientRL:  make(map[string]*rate.Limiter),
+	}
+	for range 100 {
+		assert.NoError(t, rl.rateLimit("bob"))
+	}
+	// No limiter is kept per client while disabled
+	assert.Empty(t, rl.clientRL)
+
+	// The MaxFloat64 refill convention still disables limiting
+	rl = &perClientRateLimiter{
+		maxTokens:            0,
+		tokenRefillPerSecond: math.MaxFloat64,
+		clientRL:             make(map[string]*rate.Limiter),
+	}
+	for range 100 {
+		assert.NoError(t, rl.rateLimit("bob"))
+	}
+}
+
+func TestShaperMaxWaitersPerClient(t *testing.T) {
+	// Per client limits are generous, the global rate is what clients compete for
+	rl := newPerClientRateLimiter(&config.RateLimit{
+		TokenRefillPerSecond:  math.MaxFloat64,
+		Shape:                 true,
+		MaxWaitersPerClient:   2,
+		GlobalTokensPerSecond: 10,
+		GlobalMaxTokens:       1,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Drain the burst so every following connection has to wait
+	assert.NoError(t, rl.shape(ctx, "greedy"))
+
+	// The greedy client fills its waiting slots and the rest of its connections are rejected straight away
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, rl.shape(ctx, "greedy"))
+		}()
+	}
+	assert.Eventually(t, func() bool {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		return rl.waiters["greedy"] == 2
+	}, time.Second, time.Millisecond)
+	for range 8 {
+		assert.Error(t, rl.shape(ctx, "greedy"))
+	}
+
+	// The polite client only queues behind the two greedy waiters rather than all ten connections
+	start := time.Now()
+	assert.NoError(t, rl.shape(ctx, "polite"))
+	assert.Less(t, time.Since(start), 600*time.Millisecond)
+	wg.Wait()
+}
+
+func TestShaperCancel(t *testing.T) {
+	rl := newPerClientRateLimiter(&config.RateLimit{
+		TokenRefillPerSecond: 0.001,
+		MaxTokens:            1,
+		Shape:                true,
+	})
+	assert.NoError(t, rl.shape(context.Background(), "bob"))
+
+	// Giving up on a wait frees the waiting slot
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, rl.shape(ctx, "bob"))
+	assert.Empty(t, rl.waiters)
+}
+
+func TestPerClientRateLimiterReset(t *testing.T) {
+	rl := &perClientRateLimiter{
+		maxTokens:            2,
+		tokenRefillPerSecond: 0,
+		clientRL:             make(map[string]*rate.Limiter),
+	}
+	exhaust := func(key string) {
+		for range 2 {
+			assert.NoError(t, rl.rateLimit(key))
+		}
+		assert.Error(t, rl.rateLimit(key))
+	}
+	exhaust("bob")
+	exhaust("wendy")
+
+	// Only the reset client gets a fresh bucket
+	rl.Reset("bob")
+	exhaust("bob")
+	assert.Error(t, rl.rateLimit("wendy"))
+
+	rl.ResetAll()
+	exhaust("bob")
+	exhaust("wendy")
+}
+
+func TestRateLimiterEvictions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fwdr, err := NewLeastConnectionsFromConfig(ctx, &config.Config{RateLimit: &config.RateLimit{MaxTokens: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"bob", "wendy", "carol"} {
+		assert.NoError(t, fwdr.ratelimit.rateLimit(key))
+	}
+	assert.Equal(t, RateLimiterState{Clients: 3}, fwdr.DebugState().RateLimiter)
+
+	fwdr.ResetRateLimit("bob")
+	// A client without a bucket has nothing to evict
+	fwdr.ResetRateLimit("mallory")
+	assert.Equal(t, RateLimiterState{Clients: 2, Evicted: 1}, fwdr.DebugState().RateLimiter)
+
+	fwdr.ResetAllRateLimits()
+	assert.Equal(t, RateLimiterState{Clients: 0, Evicted: 3}, fwdr.DebugState().RateLimiter)
+}
+
+func TestPerClientRateLimiterResetConcurrent(t *testing.T) {
+	rl := newPerClientRateLimiter(&config.RateLimit{MaxTokens: 1})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				rl.rateLimit("bob")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				rl.Reset("bob")
+				rl.ResetAll()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRateLimitOverride(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fwdr, err := NewLeastConnectionsFromConfig(ctx, &config.Config{RateLimit: &config.RateLimit{Disabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal := &config.RateLimit{MaxTokens: 3}
+	external := &config.RateLimit{MaxTokens: 1}
+	// There are no upstreams so a connection that passes the rate limit fails to find its upstream
+	limited := func(override *config.RateLimit) bool {
+		err := fwdr.Forward(ctx, FwdInfo{Upstream: "web", RateLimiterKey: "bob", RateLimit: override})
+		assert.Error(t, err)
+		return strings.Contains(err.Error(), "rate limit")
+	}
+
+	// The same client has a separate budget per override
+	assert.False(t, limited(external))
+	assert.True(t, limited(external))
+	for range 3 {
+		assert.False(t, limited(internal))
+	}
+	assert.True(t, limited(internal))
+	// The default limiter is untouched
+	assert.False(t, limited(nil))
+
+	// An equal config in a different listener is still a separate limiter
+	assert.False(t, limited(&config.RateLimit{MaxTokens: 1}))
+
+	fwdr.ResetRateLimit("bob")
+	assert.False(t, limited(external))
+	assert.False(t, limited(internal))
+	// bob has a bucket again in the two overrides used since the reset
+	assert.Equal(t, 2, fwdr.DebugState().RateLimiter.Clients)
+}
+
+// stubLimiter rejects the keys in denied and remembers every key it was asked about
+type stubLimiter struct {
+	denied map[string]bool
+	mu     sync.Mutex
+	keys   []string
+}
+
+var errStubDenied = errors.New("denied by stub")
+
+func (s *stubLimiter) Allow(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, key)
+	if s.denied[key] {
+		return errStubDenied
+	}
+	return nil
+}
+
+func TestSetRateLimiter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := newHoldingBackend(t)
+	defer backend.Close()
+	fwdr := newSingleBackendForwarder(t, ctx, backend.Addr().String())
+	stub := &stubLimiter{denied: map[string]bool{"mallory": true}}
+	fwdr.SetRateLimiter(stub)
+
+	// The stub decides even for connections with an override that would reject everything
+	forward := func(key string) (net.Conn, <-chan error) {
+		client, server := net.Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- fwdr.Forward(ctx, FwdInfo{Upstream: "test", Conn: server, RateLimiterKey: key,
+				RateLimit: &config.RateLimit{}})
+		}()
+		return client, errc
+	}
+	client, errc := forward("bob")
+	line, err := bufio.NewReader(client).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", line)
+	client.Close()
+	<-errc
+
+	_, errc = forward("mallory")
+	assert.ErrorIs(t, <-errc, errStubDenied)
+	assert.Equal(t, []string{"bob", "mallory"}, stub.keys)
+	// No built in limiter was created for the override
+	assert.Zero(t, fwdr.DebugState().RateLimiter.Clients)
+}
@@ -0,0 +1,80 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+
+	"github.com/doggydogworld/gobalancer/forwarder/upstream"
+)
+
+// CloseReason is why a connection ended, reported in the connection_closed log, connection records
+// and the close_reasons metric
+type CloseReason string
+
+const (
+	// ClientClosed and BackendClosed are connections where that side finished sending first
+	ClientClosed  CloseReason = "client_closed"
+	BackendClosed CloseReason = "backend_closed"
+	// ClientError and BackendError are connections where reading from that side failed first
+	ClientError  CloseReason = "client_error"
+	BackendError CloseReason = "backend_error"
+	// BackendNotReading is a connection closed because its backend stopped reading for longer than its
+	// upstream's BackendWriteTimeout
+	BackendNotReading CloseReason = "backend_not_reading"
+	// BackendNoResponse is a connection closed because its backend sent nothing for longer than its upstream's
+	// BackendResponseTimeout after the client's first bytes
+	BackendNoResponse CloseReason = "backend_no_response"
+	// BackendUnhealthy and BackendRemoved are connections cut off because their backend left the upstream
+	BackendUnhealthy CloseReason = "backend_unhealthy"
+	BackendRemoved   CloseReason = "backend_removed"
+	// Deadline is a connection whose context passed its deadline
+	Deadline CloseReason = "deadline"
+	// Shutdown is a connection cancelled by the caller of Forward e.g. the server shutting down
+	Shutdown CloseReason = "shutdown"
+	// RateLimited, NoBackend and DialFailed are connections that were never forwarded
+	RateLimited CloseReason = "rate_limited"
+	NoBackend   CloseReason = "no_backend"
+	DialFailed  CloseReason = "dial_failed"
+	// AuthzDenied, HandshakeFailed and ProtocolError are reported by the server for connections it never hands to
+	// a forwarder. ProtocolError is a client that didn't speak TLS at all.
+	AuthzDenied     CloseReason = "authz_denied"
+	HandshakeFailed CloseReason = "handshake_failed"
+	ProtocolError   CloseReason = "protocol_error"
+)
+
+// copyResult is the outcome of copying one direction of a forwarded connection
+type copyResult struct {
+	// fromBackend is set for the copy from the backend to the client
+	fromBackend bool
+	err         error
+}
+
+// closeReason works out why a forwarded connection ended from the direction that finished first.
+// A cancelled ctx takes precedence since cancelling closes both connections and fails both copies.
+func closeReason(ctx context.Context, first copyResult) CloseReason {
+	if ctx.Err() != nil {
+		cause := context.Cause(ctx)
+		switch {
+		case errors.Is(cause, upstream.ErrBackendRemoved):
+			return BackendRemoved
+		case errors.Is(cause, upstream.ErrBackendUnhealthy):
+			return BackendUnhealthy
+		case errors.Is(cause, context.DeadlineExceeded):
+			return Deadline
+		}
+		return Shutdown
+	}
+	switch {
+	case errors.Is(first.err, ErrBackendNotReading):
+		return BackendNotReading
+	case errors.Is(first.err, ErrBackendNoResponse):
+		return BackendNoResponse
+	case first.fromBackend && first.err == nil:
+		return BackendClosed
+	case first.fromBackend:
+		return BackendError
+	case first.err == nil:
+		return ClientClosed
+	}
+	return ClientError
+}
@@ -0,0 +1,92 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/doggydogworld/gobalancer/config"
+)
+
+// ConnRecord describes a forwarded connection once it has closed e.g. for a network accounting pipeline
+type ConnRecord struct {
+	ConnInfo
+	Ended  time.Time
+	Reason CloseReason
+	// Error is why forwarding stopped, empty when both sides closed cleanly
+	Error string `json:",omitempty"`
+}
+
+// ConnRecorder receives a record of every forwarded connection when it closes.
+// Record is called by the goroutine that forwarded the connection so it shouldn't block for long.
+type ConnRecorder interface {
+	Record(rec ConnRecord)
+}
+
+// nopRecorder is the default recorder and drops every record
+type nopRecorder struct{}
+
+func (nopRecorder) Record(ConnRecord) {}
+
+// JSONRecorder writes each record as a line of JSON.
+// Each record is a single Write so writing to a UDP socket sends one record per datagram.
+type JSONRecorder struct {
+	w      io.Writer
+	mu     sync.Mutex
+	logged bool
+}
+
+// NewJSONRecorder creates a recorder writing to w
+func NewJSONRecorder(w io.Writer) *JSONRecorder {
+	return &JSONRecorder{w: w}
+}
+
+func (r *JSONRecorder) Record(rec ConnRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// A collector that is down must not affect forwarding. Only the first failure is reported so
+	// it doesn't flood the logs.
+	if _, err := r.w.Write(append(line, '\n')); err != nil && !r.logged {
+		r.logged = true
+		slog.Default().Error("conn_record_failed", "error", err.Error())
+	}
+}
+
+// Close closes the underlying writer if it can be closed
+func (r *JSONRecorder) Close() error {
+	if c, ok := r.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// newConnRecorderFromConfig opens the file or collector connection records are written to
+func newConnRecorderFromConfig(cfg *config.ConnRecords) (*JSONRecorder, error) {
+	switch {
+	case cfg.File != "" && cfg.UDPAddr != "":
+		return nil, errors.New("ConnRecords can only set one of File and UDPAddr")
+	case cfg.File != "":
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open ConnRecords File: %w", err)
+		}
+		return NewJSONRecorder(f), nil
+	case cfg.UDPAddr != "":
+		conn, err := net.Dial("udp", cfg.UDPAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ConnRecords UDPAddr: %w", err)
+		}
+		return NewJSONRecorder(conn), nil
+	}
+	return nil, errors.New("ConnRecords must set File or UDPAddr")
+}
@@ -0,0 +1,69 @@
+package forwarder
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/doggydogworld/gobalancer/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONRecorderFromConfig(t *testing.T) {
+	record := ConnRecord{
+		ConnInfo: ConnInfo{ID: "abc", User: "sean", Upstream: "web", BytesSent: 4},
+		Ended:    time.Now(),
+	}
+	decode := func(t *testing.T, line []byte) ConnRecord {
+		var got ConnRecord
+		assert.NoError(t, json.Unmarshal(line, &got))
+		return got
+	}
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "conns.jsonl")
+		rec, err := newConnRecorderFromConfig(&config.ConnRecords{File: path})
+		assert.NoError(t, err)
+		rec.Record(record)
+		rec.Record(record)
+		assert.NoError(t, rec.Close())
+
+		f, err := os.Open(path)
+		assert.NoError(t, err)
+		defer f.Close()
+		lines := 0
+		for s := bufio.NewScanner(f); s.Scan(); lines++ {
+			got := decode(t, s.Bytes())
+			assert.Equal(t, "sean", got.User)
+			assert.Equal(t, int64(4), got.BytesSent)
+		}
+		assert.Equal(t, 2, lines)
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer collector.Close()
+		rec, err := newConnRecorderFromConfig(&config.ConnRecords{UDPAddr: collector.LocalAddr().String()})
+		assert.NoError(t, err)
+		defer rec.Close()
+		rec.Record(record)
+
+		buf := make([]byte, 64*1024)
+		collector.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := collector.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "abc", decode(t, buf[:n]).ID)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := newConnRecorderFromConfig(&config.ConnRecords{})
+		assert.ErrorContains(t, err, "must set File or UDPAddr")
+		_, err = newConnRecorderFromConfig(&config.ConnRecords{File: "conns.jsonl", UDPAddr: "127.0.0.1:9999"})
+		assert.ErrorContains(t, err, "only set one")
+	})
+}
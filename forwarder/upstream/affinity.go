@@ -0,0 +1,78 @@
+package upstream
+
+import (
+	"slices"
+	"time"
+)
+
+// affinityEntry is the backend a client was last sent to
+type affinityEntry struct {
+	backend string
+	expires time.Time
+}
+
+// ConfigureAffinity sends a client that connects again within window of its last connection back to the same
+// backend. A window of 0 disables affinity and forgets every client.
+func (t *Tracker) ConfigureAffinity(window time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.affinityWindow = window
+	if window <= 0 {
+		t.affinity = nil
+	}
+}
+
+// affinityBackend returns the backend the client of sel was last sent to if its window hasn't passed and it can
+// take the connection, or an empty string to fall back to least connections.
+// This does not lock so make sure to wrap this in a mu.Lock()
+func (t *Tracker) affinityBackend(sel Selection, now time.Time) string {
+	if sel.Client == "" || t.affinityWindow <= 0 {
+		return ""
+	}
+	entry, ok := t.affinity[sel.Client]
+	if !ok || !now.Before(entry.expires) {
+		return ""
+	}
+	b := entry.backend
+	activeConns, ok := t.healthyBackends[b]
+	switch {
+	case !ok:
+	case sel.Tag != "" && !slices.Contains(t.backendTags[b], sel.Tag):
+	case slices.Contains(sel.Exclude, b):
+	case t.breakers[b] != nil && !t.breakers[b].available(now):
+	case t.maxConns > 0 && len(activeConns) >= t.maxConns:
+	case t.ramps[b] != nil && !t.ramps[b].over(now) && !t.ramps[b].available(now):
+	case now.Before(t.penalized[b]):
+	default:
+		return b
+	}
+	return ""
+}
+
+// recordAffinity remembers the backend the client of sel was sent to. Expired clients are forgotten once per
+// window so clients that never come back don't pile up.
+// This does not lock so make sure to wrap this in a mu.Lock()
+func (t *Tracker) recordAffinity(sel Selection, backend string, now time.Time) {
+	if sel.Client == "" || t.affinityWindow <= 0 {
+		return
+	}
+	if t.affinity == nil {
+		t.affinity = map[string]affinityEntry{}
+	}
+	if now.Sub(t.affinitySwept) >= t.affinityWindow {
+		for client, entry := range t.affinity {
+			if !now.Before(entry.expires) {
+				delete(t.affinity, client)
+			}
+		}
+		t.affinitySwept = now
+	}
+	t.affinity[sel.Client] = affinityEntry{backend: backend, expires: now.Add(t.affinityWindow)}
+}
+
+// affinityClients is the number of clients remembered for affinity, expired or not
+func (t *Tracker) affinityClients() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.affinity)
+}
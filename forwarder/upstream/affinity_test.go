@@ -0,0 +1,81 @@
+package upstream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doggydogworld/gobalancer/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAffinity(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	track := NewTracker(context.Background(), "test")
+	track.Clock = clk
+	defer track.Cancel(ErrBackendRemoved)
+	track.TrackBackend("127.0.0.1:8000")
+	track.TrackBackend("127.0.0.1:8001")
+	track.ConfigureAffinity(10 * time.Second)
+
+	// held is the number of connections that are kept open
+	held := 0
+	next := func(sel Selection) string {
+		t.Helper()
+		// Connections are tracked by their context so each needs its own
+		ctx, cancelCtx := context.WithCancel(context.Background())
+		defer cancelCtx()
+		addr, _, cancel, err := track.NextMatching(ctx, sel)
+		assert.NoError(t, err)
+		// Released straight away so only the held connections add load
+		cancel()
+		assert.Eventually(t, func() bool {
+			return track.BackendActiveConns("127.0.0.1:8000")+track.BackendActiveConns("127.0.0.1:8001") == held
+		}, time.Second, time.Millisecond)
+		return addr
+	}
+	alice := Selection{Client: "alice"}
+	first := next(alice)
+	other := "127.0.0.1:8000"
+	if first == other {
+		other = "127.0.0.1:8001"
+	}
+
+	// Load up alice's backend so least connections would pick the other one
+	track.ConfigureBackendTags(map[string][]string{first: {"pin"}})
+	pinCtx, cancelPin := context.WithCancel(context.Background())
+	defer cancelPin()
+	_, _, release, err := track.NextMatching(pinCtx, Selection{Tag: "pin"})
+	assert.NoError(t, err)
+	defer release()
+	held++
+	assert.Equal(t, other, next(Selection{}))
+
+	// Reconnecting within the window goes back to the same backend
+	clk.Advance(5 * time.Second)
+	assert.Equal(t, first, next(alice))
+	// and each connection restarts the window
+	clk.Advance(9 * time.Second)
+	assert.Equal(t, first, next(alice))
+
+	// Once the window has passed least connections decides again
+	clk.Advance(10 * time.Second)
+	assert.Equal(t, other, next(alice))
+
+	// A backend that is no longer healthy or can't be used falls back to least connections
+	assert.Equal(t, first, next(Selection{Client: "alice", Exclude: []string{other}}))
+	track.UntrackBackend(first, ErrBackendUnhealthy)
+	// which cancelled the held connection
+	held = 0
+	assert.Equal(t, other, next(alice))
+
+	// Clients that don't come back are forgotten after the window
+	assert.Equal(t, 1, track.affinityClients())
+	clk.Advance(10 * time.Second)
+	next(Selection{Client: "bob"})
+	assert.Equal(t, 1, track.affinityClients())
+
+	// Disabling affinity forgets every client
+	track.ConfigureAffinity(0)
+	assert.Equal(t, 0, track.affinityClients())
+}
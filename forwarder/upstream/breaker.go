@@ -0,0 +1,102 @@
+package upstream
+
+import (
+	"time"
+)
+
+type breakerState int
+
+const (
+	// CLOSED allows all connections through
+	CLOSED breakerState = iota
+	// OPEN skips the backend until the cooldown has passed
+	OPEN
+	// HALFOPEN allows a single probe connection through to decide whether to close or re-open
+	HALFOPEN
+)
+
+// circuitBreaker tracks consecutive connection failures to a single backend.
+// After threshold consecutive failures the breaker opens and the backend is skipped in selection
+// for the cooldown. Once the cooldown passes a single probe connection is allowed through,
+// success closes the breaker and failure opens it again.
+//
+// With minRequests set a closed breaker only opens once the backend has had at least minRequests
+// connections reported within window so a single failure on a quiet backend doesn't eject it.
+//
+// This does not lock so it must only be used while holding the Tracker lock.
+type circuitBreaker struct {
+	threshold   int
+	cooldown    time.Duration
+	minRequests int
+	window      time.Duration
+
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	// recent holds when the last minRequests connections were reported, oldest first
+	recent []time.Time
+}
+
+// available reports if the backend can be selected without changing any state
+func (c *circuitBreaker) available(now time.Time) bool {
+	switch c.state {
+	case OPEN:
+		return now.Sub(c.openedAt) >= c.cooldown
+	case HALFOPEN:
+		return !c.probing
+	}
+	return true
+}
+
+// acquire is called when the backend has been selected.
+// An open breaker past its cooldown will transition to half-open and hand out its single probe.
+func (c *circuitBreaker) acquire(now time.Time) {
+	if c.state == OPEN && now.Sub(c.openedAt) >= c.cooldown {
+		c.state = HALFOPEN
+	}
+	if c.state == HALFOPEN {
+		c.probing = true
+	}
+}
+
+func (c *circuitBreaker) success(now time.Time) {
+	c.record(now)
+	c.state = CLOSED
+	c.failures = 0
+	c.probing = false
+}
+
+func (c *circuitBreaker) failure(now time.Time) {
+	c.record(now)
+	c.failures += 1
+	c.probing = false
+	// Failures of connections handed out before the breaker opened must not extend the cooldown
+	if c.state == OPEN {
+		return
+	}
+	if c.state == HALFOPEN || (c.failures >= c.threshold && c.enoughRequests(now)) {
+		c.state = OPEN
+		c.openedAt = now
+	}
+}
+
+// record remembers when a connection was reported keeping only as many as minRequests needs
+func (c *circuitBreaker) record(now time.Time) {
+	if c.minRequests <= 0 {
+		c.recent = nil
+		return
+	}
+	c.recent = append(c.recent, now)
+	if over := len(c.recent) - c.minRequests; over > 0 {
+		c.recent = c.recent[over:]
+	}
+}
+
+// enoughRequests reports if at least minRequests connections were reported within the window
+func (c *circuitBreaker) enoughRequests(now time.Time) bool {
+	if c.minRequests <= 0 {
+		return true
+	}
+	return len(c.recent) >= c.minRequests && now.Sub(c.recent[0]) <= c.window
+}
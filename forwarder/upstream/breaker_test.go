@@ -0,0 +1,148 @@
+package upstream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doggydogworld/gobalancer/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	now := time.Now()
+	b := &circuitBreaker{threshold: 3, cooldown: time.Second}
+
+	// Failures below the threshold keep the breaker closed
+	b.failure(now)
+	b.failure(now)
+	assert.Equal(t, CLOSED, b.state)
+	assert.True(t, b.available(now))
+
+	// A success resets the consecutive failures
+	b.success(now)
+	b.failure(now)
+	b.failure(now)
+	assert.Equal(t, CLOSED, b.state)
+
+	// closed -> open
+	b.failure(now)
+	assert.Equal(t, OPEN, b.state)
+	assert.False(t, b.available(now.Add(time.Second/2)))
+
+	// open -> half-open after cooldown, only a single probe is handed out
+	later := now.Add(time.Second)
+	assert.True(t, b.available(later))
+	b.acquire(later)
+	assert.Equal(t, HALFOPEN, b.state)
+	assert.False(t, b.available(later))
+
+	// half-open -> open on a failed probe
+	b.failure(later)
+	assert.Equal(t, OPEN, b.state)
+	assert.False(t, b.available(later))
+
+	// Failures while open don't extend the cooldown
+	b.failure(later.Add(time.Second / 2))
+	assert.Equal(t, OPEN, b.state)
+	assert.True(t, b.available(later.Add(time.Second)))
+
+	// half-open -> closed on a successful probe
+	evenLater := later.Add(time.Second)
+	b.acquire(evenLater)
+	b.success(evenLater)
+	assert.Equal(t, CLOSED, b.state)
+	assert.True(t, b.available(evenLater))
+}
+
+func TestTrackerCircuitBreaker(t *testing.T) {
+	addr := "127.0.0.1:8000"
+	clk := clock.NewFake(time.Now())
+	track := NewTracker(context.Background(), "test")
+	track.Clock = clk
+	defer track.Cancel(ErrBackendRemoved)
+	track.ConfigureCircuitBreaker(2, 20*time.Millisecond, 0)
+	track.TrackBackend(addr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Two consecutive failures opens the breaker and the only backend is skipped
+	for range 2 {
+		_, _, _, err := track.NextWithContext(ctx)
+		assert.NoError(t, err)
+		track.ReportFailure(addr)
+	}
+	_, _, _, err := track.NextWithContext(ctx)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	// After the cooldown a single probe is allowed through
+	clk.Advance(20 * time.Millisecond)
+	got, _, _, err := track.NextWithContext(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, addr, got)
+	_, _, _, err = track.NextWithContext(ctx)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	// A successful probe closes the breaker
+	track.ReportSuccess(addr)
+	_, _, _, err = track.NextWithContext(ctx)
+	assert.NoError(t, err)
+}
+
+func TestTrackerReconfigureCircuitBreaker(t *testing.T) {
+	addr := "127.0.0.1:8000"
+	track := NewTracker(context.Background(), "test")
+	defer track.Cancel(ErrBackendRemoved)
+	track.TrackBackend(addr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Enabling the breaker applies to backends that were already tracked
+	track.ConfigureCircuitBreaker(1, time.Minute, 0)
+	_, _, _, err := track.NextWithContext(ctx)
+	assert.NoError(t, err)
+	track.ReportFailure(addr)
+	_, _, _, err = track.NextWithContext(ctx)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	// Disabling it lets the backend be selected again
+	track.ConfigureCircuitBreaker(0, 0, 0)
+	_, _, _, err = track.NextWithContext(ctx)
+	assert.NoError(t, err)
+}
+
+func TestTrackerBreakerMinRequests(t *testing.T) {
+	addr := "127.0.0.1:8000"
+	clk := clock.NewFake(time.Now())
+	track := NewTracker(context.Background(), "test")
+	track.Clock = clk
+	defer track.Cancel(ErrBackendRemoved)
+	track.ConfigureBreakerMinRequests(5, time.Minute)
+	track.ConfigureCircuitBreaker(1, time.Minute, 0)
+	track.TrackBackend(addr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A single failure on a quiet backend doesn't eject it
+	track.ReportFailure(addr)
+	_, _, _, err := track.NextWithContext(ctx)
+	assert.NoError(t, err)
+
+	// Neither do failures spread out further than the window
+	for range 4 {
+		clk.Advance(30 * time.Second)
+		track.ReportFailure(addr)
+	}
+	_, _, _, err = track.NextWithContext(ctx)
+	assert.NoError(t, err)
+
+	// Enough failures within the window do
+	for range 4 {
+		track.ReportFailure(addr)
+	}
+	_, _, _, err = track.NextWithContext(ctx)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+}
@@ -0,0 +1,55 @@
+package upstream
+
+import (
+	"expvar"
+	"math"
+)
+
+// Fairness describes how evenly active connections are spread across the healthy backends of an upstream
+type Fairness struct {
+	Min    int
+	Max    int
+	StdDev float64
+}
+
+// Fairness computes the distribution of active connections across healthy backends
+func (t *Tracker) Fairness() Fairness {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.healthyBackends) == 0 {
+		return Fairness{}
+	}
+	f := Fairness{Min: math.MaxInt}
+	total := 0
+	for _, conns := range t.healthyBackends {
+		n := len(conns)
+		total += n
+		f.Min = min(f.Min, n)
+		f.Max = max(f.Max, n)
+	}
+	mean := float64(total) / float64(len(t.healthyBackends))
+	variance := 0.0
+	for _, conns := range t.healthyBackends {
+		variance += math.Pow(float64(len(conns))-mean, 2)
+	}
+	f.StdDev = math.Sqrt(variance / float64(len(t.healthyBackends)))
+	return f
+}
+
+// sampleFairness publishes the fairness of every upstream to the manager metrics
+func (m *Manager) sampleFairness() {
+	m.Upstreams.Range(func(key, value any) bool {
+		up := value.(*Upstream)
+		f := up.Fairness()
+		stats := new(expvar.Map).Init()
+		lo, hi, stddev := new(expvar.Int), new(expvar.Int), new(expvar.Float)
+		lo.Set(int64(f.Min))
+		hi.Set(int64(f.Max))
+		stddev.Set(f.StdDev)
+		stats.Set("min", lo)
+		stats.Set("max", hi)
+		stats.Set("stddev", stddev)
+		m.Metrics.Fairness.Set(up.Name, stats)
+		return true
+	})
+}
@@ -0,0 +1,63 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFairness(t *testing.T) {
+	addrs := []string{"127.0.0.1:8000", "127.0.0.1:8001", "127.0.0.1:8002"}
+	up := NewUpstream("test")
+	for _, addr := range addrs {
+		up.TrackBackend(addr)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Balanced state has no deviation
+	assert.Equal(t, Fairness{}, up.Fairness())
+
+	// Imbalanced state: [5, 3, 0]
+	for range 5 {
+		up.addCtxDirectly(context.WithValue(ctx, key, nil), addrs[0])
+	}
+	for range 3 {
+		up.addCtxDirectly(context.WithValue(ctx, key, nil), addrs[1])
+	}
+	f := up.Fairness()
+	assert.Equal(t, 0, f.Min)
+	assert.Equal(t, 5, f.Max)
+	assert.InDelta(t, 2.055, f.StdDev, 0.001)
+
+	// The manager publishes the sampled fairness per upstream
+	m := NewManager()
+	m.Upstreams.Store(up.Name, up)
+	m.sampleFairness()
+	var published map[string]map[string]map[string]float64
+	assert.NoError(t, json.Unmarshal([]byte(m.Metrics.String()), &published))
+	assert.InDelta(t, 2.055, published["fairness"]["test"]["stddev"], 0.001)
+	assert.Equal(t, 5.0, published["fairness"]["test"]["max"])
+}
+
+func TestPublishMetrics(t *testing.T) {
+	up := NewUpstream("test")
+	up.TrackBackend("127.0.0.1:8000")
+	m := NewManager()
+	m.Upstreams.Store(up.Name, up)
+	m.sampleFairness()
+
+	// Publishing again or from another manager must not panic on the duplicate expvar name
+	NewManager().PublishMetrics()
+	m.PublishMetrics()
+	m.PublishMetrics()
+
+	v := expvar.Get("upstreams")
+	assert.NotNil(t, v)
+	var published map[string]map[string]map[string]float64
+	assert.NoError(t, json.Unmarshal([]byte(v.String()), &published))
+	assert.Contains(t, published["fairness"], "test")
+}
@@ -2,10 +2,14 @@ package upstream
 
 import (
 	"context"
+	"errors"
 	"log/slog"
+	"net"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/doggydogworld/gobalancer/clock"
 	"github.com/doggydogworld/gobalancer/forwarder/health"
 )
 
@@ -17,6 +21,21 @@ const (
 	UNHEALTHY
 )
 
+func (b BackendStatus) String() string {
+	switch b {
+	case HEALTHY:
+		return "healthy"
+	case UNHEALTHY:
+		return "unhealthy"
+	}
+	return "init"
+}
+
+// MarshalText encodes the status by name e.g. for JSON
+func (b BackendStatus) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
 type backendStatEvent struct {
 	upstream string
 	addr     string
@@ -30,7 +49,22 @@ type BackendHeartbeat struct {
 	Checker      health.HealthChecker
 	Period       time.Duration
 	Timeout      time.Duration
+	// Clock drives the heartbeat period and defaults to the real clock when nil
+	Clock clock.Clock
+
+	// ObserveLatency is called with the latency of every successful probe when set
+	ObserveLatency func(time.Duration)
+	// WarmupProbes is how many consecutive probes must pass before the backend is first reported healthy.
+	// Once it has been reported healthy a single passing probe is enough again. 0 or 1 reports the first pass.
+	WarmupProbes int
 
+	// warmedUp and passed track the warmup and are only used by the heartbeat goroutine
+	warmedUp bool
+	passed   int
+
+	// probes limits the number of in-flight probes and is shared by all heartbeats of an upstream.
+	// A nil channel is unlimited.
+	probes chan struct{}
 	logger *slog.Logger
 }
 
@@ -39,24 +73,48 @@ type UpstreamHeartbeats struct {
 	UpstreamName string
 
 	stoppers map[*BackendHeartbeat]chan struct{}
+	probes   chan struct{}
 	wg       sync.WaitGroup
 	mu       sync.Mutex
 	logger   *slog.Logger
 }
 
-func (b *BackendHeartbeat) beat(ctx context.Context, out chan<- backendStatEvent) error {
-	ctx, cancel := context.WithTimeout(ctx, b.Timeout)
-	defer cancel()
-	event := backendStatEvent{
-		upstream: b.UpstreamName,
-		addr:     b.Addr,
+// errHeartbeatStopped is returned by beat when the heartbeat was stopped while waiting for a probe slot
+var errHeartbeatStopped = errors.New("heartbeat stopped")
+
+func (b *BackendHeartbeat) beat(ctx context.Context, stop <-chan struct{}, out chan<- backendStatEvent) error {
+	// Waiting for a probe slot shouldn't count towards the timeout
+	if b.probes != nil {
+		select {
+		case b.probes <- struct{}{}:
+		case <-stop:
+			return errHeartbeatStopped
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
-	check, changed, err := b.Checker.Check(ctx)
+	check, changed, err := b.probe(ctx)
 	if err != nil {
+		b.passed = 0
 		return err
 	}
+	if !b.warmedUp {
+		if check != health.SUCCESS {
+			b.passed = 0
+		} else if b.passed++; b.passed < b.WarmupProbes {
+			// The checker already counts the backend as healthy so the warmup decides when to report it
+			return nil
+		} else {
+			b.warmedUp = true
+			changed = true
+		}
+	}
 	if changed {
-		event.stat = UNHEALTHY
+		event := backendStatEvent{
+			upstream: b.UpstreamName,
+			addr:     b.Addr,
+			stat:     UNHEALTHY,
+		}
 		if check == health.SUCCESS {
 			event.stat = HEALTHY
 		}
@@ -65,6 +123,55 @@ func (b *BackendHeartbeat) beat(ctx context.Context, out chan<- backendStatEvent
 	return nil
 }
 
+// probe runs the health check holding the probe slot only while the check is in flight.
+// The slot is released before reporting so a slow event consumer doesn't hold up other probes.
+func (b *BackendHeartbeat) probe(ctx context.Context) (health.Status, bool, error) {
+	if b.probes != nil {
+		defer func() { <-b.probes }()
+	}
+	ctx, cancel := context.WithTimeout(ctx, b.Timeout)
+	defer cancel()
+	c := clock.Or(b.Clock)
+	start := c.Now()
+	check, changed, err := b.Checker.Check(ctx)
+	if err == nil && check == health.SUCCESS && b.ObserveLatency != nil {
+		b.ObserveLatency(c.Now().Sub(start))
+	}
+	return check, changed, err
+}
+
+// Categories of probe errors used to label the probe error metrics
+const (
+	ProbeErrRefused     = "refused"
+	ProbeErrTimeout     = "timeout"
+	ProbeErrDNS         = "dns"
+	ProbeErrReset       = "reset"
+	ProbeErrUnreachable = "unreachable"
+	ProbeErrOther       = "other"
+)
+
+// probeErrorCategory classifies why a probe failed.
+// A refused or reset connection means the host is up but the backend isn't, while timeouts and
+// unreachable networks point at a partition.
+func probeErrorCategory(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	// DNS errors can also be timeouts so they are checked first
+	case errors.As(err, &dnsErr):
+		return ProbeErrDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ProbeErrRefused
+	case errors.Is(err, syscall.ECONNRESET):
+		return ProbeErrReset
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return ProbeErrUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ProbeErrTimeout
+	}
+	return ProbeErrOther
+}
+
 func (b *BackendHeartbeat) newErrEvent(err error) backendStatEvent {
 	return backendStatEvent{
 		upstream: b.UpstreamName,
@@ -80,14 +187,16 @@ func (b *BackendHeartbeat) Run(ctx context.Context, stop <-chan struct{}) <-chan
 	out := make(chan backendStatEvent)
 	go func() {
 		defer b.logger.Info("HeartbeatStopped", "upstream", b.UpstreamName, "backend", b.Addr)
-		t := time.NewTicker(b.Period)
+		t := clock.Or(b.Clock).NewTicker(b.Period)
 		ctx, cancel := context.WithCancel(ctx)
 		// Ensuring proper cleanup
 		defer cancel()
 		defer close(out)
 		defer t.Stop()
 
-		if err := b.beat(ctx, out); err != nil {
+		if err := b.beat(ctx, stop, out); errors.Is(err, errHeartbeatStopped) {
+			return
+		} else if err != nil {
 			out <- b.newErrEvent(err)
 		}
 		// Main heartbeat loop
@@ -98,8 +207,10 @@ func (b *BackendHeartbeat) Run(ctx context.Context, stop <-chan struct{}) <-chan
 			case <-ctx.Done():
 				out <- b.newErrEvent(ctx.Err())
 				return
-			case <-t.C:
-				if err := b.beat(ctx, out); err != nil {
+			case <-t.C():
+				if err := b.beat(ctx, stop, out); errors.Is(err, errHeartbeatStopped) {
+					return
+				} else if err != nil {
 					out <- b.newErrEvent(err)
 				}
 			}
@@ -127,7 +238,21 @@ func (u *UpstreamHeartbeats) loadAndDeleteStopper(h *BackendHeartbeat) (stop cha
 	return
 }
 
+// SetProbeConcurrency limits the number of health probes in flight at once for heartbeats started after it is called.
+// A limit of 0 is unlimited.
+func (u *UpstreamHeartbeats) SetProbeConcurrency(limit int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.probes = nil
+	if limit > 0 {
+		u.probes = make(chan struct{}, limit)
+	}
+}
+
 func (u *UpstreamHeartbeats) StartHeartbeat(ctx context.Context, h *BackendHeartbeat, out chan<- backendStatEvent) {
+	u.mu.Lock()
+	h.probes = u.probes
+	u.mu.Unlock()
 	stop := make(chan struct{})
 	u.storeStopper(h, stop)
 	u.wg.Add(1)
@@ -147,6 +272,18 @@ func (u *UpstreamHeartbeats) StopHeartbeat(h *BackendHeartbeat) {
 	}
 }
 
+// StopBackendHeartbeats stops all heartbeats probing the backend address
+func (u *UpstreamHeartbeats) StopBackendHeartbeats(addr string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for h, stop := range u.stoppers {
+		if h.Addr == addr {
+			close(stop)
+			delete(u.stoppers, h)
+		}
+	}
+}
+
 func (u *UpstreamHeartbeats) StopAll() {
 	u.mu.Lock()
 	defer u.mu.Unlock()
@@ -2,11 +2,18 @@ package upstream
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/doggydogworld/gobalancer/clock"
 	"github.com/doggydogworld/gobalancer/forwarder/health"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/nettest"
@@ -45,6 +52,11 @@ func TestWithHealthy(t *testing.T) {
 
 	hb1 := newTestHeartbeat(l1.Addr().String())
 	hb2 := newTestHeartbeat(l2.Addr().String())
+	// Only the initial beat runs so a slow dial under load can't produce an extra event
+	for _, hb := range []*BackendHeartbeat{hb1, hb2} {
+		hb.Clock = clock.NewFake(time.Now())
+		hb.Timeout = time.Second
+	}
 
 	h.StartHeartbeat(ctx, hb1, out)
 	h.StartHeartbeat(ctx, hb2, out)
@@ -74,8 +86,13 @@ func TestWithUnhealthy(t *testing.T) {
 		logger:       slog.Default(),
 	}
 
+	// Heartbeats only tick when their clock is advanced so each check happens exactly when expected.
+	// Each heartbeat gets its own clock so advancing one doesn't probe the other.
+	clk1, clk2 := clock.NewFake(time.Now()), clock.NewFake(time.Now())
 	hb1 := newTestHeartbeat(l1.Addr().String())
 	hb2 := newTestHeartbeat(l2.Addr().String())
+	hb1.Clock, hb2.Clock = clk1, clk2
+	hb1.Timeout, hb2.Timeout = time.Second, time.Second
 
 	h.StartHeartbeat(ctx, hb1, out)
 	h.StartHeartbeat(ctx, hb2, out)
@@ -83,12 +100,15 @@ func TestWithUnhealthy(t *testing.T) {
 	assert.Equal(t, HEALTHY, (<-out).stat)
 	assert.Equal(t, HEALTHY, (<-out).stat)
 	assert.Len(t, out, 0)
+	assert.Eventually(t, func() bool { return clk1.Tickers() == 1 && clk2.Tickers() == 1 }, time.Second, time.Millisecond)
 
 	l2.Close()
+	clk2.Advance(hb2.Period)
 	event := <-out
 	assert.Equal(t, l2.Addr().String(), event.addr)
 	assert.Equal(t, UNHEALTHY, event.stat)
 	l1.Close()
+	clk1.Advance(hb1.Period)
 	event = <-out
 	assert.Equal(t, l1.Addr().String(), event.addr)
 	assert.Equal(t, UNHEALTHY, event.stat)
@@ -96,3 +116,157 @@ func TestWithUnhealthy(t *testing.T) {
 	// Cleanup
 	h.StopAll()
 }
+
+// slowChecker takes a while to complete and records the maximum number of concurrent checks
+type slowChecker struct {
+	inflight    *atomic.Int32
+	maxInflight *atomic.Int32
+	checked     bool
+}
+
+func (c *slowChecker) Check(ctx context.Context) (health.Status, bool, error) {
+	n := c.inflight.Add(1)
+	defer c.inflight.Add(-1)
+	for {
+		prev := c.maxInflight.Load()
+		if n <= prev || c.maxInflight.CompareAndSwap(prev, n) {
+			break
+		}
+	}
+	time.Sleep(2 * time.Millisecond)
+	changed := !c.checked
+	c.checked = true
+	return health.SUCCESS, changed, nil
+}
+
+func TestProbeConcurrencyLimit(t *testing.T) {
+	out := make(chan backendStatEvent)
+	h := &UpstreamHeartbeats{
+		UpstreamName: "test",
+		stoppers:     map[*BackendHeartbeat]chan struct{}{},
+		logger:       slog.Default(),
+	}
+	h.SetProbeConcurrency(3)
+
+	inflight, maxInflight := &atomic.Int32{}, &atomic.Int32{}
+	backends := 30
+	for i := range backends {
+		hb := newTestHeartbeat(fmt.Sprintf("127.0.0.1:%d", 8000+i))
+		hb.Checker = &slowChecker{inflight: inflight, maxInflight: maxInflight}
+		hb.Timeout = time.Second
+		h.StartHeartbeat(context.Background(), hb, out)
+	}
+	// Every backend reports healthy once
+	for range backends {
+		assert.Equal(t, HEALTHY, (<-out).stat)
+	}
+	go func() {
+		for range out {
+		}
+	}()
+	h.StopAll()
+	close(out)
+
+	assert.LessOrEqual(t, maxInflight.Load(), int32(3))
+	assert.Greater(t, maxInflight.Load(), int32(0))
+}
+
+// gateChecker blocks every check until the gate is closed and counts the checks that started
+type gateChecker struct {
+	started *atomic.Int32
+	gate    chan struct{}
+}
+
+func (c *gateChecker) Check(ctx context.Context) (health.Status, bool, error) {
+	c.started.Add(1)
+	<-c.gate
+	return health.SUCCESS, true, nil
+}
+
+func TestProbeSlotReleasedBeforeReporting(t *testing.T) {
+	probes := make(chan struct{}, 1)
+	started := &atomic.Int32{}
+	gate := make(chan struct{})
+	close(gate)
+
+	// Nothing reads the events so both heartbeats block reporting, the slot must not be held while they do
+	var outs []<-chan backendStatEvent
+	var stops []chan struct{}
+	for i := range 2 {
+		hb := newTestHeartbeat(fmt.Sprintf("127.0.0.1:%d", 8000+i))
+		hb.Checker = &gateChecker{started: started, gate: gate}
+		hb.Clock = clock.NewFake(time.Now())
+		hb.probes = probes
+		stop := make(chan struct{})
+		outs = append(outs, hb.Run(context.Background(), stop))
+		stops = append(stops, stop)
+	}
+	assert.Eventually(t, func() bool { return started.Load() == 2 }, time.Second, time.Millisecond)
+	for i := range outs {
+		<-outs[i]
+		close(stops[i])
+		for range outs[i] {
+		}
+	}
+}
+
+func TestStopWhileWaitingForProbeSlot(t *testing.T) {
+	probes := make(chan struct{}, 1)
+	gate := make(chan struct{})
+	holder := newTestHeartbeat("127.0.0.1:8000")
+	holder.Checker = &gateChecker{started: &atomic.Int32{}, gate: gate}
+	holder.Clock = clock.NewFake(time.Now())
+	holder.probes = probes
+	holderStop := make(chan struct{})
+	holderOut := holder.Run(context.Background(), holderStop)
+	assert.Eventually(t, func() bool { return len(probes) == 1 }, time.Second, time.Millisecond)
+
+	// The waiting heartbeat stops without probing or reporting
+	waiter := newTestHeartbeat("127.0.0.1:8001")
+	waiter.Clock = clock.NewFake(time.Now())
+	waiter.probes = probes
+	stop := make(chan struct{})
+	out := waiter.Run(context.Background(), stop)
+	close(stop)
+	select {
+	case e, ok := <-out:
+		assert.False(t, ok, "unexpected event %+v", e)
+	case <-time.After(time.Second):
+		t.Fatal("heartbeat waiting for a probe slot did not stop")
+	}
+
+	close(gate)
+	<-holderOut
+	close(holderStop)
+	for range holderOut {
+	}
+}
+
+func TestProbeErrorCategory(t *testing.T) {
+	tests := map[string]struct {
+		err      error
+		category string
+	}{
+		"refused": {
+			err:      &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)},
+			category: ProbeErrRefused,
+		},
+		"reset": {
+			err:      &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+			category: ProbeErrReset,
+		},
+		"unreachable": {
+			err:      &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)},
+			category: ProbeErrUnreachable,
+		},
+		"dns":              {err: &net.OpError{Op: "dial", Err: &net.DNSError{Name: "backend", IsTimeout: true}}, category: ProbeErrDNS},
+		"deadline":         {err: fmt.Errorf("probe: %w", context.DeadlineExceeded), category: ProbeErrTimeout},
+		"i/o timeout":      {err: &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, category: ProbeErrTimeout},
+		"unexpected reply": {err: errors.New("response did not match"), category: ProbeErrOther},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.category, probeErrorCategory(test.err))
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package upstream
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	defaultLatencySmoothing = 0.3
+	defaultLatencyMinWeight = 0.1
+)
+
+// ConfigureLatencyWeighting enables weighting backends by the smoothed latency of their health checks.
+// smoothing is the EWMA factor of a new sample and minWeight floors the weight of a backend as a fraction
+// of the fastest backend. Zero values use the defaults.
+func (t *Tracker) ConfigureLatencyWeighting(enabled bool, smoothing float64, minWeight float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if smoothing <= 0 || smoothing > 1 {
+		smoothing = defaultLatencySmoothing
+	}
+	if minWeight <= 0 || minWeight > 1 {
+		minWeight = defaultLatencyMinWeight
+	}
+	t.latencyWeighted = enabled
+	t.latencySmoothing = smoothing
+	t.latencyMinWeight = minWeight
+}
+
+// ObserveLatency records a health check latency sample for a backend
+func (t *Tracker) ObserveLatency(addr string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.latencyWeighted {
+		return
+	}
+	sample := d.Seconds()
+	if prev, ok := t.latency[addr]; ok {
+		sample = t.latencySmoothing*sample + (1-t.latencySmoothing)*prev
+	}
+	t.latency[addr] = sample
+}
+
+// latencyScores returns the effective latency used to weight each healthy backend.
+// Backends without a sample are treated like the fastest backend so new backends still get traffic
+// and latencies are capped so no backend falls below the minimum weight.
+// Returns nil when there is nothing to weight by.
+// This does not lock so make sure to wrap this in a mu.Lock()
+func (t *Tracker) latencyScores() map[string]float64 {
+	if !t.latencyWeighted {
+		return nil
+	}
+	fastest := math.Inf(1)
+	for addr := range t.healthyBackends {
+		if l, ok := t.latency[addr]; ok && l > 0 {
+			fastest = min(fastest, l)
+		}
+	}
+	if math.IsInf(fastest, 1) {
+		return nil
+	}
+	ceiling := fastest / t.latencyMinWeight
+	scores := make(map[string]float64, len(t.healthyBackends))
+	for addr := range t.healthyBackends {
+		l, ok := t.latency[addr]
+		if !ok || l <= 0 {
+			l = fastest
+		}
+		scores[addr] = min(l, ceiling)
+	}
+	return scores
+}
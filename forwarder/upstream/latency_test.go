@@ -0,0 +1,72 @@
+package upstream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// distribute hands out n connections without releasing any and counts them per backend
+func distribute(t *testing.T, track *Tracker, n int) map[string]int {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	counts := map[string]int{}
+	for range n {
+		addr, _, _, err := track.NextWithContext(context.WithValue(ctx, key, nil))
+		assert.NoError(t, err)
+		counts[addr] += 1
+	}
+	return counts
+}
+
+func TestLatencyWeighting(t *testing.T) {
+	fast, slow := "127.0.0.1:8000", "127.0.0.1:8001"
+	track := NewTracker(context.Background(), "test")
+	defer track.Cancel(ErrBackendRemoved)
+	track.ConfigureLatencyWeighting(true, 1, 0.01)
+	track.TrackBackend(fast)
+	track.TrackBackend(slow)
+	track.ObserveLatency(fast, time.Millisecond)
+	track.ObserveLatency(slow, 4*time.Millisecond)
+
+	// Traffic is split by the inverse of the latency
+	counts := distribute(t, track, 100)
+	assert.InDelta(t, 80, counts[fast], 2)
+	assert.InDelta(t, 20, counts[slow], 2)
+}
+
+func TestLatencyWeightingFloor(t *testing.T) {
+	fast, slow := "127.0.0.1:8000", "127.0.0.1:8001"
+	track := NewTracker(context.Background(), "test")
+	defer track.Cancel(ErrBackendRemoved)
+	track.ConfigureLatencyWeighting(true, 1, 0.1)
+	track.TrackBackend(fast)
+	track.TrackBackend(slow)
+	track.ObserveLatency(fast, time.Millisecond)
+	// A single very slow probe can't take the backend below a tenth of the fastest weight
+	track.ObserveLatency(slow, time.Second)
+
+	counts := distribute(t, track, 110)
+	assert.InDelta(t, 100, counts[fast], 2)
+	assert.InDelta(t, 10, counts[slow], 2)
+}
+
+func TestLatencySmoothing(t *testing.T) {
+	addr := "127.0.0.1:8000"
+	track := NewTracker(context.Background(), "test")
+	defer track.Cancel(ErrBackendRemoved)
+	track.ConfigureLatencyWeighting(true, 0.5, 0)
+	track.TrackBackend(addr)
+
+	track.ObserveLatency(addr, 10*time.Millisecond)
+	track.ObserveLatency(addr, 20*time.Millisecond)
+	assert.InDelta(t, 0.015, track.latency[addr], 1e-9)
+
+	// Disabled tracking ignores samples and falls back to least connections
+	track.ConfigureLatencyWeighting(false, 0, 0)
+	track.ObserveLatency(addr, time.Second)
+	assert.InDelta(t, 0.015, track.latency[addr], 1e-9)
+	assert.Nil(t, track.latencyScores())
+}
@@ -2,31 +2,214 @@ package upstream
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"expvar"
 	"fmt"
 	"log/slog"
+	"net"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/doggydogworld/gobalancer/clock"
 	"github.com/doggydogworld/gobalancer/config"
 	"github.com/doggydogworld/gobalancer/forwarder/health"
 )
 
 type Manager struct {
-	Upstreams     sync.Map
+	Upstreams sync.Map
+	// BackendStatus holds the last reported BackendStatus keyed by BackendKey.
+	// A backend shared by several upstreams is health checked and tracked separately for each of them.
 	BackendStatus sync.Map
+	// FairnessInterval is how often the connection distribution of each upstream is sampled
+	FairnessInterval time.Duration
+	Metrics          *ManagerMetrics
+	// DefaultProxy is the proxy URL used by upstreams that don't set their own Proxy. Empty dials directly.
+	DefaultProxy string
+	// Resolver looks up hostname backends of upstreams loaded after it is set. Defaults to net.DefaultResolver.
+	Resolver *net.Resolver
+	// HeartbeatClock drives the health checks of backends loaded after it is set and defaults to the real clock
+	HeartbeatClock clock.Clock
+	// StatusFile is the path a JSON snapshot of every upstream is written to for external tooling.
+	// It is replaced atomically every StatusInterval, 10s by default. Disabled when empty.
+	StatusFile     string
+	StatusInterval time.Duration
+	// OnBackendHealthy and OnBackendUnhealthy are called when a backend of an upstream changes health, e.g. to
+	// page someone or update an external registry. Each call runs on its own goroutine so a slow callback
+	// doesn't hold up health checking, and a panic is logged rather than crashing the process. Shutdown waits
+	// for callbacks that are still running. Set them before Start.
+	OnBackendHealthy   func(upstream string, addr string)
+	OnBackendUnhealthy func(upstream string, addr string)
 
 	healthEvents chan backendStatEvent
 	stop         chan struct{}
-	logger       *slog.Logger
+	stopOnce     sync.Once
+	// done is closed once Start has stopped every heartbeat and the goroutines it started have returned
+	done chan struct{}
+	// wg tracks the health receiver, status file writer and health callbacks started by Start
+	wg     sync.WaitGroup
+	logger *slog.Logger
+}
+
+// ManagerMetrics holds metrics for all upstreams.
+// It is published as the "upstreams" expvar by PublishMetrics.
+type ManagerMetrics struct {
+	// Fairness is keyed by upstream and holds the min, max and stddev of active connections per backend
+	Fairness *expvar.Map
+	// ProbeErrors is keyed by upstream then backend and counts failed health probes by error category.
+	// A backend's counters are deleted when it is removed.
+	ProbeErrors *expvar.Map
+	// NotReadyRejections is keyed by upstream and counts connections rejected because no backend was healthy
+	NotReadyRejections *expvar.Map
+	// DialRetries is keyed by upstream and counts connections retried on another backend after a failed dial
+	DialRetries *expvar.Map
+	// RetryBudgetExhausted is keyed by upstream and counts failed dials that weren't retried because the
+	// retry budget was empty
+	RetryBudgetExhausted *expvar.Map
+	// CloseReasons is keyed by upstream then reason and counts connections by why they ended
+	CloseReasons *expvar.Map
+	// Accounting is keyed by the accounting tag of connections and counts their connections, bytes_sent
+	// and bytes_received
+	Accounting *expvar.Map
+	// ContentClasses is keyed by upstream then class and counts connections by what their backend sent first
+	// e.g. gzip or tls, when content classification is enabled
+	ContentClasses *expvar.Map
+	// Concurrency is keyed by upstream and holds its active connections across every backend
+	Concurrency *expvar.Map
+	// CapacityRejections is keyed by upstream and counts connections rejected because it was at MaxConns,
+	// including ones that gave up waiting in its queue
+	CapacityRejections *expvar.Map
+	// QueueDepth is keyed by upstream and holds the connections waiting in its queue
+	QueueDepth *expvar.Map
+	// MaxQueueDepth is keyed by upstream and holds the most connections that have waited in its queue at once
+	MaxQueueDepth *expvar.Map
+	// ListenerRestarts is keyed by upstream and counts the times one of its listeners was bound again after failing
+	ListenerRestarts *expvar.Map
+	// childMu stops two callers creating the same nested map at once
+	childMu sync.Mutex
+	// probeErrorsMu stops a probe of a removed backend counting it again after its entry was deleted
+	probeErrorsMu sync.Mutex
+}
+
+func (m *ManagerMetrics) String() string {
+	out := new(expvar.Map).Init()
+	out.Set("fairness", m.Fairness)
+	out.Set("probe_errors", m.ProbeErrors)
+	out.Set("not_ready_rejections", m.NotReadyRejections)
+	out.Set("dial_retries", m.DialRetries)
+	out.Set("retry_budget_exhausted", m.RetryBudgetExhausted)
+	out.Set("close_reasons", m.CloseReasons)
+	out.Set("accounting", m.Accounting)
+	out.Set("content_classes", m.ContentClasses)
+	out.Set("concurrency", m.Concurrency)
+	out.Set("capacity_rejections", m.CapacityRejections)
+	out.Set("queue_depth", m.QueueDepth)
+	out.Set("max_queue_depth", m.MaxQueueDepth)
+	out.Set("listener_restarts", m.ListenerRestarts)
+	return out.String()
+}
+
+// childMap returns the map under key in parent, creating it the first time key is used
+func (m *ManagerMetrics) childMap(parent *expvar.Map, key string) *expvar.Map {
+	if child, ok := parent.Get(key).(*expvar.Map); ok {
+		return child
+	}
+	m.childMu.Lock()
+	defer m.childMu.Unlock()
+	child, ok := parent.Get(key).(*expvar.Map)
+	if !ok {
+		child = new(expvar.Map).Init()
+		parent.Set(key, child)
+	}
+	return child
+}
+
+// AddCloseReason counts a connection to upstream that ended for reason
+func (m *ManagerMetrics) AddCloseReason(upstream string, reason string) {
+	m.childMap(m.CloseReasons, upstream).Add(reason, 1)
+}
+
+// AddAccounting counts a closed connection and the bytes it copied each way against its accounting tag
+func (m *ManagerMetrics) AddAccounting(tag string, sent int64, received int64) {
+	counters := m.childMap(m.Accounting, tag)
+	counters.Add("connections", 1)
+	counters.Add("bytes_sent", sent)
+	counters.Add("bytes_received", received)
+}
+
+// AddContentClass counts a connection to upstream whose backend stream was classified as class
+func (m *ManagerMetrics) AddContentClass(upstream string, class string) {
+	m.childMap(m.ContentClasses, upstream).Add(class, 1)
+}
+
+// published holds the metrics behind the "upstreams" expvar.
+// expvar.Publish panics on duplicate names so the var is published once per process
+// and reports the metrics of the manager that published most recently.
+var published struct {
+	once    sync.Once
+	metrics atomic.Pointer[ManagerMetrics]
+}
+
+type publishedMetrics struct{}
+
+func (publishedMetrics) String() string {
+	if m := published.metrics.Load(); m != nil {
+		return m.String()
+	}
+	return "{}"
+}
+
+// PublishMetrics exposes the manager metrics as the "upstreams" expvar e.g. on /debug/vars.
+// It is safe to call more than once and from multiple managers, the last caller wins.
+func (m *Manager) PublishMetrics() {
+	published.metrics.Store(m.Metrics)
+	published.once.Do(func() {
+		expvar.Publish("upstreams", publishedMetrics{})
+	})
+}
+
+// BackendKey identifies a backend of an upstream
+type BackendKey struct {
+	Upstream string
+	Addr     string
+}
+
+// BackendHealth returns the last reported status of a backend of an upstream
+func (m *Manager) BackendHealth(upstream string, addr string) (BackendStatus, bool) {
+	if val, ok := m.BackendStatus.Load(BackendKey{Upstream: upstream, Addr: addr}); ok {
+		return val.(BackendStatus), true
+	}
+	return INIT, false
 }
 
 func NewManager() *Manager {
 	return &Manager{
-		Upstreams:     sync.Map{},
-		BackendStatus: sync.Map{},
-		healthEvents:  make(chan backendStatEvent),
-		stop:          make(chan struct{}),
-		logger:        slog.Default(),
+		Upstreams:        sync.Map{},
+		BackendStatus:    sync.Map{},
+		FairnessInterval: 10 * time.Second,
+		Metrics: &ManagerMetrics{
+			Fairness:             new(expvar.Map).Init(),
+			ProbeErrors:          new(expvar.Map).Init(),
+			NotReadyRejections:   new(expvar.Map).Init(),
+			DialRetries:          new(expvar.Map).Init(),
+			RetryBudgetExhausted: new(expvar.Map).Init(),
+			CloseReasons:         new(expvar.Map).Init(),
+			Accounting:           new(expvar.Map).Init(),
+			ContentClasses:       new(expvar.Map).Init(),
+			Concurrency:          new(expvar.Map).Init(),
+			CapacityRejections:   new(expvar.Map).Init(),
+			QueueDepth:           new(expvar.Map).Init(),
+			MaxQueueDepth:        new(expvar.Map).Init(),
+			ListenerRestarts:     new(expvar.Map).Init(),
+		},
+		healthEvents: make(chan backendStatEvent),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+		logger:       slog.Default(),
 	}
 }
 
@@ -37,9 +220,13 @@ func (m *Manager) handleHealthy(upstream string, backend string) {
 		m.logger.Error("MissingUpstream", "msg", err)
 		return
 	}
-	up.TrackBackend(backend)
-	m.BackendStatus.Store(backend, HEALTHY)
-	up.Status.Store(int32(HEALTHY))
+	if !up.transitionBackend(backend, HEALTHY) {
+		m.logger.Info("IgnoringRemovedBackend", "upstream", upstream, "backend", backend)
+		return
+	}
+	m.BackendStatus.Store(BackendKey{Upstream: upstream, Addr: backend}, HEALTHY)
+	up.refreshReady()
+	m.runHealthCallback(m.OnBackendHealthy, upstream, backend)
 }
 
 func (m *Manager) handleUnhealthy(upstream string, backend string) {
@@ -49,8 +236,32 @@ func (m *Manager) handleUnhealthy(upstream string, backend string) {
 		m.logger.Error("MissingUpstream", "msg", err)
 		return
 	}
-	up.UntrackBackend(backend, ErrBackendUnhealthy)
-	m.BackendStatus.Store(backend, UNHEALTHY)
+	if !up.transitionBackend(backend, UNHEALTHY) {
+		m.logger.Info("IgnoringRemovedBackend", "upstream", upstream, "backend", backend)
+		return
+	}
+	m.BackendStatus.Store(BackendKey{Upstream: upstream, Addr: backend}, UNHEALTHY)
+	up.refreshReady()
+	m.runHealthCallback(m.OnBackendUnhealthy, upstream, backend)
+}
+
+// runHealthCallback calls f on a new goroutine if it is set, recovering from any panic so a broken callback
+// can't take down the health receiver. Only the health receiver calls it and wg is already counting the receiver
+// so the Add can't race with Start waiting on wg.
+func (m *Manager) runHealthCallback(f func(upstream string, addr string), upstream string, backend string) {
+	if f == nil {
+		return
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				m.logger.Error("HealthCallbackPanicked", "upstream", upstream, "backend", backend, "msg", r)
+			}
+		}()
+		f(upstream, backend)
+	}()
 }
 
 func (m *Manager) healthReceiver() {
@@ -60,35 +271,162 @@ func (m *Manager) healthReceiver() {
 			m.handleHealthy(e.upstream, e.addr)
 		case UNHEALTHY:
 			if e.err != nil {
-				m.logger.Error("BackendError", "msg", e.err)
+				category := probeErrorCategory(e.err)
+				m.logger.Error("BackendError", "msg", e.err, "category", category)
+				m.recordProbeError(e.upstream, e.addr, category)
 			}
 			m.handleUnhealthy(e.upstream, e.addr)
 		}
 	}
 }
 
+// recordProbeError counts a failed probe of a backend under its error category.
+// Probes that were in flight when the backend was removed aren't counted so its entry stays deleted.
+func (m *Manager) recordProbeError(upstream string, backend string, category string) {
+	up, err := m.GetUpstream(upstream)
+	if err != nil {
+		return
+	}
+	m.Metrics.probeErrorsMu.Lock()
+	defer m.Metrics.probeErrorsMu.Unlock()
+	if !up.hasBackend(backend) {
+		return
+	}
+	backends := m.Metrics.childMap(m.Metrics.ProbeErrors, upstream)
+	m.Metrics.childMap(backends, backend).Add(category, 1)
+}
+
+// forgetProbeErrors deletes the probe error counters of a removed backend
+func (m *Manager) forgetProbeErrors(upstream string, backend string) {
+	m.Metrics.probeErrorsMu.Lock()
+	defer m.Metrics.probeErrorsMu.Unlock()
+	if backends, ok := m.Metrics.ProbeErrors.Get(upstream).(*expvar.Map); ok {
+		backends.Delete(backend)
+	}
+}
+
+// newBackendTLSConfig creates the TLS configuration used to connect to backends
+func newBackendTLSConfig(cfg *config.BackendTLS) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: cfg.ServerName,
+	}
+	if len(cfg.RootCA) > 0 {
+		p := x509.NewCertPool()
+		if ok := p.AppendCertsFromPEM(cfg.RootCA); !ok {
+			return nil, errors.New("no certificates found in backend RootCA")
+		}
+		tlsConf.RootCAs = p
+	}
+	if len(cfg.ClientCrt) > 0 || len(cfg.ClientKey) > 0 {
+		crt, err := tls.X509KeyPair(cfg.ClientCrt, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend client certificate: %w", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{crt}
+	}
+	return tlsConf, nil
+}
+
+// newChecker creates the health check for a backend.
+// Checks dial the backend with Upstream.Dial like forwarded connections do so they go through the same
+// proxy and TLS handshake and resolve a hostname backend the same way. A connect check therefore covers
+// TLS backends too. Backends with a health check address are checked there instead of on addr.
+func (up *Upstream) newChecker(addr string) health.HealthChecker {
+	dial := func(ctx context.Context, _ string, addr string) (net.Conn, error) {
+		return up.Dial(ctx, &net.Dialer{}, addr)
+	}
+	settings := up.settings.Load()
+	if settings != nil {
+		if healthAddr, ok := settings.healthCheckAddrs[addr]; ok {
+			addr = healthAddr
+		}
+	}
+	if settings != nil && settings.healthCheck != nil {
+		return &health.SendExpect{
+			Addr:         addr,
+			Dial:         dial,
+			Send:         settings.healthCheck.Send,
+			Expect:       settings.healthCheck.Expect,
+			ExpectRegexp: settings.expectRegexp,
+			MaxRead:      settings.healthCheck.MaxRead,
+		}
+	}
+	return &health.TCP{
+		Addr: addr,
+		Dial: dial,
+	}
+}
+
 // LoadUpstreamFromConfig will setup an upstream based on the configuration.
-func (m *Manager) LoadUpstreamFromConfig(cfg *config.Upstream) {
-	var up *Upstream
-	if val, err := m.GetUpstream(cfg.Name); err != nil {
+// Loading an upstream that already exists applies the new settings to it. Backends missing from the
+// new config are removed and only new backends get a heartbeat started. Changes to the backend TLS,
+// health check addresses or health check concurrency restart all heartbeats so the health checks pick them up.
+func (m *Manager) LoadUpstreamFromConfig(cfg *config.Upstream) error {
+	up, err := m.GetUpstream(cfg.Name)
+	created := err != nil
+	if created {
 		up = NewUpstream(cfg.Name)
+		up.Resolver = m.Resolver
+	}
+	restart, err := up.applyConfig(cfg, m.DefaultProxy)
+	if err != nil {
+		return fmt.Errorf("upstream %s: %w", cfg.Name, err)
+	}
+	if created {
 		m.Upstreams.Store(cfg.Name, up)
+		m.publishUpstreamGauges(up)
 	} else {
-		up = val
+		// The minimum healthy backends may have changed
+		up.refreshReady()
+	}
+	if restart {
+		m.logger.Info("RestartingHeartbeats", "upstream", cfg.Name)
+		up.StopAll()
+	}
+
+	configured := make(map[string]struct{}, len(cfg.Backends))
+	for _, back := range cfg.Backends {
+		configured[back] = struct{}{}
+	}
+	for _, back := range up.configuredBackends() {
+		if _, ok := configured[back]; !ok {
+			m.RemoveBackend(cfg.Name, back)
+		}
 	}
 	for _, back := range cfg.Backends {
+		// Backends that are already configured keep their running heartbeat
+		added := up.initBackendStatus(back)
+		if !added && !restart {
+			continue
+		}
 		hb := &BackendHeartbeat{
 			UpstreamName: cfg.Name,
 			Addr:         back,
-			Checker: &health.TCP{
-				Addr: back,
+			Checker:      up.newChecker(back),
+			Period:       2 * time.Second,
+			Clock:        m.HeartbeatClock,
+			Timeout:      time.Second,
+			ObserveLatency: func(d time.Duration) {
+				up.ObserveLatency(back, d)
 			},
-			Period:  2 * time.Second,
-			Timeout: time.Second,
-			logger:  slog.Default(),
+			logger: slog.Default(),
+		}
+		// Backends of a new upstream are admitted straight away so it becomes ready promptly at startup
+		if added && !created {
+			hb.WarmupProbes = up.settings.Load().warmupProbes
 		}
 		up.StartHeartbeat(context.Background(), hb, m.healthEvents)
 	}
+	return nil
+}
+
+// publishUpstreamGauges adds the gauges of a new upstream to the manager metrics.
+// They are read from the upstream whenever the metrics are so they are never stale.
+func (m *Manager) publishUpstreamGauges(up *Upstream) {
+	m.Metrics.Concurrency.Set(up.Name, expvar.Func(func() any { return up.ActiveConns() }))
+	m.Metrics.QueueDepth.Set(up.Name, expvar.Func(func() any { return up.QueueLen() }))
+	m.Metrics.MaxQueueDepth.Set(up.Name, expvar.Func(func() any { return up.MaxQueueLen() }))
 }
 
 func (m *Manager) GetUpstream(name string) (*Upstream, error) {
@@ -101,19 +439,119 @@ func (m *Manager) GetUpstream(name string) (*Upstream, error) {
 	return up, nil
 }
 
+// RemoveBackend stops health checking a backend and removes it from the upstream.
+// Active connections to the backend are cancelled with ErrBackendRemoved so they can drain.
+func (m *Manager) RemoveBackend(upstream string, addr string) error {
+	up, err := m.GetUpstream(upstream)
+	if err != nil {
+		return err
+	}
+	m.logger.Info("BackendRemoved", "upstream", upstream, "backend", addr)
+	// Forget the backend first so a health event that is already in flight can't track it again
+	up.removeBackendStatus(addr)
+	m.BackendStatus.Delete(BackendKey{Upstream: upstream, Addr: addr})
+	up.StopBackendHeartbeats(addr)
+	up.UntrackBackend(addr, ErrBackendRemoved)
+	up.refreshReady()
+	m.forgetProbeErrors(upstream, addr)
+	return nil
+}
+
+// PauseUpstream stops sending new connections to an upstream e.g. during backend maintenance.
+// New connections fail with ErrUpstreamPaused while active connections and health checks carry on.
+func (m *Manager) PauseUpstream(name string) error {
+	up, err := m.GetUpstream(name)
+	if err != nil {
+		return err
+	}
+	m.logger.Info("UpstreamPaused", "upstream", name)
+	up.SetPaused(true)
+	return nil
+}
+
+// ResumeUpstream sends new connections to a paused upstream again
+func (m *Manager) ResumeUpstream(name string) error {
+	up, err := m.GetUpstream(name)
+	if err != nil {
+		return err
+	}
+	m.logger.Info("UpstreamResumed", "upstream", name)
+	up.SetPaused(false)
+	return nil
+}
+
+// UpstreamConfigs returns the config every upstream is running with sorted by name. See Upstream.Config.
+func (m *Manager) UpstreamConfigs() []*config.Upstream {
+	var cfgs []*config.Upstream
+	m.Upstreams.Range(func(key, value any) bool {
+		cfgs = append(cfgs, value.(*Upstream).Config())
+		return true
+	})
+	slices.SortFunc(cfgs, func(a, b *config.Upstream) int { return strings.Compare(a.Name, b.Name) })
+	return cfgs
+}
+
+// UpstreamBackends returns the status of every backend configured for the named upstream
+func (m *Manager) UpstreamBackends(name string) ([]BackendInfo, error) {
+	up, err := m.GetUpstream(name)
+	if err != nil {
+		return nil, err
+	}
+	return up.Backends(), nil
+}
+
 func (m *Manager) Start() error {
-	go m.healthReceiver()
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.healthReceiver()
+	}()
+	if m.StatusFile != "" {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.writeStatusFiles()
+		}()
+	}
 
-	<-m.stop
-	close(m.healthEvents)
+	t := time.NewTicker(m.FairnessInterval)
+	defer t.Stop()
+	for running := true; running; {
+		select {
+		case <-t.C:
+			m.sampleFairness()
+		case <-m.stop:
+			running = false
+		}
+	}
+	// Heartbeats must be stopped before the events channel is closed as they may still be sending on it
 	m.Upstreams.Range(func(key any, value any) bool {
 		up := value.(*Upstream)
 		up.StopAll()
 		return true
 	})
+	close(m.healthEvents)
+	m.wg.Wait()
+	close(m.done)
 	return nil
 }
 
+// Stop signals Start to stop all heartbeats and return. It is safe to call more than once.
 func (m *Manager) Stop() {
-	m.stop <- struct{}{}
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+// Shutdown stops the manager and waits until every heartbeat has stopped and the health events have been
+// handled, or ctx is done in which case the ctx error is returned and the shutdown carries on in the
+// background. Start must have been called.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.Stop()
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
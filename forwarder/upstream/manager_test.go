@@ -0,0 +1,640 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/doggydogworld/gobalancer/clock"
+	"github.com/doggydogworld/gobalancer/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/nettest"
+)
+
+func TestUpstreamBackends(t *testing.T) {
+	healthy, err := nettest.NewLocalListener("tcp")
+	assert.NoError(t, err)
+	defer healthy.Close()
+	unhealthy, err := nettest.NewLocalListener("tcp")
+	assert.NoError(t, err)
+	unhealthy.Close()
+
+	m := NewManager()
+	go m.Start()
+	defer m.Stop()
+	m.LoadUpstreamFromConfig(&config.Upstream{
+		Name:     "web",
+		Backends: []string{healthy.Addr().String(), unhealthy.Addr().String()},
+	})
+
+	assert.Eventually(t, func() bool {
+		backends, err := m.UpstreamBackends("web")
+		if err != nil || len(backends) != 2 {
+			return false
+		}
+		for _, b := range backends {
+			if b.Status == INIT {
+				return false
+			}
+		}
+		return true
+	}, time.Second, time.Millisecond)
+
+	up, err := m.GetUpstream("web")
+	assert.NoError(t, err)
+	_, _, cancel, err := up.NextWithContext(context.Background())
+	assert.NoError(t, err)
+	defer cancel()
+
+	backends, err := m.UpstreamBackends("web")
+	assert.NoError(t, err)
+	for _, b := range backends {
+		assert.False(t, b.LastTransition.IsZero())
+		switch b.Addr {
+		case healthy.Addr().String():
+			assert.Equal(t, HEALTHY, b.Status)
+			assert.Equal(t, 1, b.ActiveConns)
+		case unhealthy.Addr().String():
+			assert.Equal(t, UNHEALTHY, b.Status)
+			assert.Equal(t, 0, b.ActiveConns)
+		default:
+			t.Errorf("unexpected backend %s", b.Addr)
+		}
+	}
+
+	_, err = m.UpstreamBackends("missing")
+	assert.Error(t, err)
+}
+
+func TestReloadAppliesUpstreamSettings(t *testing.T) {
+	m := NewManager()
+	go m.Start()
+	defer m.Stop()
+
+	cfg := &config.Upstream{Name: "web"}
+	assert.NoError(t, m.LoadUpstreamFromConfig(cfg))
+	up, err := m.GetUpstream("web")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, up.CopyBufferSize())
+	assert.False(t, up.ZeroCopy())
+	assert.Nil(t, up.TLSConfig())
+
+	assert.NoError(t, m.LoadUpstreamFromConfig(&config.Upstream{
+		Name:               "web",
+		CopyBufferSize:     1024,
+		ZeroCopy:           true,
+		BackendTLS:         &config.BackendTLS{ServerName: "backend"},
+		CircuitBreaker:     &config.CircuitBreaker{FailureThreshold: 1, MinConnLifetime: time.Second},
+		MaxConnsPerBackend: 5,
+	}))
+	assert.Equal(t, 1024, up.CopyBufferSize())
+	assert.True(t, up.ZeroCopy())
+	assert.Equal(t, "backend", up.TLSConfig().ServerName)
+	assert.Equal(t, time.Second, up.MinConnLifetime())
+	up.Tracker.mu.Lock()
+	assert.Equal(t, 5, up.maxConns)
+	up.Tracker.mu.Unlock()
+
+	// An invalid reload is rejected and leaves the previous settings in place
+	err = m.LoadUpstreamFromConfig(&config.Upstream{
+		Name:       "web",
+		BackendTLS: &config.BackendTLS{RootCA: []byte("not a pem")},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1024, up.CopyBufferSize())
+}
+
+func TestReloadDiffsBackends(t *testing.T) {
+	var addrs []string
+	for range 3 {
+		l, err := nettest.NewLocalListener("tcp")
+		assert.NoError(t, err)
+		defer l.Close()
+		addrs = append(addrs, l.Addr().String())
+	}
+	heartbeats := func(up *Upstream) int {
+		up.UpstreamHeartbeats.mu.Lock()
+		defer up.UpstreamHeartbeats.mu.Unlock()
+		return len(up.stoppers)
+	}
+	tracked := func(up *Upstream, addr string) bool {
+		up.Tracker.mu.Lock()
+		defer up.Tracker.mu.Unlock()
+		_, ok := up.healthyBackends[addr]
+		return ok
+	}
+
+	m := NewManager()
+	go m.Start()
+	defer m.Stop()
+	assert.NoError(t, m.LoadUpstreamFromConfig(&config.Upstream{Name: "web", Backends: addrs[:2]}))
+	up, err := m.GetUpstream("web")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return tracked(up, addrs[0]) && tracked(up, addrs[1]) }, time.Second, time.Millisecond)
+	assert.Equal(t, 2, heartbeats(up))
+
+	// Reloading drops the first backend and only starts a heartbeat for the new one
+	assert.NoError(t, m.LoadUpstreamFromConfig(&config.Upstream{Name: "web", Backends: addrs[1:]}))
+	assert.Equal(t, 2, heartbeats(up))
+	assert.False(t, tracked(up, addrs[0]))
+	assert.Eventually(t, func() bool { return tracked(up, addrs[2]) }, time.Second, time.Millisecond)
+	backends, err := m.UpstreamBackends("web")
+	assert.NoError(t, err)
+	assert.Len(t, backends, 2)
+	for _, b := range backends {
+		assert.NotEqual(t, addrs[0], b.Addr)
+	}
+
+	// A late health event for the removed backend is ignored
+	m.handleHealthy("web", addrs[0])
+	assert.False(t, tracked(up, addrs[0]))
+	backends, err = m.UpstreamBackends("web")
+	assert.NoError(t, err)
+	assert.Len(t, backends, 2)
+}
+
+func TestSendExpectHealthCheck(t *testing.T) {
+	// serve accepts connections and answers each with reply, or stays silent when reply is empty
+	serve := func(reply string) net.Listener {
+		l, err := nettest.NewLocalListener("tcp")
+		assert.NoError(t, err)
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					conn.Read(make([]byte, 16))
+					if reply != "" {
+						conn.Write([]byte(reply))
+					}
+					io.Copy(io.Discard, conn)
+				}()
+			}
+		}()
+		return l
+	}
+	pong := serve("+PONG\r\n")
+	defer pong.Close()
+	silent := serve("")
+	defer silent.Close()
+
+	m := NewManager()
+	go m.Start()
+	defer m.Stop()
+	assert.NoError(t, m.LoadUpstreamFromConfig(&config.Upstream{
+		Name:        "cache",
+		Backends:    []string{pong.Addr().String(), silent.Addr().String()},
+		HealthCheck: &config.HealthCheck{Send: []byte("PING\r\n"), ExpectRegexp: `^\+PONG`},
+	}))
+
+	// The silent backend accepts connections but only fails once the check times out
+	assert.Eventually(t, func() bool {
+		backends, err := m.UpstreamBackends("cache")
+		if err != nil {
+			return false
+		}
+		status := map[string]BackendStatus{}
+		for _, b := range backends {
+			status[b.Addr] = b.Status
+		}
+		return status[pong.Addr().String()] == HEALTHY && status[silent.Addr().String()] == UNHEALTHY
+	}, 3*time.Second, 10*time.Millisecond)
+
+	err := m.LoadUpstreamFromConfig(&config.Upstream{
+		Name:        "cache",
+		HealthCheck: &config.HealthCheck{ExpectRegexp: "("},
+	})
+	assert.ErrorContains(t, err, "ExpectRegexp")
+}
+
+func TestSharedBackendStatusPerUpstream(t *testing.T) {
+	// The backend accepts connections but never answers so only a connect check passes
+	l, err := nettest.NewLocalListener("tcp")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	addr := l.Addr().String()
+
+	m := NewManager()
+	go m.Start()
+	defer m.Stop()
+	assert.NoError(t, m.LoadUpstreamFromConfig(&config.Upstream{Name: "connect", Backends: []string{addr}}))
+	assert.NoError(t, m.LoadUpstreamFromConfig(&config.Upstream{
+		Name:        "ping",
+		Backends:    []string{addr},
+		HealthCheck: &config.HealthCheck{Send: []byte("PING\r\n"), Expect: "PONG"},
+	}))
+
+	assert.Eventually(t, func() bool {
+		connect, _ := m.BackendHealth("connect", addr)
+		ping, _ := m.BackendHealth("ping", addr)
+		return connect == HEALTHY && ping == UNHEALTHY
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// Each upstream only tracks the backend while its own health check passes
+	connect, err := m.GetUpstream("connect")
+	assert.NoError(t, err)
+	ping, err := m.GetUpstream("ping")
+	assert.NoError(t, err)
+	_, _, cancel, err := connect.NextWithContext(context.Background())
+	assert.NoError(t, err)
+	defer cancel()
+	_, _, _, err = ping.NextWithContext(context.Background())
+	assert.ErrorIs(t, err, ErrUpstreamNotReady)
+
+	// Removing the backend from one upstream leaves the other alone
+	assert.NoError(t, m.RemoveBackend("ping", addr))
+	_, ok := m.BackendHealth("ping", addr)
+	assert.False(t, ok)
+	status, ok := m.BackendHealth("connect", addr)
+	assert.True(t, ok)
+	assert.Equal(t, HEALTHY, status)
+}
+
+func TestProbeErrorMetrics(t *testing.T) {
+	// Nothing listens on the address once the listener is closed so probes are refused
+	l, err := nettest.NewLocalListener("tcp")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	m := NewManager()
+	go m.Start()
+	defer m.Stop()
+	assert.NoError(t, m.LoadUpstreamFromConfig(&config.Upstream{Name: "down", Backends: []string{addr}}))
+
+	refused := func() int64 {
+		backends, ok := m.Metrics.ProbeErrors.Get("down").(*expvar.Map)
+		if !ok {
+			return 0
+		}
+		categories, ok := backends.Get(addr).(*expvar.Map)
+		if !ok {
+			return 0
+		}
+		n, _ := categories.Get(ProbeErrRefused).(*expvar.Int)
+		if n == nil {
+			return 0
+		}
+		return n.Value()
+	}
+	assert.Eventually(t, func() bool { return refused() >= 1 }, 3*time.Second, 10*time.Millisecond)
+
+	var published struct {
+		ProbeErrors map[string]map[string]map[string]int64 `json:"probe_errors"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(m.Metrics.String()), &published))
+	assert.GreaterOrEqual(t, published.ProbeErrors["down"][addr][ProbeErrRefused], int64(1))
+
+	// A removed backend's counters go with it, including ones of probes that were still running
+	assert.NoError(t, m.RemoveBackend("down", addr))
+	backends := m.Metrics.ProbeErrors.Get("down").(*expvar.Map)
+	assert.Nil(t, backends.Get(addr))
+	m.recordProbeError("down", addr, ProbeErrRefused)
+	assert.Nil(t, backends.Get(addr))
+}
+
+func TestPauseUpstream(t *testing.T) {
+	l, err := nettest.NewLocalListener("tcp")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	m := NewManager()
+	go m.Start()
+	defer m.Stop()
+	assert.NoError(t, m.LoadUpstreamFromConfig(&config.Upstream{Name: "web", Backends: []string{l.Addr().String()}}))
+	up, err := m.GetUpstream("web")
+	assert.NoError(t, err)
+	assert.NoError(t, up.WaitForReady(time.Second))
+
+	_, active, cancel, err := up.NextWithContext(context.Background())
+	assert.NoError(t, err)
+	defer cancel()
+
+	assert.NoError(t, m.PauseUpstream("web"))
+	assert.True(t, up.Paused())
+	_, _, _, err = up.NextWithContext(context.Background())
+	assert.ErrorIs(t, err, ErrUpstreamPaused)
+	// Connections made before the pause are left alone
+	assert.NoError(t, active.Err())
+	assert.Equal(t, 1, up.BackendActiveConns(l.Addr().String()))
+
+	assert.NoError(t, m.ResumeUpstream("web"))
+	assert.False(t, up.Paused())
+	_, _, cancelResumed, err := up.NextWithContext(context.Background())
+	assert.NoError(t, err)
+	cancelResumed()
+
+	assert.Error(t, m.PauseUpstream("missing"))
+	assert.Error(t, m.ResumeUpstream("missing"))
+}
+
+func TestMinHealthyBackends(t *testing.T) {
+	// Health events are fed to the manager directly rather than from heartbeats
+	m := NewManager()
+	up := NewUpstream("db")
+	_, err := up.applyConfig(&config.Upstream{Name: "db", MinHealthyBackends: 2}, "")
+	assert.NoError(t, err)
+	backends := []string{"127.0.0.1:8001", "127.0.0.1:8002", "127.0.0.1:8003"}
+	for _, addr := range backends {
+		up.initBackendStatus(addr)
+	}
+	m.Upstreams.Store(up.Name, up)
+
+	assertReady := func(ready bool) {
+		t.Helper()
+		if ready {
+			assert.Equal(t, int32(READY), up.Status.Load())
+			_, _, cancel, err := up.NextWithContext(context.Background())
+			assert.NoError(t, err)
+			cancel()
+		} else {
+			assert.Equal(t, int32(NOTREADY), up.Status.Load())
+			_, _, _, err := up.NextWithContext(context.Background())
+			assert.ErrorIs(t, err, ErrUpstreamNotReady)
+		}
+	}
+
+	// A single healthy backend isn't enough
+	m.handleHealthy("db", backends[0])
+	assertReady(false)
+	m.handleHealthy("db", backends[1])
+	assertReady(true)
+	m.handleHealthy("db", backends[2])
+	assertReady(true)
+
+	// Dropping back below the threshold makes the upstream not ready again
+	m.handleUnhealthy("db", backends[2])
+	assertReady(true)
+	m.handleUnhealthy("db", backends[1])
+	assertReady(false)
+	assert.NoError(t, m.RemoveBackend("db", backends[0]))
+	assertReady(false)
+	m.handleHealthy("db", backends[1])
+	m.handleHealthy("db", backends[2])
+	assertReady(true)
+}
+
+func TestMinHealthyBackendsDefault(t *testing.T) {
+	m := NewManager()
+	up := NewUpstream("db")
+	_, err := up.applyConfig(&config.Upstream{Name: "db"}, "")
+	assert.NoError(t, err)
+	up.initBackendStatus("127.0.0.1:8001")
+	m.Upstreams.Store(up.Name, up)
+
+	m.handleHealthy("db", "127.0.0.1:8001")
+	assert.Equal(t, int32(READY), up.Status.Load())
+	m.handleUnhealthy("db", "127.0.0.1:8001")
+	assert.Equal(t, int32(NOTREADY), up.Status.Load())
+}
+
+func TestUnhealthyPolicy(t *testing.T) {
+	setup := func(policy config.UnhealthyPolicy) (*Manager, *Upstream) {
+		m := NewManager()
+		up := NewUpstream("db")
+		_, err := up.applyConfig(&config.Upstream{Name: "db", UnhealthyPolicy: policy}, "")
+		assert.NoError(t, err)
+		for _, addr := range []string{"127.0.0.1:8001", "127.0.0.1:8002"} {
+			up.initBackendStatus(addr)
+			m.Upstreams.Store(up.Name, up)
+			m.handleHealthy("db", addr)
+		}
+		return m, up
+	}
+	// Cancellation reaches connections on another goroutine
+	causeOf := func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+		return context.Cause(ctx)
+	}
+
+	t.Run("cancel", func(t *testing.T) {
+		m, up := setup(config.CancelOnUnhealthy)
+		addr, ctx, cancel, err := up.NextWithContext(context.Background())
+		assert.NoError(t, err)
+		defer cancel()
+		m.handleUnhealthy("db", addr)
+		assert.ErrorIs(t, causeOf(ctx), ErrBackendUnhealthy)
+		assert.Equal(t, 0, up.BackendActiveConns(addr))
+	})
+
+	t.Run("drain", func(t *testing.T) {
+		m, up := setup(config.DrainOnUnhealthy)
+		addr, ctx, cancel, err := up.NextWithContext(context.Background())
+		assert.NoError(t, err)
+		defer cancel()
+		m.handleUnhealthy("db", addr)
+		// Repeated failures leave the connection alone too
+		m.handleUnhealthy("db", addr)
+		assert.NoError(t, ctx.Err())
+		assert.Equal(t, 1, up.BackendActiveConns(addr))
+		// but new connections go elsewhere
+		other, _, cancelOther, err := up.NextWithContext(context.Background())
+		assert.NoError(t, err)
+		defer cancelOther()
+		assert.NotEqual(t, addr, other)
+
+		// Recovering counts the drained connection towards its load again
+		m.handleHealthy("db", addr)
+		assert.Equal(t, 1, up.BackendActiveConns(addr))
+		assert.NoError(t, ctx.Err())
+
+		// Removing a draining backend cancels what is left
+		m.handleUnhealthy("db", addr)
+		assert.NoError(t, m.RemoveBackend("db", addr))
+		assert.ErrorIs(t, causeOf(ctx), ErrBackendRemoved)
+	})
+
+	t.Run("drained", func(t *testing.T) {
+		m, up := setup(config.DrainOnUnhealthy)
+		addr, ctx, cancel, err := up.NextWithContext(context.Background())
+		assert.NoError(t, err)
+		m.handleUnhealthy("db", addr)
+		cancel()
+		assert.ErrorIs(t, context.Cause(ctx), context.Canceled)
+		assert.Eventually(t, func() bool { return up.BackendActiveConns(addr) == 0 }, time.Second, time.Millisecond)
+		up.Tracker.mu.Lock()
+		assert.Empty(t, up.draining)
+		up.Tracker.mu.Unlock()
+	})
+
+	t.Run("switched to cancel", func(t *testing.T) {
+		m, up := setup(config.DrainOnUnhealthy)
+		addr, ctx, cancel, err := up.NextWithContext(context.Background())
+		assert.NoError(t, err)
+		defer cancel()
+		m.handleUnhealthy("db", addr)
+		_, err = up.applyConfig(&config.Upstream{Name: "db"}, "")
+		assert.NoError(t, err)
+		assert.ErrorIs(t, causeOf(ctx), ErrBackendUnhealthy)
+	})
+}
+
+// countingListener accepts and closes connections counting them e.g. to tell how many health probes a backend saw
+func countingListener(t *testing.T) (net.Listener, *atomic.Int32) {
+	l, err := nettest.NewLocalListener("tcp")
+	assert.NoError(t, err)
+	accepted := &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			conn.Close()
+		}
+	}()
+	return l, accepted
+}
+
+func TestWarmupProbes(t *testing.T) {
+	existing, _ := countingListener(t)
+	defer existing.Close()
+	added, probes := countingListener(t)
+	defer added.Close()
+
+	fake := clock.NewFake(time.Now())
+	m := NewManager()
+	m.HeartbeatClock = fake
+	go m.Start()
+	defer m.Stop()
+	cfg := &config.Upstream{Name: "web", Backends: []string{existing.Addr().String()}, WarmupProbes: 3}
+	assert.NoError(t, m.LoadUpstreamFromConfig(cfg))
+	up, err := m.GetUpstream("web")
+	assert.NoError(t, err)
+	// Backends of a new upstream don't warm up
+	assert.NoError(t, up.WaitForReady(time.Second))
+	// The existing backend is busy so the added one would be picked as soon as it is eligible
+	_, _, cancel, err := up.NextWithContext(context.WithValue(context.Background(), key, nil))
+	assert.NoError(t, err)
+	defer cancel()
+
+	cfg.Backends = append(cfg.Backends, added.Addr().String())
+	assert.NoError(t, m.LoadUpstreamFromConfig(cfg))
+	assert.Eventually(t, func() bool { return fake.Tickers() == 2 }, time.Second, time.Millisecond)
+	for probe := int32(1); probe < 3; probe++ {
+		assert.Eventually(t, func() bool { return probes.Load() == probe }, time.Second, time.Millisecond)
+		assert.Never(t, func() bool {
+			status, _ := m.BackendHealth("web", added.Addr().String())
+			return status != INIT
+		}, 20*time.Millisecond, time.Millisecond, "probe %d", probe)
+		addr, _, cancel, err := up.NextWithContext(context.Background())
+		assert.NoError(t, err)
+		cancel()
+		assert.Equal(t, existing.Addr().String(), addr, "added backend was picked after %d probes", probe)
+		fake.Advance(2 * time.Second)
+	}
+
+	assert.Eventually(t, func() bool {
+		status, _ := m.BackendHealth("web", added.Addr().String())
+		return status == HEALTHY
+	}, time.Second, time.Millisecond)
+	addr, _, cancel, err := up.NextWithContext(context.Background())
+	assert.NoError(t, err)
+	defer cancel()
+	assert.Equal(t, added.Addr().String(), addr)
+}
+
+func TestHealthCheckAddrs(t *testing.T) {
+	traffic, trafficConns := countingListener(t)
+	defer traffic.Close()
+	health, healthConns := countingListener(t)
+	defer health.Close()
+	// Checked on its traffic address which isn't listening
+	unlisted, err := nettest.NewLocalListener("tcp")
+	assert.NoError(t, err)
+	unlisted.Close()
+
+	m := NewManager()
+	go m.Start()
+	defer m.Stop()
+	assert.NoError(t, m.LoadUpstreamFromConfig(&config.Upstream{
+		Name:             "web",
+		Backends:         []string{traffic.Addr().String(), unlisted.Addr().String()},
+		HealthCheckAddrs: map[string]string{traffic.Addr().String(): health.Addr().String()},
+	}))
+	up, err := m.GetUpstream("web")
+	assert.NoError(t, err)
+	assert.NoError(t, up.WaitForReady(time.Second))
+	assert.Eventually(t, func() bool {
+		status, _ := m.BackendHealth("web", unlisted.Addr().String())
+		return status == UNHEALTHY
+	}, time.Second, time.Millisecond)
+
+	assert.Positive(t, healthConns.Load())
+	assert.Zero(t, trafficConns.Load())
+	status, _ := m.BackendHealth("web", traffic.Addr().String())
+	assert.Equal(t, HEALTHY, status)
+	// Connections still go to the traffic address
+	addr, _, cancel, err := up.NextWithContext(context.Background())
+	assert.NoError(t, err)
+	defer cancel()
+	assert.Equal(t, traffic.Addr().String(), addr)
+}
+
+func TestHealthCallbacks(t *testing.T) {
+	backend, _ := countingListener(t)
+	addr := backend.Addr().String()
+
+	fake := clock.NewFake(time.Now())
+	m := NewManager()
+	m.HeartbeatClock = fake
+	healthy := make(chan string, 1)
+	unhealthy := make(chan string, 1)
+	m.OnBackendHealthy = func(upstream string, addr string) {
+		healthy <- upstream + " " + addr
+		panic("broken callback")
+	}
+	m.OnBackendUnhealthy = func(upstream string, addr string) {
+		unhealthy <- upstream + " " + addr
+	}
+	go m.Start()
+	defer m.Stop()
+	assert.NoError(t, m.LoadUpstreamFromConfig(&config.Upstream{Name: "web", Backends: []string{addr}}))
+	select {
+	case got := <-healthy:
+		assert.Equal(t, "web "+addr, got)
+	case <-time.After(time.Second):
+		t.Fatal("OnBackendHealthy wasn't called")
+	}
+
+	// The panic didn't stop health events being handled
+	backend.Close()
+	assert.Eventually(t, func() bool { return fake.Tickers() == 1 }, time.Second, time.Millisecond)
+	fake.Advance(2 * time.Second)
+	select {
+	case got := <-unhealthy:
+		assert.Equal(t, "web "+addr, got)
+	case <-time.After(time.Second):
+		t.Fatal("OnBackendUnhealthy wasn't called")
+	}
+	status, _ := m.BackendHealth("web", addr)
+	assert.Equal(t, UNHEALTHY, status)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, m.Shutdown(ctx))
+}
@@ -0,0 +1,160 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// parseProxyURL checks a proxy URL is one the upstream can dial through.
+// http proxies are tunneled through with CONNECT and socks5 proxies with the SOCKS5 protocol.
+// Credentials in the URL are used to authenticate to the proxy.
+func parseProxyURL(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Proxy: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid Proxy %q: scheme must be http, socks5 or socks5h", u.Redacted())
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid Proxy %q: missing host", u.Redacted())
+	}
+	return u, nil
+}
+
+// newProxyDialer creates a dialer that connects to backends through the proxy.
+// forward is used to connect to the proxy itself.
+func newProxyDialer(u *url.URL, forward *net.Dialer) proxy.ContextDialer {
+	if u.Scheme == "http" {
+		d := &connectDialer{addr: u.Host, forward: forward}
+		if u.Port() == "" {
+			d.addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			d.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass))
+		}
+		return d
+	}
+	var auth *proxy.Auth
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: pass}
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "1080")
+	}
+	// SOCKS5 only fails for a nil forward dialer
+	d, _ := proxy.SOCKS5("tcp", addr, auth, forward)
+	return d.(proxy.ContextDialer)
+}
+
+// connectDialer tunnels connections through an HTTP proxy with CONNECT
+type connectDialer struct {
+	addr string
+	// auth is the Proxy-Authorization header, empty when the proxy doesn't need credentials
+	auth    string
+	forward *net.Dialer
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, network, d.addr)
+	if err != nil {
+		return nil, err
+	}
+	// The CONNECT exchange ignores ctx so close the connection to unblock it
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", d.auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, d.ctxErr(ctx, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, d.ctxErr(ctx, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", d.addr, addr, resp.Status)
+	}
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	// Backends that speak first may already have sent data along with the proxy response
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// ctxErr prefers the ctx error over the error from the connection being closed by ctx
+func (d *connectDialer) ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// bufferedConn reads what was buffered while reading the proxy response before reading from the connection
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite lets the forwarder half close the backend connection
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// tlsHandshake completes a TLS handshake over a connection that was dialed through a proxy.
+// Like tls.Dialer the server name defaults to the host of addr.
+func tlsHandshake(ctx context.Context, conn net.Conn, addr string, config *tls.Config) (net.Conn, error) {
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
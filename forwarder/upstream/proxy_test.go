@@ -0,0 +1,173 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/doggydogworld/gobalancer/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/nettest"
+)
+
+// connectProxy is a stub HTTP CONNECT proxy that requires basic auth and records the targets it tunnels to
+type connectProxy struct {
+	net.Listener
+	auth string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func newConnectProxy(t *testing.T, user string, pass string) *connectProxy {
+	l, err := nettest.NewLocalListener("tcp")
+	assert.NoError(t, err)
+	p := &connectProxy{
+		Listener: l,
+		auth:     "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass)),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *connectProxy) serve(conn net.Conn) {
+	defer conn.Close()
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != p.auth {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+	backend, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer backend.Close()
+	p.mu.Lock()
+	p.targets = append(p.targets, req.Host)
+	p.mu.Unlock()
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go func() {
+		io.Copy(backend, conn)
+		backend.Close()
+	}()
+	io.Copy(conn, backend)
+}
+
+func (p *connectProxy) tunneled() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+// newGreetingBackend accepts connections and greets each one before echoing
+func newGreetingBackend(t *testing.T) net.Listener {
+	l, err := nettest.NewLocalListener("tcp")
+	assert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, "hello\n")
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestDialThroughConnectProxy(t *testing.T) {
+	backend := newGreetingBackend(t)
+	defer backend.Close()
+	proxy := newConnectProxy(t, "user", "secret")
+	defer proxy.Close()
+
+	tests := map[string]struct {
+		proxy      string
+		shouldFail bool
+	}{
+		"authenticated":       {proxy: "http://user:secret@" + proxy.Addr().String()},
+		"wrong password":      {proxy: "http://user:wrong@" + proxy.Addr().String(), shouldFail: true},
+		"missing credentials": {proxy: "http://" + proxy.Addr().String(), shouldFail: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			up := NewUpstream("proxied")
+			_, err := up.applyConfig(&config.Upstream{Name: "proxied"}, test.proxy)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			conn, err := up.Dial(ctx, &net.Dialer{}, backend.Addr().String())
+			if test.shouldFail {
+				assert.ErrorContains(t, err, "407")
+				return
+			}
+			assert.NoError(t, err)
+			defer conn.Close()
+
+			// The greeting may arrive along with the proxy response and must not be lost
+			r := bufio.NewReader(conn)
+			greeting, err := r.ReadString('\n')
+			assert.NoError(t, err)
+			assert.Equal(t, "hello\n", greeting)
+			io.WriteString(conn, "echo\n")
+			echo, err := r.ReadString('\n')
+			assert.NoError(t, err)
+			assert.Equal(t, "echo\n", echo)
+		})
+	}
+}
+
+func TestUpstreamProxyOverridesDefault(t *testing.T) {
+	backend := newGreetingBackend(t)
+	defer backend.Close()
+	proxy := newConnectProxy(t, "user", "secret")
+	defer proxy.Close()
+
+	m := NewManager()
+	// The default proxy doesn't exist so the upstream is only healthy when its own proxy is used
+	m.DefaultProxy = "http://127.0.0.1:1"
+	go m.Start()
+	defer m.Stop()
+	assert.NoError(t, m.LoadUpstreamFromConfig(&config.Upstream{
+		Name:     "proxied",
+		Backends: []string{backend.Addr().String()},
+		Proxy:    "http://user:secret@" + proxy.Addr().String(),
+	}))
+
+	up, err := m.GetUpstream("proxied")
+	assert.NoError(t, err)
+	assert.NoError(t, up.WaitForReady(time.Second))
+	// The health check reached the backend through the proxy
+	assert.Contains(t, proxy.tunneled(), backend.Addr().String())
+}
+
+func TestInvalidProxy(t *testing.T) {
+	for _, raw := range []string{"ftp://proxy:21", "http://", "://proxy"} {
+		up := NewUpstream("proxied")
+		_, err := up.applyConfig(&config.Upstream{Name: "proxied", Proxy: raw}, "")
+		assert.ErrorContains(t, err, "invalid Proxy", raw)
+	}
+}
@@ -0,0 +1,128 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// defaultQueueTimeout is how long a queued connection waits when the queue doesn't set a timeout
+const defaultQueueTimeout = time.Second
+
+var (
+	ErrQueueFull    = errors.New("upstream queue is full")
+	ErrQueueTimeout = errors.New("timed out waiting in the upstream queue")
+)
+
+// queueable reports if a connection that failed to get a backend with err may wait for one in the queue.
+// Only capacity and readiness are expected to come back by themselves within a short wait.
+func queueable(err error) bool {
+	return errors.Is(err, ErrBackendsAtCapacity) || errors.Is(err, ErrUpstreamAtCapacity) ||
+		errors.Is(err, ErrUpstreamNotReady)
+}
+
+// NextQueued is NextMatching that waits in a FIFO queue for a backend to free up or the upstream to become
+// ready instead of failing straight away, when the upstream has a queue configured.
+// A connection arriving while others are queued joins the back of the queue rather than jumping it.
+// It fails with ErrQueueFull when the queue is full and ErrQueueTimeout once it has waited for the queue
+// timeout, both wrapping why no backend was available.
+func (u *Upstream) NextQueued(parent context.Context, sel Selection) (addr string, ctx context.Context, cancelFunc context.CancelFunc, err error) {
+	s := u.settings.Load()
+	if s == nil || s.queueSize <= 0 {
+		return u.NextMatching(parent, sel)
+	}
+	// Holding queueMu while trying means a connection released meanwhile wakes this one once it has queued
+	u.queueMu.Lock()
+	if len(u.queue) == 0 {
+		addr, ctx, cancelFunc, err = u.NextMatching(parent, sel)
+		if err == nil || !queueable(err) {
+			u.queueMu.Unlock()
+			return
+		}
+	} else if u.Status.Load() != int32(READY) {
+		err = ErrUpstreamNotReady
+	} else if u.AtMaxConns() {
+		err = ErrUpstreamAtCapacity
+	} else {
+		err = ErrBackendsAtCapacity
+	}
+	if len(u.queue) >= s.queueSize {
+		u.queueMu.Unlock()
+		return "", nil, nil, fmt.Errorf("%w: %w", ErrQueueFull, err)
+	}
+	turn := make(chan struct{}, 1)
+	u.queue = append(u.queue, turn)
+	u.maxQueueLen = max(u.maxQueueLen, len(u.queue))
+	u.queueMu.Unlock()
+
+	timeout := s.queueTimeout
+	if timeout <= 0 {
+		timeout = defaultQueueTimeout
+	}
+	waitCtx, cancelWait := context.WithTimeout(parent, timeout)
+	defer cancelWait()
+	for {
+		select {
+		case <-turn:
+		case <-waitCtx.Done():
+			u.leaveQueue(turn)
+			return "", nil, nil, fmt.Errorf("%w: %w", ErrQueueTimeout, err)
+		}
+		// Only the front of the queue is woken and it keeps its place while it tries, so a wake up while it
+		// tries is kept for its next try and connections arriving meanwhile still queue behind it
+		addr, ctx, cancelFunc, err = u.NextMatching(parent, sel)
+		if err == nil || !queueable(err) {
+			u.leaveQueue(turn)
+			return
+		}
+	}
+}
+
+// wakeQueue gives the connection at the front of the queue a chance to get a backend.
+// A wake up the front hasn't taken yet is kept rather than piling up.
+func (u *Upstream) wakeQueue() {
+	u.queueMu.Lock()
+	defer u.queueMu.Unlock()
+	u.wakeQueueLocked()
+}
+
+// wakeQueueLocked is wakeQueue without locking so make sure to wrap this in a queueMu.Lock()
+func (u *Upstream) wakeQueueLocked() {
+	if len(u.queue) > 0 {
+		select {
+		case u.queue[0] <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// leaveQueue takes a connection that got a backend or gave up off the queue. When it was at the front the next
+// connection is woken, as there may be room for it too or the wake up may have been meant for it.
+func (u *Upstream) leaveQueue(turn chan struct{}) {
+	u.queueMu.Lock()
+	defer u.queueMu.Unlock()
+	i := slices.Index(u.queue, turn)
+	if i < 0 {
+		return
+	}
+	u.queue = slices.Delete(u.queue, i, i+1)
+	if i == 0 {
+		u.wakeQueueLocked()
+	}
+}
+
+// QueueLen is the number of connections waiting in the queue
+func (u *Upstream) QueueLen() int {
+	u.queueMu.Lock()
+	defer u.queueMu.Unlock()
+	return len(u.queue)
+}
+
+// MaxQueueLen is the most connections that have waited in the queue at once since the upstream was created
+func (u *Upstream) MaxQueueLen() int {
+	u.queueMu.Lock()
+	defer u.queueMu.Unlock()
+	return u.maxQueueLen
+}
@@ -0,0 +1,161 @@
+package upstream
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/doggydogworld/gobalancer/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// newQueuedUpstream loads an upstream with a single backend that takes one connection at a time
+func newQueuedUpstream(t *testing.T, m *Manager, queue *config.ConnQueue) *Upstream {
+	t.Helper()
+	backend, _ := countingListener(t)
+	t.Cleanup(func() { backend.Close() })
+	assert.NoError(t, m.LoadUpstreamFromConfig(&config.Upstream{
+		Name:               "web",
+		Backends:           []string{backend.Addr().String()},
+		MaxConnsPerBackend: 1,
+		Queue:              queue,
+	}))
+	up, err := m.GetUpstream("web")
+	assert.NoError(t, err)
+	assert.NoError(t, up.WaitForReady(time.Second))
+	return up
+}
+
+func TestQueueProceedsOnceCapacityFrees(t *testing.T) {
+	m := NewManager()
+	go m.Start()
+	defer m.Stop()
+	up := newQueuedUpstream(t, m, &config.ConnQueue{MaxQueued: 1, Timeout: 5 * time.Second})
+	conn := func(i int) context.Context { return context.WithValue(context.Background(), key, i) }
+
+	_, _, release, err := up.NextQueued(conn(0), Selection{})
+	assert.NoError(t, err)
+	queued := make(chan error, 1)
+	go func() {
+		_, _, cancel, err := up.NextQueued(conn(1), Selection{})
+		if err == nil {
+			cancel()
+		}
+		queued <- err
+	}()
+	assert.Eventually(t, func() bool { return up.QueueLen() == 1 }, time.Second, time.Millisecond)
+
+	// The queue is full so the next connection is rejected straight away
+	_, _, _, err = up.NextQueued(conn(2), Selection{})
+	assert.ErrorIs(t, err, ErrQueueFull)
+	assert.ErrorIs(t, err, ErrBackendsAtCapacity)
+
+	release()
+	select {
+	case err := <-queued:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("queued connection didn't get the backend once it was free")
+	}
+	assert.Zero(t, up.QueueLen())
+}
+
+func TestQueueTimeout(t *testing.T) {
+	m := NewManager()
+	go m.Start()
+	defer m.Stop()
+	up := newQueuedUpstream(t, m, &config.ConnQueue{MaxQueued: 1, Timeout: 50 * time.Millisecond})
+	conn := func(i int) context.Context { return context.WithValue(context.Background(), key, i) }
+
+	_, _, release, err := up.NextQueued(conn(0), Selection{})
+	assert.NoError(t, err)
+	defer release()
+	start := time.Now()
+	_, _, _, err = up.NextQueued(conn(1), Selection{})
+	assert.ErrorIs(t, err, ErrQueueTimeout)
+	assert.ErrorIs(t, err, ErrBackendsAtCapacity)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	// The connection that gave up left the queue
+	assert.Zero(t, up.QueueLen())
+}
+
+func TestQueueFrontKeepsItsPlace(t *testing.T) {
+	m := NewManager()
+	go m.Start()
+	defer m.Stop()
+	up := newQueuedUpstream(t, m, &config.ConnQueue{MaxQueued: 2, Timeout: 5 * time.Second})
+	conn := func(i int) context.Context { return context.WithValue(context.Background(), key, i) }
+
+	_, _, release, err := up.NextQueued(conn(0), Selection{})
+	assert.NoError(t, err)
+	got := make(chan int, 2)
+	releaseFront := make(chan struct{})
+	go func() {
+		_, _, cancel, err := up.NextQueued(conn(1), Selection{})
+		assert.NoError(t, err)
+		got <- 1
+		<-releaseFront
+		cancel()
+	}()
+	assert.Eventually(t, func() bool { return up.QueueLen() == 1 }, time.Second, time.Millisecond)
+
+	// Woken without room the front tries again without leaving the queue
+	up.wakeQueue()
+	assert.Never(t, func() bool { return up.QueueLen() != 1 }, 20*time.Millisecond, time.Millisecond)
+	go func() {
+		_, _, cancel, err := up.NextQueued(conn(2), Selection{})
+		assert.NoError(t, err)
+		got <- 2
+		cancel()
+	}()
+	assert.Eventually(t, func() bool { return up.QueueLen() == 2 }, time.Second, time.Millisecond)
+
+	release()
+	assert.Equal(t, 1, <-got)
+	assert.Equal(t, 1, up.QueueLen())
+	close(releaseFront)
+	assert.Equal(t, 2, <-got)
+	assert.Zero(t, up.QueueLen())
+}
+
+func TestQueueConcurrentReleases(t *testing.T) {
+	m := NewManager()
+	go m.Start()
+	defer m.Stop()
+	up := newQueuedUpstream(t, m, &config.ConnQueue{MaxQueued: 100, Timeout: time.Second})
+	// Connections keep arriving while others release the backend. A wake up lost to a release racing a
+	// queued connection leaves it waiting until it times out.
+	var active, peak atomic.Int32
+	var wg sync.WaitGroup
+	errs := make(chan error, 20*50)
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 50 {
+				ctx := context.WithValue(context.Background(), key, i*50+j)
+				_, _, release, err := up.NextQueued(ctx, Selection{})
+				if err != nil {
+					errs <- err
+					continue
+				}
+				n := active.Add(1)
+				for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+				}
+				runtime.Gosched()
+				active.Add(-1)
+				release()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("queued connection failed: %v", err)
+	}
+	assert.Equal(t, int32(1), peak.Load())
+	assert.Zero(t, up.QueueLen())
+}
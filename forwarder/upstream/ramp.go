@@ -0,0 +1,83 @@
+package upstream
+
+import (
+	"time"
+
+	"github.com/doggydogworld/gobalancer/clock"
+)
+
+// defaultRampWindow is how long the recovery ramp lasts when the config doesn't set a window
+const defaultRampWindow = 30 * time.Second
+
+// recoveryRamp caps the rate of new connections to a backend that has just recovered from being unhealthy.
+// The allowed rate rises linearly from zero when the backend recovers to rate at the end of window after which
+// the ramp is over. It is a token bucket holding at most one token so connections can't burst, starting full
+// so the first connection isn't held up.
+//
+// This does not lock so it must only be used while holding the Tracker lock.
+type recoveryRamp struct {
+	rate   float64
+	window time.Duration
+
+	started time.Time
+	// refilled is when tokens was last brought up to date
+	refilled time.Time
+	tokens   float64
+}
+
+func newRecoveryRamp(rate float64, window time.Duration, now time.Time) *recoveryRamp {
+	return &recoveryRamp{rate: rate, window: window, started: now, refilled: now, tokens: 1}
+}
+
+// over reports if the ramp has finished and the backend can take connections at any rate
+func (r *recoveryRamp) over(now time.Time) bool {
+	return now.Sub(r.started) >= r.window
+}
+
+// available refills the bucket and reports if the backend can take another connection
+func (r *recoveryRamp) available(now time.Time) bool {
+	if now.After(r.refilled) {
+		// The tokens added since the last refill are the area under the rising rate
+		from := r.refilled.Sub(r.started).Seconds()
+		to := now.Sub(r.started).Seconds()
+		r.tokens = min(1, r.tokens+r.rate/(2*r.window.Seconds())*(to*to-from*from))
+		r.refilled = now
+	}
+	return r.tokens >= 1
+}
+
+// acquire takes the token of a connection sent to the backend
+func (r *recoveryRamp) acquire() {
+	r.tokens--
+}
+
+// ConfigureRecoveryRamp caps the rate of new connections to a backend that recovers from being unhealthy,
+// ramping the cap up linearly from zero to rate connections per second over window after which it is lifted.
+// A rate of 0 disables the ramp and a window of 0 defaults to 30s. Backends that are already ramping carry on
+// with the settings they started with.
+func (t *Tracker) ConfigureRecoveryRamp(rate float64, window time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if window <= 0 {
+		window = defaultRampWindow
+	}
+	t.rampRate = rate
+	t.rampWindow = window
+	if rate <= 0 {
+		clear(t.ramps)
+	}
+}
+
+// TrackRecoveredBackend is TrackBackend for a backend that was unhealthy. It starts the recovery ramp of the
+// backend when one is configured.
+func (t *Tracker) TrackRecoveredBackend(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.trackBackendLocked(addr) || t.rampRate <= 0 {
+		return
+	}
+	if t.ramps == nil {
+		t.ramps = map[string]*recoveryRamp{}
+	}
+	t.ramps[addr] = newRecoveryRamp(t.rampRate, t.rampWindow, clock.Or(t.Clock).Now())
+}
@@ -0,0 +1,63 @@
+package upstream
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doggydogworld/gobalancer/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoveryRamp(t *testing.T) {
+	addr := "127.0.0.1:8000"
+	clk := clock.NewFake(time.Now())
+	track := NewTracker(context.Background(), "test")
+	track.Clock = clk
+	defer track.Cancel(ErrBackendRemoved)
+	// Ramps up to 10 connections per second over 10 seconds
+	track.ConfigureRecoveryRamp(10, 10*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// connectOver tries a connection every 10ms for d and returns how many got the backend
+	connectOver := func(d time.Duration) int {
+		n := 0
+		for range d / (10 * time.Millisecond) {
+			clk.Advance(10 * time.Millisecond)
+			if _, _, _, err := track.NextWithContext(ctx); err == nil {
+				n++
+			} else {
+				assert.ErrorIs(t, err, ErrBackendsAtCapacity)
+			}
+		}
+		return n
+	}
+
+	// A backend tracked for the first time isn't ramped
+	track.TrackBackend(addr)
+	assert.Equal(t, 100, connectOver(time.Second))
+
+	track.UntrackBackend(addr, ErrBackendUnhealthy)
+	track.TrackRecoveredBackend(addr)
+	// The first connection after recovering goes straight through but can't be followed by a burst
+	_, _, _, err := track.NextWithContext(ctx)
+	assert.NoError(t, err)
+	_, _, _, err = track.NextWithContext(ctx)
+	assert.ErrorIs(t, err, ErrBackendsAtCapacity)
+
+	// The rate rises from 0 to 10/s so the first second allows half a connection and the sixth 5.5
+	assert.Equal(t, 0, connectOver(time.Second))
+	clk.Advance(4 * time.Second)
+	// The bucket refilled while nobody connected but only holds one connection
+	assert.Equal(t, 6, connectOver(time.Second))
+
+	// Other backends take the connections the recovering backend turns away
+	track.TrackBackend("127.0.0.1:8001")
+	assert.Equal(t, 100, connectOver(time.Second))
+
+	// The cap is lifted at the end of the window
+	track.UntrackBackend("127.0.0.1:8001", ErrBackendRemoved)
+	clk.Advance(3 * time.Second)
+	assert.Equal(t, 100, connectOver(time.Second))
+}
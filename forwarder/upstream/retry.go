@@ -0,0 +1,54 @@
+package upstream
+
+import "sync"
+
+const (
+	defaultRetryRatio     = 0.1
+	defaultRetryMaxTokens = 10
+)
+
+// retryBudget is a token bucket that caps retries to a ratio of the connections to an upstream.
+// It starts full so an upstream that has just started can still retry its first few connections.
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	max    float64
+	tokens float64
+}
+
+func newRetryBudget() *retryBudget {
+	return &retryBudget{ratio: defaultRetryRatio, max: defaultRetryMaxTokens, tokens: defaultRetryMaxTokens}
+}
+
+// configure changes the ratio and cap keeping the tokens saved up so far. Values <= 0 use the defaults.
+func (b *retryBudget) configure(ratio float64, maxTokens int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ratio = ratio
+	if b.ratio <= 0 {
+		b.ratio = defaultRetryRatio
+	}
+	b.max = float64(maxTokens)
+	if b.max <= 0 {
+		b.max = defaultRetryMaxTokens
+	}
+	b.tokens = min(b.tokens, b.max)
+}
+
+// deposit adds the share of a retry earned by a new connection
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+b.ratio, b.max)
+}
+
+// withdraw takes a retry and reports false when the budget is exhausted
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,46 @@
+package upstream
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget()
+	b.configure(0.5, 2)
+
+	// The budget starts full
+	assert.True(t, b.withdraw())
+	assert.True(t, b.withdraw())
+	assert.False(t, b.withdraw())
+
+	// Each connection earns half a retry
+	b.deposit()
+	assert.False(t, b.withdraw())
+	b.deposit()
+	assert.True(t, b.withdraw())
+
+	// Saved up retries are capped
+	for range 10 {
+		b.deposit()
+	}
+	assert.True(t, b.withdraw())
+	assert.True(t, b.withdraw())
+	assert.False(t, b.withdraw())
+
+	// Lowering the cap drops the retries over it
+	for range 10 {
+		b.deposit()
+	}
+	b.configure(0.5, 1)
+	assert.True(t, b.withdraw())
+	assert.False(t, b.withdraw())
+}
+
+func TestRetryBudgetDefaults(t *testing.T) {
+	b := newRetryBudget()
+	b.configure(0, 0)
+	assert.Equal(t, defaultRetryRatio, b.ratio)
+	assert.Equal(t, float64(defaultRetryMaxTokens), b.max)
+}
@@ -0,0 +1,90 @@
+package upstream
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultStatusInterval is how often the status file is written when StatusInterval isn't set
+const defaultStatusInterval = 10 * time.Second
+
+// Status is a point in time snapshot of every upstream, written to the status file as JSON
+type Status struct {
+	Updated   time.Time
+	Upstreams map[string]UpstreamState
+}
+
+// UpstreamState holds the backends of an upstream with their health and active connections
+type UpstreamState struct {
+	Paused   bool
+	Backends []BackendInfo
+}
+
+// Status returns a snapshot of every upstream.
+// Each upstream is read under its own lock so they may be slightly out of step with each other.
+func (m *Manager) Status() Status {
+	status := Status{
+		Updated:   time.Now(),
+		Upstreams: map[string]UpstreamState{},
+	}
+	m.Upstreams.Range(func(key, value any) bool {
+		up := value.(*Upstream)
+		status.Upstreams[up.Name] = UpstreamState{
+			Paused:   up.Paused(),
+			Backends: up.Backends(),
+		}
+		return true
+	})
+	return status
+}
+
+// writeStatusFiles writes the status file every StatusInterval until the manager is stopped.
+// It runs on its own goroutine so a slow disk can't hold up health events.
+func (m *Manager) writeStatusFiles() {
+	interval := m.StatusInterval
+	if interval <= 0 {
+		interval = defaultStatusInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := m.writeStatusFile(); err != nil {
+			m.logger.Error("StatusFileFailed", "path", m.StatusFile, "msg", err)
+		}
+		select {
+		case <-t.C:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// writeStatusFile replaces the status file with the current status.
+// It is written to a temporary file in the same directory and renamed over the old one so readers
+// never see a partially written file.
+func (m *Manager) writeStatusFile() error {
+	data, err := json.Marshal(m.Status())
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.StatusFile), filepath.Base(m.StatusFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// CreateTemp only lets the owner read the file, monitoring often runs as another user
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), m.StatusFile)
+}
@@ -0,0 +1,75 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/doggydogworld/gobalancer/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/nettest"
+)
+
+func TestStatusFile(t *testing.T) {
+	backend, err := nettest.NewLocalListener("tcp")
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "status.json")
+	m := NewManager()
+	m.StatusFile = path
+	m.StatusInterval = 10 * time.Millisecond
+	go m.Start()
+	defer m.Stop()
+	assert.NoError(t, m.LoadUpstreamFromConfig(&config.Upstream{
+		Name:     "web",
+		Backends: []string{backend.Addr().String()},
+	}))
+	up, err := m.GetUpstream("web")
+	assert.NoError(t, err)
+	assert.NoError(t, up.WaitForReady(time.Second))
+	_, _, cancel, err := up.NextWithContext(context.Background())
+	assert.NoError(t, err)
+	defer cancel()
+
+	// Decoded generically to check the shape external tools see
+	type backendStatus struct {
+		Addr        string
+		Status      string
+		ActiveConns int
+	}
+	var status struct {
+		Updated   time.Time
+		Upstreams map[string]struct {
+			Paused   bool
+			Backends []backendStatus
+		}
+	}
+	assert.Eventually(t, func() bool {
+		data, err := os.ReadFile(path)
+		if err != nil || json.Unmarshal(data, &status) != nil {
+			return false
+		}
+		web := status.Upstreams["web"]
+		return len(web.Backends) == 1 && web.Backends[0].ActiveConns == 1
+	}, time.Second, 5*time.Millisecond)
+
+	assert.False(t, status.Updated.IsZero())
+	assert.False(t, status.Upstreams["web"].Paused)
+	assert.Equal(t, backendStatus{Addr: backend.Addr().String(), Status: "healthy", ActiveConns: 1},
+		status.Upstreams["web"].Backends[0])
+	fi, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o644), fi.Mode().Perm())
+
+	// Once the updates stop no temporary files are left behind
+	m.Stop()
+	time.Sleep(50 * time.Millisecond)
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -3,8 +3,13 @@ package upstream
 import (
 	"context"
 	"log/slog"
+	"maps"
 	"math"
+	"slices"
 	"sync"
+	"time"
+
+	"github.com/doggydogworld/gobalancer/clock"
 )
 
 // activeConns tracks contexts used for ongoing connections.
@@ -21,11 +26,19 @@ type backendCtx struct {
 	cancel context.CancelCauseFunc
 }
 
+// drainingBackend holds an unhealthy backend whose active connections are left to close by themselves
+type drainingBackend struct {
+	conns activeConns
+	ctx   *backendCtx
+}
+
 // Tracker manages tracking of connections to healthy hosts by relying on request scoped contexts.
 type Tracker struct {
 	UpstreamName string
 	Cancel       context.CancelCauseFunc
 	Ctx          context.Context
+	// Clock is used for time based selection e.g. circuit breaker cooldowns. Defaults to the real clock when nil.
+	Clock clock.Clock
 	// healthyBackends is a mapping of healthy backends by address to a mapping of contexts.
 	// Only healthy addresses will be in this map and therefore this map will be searched
 	// when deciding on least connections.
@@ -35,6 +48,57 @@ type Tracker struct {
 
 	backendCanceler map[string]*backendCtx
 
+	// breakers holds a circuit breaker per healthy backend. Only populated when breakerThreshold > 0
+	breakers         map[string]*circuitBreaker
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	// breakerMinRequests is how many connections a backend needs within breakerWindow before its breaker can open
+	breakerMinRequests int
+	breakerWindow      time.Duration
+	minConnLifetime    time.Duration
+	// maxConns caps the active connections per backend when > 0
+	maxConns int
+	// maxUpstreamConns caps the active connections across every backend when > 0
+	maxUpstreamConns int
+	// minHealthy is the number of healthy backends needed before any backend is handed out
+	minHealthy int
+	// paused rejects new connections with ErrUpstreamPaused while leaving active ones alone
+	paused bool
+	// backendTags holds the tags of each configured backend that has any, healthy or not
+	backendTags map[string][]string
+	// tagFallback chooses from every backend when no healthy backend has the tag a connection asked for
+	tagFallback bool
+	// penalized holds when each backend that recently failed a dial may be selected again.
+	// Only populated when dialPenalty > 0
+	penalized   map[string]time.Time
+	dialPenalty time.Duration
+
+	// latency holds the smoothed health check latency in seconds per backend when latency weighting is enabled
+	latency          map[string]float64
+	latencyWeighted  bool
+	latencySmoothing float64
+	latencyMinWeight float64
+
+	// ramps caps the rate of new connections to each backend that recently recovered.
+	// Only populated when rampRate > 0
+	ramps      map[string]*recoveryRamp
+	rampRate   float64
+	rampWindow time.Duration
+
+	// draining holds each unhealthy backend that still has active connections.
+	// Only populated when drainUnhealthy is set
+	draining       map[string]*drainingBackend
+	drainUnhealthy bool
+
+	// affinity holds the backend each client was last sent to. Only populated when affinityWindow > 0
+	affinity       map[string]affinityEntry
+	affinityWindow time.Duration
+	// affinitySwept is when expired clients were last forgotten
+	affinitySwept time.Time
+
+	// onRelease is called after a connection stops being tracked when set
+	onRelease func()
+
 	logger *slog.Logger
 	mu     sync.Mutex
 }
@@ -47,6 +111,8 @@ func NewTracker(parent context.Context, upstream string) *Tracker {
 		Ctx:             ctx,
 		healthyBackends: map[string]activeConns{},
 		backendCanceler: map[string]*backendCtx{},
+		breakers:        map[string]*circuitBreaker{},
+		latency:         map[string]float64{},
 		logger:          slog.Default(),
 		mu:              sync.Mutex{},
 	}
@@ -54,8 +120,19 @@ func NewTracker(parent context.Context, upstream string) *Tracker {
 
 func (t *Tracker) removeTrackedConn(ctx context.Context, addr string) {
 	t.mu.Lock()
-	defer t.mu.Unlock()
 	delete(t.healthyBackends[addr], ctx)
+	if d, ok := t.draining[addr]; ok {
+		delete(d.conns, ctx)
+		if len(d.conns) == 0 {
+			t.logger.Info("backend drained", "upstream", t.UpstreamName, "addr", addr)
+			d.ctx.cancel(ErrBackendUnhealthy)
+			delete(t.draining, addr)
+		}
+	}
+	t.mu.Unlock()
+	if t.onRelease != nil {
+		t.onRelease()
+	}
 }
 
 // trackCtx will create a new derived context that listens to cancellation signals from two parent contexts:
@@ -80,16 +157,65 @@ func (t *Tracker) trackCtx(outer context.Context, backend context.Context, addr
 func (t *Tracker) BackendActiveConns(addr string) int {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	return len(t.healthyBackends[addr])
+	n := len(t.healthyBackends[addr])
+	if d, ok := t.draining[addr]; ok {
+		n += len(d.conns)
+	}
+	return n
+}
+
+// ActiveConns is the number of active connections across every backend including draining ones
+func (t *Tracker) ActiveConns() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.activeConnsLocked()
+}
+
+// activeConnsLocked is ActiveConns without locking so make sure to wrap this in a mu.Lock()
+func (t *Tracker) activeConnsLocked() int {
+	n := 0
+	for _, conns := range t.healthyBackends {
+		n += len(conns)
+	}
+	for _, d := range t.draining {
+		n += len(d.conns)
+	}
+	return n
+}
+
+// AtMaxConns reports if the upstream is at its cap on active connections
+func (t *Tracker) AtMaxConns() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.atMaxConnsLocked()
+}
+
+// atMaxConnsLocked is AtMaxConns without locking so make sure to wrap this in a mu.Lock()
+func (t *Tracker) atMaxConnsLocked() bool {
+	return t.maxUpstreamConns > 0 && t.activeConnsLocked() >= t.maxUpstreamConns
 }
 
 // AddBackend will add backend by address to be tracked
 func (t *Tracker) TrackBackend(addr string) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	t.trackBackendLocked(addr)
+}
+
+// trackBackendLocked adds a backend and reports if it wasn't already tracked.
+// This does not lock so make sure to wrap this in a mu.Lock()
+func (t *Tracker) trackBackendLocked(addr string) bool {
 	// If doesn't exist add otherwise no-op
-	if _, ok := t.healthyBackends[addr]; !ok {
-		t.logger.Info("tracking backend", "upstream", t.UpstreamName, "addr", addr)
+	if _, ok := t.healthyBackends[addr]; ok {
+		return false
+	}
+	t.logger.Info("tracking backend", "upstream", t.UpstreamName, "addr", addr)
+	if d, ok := t.draining[addr]; ok {
+		// The connections it was draining count towards its load again
+		t.healthyBackends[addr] = d.conns
+		t.backendCanceler[addr] = d.ctx
+		delete(t.draining, addr)
+	} else {
 		ctx, cancel := context.WithCancelCause(t.Ctx)
 		t.healthyBackends[addr] = activeConns{}
 		t.backendCanceler[addr] = &backendCtx{
@@ -97,45 +223,384 @@ func (t *Tracker) TrackBackend(addr string) {
 			cancel: cancel,
 		}
 	}
+	if t.breakerThreshold > 0 {
+		t.breakers[addr] = t.newBreaker()
+	}
+	return true
+}
+
+// ConfigureCircuitBreaker enables a circuit breaker for each backend that opens after threshold consecutive
+// failures and stays open for cooldown. A threshold of 0 disables the circuit breaker.
+// Connections closing within minConnLifetime of being dialed are expected to be reported as failures.
+// Breakers of backends that are already tracked keep their state but pick up the new settings.
+func (t *Tracker) ConfigureCircuitBreaker(threshold int, cooldown time.Duration, minConnLifetime time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.breakerThreshold = threshold
+	t.breakerCooldown = cooldown
+	t.minConnLifetime = minConnLifetime
+	if threshold <= 0 {
+		clear(t.breakers)
+		return
+	}
+	t.configureBreakersLocked()
+}
+
+// ConfigureBreakerMinRequests stops a circuit breaker opening until its backend has had at least min
+// connections within window. A min of 0 lets the failure threshold alone open the breaker.
+// A window of 0 defaults to a minute.
+func (t *Tracker) ConfigureBreakerMinRequests(min int, window time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if window <= 0 {
+		window = time.Minute
+	}
+	t.breakerMinRequests = min
+	t.breakerWindow = window
+	if t.breakerThreshold > 0 {
+		t.configureBreakersLocked()
+	}
+}
+
+// configureBreakersLocked gives every healthy backend a breaker with the current settings
+func (t *Tracker) configureBreakersLocked() {
+	for addr := range t.healthyBackends {
+		if b, ok := t.breakers[addr]; ok {
+			b.threshold = t.breakerThreshold
+			b.cooldown = t.breakerCooldown
+			b.minRequests = t.breakerMinRequests
+			b.window = t.breakerWindow
+			continue
+		}
+		t.breakers[addr] = t.newBreaker()
+	}
+}
+
+func (t *Tracker) newBreaker() *circuitBreaker {
+	return &circuitBreaker{
+		threshold:   t.breakerThreshold,
+		cooldown:    t.breakerCooldown,
+		minRequests: t.breakerMinRequests,
+		window:      t.breakerWindow,
+	}
+}
+
+// ConfigureMaxConnsPerBackend caps the active connections of each backend.
+// Backends at the cap are skipped when selecting a backend. A max of 0 is unlimited.
+// Lowering the cap doesn't close connections, the backend just isn't selected until it drops below it.
+func (t *Tracker) ConfigureMaxConnsPerBackend(max int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.maxConns = max
+}
+
+// ConfigureMaxConns caps the active connections across every backend. A max of 0 is unlimited.
+// Lowering the cap doesn't close connections, new ones are just rejected until the upstream drops below it.
+func (t *Tracker) ConfigureMaxConns(max int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.maxUpstreamConns = max
+}
+
+// ConfigureMinHealthyBackends sets how many backends must be healthy before the upstream is ready.
+// Values below 1 mean a single healthy backend is enough.
+func (t *Tracker) ConfigureMinHealthyBackends(min int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.minHealthy = min
+}
+
+// ConfigureBackendTags sets the tags of each backend by address. Backends without tags are only
+// selected for connections that don't ask for a tag.
+func (t *Tracker) ConfigureBackendTags(tags map[string][]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.backendTags = maps.Clone(tags)
+}
+
+// ConfigureBackendTagFallback sets whether a connection whose tag no healthy backend has is sent to any
+// backend instead of failing with ErrNoTaggedBackend
+func (t *Tracker) ConfigureBackendTagFallback(fallback bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tagFallback = fallback
+}
+
+// ConfigureDialPenalty skips a backend for penalty after a dial to it fails so connections arriving at
+// the same time don't all pick the backend that just failed. Penalized backends are still selected when
+// no other backend is available. A penalty of 0 disables it.
+func (t *Tracker) ConfigureDialPenalty(penalty time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dialPenalty = penalty
+	if penalty <= 0 {
+		clear(t.penalized)
+	}
+}
+
+// hasMinHealthy reports if enough backends are healthy for the upstream to be ready
+func (t *Tracker) hasMinHealthy() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.hasMinHealthyLocked()
+}
+
+func (t *Tracker) hasMinHealthyLocked() bool {
+	return len(t.healthyBackends) > 0 && len(t.healthyBackends) >= t.minHealthy
+}
+
+// MinConnLifetime is how long a connection must stay open before it counts as a success
+func (t *Tracker) MinConnLifetime() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.minConnLifetime
+}
+
+// ReportSuccess records a successful connection to a backend closing its circuit breaker
+func (t *Tracker) ReportSuccess(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b, ok := t.breakers[addr]; ok {
+		b.success(clock.Or(t.Clock).Now())
+	}
+}
+
+// ReportFailure records a failed connection to a backend which may open its circuit breaker
+func (t *Tracker) ReportFailure(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b, ok := t.breakers[addr]; ok {
+		b.failure(clock.Or(t.Clock).Now())
+		if b.state == OPEN {
+			t.logger.Info("circuit breaker open", "upstream", t.UpstreamName, "addr", addr)
+		}
+	}
+}
+
+// ReportDialFailure records a failed dial to a backend. It counts as a failure towards the circuit breaker
+// and skips the backend for the dial penalty.
+func (t *Tracker) ReportDialFailure(addr string) {
+	t.ReportFailure(addr)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dialPenalty <= 0 {
+		return
+	}
+	if t.penalized == nil {
+		t.penalized = map[string]time.Time{}
+	}
+	t.penalized[addr] = clock.Or(t.Clock).Now().Add(t.dialPenalty)
 }
 
 // leastConnections chooses the least active backend.
+// With latency weighting the active connections are scaled by the latency of the backend so faster
+// backends are given proportionally more connections.
+// Backends that don't match sel, have an open circuit breaker, are at the connection cap or have used up
+// their recovery ramp are skipped and an error explains why no backend could be chosen. A tag no healthy backend has is ignored when the
+// tag fallback is enabled.
 // This does not lock so make sure to wrap this in a mu.Lock()
-func (t *Tracker) leastConnections() string {
-	var choice string
-	min := math.MaxInt32
+func (t *Tracker) leastConnections(sel Selection) (string, error) {
+	var choice, penalized string
+	min, penalizedMin := math.Inf(1), math.Inf(1)
+	now := clock.Or(t.Clock).Now()
+	scores := t.latencyScores()
+	atCapacity := false
+	tagged := 0
 	for b, activeConns := range t.healthyBackends {
-		if len(activeConns) < min {
-			min = len(activeConns)
+		if sel.Tag != "" {
+			if !slices.Contains(t.backendTags[b], sel.Tag) {
+				continue
+			}
+			tagged++
+		}
+		if slices.Contains(sel.Exclude, b) {
+			continue
+		}
+		if breaker, ok := t.breakers[b]; ok && !breaker.available(now) {
+			continue
+		}
+		if t.maxConns > 0 && len(activeConns) >= t.maxConns {
+			atCapacity = true
+			continue
+		}
+		if ramp, ok := t.ramps[b]; ok {
+			if ramp.over(now) {
+				delete(t.ramps, b)
+			} else if !ramp.available(now) {
+				atCapacity = true
+				continue
+			}
+		}
+		load := float64(len(activeConns))
+		if scores != nil {
+			load = (load + 1) * scores[b]
+		}
+		if until, ok := t.penalized[b]; ok {
+			if now.Before(until) {
+				// Only chosen when every other backend is ruled out
+				if load < penalizedMin {
+					penalizedMin = load
+					penalized = b
+				}
+				continue
+			}
+			delete(t.penalized, b)
+		}
+		if load < min {
+			min = load
 			choice = b
 		}
 	}
-	return choice
+	if choice == "" {
+		choice = penalized
+	}
+	if choice == "" {
+		// Report the cap when it ruled out any backend since the rest have an open circuit breaker
+		if atCapacity {
+			return "", ErrBackendsAtCapacity
+		}
+		if sel.Tag != "" && tagged == 0 {
+			if t.tagFallback {
+				return t.leastConnections(Selection{Exclude: sel.Exclude})
+			}
+			return "", ErrNoTaggedBackend
+		}
+		return "", ErrCircuitOpen
+	}
+	return choice, nil
 }
 
 // UntrackBackend will remove backend by address and send the error down as cancellation cause
 func (t *Tracker) UntrackBackend(addr string, err error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	t.untrackBackendLocked(addr, err)
+}
+
+// untrackBackendLocked is UntrackBackend without locking so make sure to wrap this in a mu.Lock()
+func (t *Tracker) untrackBackendLocked(addr string, err error) {
 	// With a fast enough heartbeat this could be called too often
 	// Probably won't cause issues in actual use but in testing at 1ms period it caused issues
 	// no-op on repeated use
 	if c, ok := t.backendCanceler[addr]; ok {
 		t.logger.Info("untracking backend", "upstream", t.UpstreamName, "addr", addr, "reason", err.Error())
 		c.cancel(err)
-		delete(t.backendCanceler, addr)
-		delete(t.healthyBackends, addr)
+		t.forgetBackendLocked(addr)
+	}
+	if d, ok := t.draining[addr]; ok {
+		d.ctx.cancel(err)
+		delete(t.draining, addr)
 	}
 }
 
+// UntrackUnhealthyBackend stops handing out a backend that failed its health checks. Its active connections
+// are cancelled with ErrBackendUnhealthy unless draining is configured, in which case they carry on until they
+// close by themselves.
+func (t *Tracker) UntrackUnhealthyBackend(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Repeated health check failures leave a backend that is already draining alone
+	conns, ok := t.healthyBackends[addr]
+	if !ok {
+		return
+	}
+	if !t.drainUnhealthy || len(conns) == 0 {
+		t.untrackBackendLocked(addr, ErrBackendUnhealthy)
+		return
+	}
+	t.logger.Info("draining backend", "upstream", t.UpstreamName, "addr", addr, "active", len(conns))
+	if t.draining == nil {
+		t.draining = map[string]*drainingBackend{}
+	}
+	t.draining[addr] = &drainingBackend{conns: conns, ctx: t.backendCanceler[addr]}
+	t.forgetBackendLocked(addr)
+}
+
+// forgetBackendLocked removes a backend from selection without touching its connections.
+// This does not lock so make sure to wrap this in a mu.Lock()
+func (t *Tracker) forgetBackendLocked(addr string) {
+	delete(t.backendCanceler, addr)
+	delete(t.healthyBackends, addr)
+	delete(t.breakers, addr)
+	delete(t.latency, addr)
+	delete(t.penalized, addr)
+	delete(t.ramps, addr)
+}
+
+// ConfigureDrainOnUnhealthy chooses whether the active connections of a backend that fails its health checks
+// are left to drain rather than cancelled. Turning it off cancels the connections still draining.
+func (t *Tracker) ConfigureDrainOnUnhealthy(drain bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.drainUnhealthy = drain
+	if drain {
+		return
+	}
+	for addr, d := range t.draining {
+		d.ctx.cancel(ErrBackendUnhealthy)
+		delete(t.draining, addr)
+	}
+}
+
+// SetPaused stops or resumes handing out backends. Active connections are left alone.
+func (t *Tracker) SetPaused(paused bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.paused = paused
+}
+
+// Paused reports if the tracker is rejecting new connections with ErrUpstreamPaused
+func (t *Tracker) Paused() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.paused
+}
+
 func (t *Tracker) NextWithContext(parent context.Context) (addr string, ctx context.Context, cancelFunc context.CancelFunc, err error) {
+	return t.NextMatching(parent, Selection{})
+}
+
+// Selection narrows down the backends a connection can be sent to
+type Selection struct {
+	// Exclude skips backends e.g. ones a connection was already tried on
+	Exclude []string
+	// Tag only selects backends with the tag when set e.g. to send canary traffic to canary backends
+	Tag string
+	// Client identifies the client for affinity, which sends it back to the backend it was last sent to
+	// when affinity is configured. Empty skips affinity.
+	Client string
+}
+
+// NextMatching is NextWithContext choosing only from the backends that match sel
+func (t *Tracker) NextMatching(parent context.Context, sel Selection) (addr string, ctx context.Context, cancelFunc context.CancelFunc, err error) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	if len(t.healthyBackends) == 0 {
+	if t.paused {
+		err = ErrUpstreamPaused
+		return
+	}
+	if !t.hasMinHealthyLocked() {
 		err = ErrUpstreamNotReady
 		return
 	}
-	addr = t.leastConnections()
+	if t.atMaxConnsLocked() {
+		err = ErrUpstreamAtCapacity
+		return
+	}
+	now := clock.Or(t.Clock).Now()
+	if addr = t.affinityBackend(sel, now); addr == "" {
+		addr, err = t.leastConnections(sel)
+		if err != nil {
+			return
+		}
+	}
+	t.recordAffinity(sel, addr, now)
+	if b, ok := t.breakers[addr]; ok {
+		b.acquire(now)
+	}
+	if ramp, ok := t.ramps[addr]; ok {
+		ramp.acquire()
+	}
 	t.healthyBackends[addr][parent] = struct{}{}
 	ctx, cancelFunc = t.trackCtx(parent, t.backendCanceler[addr].ctx, addr)
 	return
@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/doggydogworld/gobalancer/clock"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -203,3 +204,189 @@ func TestLeastConnections(t *testing.T) {
 	parentReqCancel()
 	assert.Eventually(t, func() bool { return assertExpectedLengths(track, listeners, []int{0, 0, 0}) }, time.Second, time.Millisecond)
 }
+
+func TestMaxConnsPerBackend(t *testing.T) {
+	l1 := "127.0.0.1:8000"
+	l2 := "127.0.0.1:8001"
+	listeners := []string{l1, l2}
+	track := NewTracker(context.Background(), "test")
+	defer track.Cancel(ErrBackendRemoved)
+	track.ConfigureMaxConnsPerBackend(2)
+	track.TrackBackend(l1)
+	track.TrackBackend(l2)
+
+	// Fill both backends to their cap : [2, 2]
+	cancels := map[string][]context.CancelFunc{}
+	for range 4 {
+		addr, _, cancel, err := track.NextWithContext(context.WithValue(context.Background(), key, nil))
+		assert.NoError(t, err)
+		cancels[addr] = append(cancels[addr], cancel)
+	}
+	assert.True(t, assertExpectedLengths(track, listeners, []int{2, 2}))
+
+	// Overflow is rejected
+	_, _, _, err := track.NextWithContext(context.WithValue(context.Background(), key, nil))
+	assert.ErrorIs(t, err, ErrBackendsAtCapacity)
+
+	// Releasing a connection makes room on that backend only : [1, 2]
+	cancels[l1][0]()
+	assert.Eventually(t, func() bool { return assertExpectedLengths(track, listeners, []int{1, 2}) }, time.Second, time.Millisecond)
+	addr, _, cancel, err := track.NextWithContext(context.WithValue(context.Background(), key, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, l1, addr)
+	defer cancel()
+
+	// Removing the cap accepts the overflow
+	track.ConfigureMaxConnsPerBackend(0)
+	_, _, cancel, err = track.NextWithContext(context.WithValue(context.Background(), key, nil))
+	assert.NoError(t, err)
+	defer cancel()
+	for _, c := range cancels {
+		for _, cancel := range c {
+			cancel()
+		}
+	}
+}
+
+func TestMaxConnsSkipsPreferredBackend(t *testing.T) {
+	fast, slow := "127.0.0.1:8000", "127.0.0.1:8001"
+	track := NewTracker(context.Background(), "test")
+	defer track.Cancel(ErrBackendRemoved)
+	track.ConfigureLatencyWeighting(true, 1, 0.01)
+	track.ConfigureMaxConnsPerBackend(3)
+	track.TrackBackend(fast)
+	track.TrackBackend(slow)
+	track.ObserveLatency(fast, time.Millisecond)
+	track.ObserveLatency(slow, 100*time.Millisecond)
+
+	// The fast backend would take every connection but is skipped once it is at its cap
+	counts := distribute(t, track, 5)
+	assert.Equal(t, 3, counts[fast])
+	assert.Equal(t, 2, counts[slow])
+}
+
+func TestMaxConnsWithOpenCircuitBreaker(t *testing.T) {
+	l1 := "127.0.0.1:8000"
+	l2 := "127.0.0.1:8001"
+	track := NewTracker(context.Background(), "test")
+	defer track.Cancel(ErrBackendRemoved)
+	track.ConfigureCircuitBreaker(1, time.Hour, 0)
+	track.ConfigureMaxConnsPerBackend(1)
+	track.TrackBackend(l1)
+	track.TrackBackend(l2)
+	track.ReportFailure(l1)
+
+	_, _, cancel, err := track.NextWithContext(context.WithValue(context.Background(), key, nil))
+	assert.NoError(t, err)
+	defer cancel()
+	// l1 has an open breaker and l2 is at its cap
+	_, _, _, err = track.NextWithContext(context.WithValue(context.Background(), key, nil))
+	assert.ErrorIs(t, err, ErrBackendsAtCapacity)
+}
+
+func TestNextMatchingTag(t *testing.T) {
+	track := NewTracker(context.Background(), "test")
+	defer track.Cancel(ErrBackendRemoved)
+	track.TrackBackend("stable-1")
+	track.TrackBackend("stable-2")
+	track.TrackBackend("canary")
+	track.ConfigureBackendTags(map[string][]string{
+		"stable-1": {"stable"},
+		"stable-2": {"stable"},
+		"canary":   {"canary", "beta"},
+	})
+
+	// Each connection needs its own context to be counted
+	conn := func(i int) context.Context { return context.WithValue(context.Background(), key, i) }
+
+	// Tagged connections only go to backends with the tag however loaded they are
+	for i := range 5 {
+		addr, _, _, err := track.NextMatching(conn(i), Selection{Tag: "canary"})
+		assert.NoError(t, err)
+		assert.Equal(t, "canary", addr)
+	}
+	addr, _, _, err := track.NextMatching(conn(5), Selection{Tag: "stable", Exclude: []string{"stable-1"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "stable-2", addr)
+
+	// Untagged connections can go to any backend so they avoid the loaded canary
+	for i := range 4 {
+		addr, _, _, err := track.NextMatching(conn(6+i), Selection{})
+		assert.NoError(t, err)
+		assert.NotEqual(t, "canary", addr)
+	}
+
+	_, _, _, err = track.NextMatching(context.Background(), Selection{Tag: "missing"})
+	assert.ErrorIs(t, err, ErrNoTaggedBackend)
+	// A tagged backend that isn't healthy can't be chosen either
+	track.UntrackBackend("canary", ErrBackendUnhealthy)
+	_, _, _, err = track.NextMatching(context.Background(), Selection{Tag: "beta"})
+	assert.ErrorIs(t, err, ErrNoTaggedBackend)
+}
+
+func TestBackendTagFallback(t *testing.T) {
+	track := NewTracker(context.Background(), "test")
+	defer track.Cancel(ErrBackendRemoved)
+	track.TrackBackend("stable-1")
+	track.TrackBackend("stable-2")
+	track.TrackBackend("canary")
+	track.ConfigureBackendTags(map[string][]string{"canary": {"canary"}})
+	track.ConfigureBackendTagFallback(true)
+	conn := func(i int) context.Context { return context.WithValue(context.Background(), key, i) }
+
+	// A healthy canary is still preferred however loaded it is
+	for i := range 3 {
+		addr, _, _, err := track.NextMatching(conn(i), Selection{Tag: "canary"})
+		assert.NoError(t, err)
+		assert.Equal(t, "canary", addr)
+	}
+
+	// Without a healthy canary the connections fall back to the stable backends
+	track.UntrackBackend("canary", ErrBackendUnhealthy)
+	var addrs []string
+	for i := range 2 {
+		addr, _, _, err := track.NextMatching(conn(3+i), Selection{Tag: "canary"})
+		assert.NoError(t, err)
+		addrs = append(addrs, addr)
+	}
+	assert.ElementsMatch(t, []string{"stable-1", "stable-2"}, addrs)
+	// Backends the connection was already tried on are still skipped
+	addr, _, _, err := track.NextMatching(conn(5), Selection{Tag: "canary", Exclude: []string{"stable-1"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "stable-2", addr)
+
+	// Rejecting is the default
+	track.ConfigureBackendTagFallback(false)
+	_, _, _, err = track.NextMatching(conn(6), Selection{Tag: "canary"})
+	assert.ErrorIs(t, err, ErrNoTaggedBackend)
+}
+
+func TestDialPenalty(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	track := NewTracker(context.Background(), "test")
+	track.Clock = clk
+	defer track.Cancel(ErrBackendRemoved)
+	track.ConfigureDialPenalty(time.Second)
+	track.TrackBackend("failed")
+	track.TrackBackend("loaded")
+
+	conn := func(i int) context.Context { return context.WithValue(context.Background(), key, i) }
+	track.ReportDialFailure("failed")
+
+	// The failed backend is skipped however loaded the other one gets
+	for i := range 3 {
+		addr, _, _, err := track.NextMatching(conn(i), Selection{})
+		assert.NoError(t, err)
+		assert.Equal(t, "loaded", addr)
+	}
+	// Unless nothing else can be chosen
+	addr, _, _, err := track.NextMatching(conn(3), Selection{Exclude: []string{"loaded"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "failed", addr)
+
+	// The penalty expires on its own
+	clk.Advance(time.Second)
+	addr, _, _, err = track.NextMatching(conn(4), Selection{})
+	assert.NoError(t, err)
+	assert.Equal(t, "failed", addr)
+}
@@ -1,12 +1,25 @@
 package upstream
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"log/slog"
+	"maps"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/doggydogworld/gobalancer/clock"
+	"github.com/doggydogworld/gobalancer/config"
 )
 
 type UpstreamStatus int
@@ -18,17 +31,95 @@ const (
 )
 
 var (
-	ErrUpstreamNotReady = errors.New("upstream is not ready for requests")
-	ErrBackendUnhealthy = errors.New("backend is unhealthy")
-	ErrBackendRemoved   = errors.New("backend config has been removed")
+	ErrUpstreamNotReady   = errors.New("upstream is not ready for requests")
+	ErrBackendUnhealthy   = errors.New("backend is unhealthy")
+	ErrBackendRemoved     = errors.New("backend config has been removed")
+	ErrCircuitOpen        = errors.New("all backends have an open circuit breaker")
+	ErrBackendsAtCapacity = errors.New("all backends are at their connection limit")
+	ErrUpstreamAtCapacity = errors.New("upstream is at its connection limit")
+	ErrUpstreamPaused     = errors.New("upstream is paused")
+	ErrNoTaggedBackend    = errors.New("no healthy backend has the requested tag")
 )
 
 type Upstream struct {
 	Name   string
 	Status atomic.Int32
+	// ReadyClock drives WaitForReady and defaults to the real clock when nil
+	ReadyClock clock.Clock
+	// Resolver looks up hostname backends on every dial, defaulting to net.DefaultResolver when nil.
+	// Nothing is cached so a DNS change reaches new connections and health checks straight away while
+	// established connections stay on the address they were dialed to.
+	Resolver *net.Resolver
 
 	*Tracker
 	*UpstreamHeartbeats
+
+	// settings is swapped as a whole on reload so the forwarder never sees a partial update
+	settings atomic.Pointer[upstreamSettings]
+
+	// backends holds the health status of every configured backend, healthy or not
+	backends map[string]*backendState
+	statusMu sync.Mutex
+
+	// ready is closed once the upstream is ready and replaced when it stops being ready
+	ready   chan struct{}
+	readyMu sync.Mutex
+
+	// retries is shared by every connection to the upstream and survives reloads
+	retries *retryBudget
+
+	// queue holds a channel per connection waiting in NextQueued, signalled when the front of the queue should try again
+	queue   []chan struct{}
+	queueMu sync.Mutex
+	// maxQueueLen is the most connections that have waited in the queue at once
+	maxQueueLen int
+}
+
+// upstreamSettings are the parts of the upstream config that the forwarder reads per connection
+type upstreamSettings struct {
+	tlsConfig      *tls.Config
+	copyBufferSize int
+	zeroCopy       bool
+	linger         time.Duration
+	grace          time.Duration
+	writeTimeout   time.Duration
+	failFast       bool
+	respTimeout    time.Duration
+	queueSize      int
+	queueTimeout   time.Duration
+	preamble       []byte
+	dialRetries    int
+	warmupProbes   int
+	// affinity is the affinity config, nil when clients aren't kept on their backend
+	affinity *config.Affinity
+
+	// expectRegexp is compiled from healthCheck.ExpectRegexp
+	expectRegexp *regexp.Regexp
+	// proxy is the proxy backends are dialed through, nil dials them directly
+	proxy *url.URL
+
+	// backendTLS, healthCheck, healthCheckAddrs and probeConcurrency are kept to detect changes that need the
+	// heartbeats restarted
+	backendTLS       *config.BackendTLS
+	healthCheck      *config.HealthCheck
+	healthCheckAddrs map[string]string
+	probeConcurrency int
+
+	// cfg is the config the settings were applied from, kept for Config
+	cfg config.Upstream
+}
+
+type backendState struct {
+	status         BackendStatus
+	lastTransition time.Time
+}
+
+// BackendInfo is a point in time snapshot of a single backend of an upstream
+type BackendInfo struct {
+	Addr           string
+	Status         BackendStatus
+	ActiveConns    int
+	LastTransition time.Time
 }
 
 func NewUpstream(name string) *Upstream {
@@ -38,6 +129,8 @@ func NewUpstream(name string) *Upstream {
 		Ctx:             context.Background(),
 		healthyBackends: map[string]activeConns{},
 		backendCanceler: map[string]*backendCtx{},
+		breakers:        map[string]*circuitBreaker{},
+		latency:         map[string]float64{},
 		logger:          logger,
 		mu:              sync.Mutex{},
 	}
@@ -47,10 +140,394 @@ func NewUpstream(name string) *Upstream {
 		mu:           sync.Mutex{},
 		logger:       logger,
 	}
-	return &Upstream{
+	u := &Upstream{
 		Name:               name,
 		Tracker:            t,
 		UpstreamHeartbeats: h,
+		backends:           map[string]*backendState{},
+		ready:              make(chan struct{}),
+		retries:            newRetryBudget(),
+	}
+	// A closed connection frees up room for a queued one
+	t.onRelease = u.wakeQueue
+	return u
+}
+
+// TLSConfig is used to dial backends over TLS. Backends are dialed in plaintext when nil.
+func (u *Upstream) TLSConfig() *tls.Config {
+	if s := u.settings.Load(); s != nil {
+		return s.tlsConfig
+	}
+	return nil
+}
+
+// CopyBufferSize overrides the forwarder copy buffer size when non zero
+func (u *Upstream) CopyBufferSize() int {
+	if s := u.settings.Load(); s != nil {
+		return s.copyBufferSize
+	}
+	return 0
+}
+
+// ZeroCopy lets the forwarder copy without a buffer so splice(2) can be used
+func (u *Upstream) ZeroCopy() bool {
+	if s := u.settings.Load(); s != nil {
+		return s.zeroCopy
+	}
+	return false
+}
+
+// LingerAfterClientClose is how long the forwarder keeps copying from the backend after the client closed its side
+func (u *Upstream) LingerAfterClientClose() time.Duration {
+	if s := u.settings.Load(); s != nil {
+		return s.linger
+	}
+	return 0
+}
+
+// ClientDisconnectGrace is how long the backend may keep running after the client disconnected
+func (u *Upstream) ClientDisconnectGrace() time.Duration {
+	if s := u.settings.Load(); s != nil {
+		return s.grace
+	}
+	return 0
+}
+
+// BackendWriteTimeout is how long a write to a backend may block before the connection is closed
+func (u *Upstream) BackendWriteTimeout() time.Duration {
+	if s := u.settings.Load(); s != nil {
+		return s.writeTimeout
+	}
+	return 0
+}
+
+// FailFast reports if connections shouldn't wait for the upstream to become ready
+func (u *Upstream) FailFast() bool {
+	if s := u.settings.Load(); s != nil {
+		return s.failFast
+	}
+	return false
+}
+
+// BackendResponseTimeout is how long a backend may take to send its first byte after the client's first bytes
+func (u *Upstream) BackendResponseTimeout() time.Duration {
+	if s := u.settings.Load(); s != nil {
+		return s.respTimeout
+	}
+	return 0
+}
+
+// AffinityKey reports how clients are recognised for affinity and false when it is disabled
+func (u *Upstream) AffinityKey() (config.AffinityKey, bool) {
+	if s := u.settings.Load(); s != nil && s.affinity != nil {
+		return s.affinity.Key, true
+	}
+	return config.AffinityByUser, false
+}
+
+// Preamble is written to each backend connection before the client's bytes
+func (u *Upstream) Preamble() []byte {
+	if s := u.settings.Load(); s != nil {
+		return s.preamble
+	}
+	return nil
+}
+
+// Config returns the config the upstream is running with, which is the config it was last loaded with less any
+// backends removed since. Pointer fields are shared with the loaded config and must not be modified.
+func (u *Upstream) Config() *config.Upstream {
+	s := u.settings.Load()
+	if s == nil {
+		return &config.Upstream{Name: u.Name}
+	}
+	cfg := s.cfg
+	cfg.Tags = slices.Clone(cfg.Tags)
+	u.statusMu.Lock()
+	cfg.Backends = slices.DeleteFunc(slices.Clone(cfg.Backends), func(addr string) bool {
+		_, ok := u.backends[addr]
+		return !ok
+	})
+	u.statusMu.Unlock()
+	return &cfg
+}
+
+// DialRetries is how many other backends a connection may be tried on when dialing fails
+func (u *Upstream) DialRetries() int {
+	if s := u.settings.Load(); s != nil {
+		return s.dialRetries
+	}
+	return 0
+}
+
+// AddRetryCredit earns the retry budget its share of a retry for a new connection
+func (u *Upstream) AddRetryCredit() {
+	u.retries.deposit()
+}
+
+// SpendRetry takes a retry from the budget and reports false when it is exhausted
+func (u *Upstream) SpendRetry() bool {
+	return u.retries.withdraw()
+}
+
+// Dial connects to a backend through the proxy of the upstream if it has one and over TLS if it requires it.
+// forward dials the proxy, or the backend itself when there is no proxy. Hostnames are resolved with the
+// Resolver of the upstream except behind a proxy which is handed the hostname to resolve itself.
+func (u *Upstream) Dial(ctx context.Context, forward *net.Dialer, addr string) (net.Conn, error) {
+	if u.Resolver != nil {
+		d := *forward
+		d.Resolver = u.Resolver
+		forward = &d
+	}
+	var proxyURL *url.URL
+	tlsConf := u.TLSConfig()
+	if s := u.settings.Load(); s != nil {
+		proxyURL = s.proxy
+	}
+	if proxyURL == nil {
+		if tlsConf != nil {
+			d := tls.Dialer{NetDialer: forward, Config: tlsConf}
+			return d.DialContext(ctx, "tcp", addr)
+		}
+		return forward.DialContext(ctx, "tcp", addr)
+	}
+	conn, err := newProxyDialer(proxyURL, forward).DialContext(ctx, "tcp", addr)
+	if err != nil || tlsConf == nil {
+		return conn, err
+	}
+	return tlsHandshake(ctx, conn, addr, tlsConf)
+}
+
+// applyConfig applies the per upstream settings of cfg. It is used both when the upstream is created and on reload.
+// defaultProxy is used when the upstream doesn't set its own Proxy.
+// restartHeartbeats reports that the health checks of an existing upstream must be restarted to pick up the change.
+func (u *Upstream) applyConfig(cfg *config.Upstream, defaultProxy string) (restartHeartbeats bool, err error) {
+	next := &upstreamSettings{
+		copyBufferSize:   cfg.CopyBufferSize,
+		zeroCopy:         cfg.ZeroCopy,
+		linger:           cfg.LingerAfterClientClose,
+		grace:            cfg.ClientDisconnectGrace,
+		writeTimeout:     cfg.BackendWriteTimeout,
+		failFast:         cfg.FailFastWhenNotReady,
+		respTimeout:      cfg.BackendResponseTimeout,
+		dialRetries:      cfg.DialRetries,
+		warmupProbes:     cfg.WarmupProbes,
+		probeConcurrency: cfg.HealthCheckConcurrency,
+		healthCheckAddrs: maps.Clone(cfg.HealthCheckAddrs),
+		preamble:         bytes.Clone(cfg.Preamble),
+		cfg:              *cfg,
+	}
+	var affinityWindow time.Duration
+	if cfg.Affinity != nil && cfg.Affinity.Window > 0 {
+		affinity := *cfg.Affinity
+		next.affinity = &affinity
+		affinityWindow = affinity.Window
+	}
+	if cfg.Queue != nil {
+		next.queueSize = cfg.Queue.MaxQueued
+		next.queueTimeout = cfg.Queue.Timeout
+	}
+	proxyURL := cfg.Proxy
+	if proxyURL == "" {
+		proxyURL = defaultProxy
+	}
+	if next.proxy, err = parseProxyURL(proxyURL); err != nil {
+		return false, err
+	}
+	if cfg.BackendTLS != nil {
+		tlsConf, err := newBackendTLSConfig(cfg.BackendTLS)
+		if err != nil {
+			return false, err
+		}
+		backendTLS := *cfg.BackendTLS
+		next.tlsConfig = tlsConf
+		next.backendTLS = &backendTLS
+	}
+	if cfg.HealthCheck != nil {
+		if cfg.HealthCheck.ExpectRegexp != "" {
+			re, err := regexp.Compile(cfg.HealthCheck.ExpectRegexp)
+			if err != nil {
+				return false, fmt.Errorf("invalid health check ExpectRegexp: %w", err)
+			}
+			next.expectRegexp = re
+		}
+		healthCheck := *cfg.HealthCheck
+		next.healthCheck = &healthCheck
+	}
+
+	var threshold, minRequests int
+	var cooldown, minConnLifetime, window time.Duration
+	if cfg.CircuitBreaker != nil {
+		threshold = cfg.CircuitBreaker.FailureThreshold
+		cooldown = cfg.CircuitBreaker.Cooldown
+		minConnLifetime = cfg.CircuitBreaker.MinConnLifetime
+		minRequests = cfg.CircuitBreaker.MinRequests
+		window = cfg.CircuitBreaker.SampleWindow
+	}
+	u.ConfigureBreakerMinRequests(minRequests, window)
+	u.ConfigureCircuitBreaker(threshold, cooldown, minConnLifetime)
+	u.ConfigureDialPenalty(cfg.DialFailurePenalty)
+	u.ConfigureMaxConnsPerBackend(cfg.MaxConnsPerBackend)
+	u.ConfigureMaxConns(cfg.MaxConns)
+	u.ConfigureMinHealthyBackends(cfg.MinHealthyBackends)
+	u.ConfigureDrainOnUnhealthy(cfg.UnhealthyPolicy == config.DrainOnUnhealthy)
+	u.ConfigureBackendTags(cfg.BackendTags)
+	u.ConfigureBackendTagFallback(cfg.BackendTagFallback == config.FallbackToAnyBackend)
+	if rb := cfg.RetryBudget; rb != nil {
+		u.retries.configure(rb.Ratio, rb.MaxTokens)
+	} else {
+		u.retries.configure(0, 0)
+	}
+	if rr := cfg.RecoveryRamp; rr != nil {
+		u.ConfigureRecoveryRamp(rr.Rate, rr.Window)
+	} else {
+		u.ConfigureRecoveryRamp(0, 0)
+	}
+	u.ConfigureAffinity(affinityWindow)
+	if lw := cfg.LatencyWeighting; lw != nil {
+		u.ConfigureLatencyWeighting(true, lw.Smoothing, lw.MinWeight)
+	} else {
+		u.ConfigureLatencyWeighting(false, 0, 0)
+	}
+
+	prev := u.settings.Swap(next)
+	if prev == nil {
+		u.SetProbeConcurrency(next.probeConcurrency)
+		return false, nil
+	}
+	if prev.probeConcurrency != next.probeConcurrency {
+		u.SetProbeConcurrency(next.probeConcurrency)
+		restartHeartbeats = true
+	}
+	if !reflect.DeepEqual(prev.backendTLS, next.backendTLS) || !reflect.DeepEqual(prev.healthCheck, next.healthCheck) ||
+		!reflect.DeepEqual(prev.proxy, next.proxy) || !maps.Equal(prev.healthCheckAddrs, next.healthCheckAddrs) {
+		restartHeartbeats = true
+	}
+	return restartHeartbeats, nil
+}
+
+// initBackendStatus records a newly configured backend if it isn't already known and reports if it was added
+func (u *Upstream) initBackendStatus(addr string) (added bool) {
+	u.statusMu.Lock()
+	defer u.statusMu.Unlock()
+	if _, ok := u.backends[addr]; ok {
+		return false
+	}
+	u.backends[addr] = &backendState{status: INIT, lastTransition: time.Now()}
+	return true
+}
+
+// transitionBackend records a health check result for a configured backend and tracks it for selection
+// while it is healthy. Results for backends that are no longer configured are ignored and false is
+// returned since a heartbeat can still report once after its backend was removed.
+// Holding statusMu throughout keeps this from racing with the backend being removed.
+func (u *Upstream) transitionBackend(addr string, stat BackendStatus) bool {
+	u.statusMu.Lock()
+	defer u.statusMu.Unlock()
+	state, ok := u.backends[addr]
+	if !ok {
+		return false
+	}
+	switch {
+	case stat == HEALTHY && state.status == UNHEALTHY:
+		u.TrackRecoveredBackend(addr)
+	case stat == HEALTHY:
+		u.TrackBackend(addr)
+	default:
+		u.UntrackUnhealthyBackend(addr)
+	}
+	if state.status != stat {
+		state.status = stat
+		state.lastTransition = time.Now()
+	}
+	return true
+}
+
+// configuredBackends returns the addresses of every configured backend
+func (u *Upstream) configuredBackends() []string {
+	u.statusMu.Lock()
+	defer u.statusMu.Unlock()
+	addrs := make([]string, 0, len(u.backends))
+	for addr := range u.backends {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// hasBackend reports if the backend is configured
+func (u *Upstream) hasBackend(addr string) bool {
+	u.statusMu.Lock()
+	defer u.statusMu.Unlock()
+	_, ok := u.backends[addr]
+	return ok
+}
+
+// removeBackendStatus forgets a backend that is no longer configured
+func (u *Upstream) removeBackendStatus(addr string) {
+	u.statusMu.Lock()
+	defer u.statusMu.Unlock()
+	delete(u.backends, addr)
+}
+
+// Backends returns a snapshot of all backends of the upstream sorted by address
+func (u *Upstream) Backends() []BackendInfo {
+	u.statusMu.Lock()
+	infos := make([]BackendInfo, 0, len(u.backends))
+	for addr, state := range u.backends {
+		infos = append(infos, BackendInfo{
+			Addr:           addr,
+			Status:         state.status,
+			LastTransition: state.lastTransition,
+		})
+	}
+	u.statusMu.Unlock()
+
+	for i := range infos {
+		infos[i].ActiveConns = u.BackendActiveConns(infos[i].Addr)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Addr < infos[j].Addr })
+	return infos
+}
+
+// refreshReady sets the upstream ready when enough of its backends are healthy and not ready otherwise.
+// WaitForReadyCtx callers are woken up once it is ready. The count is taken under the ready lock so
+// concurrent refreshes can't store a stale status.
+func (u *Upstream) refreshReady() {
+	u.readyMu.Lock()
+	defer u.readyMu.Unlock()
+	ready := u.hasMinHealthy()
+	select {
+	case <-u.ready:
+		if !ready {
+			u.ready = make(chan struct{})
+		}
+	default:
+		if ready {
+			close(u.ready)
+		}
+	}
+	if ready {
+		u.Status.Store(int32(READY))
+		// A backend that became healthy may have room for a queued connection
+		u.wakeQueue()
+	} else {
+		u.Status.Store(int32(NOTREADY))
+	}
+}
+
+// WaitForReadyCtx waits for the upstream to be ready or ctx to be done, whichever is first.
+// It returns an error wrapping both ErrUpstreamNotReady and the ctx error when ctx is done first.
+func (u *Upstream) WaitForReadyCtx(ctx context.Context) error {
+	u.readyMu.Lock()
+	ready := u.ready
+	u.readyMu.Unlock()
+	if u.Status.Load() == int32(READY) {
+		return nil
+	}
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %w", ErrUpstreamNotReady, ctx.Err())
 	}
 }
 
@@ -58,11 +535,18 @@ func NewUpstream(name string) *Upstream {
 // This is mostly to simplify testing and shouldn't really be used to confirm readiness as it can cause a TOCTOU race.
 // In concurrency it's better to ask for forgiveness rather than permission so use NextWithContext for normal use.
 func (u *Upstream) WaitForReady(d time.Duration) error {
-	deadline := time.Now().Add(d)
-	for time.Now().Before(deadline) {
+	c := clock.Or(u.ReadyClock)
+	deadline := c.After(d)
+	poll := c.NewTicker(time.Millisecond)
+	defer poll.Stop()
+	for {
 		if u.Status.Load() == int32(READY) {
 			return nil
 		}
+		select {
+		case <-deadline:
+			return ErrUpstreamNotReady
+		case <-poll.C():
+		}
 	}
-	return ErrUpstreamNotReady
 }
@@ -1,11 +1,196 @@
 package upstream
 
 import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/doggydogworld/gobalancer/clock"
+	"github.com/doggydogworld/gobalancer/config"
+	"github.com/doggydogworld/gobalancer/forwarder/health"
+	"github.com/stretchr/testify/assert"
 	"go.uber.org/goleak"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func TestMain(m *testing.M) {
 	goleak.VerifyTestMain(m)
 }
+
+func TestWaitForReadyFakeClock(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	up := NewUpstream("test")
+	up.ReadyClock = clk
+
+	errc := make(chan error)
+	go func() { errc <- up.WaitForReady(time.Second) }()
+	assert.Eventually(t, func() bool { return clk.Tickers() == 1 }, time.Second, time.Millisecond)
+	clk.Advance(time.Second)
+	assert.ErrorIs(t, <-errc, ErrUpstreamNotReady)
+
+	up.Status.Store(int32(READY))
+	assert.NoError(t, up.WaitForReady(time.Second))
+}
+
+func TestWaitForReadyCtx(t *testing.T) {
+	up := NewUpstream("test")
+
+	// Cancelling the context returns straight away
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() { errc <- up.WaitForReadyCtx(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	cancel()
+	err := <-errc
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+	assert.ErrorIs(t, err, ErrUpstreamNotReady)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Becoming ready wakes up waiters
+	go func() { errc <- up.WaitForReadyCtx(context.Background()) }()
+	time.Sleep(10 * time.Millisecond)
+	up.TrackBackend("127.0.0.1:8000")
+	up.refreshReady()
+	assert.NoError(t, <-errc)
+	assert.NoError(t, up.WaitForReadyCtx(context.Background()))
+
+	// Waiters block again once the upstream is no longer ready
+	up.UntrackBackend("127.0.0.1:8000", ErrBackendUnhealthy)
+	up.refreshReady()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, up.WaitForReadyCtx(ctx), context.DeadlineExceeded)
+}
+
+// fakeDNS answers every A query with the current IP and every other query with no records
+type fakeDNS struct {
+	ip atomic.Pointer[[4]byte]
+}
+
+func (f *fakeDNS) set(ip string) {
+	a := [4]byte(net.ParseIP(ip).To4())
+	f.ip.Store(&a)
+}
+
+func (f *fakeDNS) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go f.serve(server)
+			return client, nil
+		},
+	}
+}
+
+// serve answers queries framed like DNS over TCP since a pipe isn't a packet connection
+func (f *fakeDNS) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(query); err != nil {
+			return
+		}
+		msg.Header.Response = true
+		msg.Header.Authoritative = true
+		q := msg.Questions[0]
+		if q.Type == dnsmessage.TypeA {
+			msg.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: *f.ip.Load()},
+			}}
+		}
+		resp, err := msg.Pack()
+		if err != nil {
+			return
+		}
+		binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+		if _, err := conn.Write(append(size[:], resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// newNamedBackend listens on ip:port and greets connections with its name before echoing
+func newNamedBackend(t *testing.T, addr string, name string) net.Listener {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("can't listen on %s: %v", addr, err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, name+"\n")
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestDNSChange(t *testing.T) {
+	primary := newNamedBackend(t, "127.0.0.1:0", "primary")
+	defer primary.Close()
+	_, port, _ := net.SplitHostPort(primary.Addr().String())
+	failover := newNamedBackend(t, net.JoinHostPort("127.0.0.2", port), "failover")
+	defer failover.Close()
+	dns := &fakeDNS{}
+	dns.set("127.0.0.1")
+
+	m := NewManager()
+	m.Resolver = dns.resolver()
+	go m.Start()
+	defer m.Stop()
+	backend := net.JoinHostPort("backend.test", port)
+	assert.NoError(t, m.LoadUpstreamFromConfig(&config.Upstream{Name: "test", Backends: []string{backend}}))
+	up, err := m.GetUpstream("test")
+	assert.NoError(t, err)
+	assert.NoError(t, up.WaitForReady(time.Second))
+
+	greet := func(conn net.Conn) string {
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		assert.NoError(t, err)
+		return line
+	}
+	established, err := up.Dial(context.Background(), &net.Dialer{}, backend)
+	assert.NoError(t, err)
+	defer established.Close()
+	assert.Equal(t, "primary\n", greet(established))
+
+	// Fail over in DNS and take the old address down
+	dns.set("127.0.0.2")
+	primary.Close()
+
+	conn, err := up.Dial(context.Background(), &net.Dialer{}, backend)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "failover\n", greet(conn))
+
+	// Health checks follow the new address too
+	stat, _, err := up.newChecker(backend).Check(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, health.SUCCESS, stat)
+
+	// The established connection stays on the address it was dialed to
+	io.WriteString(established, "still primary\n")
+	assert.Equal(t, "still primary\n", greet(established))
+}
@@ -0,0 +1,97 @@
+package srv
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/doggydogworld/gobalancer/config"
+)
+
+// connLimiter is shared by all listeners and caps the connections that are being handshaken or forwarded
+// so many listeners that are each under their own limits can't exhaust the file descriptors together
+type connLimiter struct {
+	slots    chan struct{}
+	pause    bool
+	rejected atomic.Int64
+}
+
+func newConnLimiter(max int, policy config.MaxConnectionsPolicy) *connLimiter {
+	return &connLimiter{
+		slots: make(chan struct{}, max),
+		pause: policy == config.PauseAtMaxConnections,
+	}
+}
+
+// acquire takes a slot for a new connection. When pausing it waits for a slot until done is closed
+// and otherwise it reports false straight away when there is none.
+func (c *connLimiter) acquire(done <-chan struct{}) bool {
+	if c.pause {
+		select {
+		case c.slots <- struct{}{}:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *connLimiter) release() {
+	<-c.slots
+}
+
+// limitListener only hands out connections that got a slot from the limiter.
+// While paused the connection that was just accepted waits for a slot and the rest wait in the listen backlog.
+type limitListener struct {
+	net.Listener
+	limiter   *connLimiter
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLimitListener(l net.Listener, limiter *connLimiter) *limitListener {
+	return &limitListener{Listener: l, limiter: limiter, done: make(chan struct{})}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.limiter.acquire(l.done) {
+			return &limitedConn{Conn: conn, release: l.limiter.release}, nil
+		}
+		conn.Close()
+		select {
+		case <-l.done:
+			return nil, net.ErrClosed
+		default:
+			l.limiter.rejected.Add(1)
+		}
+	}
+}
+
+// Close also stops an Accept waiting for a slot
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// limitedConn gives its slot back to the limiter when it is closed
+type limitedConn struct {
+	net.Conn
+	release   func()
+	closeOnce sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.closeOnce.Do(c.release)
+	return c.Conn.Close()
+}
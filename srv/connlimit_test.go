@@ -0,0 +1,106 @@
+package srv
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/doggydogworld/gobalancer/config"
+)
+
+func TestMaxConnections(t *testing.T) {
+	tests := map[string]struct {
+		policy config.MaxConnectionsPolicy
+	}{
+		"reject": {policy: config.RejectOverMaxConnections},
+		"pause":  {policy: config.PauseAtMaxConnections},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := LoadStaticConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.MaxConnections = 2
+			cfg.MaxConnectionsPolicy = test.policy
+			srv, upstream := newTestServerWithConfig(t, cfg)
+			fwdr := &holdingForwarder{started: make(chan struct{}, 3)}
+			for _, d := range srv.Downstreams {
+				d.fwdr = fwdr
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			errc := make(chan error, 1)
+			go func() { errc <- srv.ListenAndServe(ctx) }()
+			defer func() {
+				cancel()
+				<-errc
+			}()
+			tlsConf := newUserClient(t, "sre.crt", "sre.key").Transport.(*http.Transport).TLSClientConfig
+
+			// Each listener is far from any limit of its own but together they reach the global cap
+			var open []*tls.Conn
+			for _, name := range []string{"web", "db"} {
+				conn, err := tls.Dial("tcp", upstream[name], tlsConf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				<-fwdr.started
+				open = append(open, conn)
+			}
+
+			// The handshake of a connection over the cap is never answered or answered with a close
+			dialer := &tls.Dialer{Config: tlsConf}
+			dialCtx, cancelDial := context.WithTimeout(ctx, 200*time.Millisecond)
+			over, err := dialer.DialContext(dialCtx, "tcp", upstream["telemetry"])
+			cancelDial()
+			if err == nil {
+				// TLS 1.3 clients finish their side of the handshake first so the close shows up on read
+				over.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+				n, _ := over.Read(make([]byte, 1))
+				over.Close()
+				if n > 0 {
+					t.Fatal("expected the connection over the cap not to be forwarded")
+				}
+			}
+			select {
+			case <-fwdr.started:
+				t.Fatal("connection over the cap was forwarded")
+			default:
+			}
+
+			// Closing a connection frees its slot for a new one once the server has noticed
+			open[0].Close()
+			deadline := time.Now().Add(2 * time.Second)
+			for forwarded := false; !forwarded; {
+				if time.Now().After(deadline) {
+					t.Fatal("connection was not forwarded once a slot was free")
+				}
+				conn, err := tls.Dial("tcp", upstream["telemetry"], tlsConf)
+				if err != nil {
+					continue
+				}
+				defer conn.Close()
+				select {
+				case <-fwdr.started:
+					forwarded = true
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+			if _, err := io.WriteString(open[1], "still open"); err != nil {
+				t.Errorf("expected the connections under the cap to stay open got %v", err)
+			}
+
+			rejected := srv.ConnectionsRejected()
+			if test.policy == config.RejectOverMaxConnections && rejected < 1 {
+				t.Errorf("expected the connection over the cap to be counted got %d", rejected)
+			}
+			if test.policy == config.PauseAtMaxConnections && rejected != 0 {
+				t.Errorf("expected paused listeners not to reject got %d", rejected)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package srv
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+)
+
+// controlServer accepts line based commands on a Unix socket for process managers that
+// shouldn't need an HTTP admin port. Access is controlled by the permissions of the socket file.
+type controlServer struct {
+	listener net.Listener
+	logger   *slog.Logger
+}
+
+// newControlServer binds the control socket at path replacing a socket left behind by a previous process
+func newControlServer(path string, logger *slog.Logger) (*controlServer, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &controlServer{listener: l, logger: logger}, nil
+}
+
+// serveControl accepts control connections until ctx is done
+func (s *Server) serveControl(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() { s.control.listener.Close() })
+	defer stop()
+	for {
+		conn, err := s.control.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			s.handleControl(conn)
+		}()
+	}
+}
+
+// handleControl runs the commands read from rw one per line until it is closed.
+// Each command is answered with a single line, ok or error: <reason>, except stats which replies with
+// the same JSON document as the debug endpoint.
+func (s *Server) handleControl(rw io.ReadWriter) {
+	logger := slog.Default()
+	if s.control != nil {
+		logger = s.control.logger
+	}
+	scanner := bufio.NewScanner(rw)
+	for scanner.Scan() {
+		cmd := strings.TrimSpace(scanner.Text())
+		if cmd == "" {
+			continue
+		}
+		var err error
+		switch cmd {
+		case "stats":
+			err = json.NewEncoder(rw).Encode(s.debugState())
+		case "drain":
+			s.Drain()
+			_, err = io.WriteString(rw, "ok\n")
+		case "reload":
+			if s.Reload == nil {
+				err = errors.New("reload is not supported")
+			} else {
+				err = s.Reload()
+			}
+			if err != nil {
+				logger.Error("control_reload_failed", "error", err.Error())
+				_, err = fmt.Fprintf(rw, "error: %s\n", err)
+			} else {
+				_, err = io.WriteString(rw, "ok\n")
+			}
+		default:
+			_, err = fmt.Fprintf(rw, "error: unknown command %q\n", cmd)
+		}
+		logger.Info("control_command", "command", cmd)
+		if err != nil {
+			return
+		}
+	}
+}
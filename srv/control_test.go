@@ -0,0 +1,200 @@
+package srv
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/doggydogworld/gobalancer/forwarder"
+)
+
+func TestControlCommands(t *testing.T) {
+	reloads := 0
+	var reloadErr error
+	srv := &Server{Reload: func() error {
+		reloads++
+		return reloadErr
+	}}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer conn.Close()
+		srv.handleControl(conn)
+	}()
+	r := bufio.NewReader(client)
+	send := func(cmd string) string {
+		t.Helper()
+		if _, err := io.WriteString(client, cmd+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line
+	}
+
+	var state debugState
+	if err := json.Unmarshal([]byte(send("stats")), &state); err != nil {
+		t.Errorf("expected stats to reply with the debug state: %v", err)
+	}
+	if got := send("reload"); got != "ok\n" || reloads != 1 {
+		t.Errorf("expected reload to succeed got %q after %d reloads", got, reloads)
+	}
+	reloadErr = errors.New("bad config")
+	if got := send("reload"); got != "error: bad config\n" {
+		t.Errorf("expected the reload error got %q", got)
+	}
+	if got := send("restart"); got != "error: unknown command \"restart\"\n" {
+		t.Errorf("expected an unknown command error got %q", got)
+	}
+	select {
+	case <-srv.drainChan():
+		t.Fatal("expected the server not to be draining before the drain command")
+	default:
+	}
+	if got := send("drain"); got != "ok\n" {
+		t.Errorf("expected drain to succeed got %q", got)
+	}
+	select {
+	case <-srv.drainChan():
+	default:
+		t.Error("expected the drain command to drain the server")
+	}
+	// Draining twice is harmless
+	if got := send("drain"); got != "ok\n" {
+		t.Errorf("expected a second drain to succeed got %q", got)
+	}
+}
+
+func TestReloadNotSupported(t *testing.T) {
+	srv := &Server{}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer conn.Close()
+		srv.handleControl(conn)
+	}()
+	io.WriteString(client, "reload\n")
+	line, _ := bufio.NewReader(client).ReadString('\n')
+	if line != "error: reload is not supported\n" {
+		t.Errorf("expected reload to fail without a Reload func got %q", line)
+	}
+}
+
+func TestControlSocket(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "gobalancer.sock")
+	cfg.ControlSocket = path
+	srv, _ := newTestServerWithConfig(t, cfg)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("expected the control socket to only be accessible by its owner got %v", fi.Mode().Perm())
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(context.Background()) }()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "drain\n")
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if line != "ok\n" {
+		t.Errorf("expected drain to succeed got %q", line)
+	}
+	// Nothing is being forwarded so draining stops the server straight away
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("expected a drained server to stop cleanly got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop after draining")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the control socket to be removed on shutdown got %v", err)
+	}
+}
+
+// holdingForwarder keeps connections open until the client closes them
+type holdingForwarder struct {
+	started chan struct{}
+}
+
+func (f *holdingForwarder) Forward(ctx context.Context, info forwarder.FwdInfo) error {
+	defer info.Conn.Close()
+	f.started <- struct{}{}
+	io.Copy(io.Discard, info.Conn)
+	return nil
+}
+
+func TestDrainWaitsForActiveConnections(t *testing.T) {
+	srv, upstream := newTestServer(t)
+	fwdr := &holdingForwarder{started: make(chan struct{}, 1)}
+	for _, d := range srv.Downstreams {
+		d.fwdr = fwdr
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(ctx) }()
+
+	tlsConf := newUserClient(t, "sre.crt", "sre.key").Transport.(*http.Transport).TLSClientConfig
+	active, err := tls.Dial("tcp", upstream["web"], tlsConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	<-fwdr.started
+
+	srv.Drain()
+	// New connections are refused once the listener has been closed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", upstream["web"])
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("listener kept accepting connections after draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-errc:
+		t.Fatalf("server stopped before the active connection closed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The active connection is still forwarded
+	if _, err := active.Write([]byte("still here")); err != nil {
+		t.Errorf("expected the active connection to survive draining got %v", err)
+	}
+	active.Close()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("expected a drained server to stop cleanly got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop after its last connection closed")
+	}
+}
@@ -0,0 +1,168 @@
+package srv
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/doggydogworld/gobalancer/config"
+	"github.com/doggydogworld/gobalancer/forwarder"
+)
+
+// debugUpstream is the name the debug listener is authorized as
+const debugUpstream = "debug"
+
+// debugServer serves pprof and a dump of the server state to privileged clients
+type debugServer struct {
+	listener net.Listener
+	policy   *policyEnforcer
+	logger   *slog.Logger
+}
+
+// newDebugServer binds the debug listener. Clients are authenticated with the same CA as the listeners.
+func newDebugServer(cfg *config.Debug, tlsConf *tls.Config, logger *slog.Logger) (*debugServer, error) {
+	l, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &debugServer{
+		listener: tls.NewListener(l, tlsConf),
+		policy: &policyEnforcer{
+			upstreamTags: map[string][]string{debugUpstream: cfg.Tags},
+			logger:       logger.WithGroup("audit"),
+		},
+		logger: logger,
+	}, nil
+}
+
+// debugStater is implemented by forwarders that can dump their state
+type debugStater interface {
+	DebugState() forwarder.DebugState
+}
+
+// debugListenerState describes a downstream listener in the debug dump
+type debugListenerState struct {
+	Addr     string
+	Upstream string
+	Restarts int64
+}
+
+// debugState is the JSON document served on /debug/state
+type debugState struct {
+	Listeners          []debugListenerState
+	HandshakesRejected int64
+	// ConnectionsRejected were over MaxConnections
+	ConnectionsRejected int64
+	NegotiatedTLS       NegotiatedTLS
+	// Rejections are connections closed by the handshake or authorization by reason
+	Rejections map[forwarder.CloseReason]int64
+	// Forwarder is omitted when the forwarder can't dump its state
+	Forwarder *forwarder.DebugState `json:",omitempty"`
+}
+
+func (s *Server) debugState() debugState {
+	state := debugState{
+		HandshakesRejected:  s.HandshakesRejected(),
+		ConnectionsRejected: s.ConnectionsRejected(),
+		NegotiatedTLS:       s.NegotiatedTLS(),
+		Rejections:          s.Rejections(),
+	}
+	for _, d := range s.downstreams() {
+		state.Listeners = append(state.Listeners, debugListenerState{
+			Addr:     d.Addr().String(),
+			Upstream: d.Upstream,
+			Restarts: d.restarts.Load(),
+		})
+	}
+	if f, ok := s.Forwarder.(debugStater); ok {
+		fwd := f.DebugState()
+		state.Forwarder = &fwd
+	}
+	return state
+}
+
+func (s *Server) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.debugState())
+	})
+	mux.HandleFunc("/debug/config", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.EffectiveConfig())
+	})
+	mux.HandleFunc("POST /debug/ratelimit/reset", s.resetRateLimit)
+	return s.debug.authorize(mux)
+}
+
+// rateLimitResetter is implemented by forwarders whose client rate limits can be reset
+type rateLimitResetter interface {
+	ResetRateLimit(key string)
+	ResetAllRateLimits()
+}
+
+// resetRateLimit gives the client in the key parameter, or every client with all=true, a full token bucket
+func (s *Server) resetRateLimit(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.Forwarder.(rateLimitResetter)
+	if !ok {
+		http.Error(w, "forwarder does not support resetting rate limits", http.StatusNotImplemented)
+		return
+	}
+	key := r.FormValue("key")
+	switch {
+	case key != "":
+		f.ResetRateLimit(key)
+		s.debug.logger.Info("rate_limit_reset", "key", key, "by", r.TLS.PeerCertificates[0].Subject.CommonName)
+	case r.FormValue("all") == "true":
+		f.ResetAllRateLimits()
+		s.debug.logger.Info("rate_limit_reset_all", "by", r.TLS.PeerCertificates[0].Subject.CommonName)
+	default:
+		http.Error(w, "key or all=true is required", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorize only lets through clients whose primary OU is in the debug tags
+func (d *debugServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The TLS config requires a verified client certificate so there is always one
+		crt := r.TLS.PeerCertificates[0]
+		allowed, err := d.policy.Authorize(PolicyQuery{
+			User:     crt.Subject.CommonName,
+			OUs:      crt.Subject.OrganizationalUnit,
+			Upstream: debugUpstream,
+		})
+		if err != nil || !allowed {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveDebug serves the debug listener until ctx is done
+func (s *Server) serveDebug(ctx context.Context) error {
+	srv := &http.Server{
+		Handler:           s.debugHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+		ErrorLog:          slog.NewLogLogger(s.debug.logger.Handler(), slog.LevelDebug),
+	}
+	stop := context.AfterFunc(ctx, func() { srv.Close() })
+	defer stop()
+	if err := srv.Serve(s.debug.listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/doggydogworld/gobalancer/config"
+)
+
+func TestDebugEndpoint(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Debug = &config.Debug{Addr: "127.0.0.1:0", Tags: []string{"sre"}}
+	srv, err := NewServerFromCfg(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-errc; err != context.Canceled {
+			t.Error(err)
+		}
+	}()
+	base := "https://" + srv.debug.listener.Addr().String()
+
+	sre := newUserClient(t, "sre.crt", "sre.key")
+	resp, err := sre.Get(base + "/debug/state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 got %d", resp.StatusCode)
+	}
+	var state struct {
+		Listeners []struct {
+			Addr     string
+			Upstream string
+			Restarts int64
+		}
+		HandshakesRejected int64
+		Forwarder          struct {
+			Upstreams map[string][]struct {
+				Addr        string
+				Status      string
+				ActiveConns int
+			}
+			RateLimiter struct {
+				Clients int
+				Waiters int
+			}
+			Connections []json.RawMessage
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Listeners) != len(cfg.Listeners) {
+		t.Errorf("expected %d listeners got %d", len(cfg.Listeners), len(state.Listeners))
+	}
+	for _, up := range cfg.Upstreams {
+		backends, ok := state.Forwarder.Upstreams[up.Name]
+		if !ok {
+			t.Errorf("upstream %s is missing from the dump", up.Name)
+			continue
+		}
+		if len(backends) != len(up.Backends) {
+			t.Errorf("expected %d backends for %s got %d", len(up.Backends), up.Name, len(backends))
+		}
+		for _, b := range backends {
+			if b.Status == "" {
+				t.Errorf("backend %s has no status", b.Addr)
+			}
+		}
+	}
+
+	resp, err = sre.Get(base + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected pprof to be served got %d", resp.StatusCode)
+	}
+
+	// Only the privileged OU is allowed
+	resp, err = newUserClient(t, "webdev.crt", "webdev.key").Get(base + "/debug/state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected webdev to be forbidden got %d", resp.StatusCode)
+	}
+}
+
+func TestDebugDisabledByDefault(t *testing.T) {
+	srv, _ := newTestServer(t)
+	if srv.debug != nil {
+		t.Fatal("debug listener should be off by default")
+	}
+}
+
+// resetRecorder is a forwarder that records rate limit resets
+type resetRecorder struct {
+	dummyForwarder
+	mu    sync.Mutex
+	reset []string
+}
+
+func (r *resetRecorder) ResetRateLimit(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reset = append(r.reset, key)
+}
+
+func (r *resetRecorder) ResetAllRateLimits() {
+	r.ResetRateLimit("*")
+}
+
+func TestDebugRateLimitReset(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Debug = &config.Debug{Addr: "127.0.0.1:0", Tags: []string{"sre"}}
+	srv, err := NewServerFromCfg(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &resetRecorder{}
+	srv.Forwarder = rec
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(ctx) }()
+	defer func() {
+		cancel()
+		<-errc
+	}()
+	endpoint := "https://" + srv.debug.listener.Addr().String() + "/debug/ratelimit/reset"
+	sre := newUserClient(t, "sre.crt", "sre.key")
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{query: "key=bob", status: http.StatusNoContent},
+		{query: "all=true", status: http.StatusNoContent},
+		{query: "", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		resp, err := sre.Post(endpoint+"?"+test.query, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%q: expected %d got %d", test.query, test.status, resp.StatusCode)
+		}
+	}
+	resp, err := sre.Get(endpoint + "?key=bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be rejected got %d", resp.StatusCode)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if strings.Join(rec.reset, ",") != "bob,*" {
+		t.Errorf("unexpected resets %v", rec.reset)
+	}
+}
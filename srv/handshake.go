@@ -0,0 +1,197 @@
+package srv
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"maps"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/doggydogworld/gobalancer/config"
+	"github.com/doggydogworld/gobalancer/forwarder"
+	"golang.org/x/time/rate"
+)
+
+// handshakeLimiter is shared by all listeners and rejects connections before the TLS handshake.
+// Rejections are counted rather than logged individually since a flood of handshakes would
+// otherwise become a flood of logs. Only the start and end of a limiting period is logged.
+type handshakeLimiter struct {
+	limiter  *rate.Limiter
+	limiting atomic.Bool
+	rejected atomic.Int64
+	logger   *slog.Logger
+}
+
+// newHandshakeLimiter creates the limiter from config.
+// A burst below 1 would reject every handshake so it defaults to the per second rate rounded up.
+func newHandshakeLimiter(cfg *config.HandshakeRateLimit, logger *slog.Logger) *handshakeLimiter {
+	burst := cfg.Burst
+	if burst < 1 {
+		burst = max(1, int(math.Ceil(cfg.HandshakesPerSecond)))
+	}
+	return &handshakeLimiter{
+		limiter: rate.NewLimiter(rate.Limit(cfg.HandshakesPerSecond), burst),
+		logger:  logger,
+	}
+}
+
+// allow reports if a handshake can go ahead
+func (h *handshakeLimiter) allow() bool {
+	if h.limiter.Allow() {
+		if h.limiting.CompareAndSwap(true, false) {
+			h.logger.Info("handshake_rate_limit_stopped", "rejected_total", h.rejected.Load())
+		}
+		return true
+	}
+	h.rejected.Add(1)
+	if h.limiting.CompareAndSwap(false, true) {
+		h.logger.Warn("handshake_rate_limit_started", "handshakes_per_second", float64(h.limiter.Limit()), "burst", h.limiter.Burst())
+	}
+	return false
+}
+
+// defaultHandshakeErrorSummaryInterval is how often dropped handshake failures are reported when
+// HandshakeErrorLog.SummaryInterval isn't set
+const defaultHandshakeErrorSummaryInterval = 10 * time.Second
+
+// handshakeErrorSampler is shared by all listeners and drops handshake failure logs over its rate.
+// The number dropped is logged with the next failure that is logged or every summary interval while
+// failures keep being dropped, whichever comes first.
+type handshakeErrorSampler struct {
+	limiter         *rate.Limiter
+	summaryInterval time.Duration
+	mu              sync.Mutex
+	// suppressed counts the failures dropped since the last summary
+	suppressed  int64
+	lastSummary time.Time
+	logger      *slog.Logger
+}
+
+// newHandshakeErrorSampler creates the sampler from config.
+// A burst below 1 would drop every log so it defaults to the per second rate rounded up.
+func newHandshakeErrorSampler(cfg *config.HandshakeErrorLog, logger *slog.Logger) *handshakeErrorSampler {
+	burst := cfg.Burst
+	if burst < 1 {
+		burst = max(1, int(math.Ceil(cfg.PerSecond)))
+	}
+	interval := cfg.SummaryInterval
+	if interval <= 0 {
+		interval = defaultHandshakeErrorSummaryInterval
+	}
+	return &handshakeErrorSampler{
+		limiter:         rate.NewLimiter(rate.Limit(cfg.PerSecond), burst),
+		summaryInterval: interval,
+		lastSummary:     time.Now(),
+		logger:          logger,
+	}
+}
+
+// allow reports if a handshake failure should be logged
+func (s *handshakeErrorSampler) allow() bool {
+	allowed := s.limiter.Allow()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !allowed {
+		s.suppressed++
+	}
+	if s.suppressed > 0 && (allowed || time.Since(s.lastSummary) >= s.summaryInterval) {
+		s.logger.Warn("handshake_errors_suppressed", "suppressed", s.suppressed, "since", s.lastSummary)
+		s.suppressed = 0
+		s.lastSummary = time.Now()
+	}
+	return allowed
+}
+
+// NegotiatedTLS counts completed handshakes by the TLS version and cipher suite the client negotiated
+// e.g. to tell when it's safe to retire an old version or a weak cipher.
+type NegotiatedTLS struct {
+	Versions     map[string]int64
+	CipherSuites map[string]int64
+}
+
+// tlsStats is shared by all listeners and counts what clients negotiate
+type tlsStats struct {
+	mu     sync.Mutex
+	counts NegotiatedTLS
+}
+
+func newTLSStats() *tlsStats {
+	return &tlsStats{counts: NegotiatedTLS{Versions: map[string]int64{}, CipherSuites: map[string]int64{}}}
+}
+
+func (s *tlsStats) record(state tls.ConnectionState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts.Versions[tls.VersionName(state.Version)]++
+	s.counts.CipherSuites[tls.CipherSuiteName(state.CipherSuite)]++
+}
+
+func (s *tlsStats) snapshot() NegotiatedTLS {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return NegotiatedTLS{Versions: maps.Clone(s.counts.Versions), CipherSuites: maps.Clone(s.counts.CipherSuites)}
+}
+
+// rejections is shared by all listeners and counts connections closed before they were forwarded by reason
+type rejections struct {
+	mu     sync.Mutex
+	counts map[forwarder.CloseReason]int64
+}
+
+func newRejections() *rejections {
+	return &rejections{counts: map[forwarder.CloseReason]int64{}}
+}
+
+func (r *rejections) record(reason forwarder.CloseReason) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[reason]++
+}
+
+func (r *rejections) snapshot() map[forwarder.CloseReason]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return maps.Clone(r.counts)
+}
+
+// rejectedError is returned for a connection that was closed before it was forwarded
+type rejectedError struct {
+	reason forwarder.CloseReason
+	err    error
+}
+
+func (e *rejectedError) Error() string { return e.err.Error() }
+
+func (e *rejectedError) Unwrap() error { return e.err }
+
+// reject counts a connection closed for reason and wraps err so the reason is logged with it
+func (d *DownstreamListener) reject(reason forwarder.CloseReason, err error) error {
+	if d.rejections != nil {
+		d.rejections.record(reason)
+	}
+	return &rejectedError{reason: reason, err: err}
+}
+
+// logConnError logs an error from handling a connection along with why it was rejected if it was.
+// Clients that didn't speak TLS at all are logged as a protocol_error with their address so scanners and
+// misconfigured clients stand out from clients that failed the handshake.
+func (d *DownstreamListener) logConnError(conn net.Conn, err error) {
+	attrs := []any{"upstream", d.Upstream, "error", err.Error()}
+	var rejected *rejectedError
+	if errors.As(err, &rejected) {
+		failed := rejected.reason == forwarder.HandshakeFailed || rejected.reason == forwarder.ProtocolError
+		if failed && d.handshakeErrors != nil && !d.handshakeErrors.allow() {
+			return
+		}
+		if rejected.reason == forwarder.ProtocolError {
+			d.logger.Warn("protocol_error", "upstream", d.Upstream, "remote", conn.RemoteAddr().String(), "error", err.Error())
+			return
+		}
+		attrs = append(attrs, "reason", string(rejected.reason))
+	}
+	d.logger.Error("handleConn.error", attrs...)
+}
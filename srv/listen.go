@@ -0,0 +1,48 @@
+package srv
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+
+	"github.com/doggydogworld/gobalancer/config"
+)
+
+// listen creates the listener for a listener config without TLS so the socket can later be handed
+// to another process with listenerFile.
+// If an inherited file descriptor is configured the socket is taken over instead of binding the address.
+// See Zero Downtime Upgrades in the README for how a supervising process uses this.
+func listen(cfg *config.Listener) (net.Listener, error) {
+	if cfg.FD == 0 {
+		if !cfg.ReusePort {
+			return net.Listen("tcp", cfg.Addr)
+		}
+		if !reusePortSupported {
+			slog.Default().Warn("SO_REUSEPORT is not supported on this platform binding without it", "addr", cfg.Addr)
+		}
+		lc := net.ListenConfig{Control: reusePortControl}
+		return lc.Listen(context.Background(), "tcp", cfg.Addr)
+	}
+	f := os.NewFile(uintptr(cfg.FD), fmt.Sprintf("inherited-listener-%d", cfg.FD))
+	if f == nil {
+		return nil, fmt.Errorf("invalid inherited file descriptor %d", cfg.FD)
+	}
+	// FileListener dups the descriptor so the original can be closed
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited file descriptor %d is not a listener: %w", cfg.FD, err)
+	}
+	return l, nil
+}
+
+// listenerFile returns a duplicate of the socket of a listener created by listen
+func listenerFile(l net.Listener) (*os.File, error) {
+	fl, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("listener %s has no file descriptor", l.Addr())
+	}
+	return fl.File()
+}
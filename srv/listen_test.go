@@ -0,0 +1,104 @@
+//go:build unix
+
+package srv
+
+import (
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// inheritableFD creates a listening socket and returns a raw descriptor for it that isn't owned by any *os.File
+// just like a descriptor that was passed to the process by a parent.
+func inheritableFD(t *testing.T) (int, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd, l.Addr().String()
+}
+
+func TestInheritedListener(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, addr := inheritableFD(t)
+	cfg.Listeners[0].FD = fd
+	srv, _ := newTestServerWithConfig(t, cfg)
+	injectDummyForwarders(srv)
+	go runTestServer(t, srv)
+
+	if got := srv.Downstreams[0].listener.Addr().String(); got != addr {
+		t.Fatalf("expected inherited address %s got %s", addr, got)
+	}
+	client := newUserClient(t, "sre.crt", "sre.key")
+	resp, err := client.Get("https://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(body)) != cfg.Listeners[0].Upstream {
+		t.Fatalf("expected '%s' got %s", cfg.Listeners[0].Upstream, body)
+	}
+}
+
+func TestInheritedNonListener(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds := make([]int, 2)
+	if err := syscall.Pipe(fds); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[1])
+	cfg.Listeners[0].FD = fds[0]
+	if _, err := NewDownstreamListeners(cfg, &mustNotForwarder{t: t}); err == nil {
+		t.Fatal("expected a pipe to be rejected as a listener")
+	}
+}
+
+func TestListenerFiles(t *testing.T) {
+	srv, _ := newTestServer(t)
+	defer func() {
+		for _, d := range srv.Downstreams {
+			d.listener.Close()
+		}
+	}()
+	files, err := srv.ListenerFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(srv.Downstreams) {
+		t.Fatalf("expected %d files got %d", len(srv.Downstreams), len(files))
+	}
+	// The files are in listener order and can be turned back into the same listening socket
+	for i, f := range files {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := l.Addr().String(), srv.Downstreams[i].listener.Addr().String(); got != want {
+			t.Errorf("expected file %d to be %s got %s", i, want, got)
+		}
+		l.Close()
+	}
+}
@@ -0,0 +1,138 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/doggydogworld/gobalancer/clock"
+	"github.com/doggydogworld/gobalancer/config"
+	"github.com/doggydogworld/gobalancer/forwarder"
+)
+
+// Option configures a server created by NewServer
+type Option func(o *serverOptions)
+
+// serverOptions holds the components a server is built from. Anything left unset is built from the config.
+type serverOptions struct {
+	cfg        *config.Config
+	fwdr       Forwarder
+	authorizer Authorizer
+	logger     *slog.Logger
+	clock      clock.Clock
+	dialer     *net.Dialer
+}
+
+// WithConfig sets the config the listeners, policy and any component not supplied by another option are built from.
+// It is required.
+func WithConfig(cfg *config.Config) Option {
+	return func(o *serverOptions) { o.cfg = cfg }
+}
+
+// WithForwarder forwards connections with f instead of the least connections forwarder built from the config
+func WithForwarder(f Forwarder) Option {
+	return func(o *serverOptions) { o.fwdr = f }
+}
+
+// WithAuthorizer authorizes every listener with a instead of the tag based policy, like SetAuthorizer
+func WithAuthorizer(a Authorizer) Option {
+	return func(o *serverOptions) { o.authorizer = a }
+}
+
+// WithLogger sends the logs of the server, its listeners and the audit log to logger instead of slog.Default()
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *serverOptions) { o.logger = logger }
+}
+
+// WithClock checks client certificates against c instead of the real clock, both their validity and their
+// maximum age, e.g. to test certificates expiring without waiting
+func WithClock(c clock.Clock) Option {
+	return func(o *serverOptions) { o.clock = c }
+}
+
+// WithDialer connects to backends with d. It only applies to the forwarder built from the config.
+func WithDialer(d *net.Dialer) Option {
+	return func(o *serverOptions) { o.dialer = d }
+}
+
+// NewServer creates a server from its options, building whatever they don't supply from the config, e.g. a test
+// or an embedder can supply its own Forwarder and Authorizer and still have the listeners bound from the config.
+func NewServer(opts ...Option) (*Server, error) {
+	o := &serverOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	cfg := o.cfg
+	if cfg == nil {
+		return &Server{}, errors.New("NewServer needs a config, pass WithConfig")
+	}
+	if o.dialer != nil && o.fwdr != nil {
+		return &Server{}, errors.New("WithDialer only applies to the built in forwarder and can't be used with WithForwarder")
+	}
+	logger := o.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if err := cfg.Validate(); err != nil {
+		return &Server{}, err
+	}
+	fwdr := o.fwdr
+	// stopFwdr stops the forwarder when it was built here and the server can't be created
+	stopFwdr := func() {}
+	if fwdr == nil {
+		lc, err := forwarder.NewLeastConnectionsFromConfig(context.Background(), cfg)
+		if err != nil {
+			return &Server{}, err
+		}
+		if o.dialer != nil {
+			lc.SetDialer(o.dialer)
+		}
+		fwdr = lc
+		stopFwdr = func() { lc.Close(context.Background()) }
+	}
+	d, err := newDownstreamListeners(cfg, fwdr, logger, o.clock)
+	if err != nil {
+		stopFwdr()
+		return &Server{}, err
+	}
+	s := &Server{
+		Downstreams: d,
+		Forwarder:   fwdr,
+		Logger:      o.logger,
+		cfg:         cfg,
+	}
+	if o.authorizer != nil {
+		s.SetAuthorizer(o.authorizer)
+	}
+	if cfg.Debug != nil {
+		// The config was already checked by newDownstreamListeners
+		tlsConf, _ := newTLSConfig(cfg)
+		if o.clock != nil {
+			tlsConf.Time = o.clock.Now
+		}
+		s.debug, err = newDebugServer(cfg.Debug, tlsConf, logger)
+		if err != nil {
+			for _, l := range d {
+				l.listener.Close()
+			}
+			stopFwdr()
+			return &Server{}, fmt.Errorf("failed to bind debug listener %s: %w", cfg.Debug.Addr, err)
+		}
+	}
+	if cfg.ControlSocket != "" {
+		s.control, err = newControlServer(cfg.ControlSocket, logger)
+		if err != nil {
+			for _, l := range d {
+				l.listener.Close()
+			}
+			if s.debug != nil {
+				s.debug.listener.Close()
+			}
+			stopFwdr()
+			return &Server{}, fmt.Errorf("failed to bind control socket %s: %w", cfg.ControlSocket, err)
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,100 @@
+package srv
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/doggydogworld/gobalancer/clock"
+)
+
+// listenerAddr returns the address of the first listener of upstream
+func listenerAddr(t *testing.T, srv *Server, upstream string) string {
+	t.Helper()
+	for _, d := range srv.downstreams() {
+		if d.Upstream == upstream {
+			return d.Addr().String()
+		}
+	}
+	t.Fatalf("no listener for %s", upstream)
+	return ""
+}
+
+func TestNewServerWithOptions(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &recordingHandler{}
+	authz := &stubAuthorizer{allowUser: "dba", queries: make(chan PolicyQuery, 10)}
+	srv, err := NewServer(
+		WithConfig(cfg),
+		WithForwarder(&dummyForwarder{WithMsg: "stub"}),
+		WithAuthorizer(authz),
+		WithLogger(slog.New(h)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go runTestServer(t, srv)
+	addr := listenerAddr(t, srv, "web")
+
+	// dba is normally denied web but the stub authorizer allows it and the stub forwarder answers
+	resp, err := newUserClient(t, "dba.crt", "dba.key").Get("https://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(body)) != "stub" {
+		t.Errorf("expected the stub forwarder to answer got %q", body)
+	}
+	if q := <-authz.queries; q.User != "dba" || q.Upstream != "web" {
+		t.Errorf("unexpected query %+v", q)
+	}
+	if _, err := newUserClient(t, "sre.crt", "sre.key").Get("https://" + addr); err == nil {
+		t.Error("expected sre to be denied by the stub authorizer")
+	}
+	if len(h.find("listener_bound")) == 0 {
+		t.Error("expected the server to log to the supplied logger")
+	}
+}
+
+func TestNewServerWithClock(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client certificates have expired by then
+	srv, err := NewServer(
+		WithConfig(cfg),
+		WithForwarder(&dummyForwarder{WithMsg: "stub"}),
+		WithClock(clock.NewFake(time.Date(2040, 1, 1, 0, 0, 0, 0, time.UTC))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go runTestServer(t, srv)
+	if _, err := newUserClient(t, "sre.crt", "sre.key").Get("https://" + listenerAddr(t, srv, "web")); err == nil {
+		t.Error("expected a certificate that expired by the server's clock to be refused")
+	}
+}
+
+func TestNewServerOptionErrors(t *testing.T) {
+	if _, err := NewServer(WithForwarder(&dummyForwarder{})); err == nil {
+		t.Error("expected a server without a config to fail")
+	}
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServer(WithConfig(cfg), WithForwarder(&dummyForwarder{}), WithDialer(&net.Dialer{})); err == nil {
+		t.Error("expected a dialer to be refused with a custom forwarder")
+	}
+}
@@ -1,53 +1,232 @@
 package srv
 
 import (
+	"cmp"
+	"crypto/x509"
+	"encoding/asn1"
 	"errors"
+	"fmt"
 	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/doggydogworld/gobalancer/clock"
 	"github.com/doggydogworld/gobalancer/config"
 )
 
+// Authorizer decides whether an authenticated client may access an upstream.
+// The built-in implementation is the tag based policyEnforcer but embedders can
+// supply their own e.g. one that delegates the decision to an external policy service.
+//
+// Implementations must be safe for concurrent use.
+type Authorizer interface {
+	// Authorize returns true if the query should be allowed.
+	// An error means no decision could be made and the connection will be refused.
+	Authorize(q PolicyQuery) (bool, error)
+}
+
+// PolicyQuery holds everything known about a client at authorization time
+type PolicyQuery struct {
+	// User is the CN of the client certificate
+	User string
+	// OUs are the organizational units of the client certificate
+	OUs []string
+	// Upstream is the name of the upstream the client is attempting to access
+	Upstream string
+	// RemoteAddr is the network address of the client
+	RemoteAddr net.Addr
+	// Certificate is the verified leaf certificate of the client
+	Certificate *x509.Certificate
+	// CertFingerprint is the SHA-256 fingerprint of Certificate when LogCertFingerprints is set, empty otherwise
+	CertFingerprint string
+}
+
 type policyEnforcer struct {
 	upstreamTags map[string][]string
-	logger       *slog.Logger
-	mu           sync.RWMutex
+	// extensions holds the certificate extension required by an upstream if it has one
+	extensions map[string]*requiredExtension
+	// maxCertAge holds how long ago the certificate of a client of an upstream may have been issued if it is limited
+	maxCertAge map[string]time.Duration
+	// clock is used for the certificate age. Defaults to the real clock when nil.
+	clock  clock.Clock
+	logger *slog.Logger
+	mu     sync.RWMutex
 }
 
-type policyQuery struct {
-	user     string
-	ou       string
-	upstream string
+// requiredExtension is a parsed config.CertExtension
+type requiredExtension struct {
+	oid    asn1.ObjectIdentifier
+	values []string
 }
 
-func newPolicyEnforcerFromConfig(cfg *config.Config) *policyEnforcer {
+func newPolicyEnforcerFromConfig(cfg *config.Config) (*policyEnforcer, error) {
 	m := map[string][]string{}
+	extensions := map[string]*requiredExtension{}
+	maxCertAge := map[string]time.Duration{}
 	logger := slog.Default().WithGroup("audit")
 	for _, v := range cfg.Upstreams {
 		m[v.Name] = v.Tags
+		if age := cmp.Or(v.MaxClientCertAge, cfg.MaxClientCertAge); age > 0 {
+			maxCertAge[v.Name] = age
+		}
+		if v.RequiredCertExtension != nil {
+			ext, err := parseRequiredExtension(v.RequiredCertExtension)
+			if err != nil {
+				return nil, fmt.Errorf("upstream %s: %w", v.Name, err)
+			}
+			extensions[v.Name] = ext
+		}
 	}
 	return &policyEnforcer{
 		upstreamTags: m,
+		extensions:   extensions,
+		maxCertAge:   maxCertAge,
 		logger:       logger,
+	}, nil
+}
+
+func parseRequiredExtension(cfg *config.CertExtension) (*requiredExtension, error) {
+	oid, err := parseOID(cfg.OID)
+	if err != nil {
+		return nil, fmt.Errorf("RequiredCertExtension %w", err)
+	}
+	return &requiredExtension{oid: oid, values: cfg.Values}, nil
+}
+
+// parseOID parses an OID in dotted form e.g. 1.3.6.1.4.1.99999.1
+func parseOID(dotted string) (asn1.ObjectIdentifier, error) {
+	var oid asn1.ObjectIdentifier
+	for _, arc := range strings.Split(dotted, ".") {
+		n, err := strconv.Atoi(arc)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("OID %q is not a dotted OID", dotted)
+		}
+		oid = append(oid, n)
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("OID %q is not a dotted OID", dotted)
 	}
+	return oid, nil
+}
+
+// allows reports if the certificate carries the extension with an allowed value
+func (r *requiredExtension) allows(crt *x509.Certificate) bool {
+	value, ok := extensionValue(crt, r.oid)
+	return ok && slices.Contains(r.values, value)
 }
 
-func (p *policyEnforcer) query(q policyQuery) (bool, error) {
+// extensionValue returns the value of the certificate extension oid and false if the certificate doesn't have it.
+// Extensions holding an ASN.1 string are read as the string and anything else as its raw DER bytes.
+func extensionValue(crt *x509.Certificate, oid asn1.ObjectIdentifier) (string, bool) {
+	if crt == nil {
+		return "", false
+	}
+	for _, ext := range crt.Extensions {
+		if !ext.Id.Equal(oid) {
+			continue
+		}
+		var str string
+		if rest, err := asn1.Unmarshal(ext.Value, &str); err == nil && len(rest) == 0 {
+			return str, true
+		}
+		return string(ext.Value), true
+	}
+	return "", false
+}
+
+// newListenerPolicy returns the policy for a listener. Listeners that override the tags of their
+// upstream get their own policy while the others share the policy built from the upstreams.
+func newListenerPolicy(cfg *config.Listener, shared *policyEnforcer) *policyEnforcer {
+	if len(cfg.Tags) == 0 {
+		return shared
+	}
+	m := map[string][]string{cfg.Upstream: cfg.Tags}
+	for _, route := range cfg.ALPN {
+		m[route.Upstream] = cfg.Tags
+	}
+	return &policyEnforcer{
+		upstreamTags: m,
+		// Only the tags are overridden, required extensions and certificate ages still apply
+		extensions: shared.extensions,
+		maxCertAge: shared.maxCertAge,
+		clock:      shared.clock,
+		logger:     shared.logger,
+	}
+}
+
+// reload replaces the policy with next under the write lock so every authorization sees either the old or the
+// new policy. Listener policies that override the tags of their upstream keep their tags.
+func (p *policyEnforcer) reload(next *policyEnforcer, keepTags bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !keepTags {
+		p.upstreamTags = next.upstreamTags
+	}
+	p.extensions = next.extensions
+	p.maxCertAge = next.maxCertAge
+}
+
+// tagMatches reports if an OU matches a tag. Tags match exactly unless they end in ".*" which matches
+// any OU below the prefix in the dot separated hierarchy, e.g. "team.web.*" matches "team.web.frontend"
+// and "team.web.frontend.cdn" but not "team.web" itself or "team.webhooks". Nothing else is a wildcard.
+func tagMatches(tag string, ou string) bool {
+	if prefix, ok := strings.CutSuffix(tag, "*"); ok && strings.HasSuffix(prefix, ".") {
+		return len(ou) > len(prefix) && strings.HasPrefix(ou, prefix)
+	}
+	return tag == ou
+}
+
+// Authorize grants access if the primary (first) OU of the client matches a tag of the upstream
+// and the client certificate has the extension the upstream requires if it requires one
+// and was issued within the maximum certificate age if there is one.
+func (p *policyEnforcer) Authorize(q PolicyQuery) (bool, error) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	tags, ok := p.upstreamTags[q.upstream]
+	tags, ok := p.upstreamTags[q.Upstream]
 	if !ok {
 		return false, errors.New("upstream wasn't found in config")
 	}
+	if ext, ok := p.extensions[q.Upstream]; ok && !ext.allows(q.Certificate) {
+		p.logDenied(q, "reason", "missing required certificate extension")
+		return false, nil
+	}
+	// Without a certificate, e.g. for Server.Authorize, there is no age to check
+	if maxAge, ok := p.maxCertAge[q.Upstream]; ok && q.Certificate != nil && clock.Or(p.clock).Now().Sub(q.Certificate.NotBefore) > maxAge {
+		p.logDenied(q, "reason", "certificate older than maximum age", "issued", q.Certificate.NotBefore, "max_age", maxAge)
+		return false, nil
+	}
 
-	for _, t := range tags {
-		// Attempt to find ou in tags
-		if t == q.ou {
-			return true, nil
+	if len(q.OUs) > 0 {
+		for _, t := range tags {
+			// Attempt to find ou in tags
+			if tagMatches(t, q.OUs[0]) {
+				return true, nil
+			}
 		}
 	}
 
-	p.logger.Info("access_denied", "user", q.user, "upstream", q.upstream)
+	p.logDenied(q)
 	// Deny by default
 	return false, nil
 }
+
+// tags returns the tags clients of upstream are authorized by and false if it isn't in the policy
+func (p *policyEnforcer) tags(upstream string) ([]string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	tags, ok := p.upstreamTags[upstream]
+	return slices.Clone(tags), ok
+}
+
+// logDenied writes the access_denied audit event for q with any extra attributes
+func (p *policyEnforcer) logDenied(q PolicyQuery, attrs ...any) {
+	attrs = append([]any{"user", q.User, "upstream", q.Upstream}, attrs...)
+	if q.CertFingerprint != "" {
+		attrs = append(attrs, "cert_fingerprint", q.CertFingerprint)
+	}
+	p.logger.Info("access_denied", attrs...)
+}
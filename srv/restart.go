@@ -0,0 +1,161 @@
+package srv
+
+import (
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/doggydogworld/gobalancer/config"
+)
+
+// downstreams returns the current listeners, which RestartListener may replace while the server runs
+func (s *Server) downstreams() []*DownstreamListener {
+	s.downstreamsMu.Lock()
+	defer s.downstreamsMu.Unlock()
+	return s.Downstreams
+}
+
+// RestartListener replaces the listeners of upstream with ones bound from cfg, e.g. to move a listener to another
+// address or change its settings without restarting the server. Every address of the old listener is replaced
+// by the addresses of cfg. An address the old listener is already bound to keeps its socket so clients aren't
+// refused while it is swapped. The new listeners take connections straight away and the old ones drain like
+// Drain, leaving the other listeners alone. Nothing changes when cfg can't be bound.
+// The new listeners keep the server wide settings, forwarder and custom authorizer of the ones they replace.
+func (s *Server) RestartListener(upstream string, cfg *config.Listener) error {
+	if cfg.Upstream != upstream {
+		return fmt.Errorf("listener config is for upstream %s not %s", cfg.Upstream, upstream)
+	}
+	s.downstreamsMu.Lock()
+	defer s.downstreamsMu.Unlock()
+	select {
+	case <-s.drainChan():
+		return fmt.Errorf("can't restart the listener for upstream %s while draining", upstream)
+	default:
+	}
+	var old []*DownstreamListener
+	first := -1
+	for i, d := range s.Downstreams {
+		// Only listeners built from a config can be built again
+		if d.Upstream == upstream && d.cfg != nil {
+			old = append(old, d)
+			if first < 0 {
+				first = i
+			}
+		}
+	}
+	if len(old) == 0 {
+		return fmt.Errorf("no listener for upstream %s", upstream)
+	}
+
+	var next []*DownstreamListener
+	for _, bind := range listenerBindings(cfg) {
+		socket, err := rebindSocket(bind, old)
+		if err != nil {
+			for _, d := range next {
+				d.socket.Close()
+			}
+			return fmt.Errorf("failed to bind listener %s for upstream %s: %w", bind.Addr, upstream, err)
+		}
+		next = append(next, s.replaceListener(old[0], bind, cfg, socket))
+	}
+
+	downstreams := slices.DeleteFunc(slices.Clone(s.Downstreams), func(d *DownstreamListener) bool {
+		return slices.Contains(old, d)
+	})
+	s.Downstreams = slices.Insert(downstreams, first, next...)
+	for _, d := range next {
+		if s.startListener != nil {
+			s.startListener(d)
+		}
+	}
+	// The new listeners take over the token buckets of the clients of the first old listener when they override
+	// the rate limit too. Nothing uses the buckets of the others anymore.
+	for _, d := range old {
+		f, ok := d.fwdr.(rateLimitForgetter)
+		if ok && (cfg.RateLimit == nil || d.rateLimitID != old[0].rateLimitID) {
+			f.ForgetRateLimit(d.rateLimitID)
+		}
+	}
+	for _, d := range old {
+		d.logger.Info("listener_replaced", "addr", d.Addr().String(), "upstream", upstream)
+		close(d.retire)
+		if s.startListener == nil {
+			d.listener.Close()
+		}
+	}
+	return nil
+}
+
+// rateLimitForgetter is implemented by forwarders that keep the token buckets of a listener's rate limit override
+type rateLimitForgetter interface {
+	ForgetRateLimit(id string)
+}
+
+// rebindSocket binds the socket for bind. When one of the old listeners is bound to the same address its socket is
+// duplicated instead, since the address can't be bound again while the old listener drains.
+func rebindSocket(bind *config.Listener, old []*DownstreamListener) (net.Listener, error) {
+	if bind.FD == 0 {
+		for _, d := range old {
+			d.mu.Lock()
+			socket := d.socket
+			d.mu.Unlock()
+			if socket.Addr().String() != bind.Addr || d.cfg.ReusePort != bind.ReusePort {
+				continue
+			}
+			f, err := listenerFile(socket)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			return net.FileListener(f)
+		}
+	}
+	return listen(bind)
+}
+
+// replaceListener builds the listener for bind that replaces old. cfg is the listener config bind is one
+// address of. Everything shared by the listeners of the server is taken from old.
+func (s *Server) replaceListener(old *DownstreamListener, bind *config.Listener, cfg *config.Listener, socket net.Listener) *DownstreamListener {
+	// A custom authorizer replaces the built in policy for the listener whatever its config
+	authorizer := old.Authorizer
+	if _, ok := authorizer.(*policyEnforcer); ok && old.policy != nil {
+		authorizer = newListenerPolicy(cfg, old.policy)
+	}
+	policy := old.failurePolicy
+	if s.cfg != nil {
+		policy = failurePolicy(s.cfg, cfg)
+	} else if cfg.FailurePolicy != nil {
+		policy = *cfg.FailurePolicy
+	}
+	// The ALPN protocols of the old listener are replaced with the ones of cfg
+	tlsConf := old.tlsConf.Clone()
+	tlsConf.NextProtos = nil
+	d := &DownstreamListener{
+		Upstream:         cfg.Upstream,
+		Authorizer:       authorizer,
+		failOpen:         old.failOpen,
+		logFingerprints:  old.logFingerprints,
+		fwdr:             old.fwdr,
+		emptyCNPolicy:    old.emptyCNPolicy,
+		rateLimitKey:     old.rateLimitKey,
+		queuedPolicy:     old.queuedPolicy,
+		drainTimeout:     old.drainTimeout,
+		handshakeTimeout: old.handshakeTimeout,
+		handshakeLimiter: old.handshakeLimiter,
+		handshakeErrors:  old.handshakeErrors,
+		tlsStats:         old.tlsStats,
+		rejections:       old.rejections,
+		connLimiter:      old.connLimiter,
+		tiers:            old.tiers,
+		logger:           old.logger,
+		socket:           socket,
+		cfg:              bind,
+		tlsConf:          listenerTLSConfig(tlsConf, cfg),
+		failurePolicy:    policy,
+		retire:           make(chan struct{}),
+		policy:           old.policy,
+		rateLimitID:      old.rateLimitID,
+	}
+	d.listener = d.newTLSListener(socket)
+	return d
+}
@@ -0,0 +1,204 @@
+package srv
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/doggydogworld/gobalancer/config"
+	"github.com/doggydogworld/gobalancer/forwarder"
+)
+
+// finishRequest sends the request the dummy forwarder waits for on conn and checks it answers with upstream
+func finishRequest(t *testing.T, conn net.Conn, upstream string) {
+	t.Helper()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\n"); err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(body), upstream) {
+		t.Errorf("expected a response from %s got %q", upstream, body)
+	}
+}
+
+func TestRestartListener(t *testing.T) {
+	srv, upstream := newTestServer(t)
+	injectDummyForwarders(srv)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(ctx) }()
+	client := newUserClient(t, "sre.crt", "sre.key")
+	tlsConf := client.Transport.(*http.Transport).TLSClientConfig
+
+	// Connections in progress on the listener being restarted and on another listener
+	web, err := tls.Dial("tcp", upstream["web"], tlsConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer web.Close()
+	db, err := tls.Dial("tcp", upstream["db"], tlsConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := srv.RestartListener("web", &config.Listener{Addr: "127.0.0.1:0", Upstream: "web"}); err != nil {
+		t.Fatal(err)
+	}
+	moved := listenerAddr(t, srv, "web")
+	if moved == upstream["web"] {
+		t.Fatalf("expected the web listener to move from %s", moved)
+	}
+	if got := len(srv.downstreams()); got != 3 {
+		t.Fatalf("expected the restarted listener to replace the old one got %d listeners", got)
+	}
+	get := func(addr string, upstream string) {
+		t.Helper()
+		resp, err := client.Get("https://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(body)) != upstream {
+			t.Fatalf("expected '%s' got %s", upstream, body)
+		}
+	}
+	get(moved, "web")
+	get(upstream["db"], "db")
+
+	// Both connections carry on, the one on the old listener drains rather than being cut off
+	finishRequest(t, web, "web")
+	finishRequest(t, db, "db")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", upstream["web"])
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("old listener kept accepting connections after it was replaced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Restarting on the same address keeps the socket so it can't fail to bind it
+	web, err = tls.Dial("tcp", moved, tlsConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer web.Close()
+	if err := srv.RestartListener("web", &config.Listener{Addr: moved, Upstream: "web"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := listenerAddr(t, srv, "web"); got != moved {
+		t.Fatalf("expected the web listener to stay on %s got %s", moved, got)
+	}
+	finishRequest(t, web, "web")
+	get(moved, "web")
+
+	if err := srv.RestartListener("web", &config.Listener{Addr: "127.0.0.1:0", Upstream: "db"}); err == nil {
+		t.Error("expected a config for another upstream to be rejected")
+	}
+	if err := srv.RestartListener("missing", &config.Listener{Addr: "127.0.0.1:0", Upstream: "missing"}); err == nil {
+		t.Error("expected restarting a listener that doesn't exist to fail")
+	}
+	select {
+	case err := <-errc:
+		t.Fatalf("server stopped while a listener was restarted: %v", err)
+	default:
+	}
+}
+
+// errForwarder records why each connection Forward was called with ended
+type errForwarder struct {
+	next Forwarder
+	errs chan error
+}
+
+func (e *errForwarder) Forward(ctx context.Context, info forwarder.FwdInfo) error {
+	err := e.next.Forward(ctx, info)
+	e.errs <- err
+	return err
+}
+
+func TestRestartListenerKeepsRateLimit(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each listener config gets its own copy of the same settings
+	throttled := func() *config.RateLimit {
+		return &config.RateLimit{TokenRefillPerSecond: 0.001, MaxTokens: 1}
+	}
+	cfg.Listeners[0].RateLimit = throttled()
+	cfg.Upstreams[0].FailFastWhenNotReady = true
+	srv, _ := newTestServerWithConfig(t, cfg)
+	fwdr := srv.Forwarder.(*forwarder.LeastConnections)
+	defer fwdr.Close(context.Background())
+	rec := &errForwarder{next: fwdr, errs: make(chan error, 1)}
+	srv.Downstreams[0].fwdr = rec
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(ctx) }()
+	defer func() {
+		cancel()
+		<-errc
+	}()
+
+	tlsConf := newUserClient(t, "sre.crt", "sre.key").Transport.(*http.Transport).TLSClientConfig
+	// web has no backends so a connection the rate limit lets through is rejected as not ready instead
+	connect := func(limited bool) {
+		t.Helper()
+		conn, err := tls.Dial("tcp", listenerAddr(t, srv, "web"), tlsConf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(conn)
+		conn.Close()
+		err = <-rec.errs
+		if got := err != nil && strings.Contains(err.Error(), "rate limit"); got != limited {
+			t.Errorf("expected rate limited %t got %v", limited, err)
+		}
+	}
+	connect(false)
+	connect(true)
+
+	// The restarted listener is built from a new config with the same settings
+	if err := srv.RestartListener("web", &config.Listener{Addr: "127.0.0.1:0", Upstream: "web", RateLimit: throttled()}); err != nil {
+		t.Fatal(err)
+	}
+	connect(true)
+
+	// New settings start from a full bucket
+	if err := srv.RestartListener("web", &config.Listener{Addr: "127.0.0.1:0", Upstream: "web", RateLimit: &config.RateLimit{TokenRefillPerSecond: 0.001, MaxTokens: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	connect(false)
+	connect(false)
+	connect(true)
+
+	// Dropping the override drops the buckets too
+	if err := srv.RestartListener("web", &config.Listener{Addr: "127.0.0.1:0", Upstream: "web"}); err != nil {
+		t.Fatal(err)
+	}
+	connect(false)
+	if err := srv.RestartListener("web", &config.Listener{Addr: "127.0.0.1:0", Upstream: "web", RateLimit: throttled()}); err != nil {
+		t.Fatal(err)
+	}
+	connect(false)
+	connect(true)
+}
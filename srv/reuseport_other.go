@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package srv
+
+import (
+	"syscall"
+)
+
+const reusePortSupported = false
+
+// reusePortControl is a no-op on platforms without SO_REUSEPORT
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,39 @@
+//go:build linux
+
+package srv
+
+import (
+	"testing"
+)
+
+func TestReusePortListeners(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listeners[0].ReusePort = true
+	first, err := NewDownstreamListeners(cfg, &mustNotForwarder{t: t})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, d := range first {
+			d.listener.Close()
+		}
+	}()
+
+	// A second set of listeners can bind the exact same address
+	cfg.Listeners = cfg.Listeners[:1]
+	cfg.Listeners[0].Addr = first[0].listener.Addr().String()
+	second, err := NewDownstreamListeners(cfg, &mustNotForwarder{t: t})
+	if err != nil {
+		t.Fatalf("expected SO_REUSEPORT to allow binding the same address: %v", err)
+	}
+	second[0].listener.Close()
+
+	// Without the option the bind fails
+	cfg.Listeners[0].ReusePort = false
+	if _, err := NewDownstreamListeners(cfg, &mustNotForwarder{t: t}); err == nil {
+		t.Fatal("expected bind to fail without SO_REUSEPORT")
+	}
+}
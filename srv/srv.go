@@ -1,21 +1,43 @@
 package srv
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/doggydogworld/gobalancer/clock"
 	"github.com/doggydogworld/gobalancer/config"
 	"github.com/doggydogworld/gobalancer/forwarder"
 	"golang.org/x/sync/errgroup"
 )
 
+var (
+	ErrHandshakeRateLimited = errors.New("handshake rate limit exceeded")
+	ErrUnauthorized         = errors.New("user is not authorized to access resource")
+)
+
+// errDrainTimeout cancels queued connections that are still being served when the drain timeout passes
+var errDrainTimeout = errors.New("queued connection drain timeout passed")
+
+// defaultHandshakeTimeout bounds the TLS handshake when no timeout is configured
+const defaultHandshakeTimeout = 5 * time.Second
+
+// defaultQueuedDrainTimeout bounds connections served after shutdown when no timeout is configured
+const defaultQueuedDrainTimeout = 30 * time.Second
+
 type Forwarder interface {
 	Forward(ctx context.Context, info forwarder.FwdInfo) error
 }
@@ -23,28 +45,87 @@ type Forwarder interface {
 // newTLSConfig generates TLS configuration that uses modern best practices from a given config
 // TODO: Consider adding support PKCS12
 func newTLSConfig(cfg *config.Config) (*tls.Config, error) {
-	p := x509.NewCertPool()
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	// advertised is every certificate of RootCA so clients issued by an intermediate pick their certificate.
+	// It is only sent to clients, nothing is verified against it.
+	advertised := x509.NewCertPool()
 
-	pemBlock, _ := pem.Decode(cfg.RootCA)
+	// RootCA may be a chain of a root followed by intermediates so clients issued by an intermediate
+	// verify without having to present the intermediate themselves. Only self-signed roots are trusted,
+	// intermediates are only used to build a chain to one of them.
+	pemBlock, rest := pem.Decode(cfg.RootCA)
 	if pemBlock == nil {
-		return &tls.Config{}, errors.New("no pem data found in configured rootCA")
+		return &tls.Config{}, errors.New("RootCA is not valid PEM")
 	}
-	caCrt, err := x509.ParseCertificate(pemBlock.Bytes)
-	if err != nil {
-		return &tls.Config{}, err
+	hasRoot := false
+	for pemBlock != nil {
+		caCrt, err := x509.ParseCertificate(pemBlock.Bytes)
+		if err != nil {
+			return &tls.Config{}, fmt.Errorf("RootCA is not a valid certificate: %w", err)
+		}
+		advertised.AddCert(caCrt)
+		if isSelfSigned(caCrt) {
+			roots.AddCert(caCrt)
+			hasRoot = true
+		} else {
+			intermediates.AddCert(caCrt)
+		}
+		pemBlock, rest = pem.Decode(rest)
+	}
+	if !hasRoot {
+		return &tls.Config{}, errors.New("RootCA has no self-signed root certificate")
 	}
-	p.AddCert(caCrt)
 	crt, err := tls.X509KeyPair(cfg.ServerCrt, cfg.ServerKey)
 	if err != nil {
-		return &tls.Config{}, err
+		return &tls.Config{}, fmt.Errorf("failed to load ServerCrt and ServerKey, check both are valid PEM and are a matching pair: %w", err)
 	}
-	return &tls.Config{
-		MinVersion:   tls.VersionTLS13,
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		RootCAs:      p,
-		ClientCAs:    p,
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		// The chain is verified by VerifyConnection so the intermediates of RootCA can be used without trusting them
+		ClientAuth:   tls.RequireAnyClientCert,
+		RootCAs:      roots,
+		ClientCAs:    advertised,
 		Certificates: []tls.Certificate{crt},
-	}, nil
+		// crypto/tls servers refuse 0-RTT early data whatever this is set to
+		SessionTicketsDisabled: cfg.DisableTLSResumption,
+	}
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		now := time.Now
+		// Time may be set after the config is created e.g. by WithClock
+		if conf.Time != nil {
+			now = conf.Time
+		}
+		return verifyClientChain(cs.PeerCertificates, roots, intermediates, now())
+	}
+	return conf, nil
+}
+
+// isSelfSigned reports if a certificate is a root that issued itself
+func isSelfSigned(crt *x509.Certificate) bool {
+	return bytes.Equal(crt.RawIssuer, crt.RawSubject) && crt.CheckSignatureFrom(crt) == nil
+}
+
+// verifyClientChain verifies a client certificate chains to one of roots through the intermediates it presented
+// or the ones configured in RootCA, the way crypto/tls would verify it against ClientCAs
+func verifyClientChain(peer []*x509.Certificate, roots *x509.CertPool, intermediates *x509.CertPool, now time.Time) error {
+	if len(peer) == 0 {
+		return errors.New("client didn't present a certificate")
+	}
+	pool := intermediates.Clone()
+	for _, crt := range peer[1:] {
+		pool.AddCert(crt)
+	}
+	_, err := peer[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: pool,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to verify client certificate: %w", err)
+	}
+	return nil
 }
 
 // DownstreamListener binds to an address and listens for connections to forward
@@ -54,104 +135,597 @@ type DownstreamListener struct {
 	// Policy enforcement and forwarding will need this value
 	Upstream string
 
-	// The authz component. All requests will need to pass a query to this.
-	policy *policyEnforcer
+	// Authorizer is the authz component. All requests will need to pass a query to this.
+	// Defaults to a tag based policy built from the config.
+	Authorizer Authorizer
+	// failOpen allows connections when a custom Authorizer errors rather than denying them.
+	// Errors from the built-in policy always deny as they mean the config is broken.
+	failOpen bool
+	// logFingerprints adds the fingerprint of the client certificate to the identity and the audit log
+	logFingerprints bool
+
 	// listener is an bound socket that is ready to accept connections
 	listener net.Listener
+	// socket is the listener without TLS and is used to hand the socket to another process
+	socket net.Listener
+	// mu guards listener and socket being replaced when the listener is restarted
+	mu sync.Mutex
+	// cfg and tlsConf are kept to re-bind the listener
+	cfg     *config.Listener
+	tlsConf *tls.Config
+	// failurePolicy decides whether a failed listener stops the server or is restarted
+	failurePolicy config.ListenerFailurePolicy
+	// restarts counts the times the listener was re-bound after failing
+	restarts atomic.Int64
 	// fwdr allows l4 forwarding for open connections
 	fwdr Forwarder
+	// emptyCNPolicy decides how clients without a CommonName are identified
+	emptyCNPolicy config.EmptyCommonNamePolicy
+	// rateLimitKey decides what the token bucket of a client is keyed by
+	rateLimitKey config.RateLimitKey
+	// queuedPolicy decides what to do with connections accepted during shutdown
+	queuedPolicy config.QueuedConnPolicy
+	// drainTimeout bounds how long a queued connection is served for after shutdown
+	drainTimeout time.Duration
+	// handshakeTimeout bounds the TLS handshake regardless of the deadline of the connection.
+	// It is always set, to defaultHandshakeTimeout when the config doesn't.
+	handshakeTimeout time.Duration
+	// queued tracks queued connections that are still being served so serve can wait for them
+	queued sync.WaitGroup
+	// active tracks connections being handled so a drained listener can wait for them to close
+	active sync.WaitGroup
+	// drain is closed to stop accepting connections while letting the active ones finish.
+	// A nil channel never drains.
+	drain chan struct{}
+	// retire is closed to drain only this listener once RestartListener has replaced it.
+	// A nil channel never retires.
+	retire chan struct{}
+	// policy is the built in policy shared by every listener, kept to authorize the listener that replaces this one
+	policy *policyEnforcer
+	// rateLimitID names the RateLimit of the listener to the forwarder so clients keep their token buckets when
+	// the listener is replaced. It is the upstream and first address the listener bound and is handed down to the
+	// listener replacing it.
+	rateLimitID string
+	// handshakeLimiter is shared by all listeners and rejects connections before the handshake.
+	// A nil limiter allows all handshakes.
+	handshakeLimiter *handshakeLimiter
+	// handshakeErrors is shared by all listeners and samples the logs of failed handshakes.
+	// A nil sampler logs every failure.
+	handshakeErrors *handshakeErrorSampler
+	// tlsStats is shared by all listeners and counts the negotiated TLS versions and cipher suites
+	tlsStats *tlsStats
+	// rejections is shared by all listeners and counts connections that failed the handshake or authorization
+	rejections *rejections
+	// connLimiter is shared by all listeners and caps the connections open across them.
+	// A nil limiter allows any number of connections.
+	connLimiter *connLimiter
+	// tiers is shared by all listeners and picks the rate limit of a client by its certificate.
+	// Without tiers every client of the listener gets the listener's rate limit.
+	tiers *rateLimitTiers
 
 	logger *slog.Logger
 }
 
 // Server is a set of downstream listeners that are ready to forward connections using a LCU load balancer
 type Server struct {
+	// Downstreams is replaced rather than modified by RestartListener
 	Downstreams []*DownstreamListener
 	Forwarder   Forwarder
+	// Logger receives the startup events. Defaults to slog.Default().
+	Logger *slog.Logger
+	// Reload is run by the reload control command e.g. to re-read the config and load it into the forwarder.
+	// The command fails when it is nil.
+	Reload func() error
+	// debug serves diagnostics when enabled in the config
+	debug *debugServer
+	// control accepts commands on a Unix socket when enabled in the config
+	control *controlServer
+	// cfg is the config the server was created from, kept for EffectiveConfig
+	cfg *config.Config
+	// downstreamsMu guards Downstreams being replaced by RestartListener and startListener
+	downstreamsMu sync.Mutex
+	// startListener serves a listener alongside the others while ListenAndServe is running and is nil otherwise
+	startListener func(d *DownstreamListener)
+	// drain is closed by Drain and created on first use so a Server literal can be drained
+	drain     chan struct{}
+	drainMu   sync.Mutex
+	drainOnce sync.Once
 }
 
 // NewDownstreamListenersFromCfg is a helper function that initializes multiple listeners and returns them
 // Use this in combination with `StartDownstreamListeners` to concurrently start all listeners
 func NewDownstreamListeners(cfg *config.Config, fwdr Forwarder) ([]*DownstreamListener, error) {
-	logger := slog.Default()
+	return newDownstreamListeners(cfg, fwdr, slog.Default(), nil)
+}
+
+// newDownstreamListeners is NewDownstreamListeners logging to logger and checking certificates against clk
+// instead of the real clock when it is set
+func newDownstreamListeners(cfg *config.Config, fwdr Forwarder, logger *slog.Logger, clk clock.Clock) ([]*DownstreamListener, error) {
 	d := []*DownstreamListener{}
-	policy := newPolicyEnforcerFromConfig(cfg)
+	policy, err := newPolicyEnforcerFromConfig(cfg)
+	if err != nil {
+		return d, err
+	}
+	policy.logger = logger.WithGroup("audit")
+	policy.clock = clk
+	var handshakeLimiter *handshakeLimiter
+	if cfg.HandshakeRateLimit != nil {
+		handshakeLimiter = newHandshakeLimiter(cfg.HandshakeRateLimit, logger)
+	}
+	var handshakeErrors *handshakeErrorSampler
+	if cfg.HandshakeErrorLog != nil {
+		handshakeErrors = newHandshakeErrorSampler(cfg.HandshakeErrorLog, logger)
+	}
+	stats := newTLSStats()
+	rejections := newRejections()
+	var tiers *rateLimitTiers
+	if cfg.RateLimitTiers != nil {
+		if tiers, err = newRateLimitTiers(cfg.RateLimitTiers); err != nil {
+			return d, err
+		}
+	}
+	var limiter *connLimiter
+	if cfg.MaxConnections > 0 {
+		limiter = newConnLimiter(cfg.MaxConnections, cfg.MaxConnectionsPolicy)
+	}
+	drainTimeout := cfg.QueuedDrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = defaultQueuedDrainTimeout
+	}
+	handshakeTimeout := cfg.HandshakeTimeout
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = defaultHandshakeTimeout
+	}
 	tlsConf, err := newTLSConfig(cfg)
 	if err != nil {
 		return d, err
 	}
+	if clk != nil {
+		tlsConf.Time = clk.Now
+	}
 	for _, v := range cfg.Listeners {
-		l, err := tls.Listen("tcp", v.Addr, tlsConf)
-		if err != nil {
-			return d, err
+		listenerTLS := listenerTLSConfig(tlsConf, v)
+		// The addresses of a listener share its policy
+		authorizer := newListenerPolicy(v, policy)
+		rateLimitID := ""
+		for _, bind := range listenerBindings(v) {
+			socket, err := listen(bind)
+			if err != nil {
+				// Don't leak the sockets that were already bound
+				for _, bound := range d {
+					bound.listener.Close()
+				}
+				return []*DownstreamListener{}, fmt.Errorf("failed to bind listener %s for upstream %s: %w", bind.Addr, v.Upstream, err)
+			}
+			// Bound addresses are unique unlike configured ones such as port 0
+			if rateLimitID == "" {
+				rateLimitID = v.Upstream + "/" + socket.Addr().String()
+			}
+			dl := &DownstreamListener{
+				Upstream:         v.Upstream,
+				Authorizer:       authorizer,
+				failOpen:         cfg.AuthorizerFailOpen,
+				logFingerprints:  cfg.LogCertFingerprints,
+				fwdr:             fwdr,
+				emptyCNPolicy:    cfg.EmptyCommonNamePolicy,
+				rateLimitKey:     cfg.RateLimitKey,
+				queuedPolicy:     cfg.QueuedConnPolicy,
+				drainTimeout:     drainTimeout,
+				handshakeTimeout: handshakeTimeout,
+				handshakeLimiter: handshakeLimiter,
+				handshakeErrors:  handshakeErrors,
+				tlsStats:         stats,
+				rejections:       rejections,
+				connLimiter:      limiter,
+				tiers:            tiers,
+				logger:           logger,
+				socket:           socket,
+				cfg:              bind,
+				tlsConf:          listenerTLS,
+				failurePolicy:    failurePolicy(cfg, v),
+				retire:           make(chan struct{}),
+				policy:           policy,
+				rateLimitID:      rateLimitID,
+			}
+			dl.listener = dl.newTLSListener(socket)
+			d = append(d, dl)
 		}
-		d = append(d, &DownstreamListener{
-			Upstream: v.Upstream,
-			fwdr:     fwdr,
-			policy:   policy,
-			logger:   logger,
-			listener: l,
-		})
 	}
 	return d, nil
 }
 
+// listenerTLSConfig returns the TLS config of a listener which is base advertising the ALPN protocols it routes by
+func listenerTLSConfig(base *tls.Config, l *config.Listener) *tls.Config {
+	if len(l.ALPN) == 0 {
+		return base
+	}
+	tlsConf := base.Clone()
+	// The server picks the first protocol it advertises that the client offers so the config order is the preference
+	for _, route := range l.ALPN {
+		tlsConf.NextProtos = append(tlsConf.NextProtos, route.Protocol)
+	}
+	return tlsConf
+}
+
+// listenerBindings splits a listener config into one config per address it binds.
+// Everything but the address is shared, including the RateLimit the forwarder keys its token buckets by.
+func listenerBindings(l *config.Listener) []*config.Listener {
+	if len(l.Addrs) == 0 {
+		return []*config.Listener{l}
+	}
+	var binds []*config.Listener
+	for _, addr := range l.ListenAddrs() {
+		bind := *l
+		bind.Addr = addr
+		bind.Addrs = nil
+		binds = append(binds, &bind)
+	}
+	return binds
+}
+
+// NewServerFromCfg creates a server with the listeners, policy and forwarder described by cfg.
+// It is NewServer with only WithConfig.
 func NewServerFromCfg(cfg *config.Config) (*Server, error) {
-	fwdr, err := forwarder.NewLeastConnectionsFromConfig(context.Background(), cfg)
-	if err != nil {
-		return &Server{}, err
+	return NewServer(WithConfig(cfg))
+}
+
+// ListenerFiles returns duplicates of the listening sockets in the same order as the listener config,
+// with one socket per address of a listener that sets Addrs.
+// Passing them to exec.Cmd.ExtraFiles in order gives listener i the descriptor 3+i in the new process
+// which can then take them over by setting FD on its listener config.
+// The caller owns the returned files and should close them once they have been handed over.
+func (s *Server) ListenerFiles() ([]*os.File, error) {
+	downstreams := s.downstreams()
+	files := make([]*os.File, 0, len(downstreams))
+	for _, d := range downstreams {
+		d.mu.Lock()
+		f, err := listenerFile(d.socket)
+		d.mu.Unlock()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// HandshakesRejected is the number of connections rejected by the handshake rate limit
+func (s *Server) HandshakesRejected() int64 {
+	for _, d := range s.downstreams() {
+		// The limiter is shared so the first one has the total
+		if d.handshakeLimiter != nil {
+			return d.handshakeLimiter.rejected.Load()
+		}
+	}
+	return 0
+}
+
+// ConnectionsRejected is the number of connections rejected because MaxConnections were already open
+func (s *Server) ConnectionsRejected() int64 {
+	for _, d := range s.downstreams() {
+		// The limiter is shared so the first one has the total
+		if d.connLimiter != nil {
+			return d.connLimiter.rejected.Load()
+		}
+	}
+	return 0
+}
+
+// NegotiatedTLS counts the TLS versions and cipher suites clients negotiated across all listeners
+func (s *Server) NegotiatedTLS() NegotiatedTLS {
+	for _, d := range s.downstreams() {
+		// The stats are shared so the first one has the total
+		if d.tlsStats != nil {
+			return d.tlsStats.snapshot()
+		}
+	}
+	return newTLSStats().snapshot()
+}
+
+// Rejections counts connections closed before they were forwarded across all listeners by the reason
+// they were closed, authz_denied, handshake_failed or protocol_error. Why forwarded connections closed is reported by the forwarder.
+func (s *Server) Rejections() map[forwarder.CloseReason]int64 {
+	for _, d := range s.downstreams() {
+		// The counts are shared so the first one has the total
+		if d.rejections != nil {
+			return d.rejections.snapshot()
+		}
 	}
-	d, err := NewDownstreamListeners(cfg, fwdr)
+	return map[forwarder.CloseReason]int64{}
+}
+
+// upstreamConfiger is implemented by forwarders that can report the config their upstreams are running with
+type upstreamConfiger interface {
+	UpstreamConfigs() []*config.Upstream
+}
+
+// EffectiveConfig returns the config the server is running with rather than the one it was started from, e.g. to
+// track down config drift. Listeners have the addresses they are bound to, one per address, and the timeouts
+// have their defaults filled in. Upstreams have the backends and settings the forwarder has loaded since startup
+// and the tags the built in policy enforces. ServerKey and backend client keys are left out.
+// It returns nil for a Server that wasn't created by NewServerFromCfg.
+func (s *Server) EffectiveConfig() *config.Config {
+	if s.cfg == nil {
+		return nil
+	}
+	cfg := *s.cfg
+	cfg.ServerKey = nil
+	cfg.Listeners = nil
+	// Listeners that don't override the tags of their upstream share the built in policy
+	var policy *policyEnforcer
+	for _, d := range s.downstreams() {
+		l := *d.cfg
+		l.Addr = d.Addr().String()
+		cfg.Listeners = append(cfg.Listeners, &l)
+		if p, ok := d.Authorizer.(*policyEnforcer); ok && len(l.Tags) == 0 {
+			policy = p
+		}
+		cfg.HandshakeTimeout = d.handshakeTimeout
+		cfg.QueuedDrainTimeout = d.drainTimeout
+	}
+	upstreams := s.cfg.Upstreams
+	if f, ok := s.Forwarder.(upstreamConfiger); ok {
+		upstreams = f.UpstreamConfigs()
+	}
+	cfg.Upstreams = nil
+	for _, v := range upstreams {
+		up := *v
+		if policy != nil {
+			if tags, ok := policy.tags(up.Name); ok {
+				up.Tags = tags
+			}
+		}
+		if up.BackendTLS != nil {
+			backendTLS := *up.BackendTLS
+			backendTLS.ClientKey = nil
+			up.BackendTLS = &backendTLS
+		}
+		cfg.Upstreams = append(cfg.Upstreams, &up)
+	}
+	return &cfg
+}
+
+// drainChan returns the channel closed by Drain
+func (s *Server) drainChan() chan struct{} {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	if s.drain == nil {
+		s.drain = make(chan struct{})
+	}
+	return s.drain
+}
+
+// Drain stops every listener accepting new connections and lets the connections being forwarded finish.
+// ListenAndServe returns nil once they have all closed. Cancel its context to close them sooner.
+func (s *Server) Drain() {
+	s.drainOnce.Do(func() { close(s.drainChan()) })
+}
+
+// SetAuthorizer replaces the authorizer on all downstream listeners including any listener tag overrides.
+// To authorize a single listener differently set Authorizer on that DownstreamListener instead.
+// This should be called before ListenAndServe.
+func (s *Server) SetAuthorizer(a Authorizer) {
+	for _, d := range s.downstreams() {
+		d.Authorizer = a
+	}
+}
+
+// ReloadPolicy replaces the built in policy with the upstream tags, required certificate extensions and maximum
+// certificate ages of cfg without touching listeners, upstreams or certificates, e.g. for frequent access changes.
+// Connections that were already authorized carry on and the next authorization uses the new policy. Listeners that
+// override the tags of their upstream keep their tags and listeners using an authorizer from SetAuthorizer are
+// left alone. Nothing changes when the policy in cfg is invalid.
+func (s *Server) ReloadPolicy(cfg *config.Config) error {
+	next, err := newPolicyEnforcerFromConfig(cfg)
 	if err != nil {
-		return &Server{}, err
+		return err
 	}
-	return &Server{
-		Downstreams: d,
-		Forwarder:   fwdr,
-	}, nil
+	// Logged the way the policy being replaced logs
+	logger := next.logger
+	for _, d := range s.downstreams() {
+		if p, ok := d.Authorizer.(*policyEnforcer); ok {
+			p.reload(next, d.cfg != nil && len(d.cfg.Tags) > 0)
+			logger = p.logger
+		}
+	}
+	logger.Info("policy_reloaded", "upstreams", len(next.upstreamTags))
+	return nil
+}
+
+// Authorize reports if a client whose certificate has the CN user and the primary OU ou would be allowed
+// to access upstream without it having to connect, e.g. for tooling to check access ahead of time.
+// The query goes to the same authorizers as the listeners serving the upstream would use right now,
+// including one set by SetAuthorizer, and access through any of those listeners allows it.
+// No certificate or address is known so upstreams that require a certificate extension are denied
+// and the maximum certificate age isn't checked.
+func (s *Server) Authorize(user string, ou string, upstream string) (bool, error) {
+	var served bool
+	for _, d := range s.downstreams() {
+		if !d.serves(upstream) {
+			continue
+		}
+		served = true
+		// Certificates without an OU are refused before the authorizer is asked
+		if ou == "" {
+			return false, nil
+		}
+		allow, err := d.authorize(PolicyQuery{User: user, OUs: []string{ou}, Upstream: upstream})
+		if err != nil {
+			return false, err
+		}
+		if allow {
+			return true, nil
+		}
+	}
+	if !served {
+		return false, fmt.Errorf("no listener serves upstream %q", upstream)
+	}
+	return false, nil
 }
 
 // verifyTLS forces the handshake to happen and verifies user authenticy and authorization.
-// Returns a user that passes authn/authz or an error if the user certificate is not verified.
+// Returns the identity of a user that passes authn/authz and the upstream the connection is routed to
+// or an error if the user certificate is not verified.
 //
 // The default implementation of TLS will only do the handshake whenever the conn is read/written to.
 // That could be problematic for our forwarder since we will take a rate limiting token if we pass it a connection that hasn't been written/read to.
-// This function will force the handshake to happen NOW and finish within 5 seconds.
-func (d *DownstreamListener) verifyTLS(ctx context.Context, conn *tls.Conn) (string, error) {
-	deadline, cancel := context.WithTimeout(ctx, 5.0*time.Second)
+// This function will force the handshake to happen NOW and finish within the handshake timeout.
+// ctx governs the whole connection so the timeout isn't derived from it. A long lived connection must not
+// get longer to handshake and a short lived one must not be cut off mid handshake by its deadline,
+// but cancelling ctx still aborts the handshake.
+func (d *DownstreamListener) verifyTLS(ctx context.Context, conn *tls.Conn) (*forwarder.Identity, string, error) {
+	handshakeCtx, cancel := context.WithTimeout(context.Background(), d.handshakeTimeout)
 	defer cancel()
-	if err := conn.HandshakeContext(deadline); err != nil {
-		return "", err
+	stop := context.AfterFunc(ctx, func() {
+		if !errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+			cancel()
+		}
+	})
+	defer stop()
+	if err := conn.HandshakeContext(handshakeCtx); err != nil {
+		// The first bytes weren't a TLS record at all e.g. plain HTTP or a port scanner's probe
+		var notTLS tls.RecordHeaderError
+		if errors.As(err, &notTLS) {
+			return nil, "", d.reject(forwarder.ProtocolError, err)
+		}
+		return nil, "", d.reject(forwarder.HandshakeFailed, err)
+	}
+	// The negotiated protocol is only known once the handshake is done
+	upstream := d.route(conn)
+	state := conn.ConnectionState()
+	if d.tlsStats != nil {
+		d.tlsStats.record(state)
 	}
 
-	user, ou, err := extractCertSubjFromConn(conn)
+	id, err := extractIdentityFromConn(conn, d.emptyCNPolicy)
 	if err != nil {
-		return "", err
+		return nil, "", d.reject(forwarder.AuthzDenied, err)
+	}
+	id.TLSVersion = state.Version
+	id.CipherSuite = state.CipherSuite
+	id.Resumed = state.DidResume
+	id.ServerName = state.ServerName
+	if d.logFingerprints {
+		id.CertFingerprint = certFingerprint(id.Certificate)
 	}
 
-	allow, err := d.policy.query(policyQuery{
-		user:     user,
-		ou:       ou,
-		upstream: d.Upstream,
+	allow, err := d.authorize(PolicyQuery{
+		User:            id.User,
+		OUs:             id.OUs,
+		Upstream:        upstream,
+		RemoteAddr:      conn.RemoteAddr(),
+		Certificate:     id.Certificate,
+		CertFingerprint: id.CertFingerprint,
 	})
 	if err != nil {
-		return "", err
+		return nil, "", d.reject(forwarder.AuthzDenied, err)
 	}
 	if !allow {
-		return "", errors.New("user is not authorized to access resource")
+		return nil, "", d.reject(forwarder.AuthzDenied, ErrUnauthorized)
+	}
+
+	return id, upstream, nil
+}
+
+// authorize asks the authorizer of the listener about q applying the fail open policy to its errors
+func (d *DownstreamListener) authorize(q PolicyQuery) (bool, error) {
+	allow, err := d.Authorizer.Authorize(q)
+	if err != nil {
+		if _, builtin := d.Authorizer.(*policyEnforcer); builtin || !d.failOpen {
+			return false, fmt.Errorf("authorizer failed: %w", err)
+		}
+		d.logger.Warn("authorizer_error_fail_open", "user", q.User, "upstream", q.Upstream, "error", err.Error())
+		allow = true
 	}
+	return allow, nil
+}
+
+// serves reports if the listener routes any connections to upstream
+func (d *DownstreamListener) serves(upstream string) bool {
+	if d.Upstream == upstream {
+		return true
+	}
+	for _, route := range d.cfg.ALPN {
+		if route.Upstream == upstream {
+			return true
+		}
+	}
+	return false
+}
 
-	return user, nil
+// route returns the upstream for a connection that completed its handshake.
+// Clients that negotiated a protocol with an ALPN route go to its upstream and the rest to the listener default.
+func (d *DownstreamListener) route(conn *tls.Conn) string {
+	proto := conn.ConnectionState().NegotiatedProtocol
+	for _, route := range d.cfg.ALPN {
+		if route.Protocol == proto {
+			return route.Upstream
+		}
+	}
+	return d.Upstream
 }
 
-func extractCertSubjFromConn(conn *tls.Conn) (string, string, error) {
+func extractIdentityFromConn(conn *tls.Conn, emptyCN config.EmptyCommonNamePolicy) (*forwarder.Identity, error) {
 	cert := conn.ConnectionState().PeerCertificates[0]
 	if len(cert.Subject.OrganizationalUnit) == 0 {
-		return "", "", errors.New("user certificate has no OU set")
+		return nil, errors.New("user certificate has no OU set")
+	}
+	user, err := certUser(cert, emptyCN)
+	if err != nil {
+		return nil, err
+	}
+	return &forwarder.Identity{
+		User:        user,
+		OUs:         cert.Subject.OrganizationalUnit,
+		Certificate: cert,
+	}, nil
+}
+
+// certFingerprint is the lowercase hex SHA-256 of the DER encoding of the leaf certificate, the same value as
+// openssl x509 -fingerprint -sha256 without the colons
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// fallbackUserPrefixes start the users of clients identified by something other than their CommonName
+var fallbackUserPrefixes = []string{"serial:", "email:"}
+
+// certUser returns the user a certificate identifies.
+// An empty CommonName would put every such client in one rate limit bucket and audit identity so it is
+// either refused or replaced by another identifier. Fallbacks are prefixed and while they are enabled a
+// CommonName starting with one of the prefixes is refused, so a client can't pose as another one's fallback.
+func certUser(cert *x509.Certificate, emptyCN config.EmptyCommonNamePolicy) (string, error) {
+	if cn := cert.Subject.CommonName; cn != "" {
+		for _, prefix := range fallbackUserPrefixes {
+			if emptyCN != config.RejectEmptyCommonName && strings.HasPrefix(cn, prefix) {
+				return "", fmt.Errorf("user certificate CN %q starts with %q which is reserved for clients without a CN", cn, prefix)
+			}
+		}
+		return cn, nil
 	}
-	user := cert.Subject.CommonName
-	ou := cert.Subject.OrganizationalUnit[0]
-	return user, ou, nil
+	switch emptyCN {
+	case config.FallbackToSerialNumber:
+		return "serial:" + cert.SerialNumber.Text(16), nil
+	case config.FallbackToEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return "email:" + cert.EmailAddresses[0], nil
+		}
+		return "", errors.New("user certificate has no CN or email address set")
+	}
+	return "", errors.New("user certificate has no CN set")
+}
+
+// rateLimiterKey is the key of the client's token bucket. Hostnames can't contain a / so keys with the SNI are
+// unambiguous.
+func (d *DownstreamListener) rateLimiterKey(id *forwarder.Identity) string {
+	if d.rateLimitKey == config.RateLimitByUserAndSNI {
+		return id.ServerName + "/" + id.User
+	}
+	return id.User
 }
 
 // handleConn performs authn/authz checks and forwards connections if they pass
@@ -159,75 +733,310 @@ func (d *DownstreamListener) handleConn(ctx context.Context, conn net.Conn) erro
 	defer conn.Close()
 	tlsConn, ok := conn.(*tls.Conn)
 	if !ok {
-		return errors.New("did not receive a TLS connection refusing to serve connection")
+		return d.reject(forwarder.ProtocolError, errors.New("did not receive a TLS connection refusing to serve connection"))
+	}
+	// Reject before paying the cost of the handshake
+	if d.handshakeLimiter != nil && !d.handshakeLimiter.allow() {
+		return ErrHandshakeRateLimited
 	}
 	// verify authenticity and authorization for user
-	user, err := d.verifyTLS(ctx, tlsConn)
+	id, upstream, err := d.verifyTLS(ctx, tlsConn)
 	if err != nil {
 		return err
 	}
+	ctx = forwarder.WithIdentity(ctx, id)
+	state := tlsConn.ConnectionState()
+	rateLimit, rateLimitID := d.cfg.RateLimit, d.rateLimitID
+	if d.tiers != nil {
+		if rl, ok := d.tiers.rateLimit(state.PeerCertificates[0], id); ok {
+			// Tiers are shared by every listener and never rebuilt
+			rateLimit, rateLimitID = rl, ""
+		}
+	}
 
 	// TODO: Could consider setting deadlines for read/write to conn
 	// would be done with SetReadDeadline/SetWriteDeadline/SetDeadline method
 	// Would need to also have a wrapper around conn Read/Write to reset the deadline
 	// This would make it so potentially dead upstream servers don't hang the client side
 	return d.fwdr.Forward(ctx, forwarder.FwdInfo{
-		Upstream:       d.Upstream,
+		Upstream:       upstream,
 		Conn:           conn,
-		RateLimiterKey: user,
+		RateLimiterKey: d.rateLimiterKey(id),
+		RateLimit:      rateLimit,
+		RateLimitID:    rateLimitID,
+		BackendTag:     d.cfg.BackendTag,
+		Metadata: map[string]any{
+			forwarder.MetadataListener: d.Addr().String(),
+			forwarder.MetadataALPN:     state.NegotiatedProtocol,
+			forwarder.MetadataSNI:      state.ServerName,
+			forwarder.MetadataIdentity: id,
+		},
 	})
 }
 
+// handleQueued deals with a connection that was accepted after shutdown started based on the configured policy
+func (d *DownstreamListener) handleQueued(ctx context.Context, conn net.Conn) {
+	if d.queuedPolicy == config.ServeQueued {
+		d.queued.Add(1)
+		go func() {
+			defer d.queued.Done()
+			// The serve context has been cancelled so detach from it to allow the handshake to finish
+			// but don't let the connection hold up shutdown forever
+			// The cause tells verifyTLS this is shutdown giving up on the connection rather than its deadline
+			ctx, cancel := context.WithTimeoutCause(context.WithoutCancel(ctx), d.drainTimeout, errDrainTimeout)
+			defer cancel()
+			err := d.handleConn(ctx, conn)
+			// Rate limited handshakes are counted by the limiter rather than logged one by one
+			if err != nil && !errors.Is(err, ErrHandshakeRateLimited) {
+				d.logConnError(conn, err)
+			}
+		}()
+		return
+	}
+	d.logger.Info("closing queued connection on shutdown", "upstream", d.Upstream, "remote", conn.RemoteAddr().String())
+	conn.Close()
+}
+
 // serve will accept connections on a single downstream listener and will handle authn/authz.
 // Errors returned from this are expected to be fatal to the functioning of the app
 // e.g. accept from a listener returns an error.
 //
 // Errors received when handling connections are not returned and are logged as errors.
+//
+// On shutdown the listener is closed and any connection that was accepted but not yet handled
+// is dealt with according to the queued connection policy. serve returns once queued connections
+// have been served or their drain timeout has passed.
+//
+// When drained, or retired after being replaced, the listener is closed the same way but serve also waits for the
+// active connections to finish and returns nil.
 func (d *DownstreamListener) serve(ctx context.Context) error {
 	defer d.listener.Close()
 	connChan := make(chan net.Conn)
+	acceptDone := make(chan struct{})
 	ctx, cancel := context.WithCancelCause(ctx)
-	fmt.Printf("%s <-> %s\n", d.listener.Addr().String(), d.Upstream)
 
 	// Goroutine to accept connections and send them over a channel
 	go func() {
+		defer close(acceptDone)
 		for {
 			conn, err := d.listener.Accept()
 			if err != nil {
-				cancel(err)
+				// Closing the listener to drain it must not cancel the connections being handled
+				select {
+				case <-d.drain:
+				case <-d.retire:
+				default:
+					cancel(err)
+				}
 				return
 			}
-			connChan <- conn
+			select {
+			case connChan <- conn:
+			case <-ctx.Done():
+				// Nothing is receiving anymore so this connection would be abandoned
+				d.handleQueued(ctx, conn)
+			case <-d.drain:
+				d.handleQueued(ctx, conn)
+			case <-d.retire:
+				d.handleQueued(ctx, conn)
+			}
 		}
 	}()
+	drained := func() error {
+		d.logger.Info("listener_draining", "addr", d.listener.Addr().String(), "upstream", d.Upstream)
+		d.listener.Close()
+		<-acceptDone
+		d.queued.Wait()
+		d.active.Wait()
+		d.logger.Info("listener_drained", "addr", d.listener.Addr().String(), "upstream", d.Upstream)
+		return nil
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			// Unblock the accept goroutine and wait for it to hand off anything it accepted
+			d.listener.Close()
+			<-acceptDone
+			d.queued.Wait()
+			return context.Cause(ctx)
+		case <-d.drain:
+			return drained()
+		case <-d.retire:
+			return drained()
 		case conn := <-connChan:
+			if ctx.Err() != nil {
+				d.handleQueued(ctx, conn)
+				continue
+			}
 			// TODO: Consider adding some protection from a goroutine leak here? maybe we can trust the func or add a deadline
+			d.active.Add(1)
 			go func() {
+				defer d.active.Done()
 				err := d.handleConn(ctx, conn)
-				if err != nil {
-					d.logger.Error("handleConn.error", "upstream", d.Upstream, "error", err.Error())
+				if err != nil && !errors.Is(err, ErrHandshakeRateLimited) {
+					d.logConnError(conn, err)
 				}
 			}()
 		}
 	}
 }
 
-// ListenAndServe will start the server and forward connections that pass authn/authz
+// Addr is the address the listener is bound to
+func (d *DownstreamListener) Addr() net.Addr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.listener.Addr()
+}
+
+// newTLSListener terminates TLS on connections accepted from socket once they are within the connection limit
+func (d *DownstreamListener) newTLSListener(socket net.Listener) net.Listener {
+	if d.connLimiter != nil {
+		return tls.NewListener(newLimitListener(socket, d.connLimiter), d.tlsConf)
+	}
+	return tls.NewListener(socket, d.tlsConf)
+}
+
+// listenerRestartRecorder is implemented by forwarders that publish the restarts of listeners with their metrics
+type listenerRestartRecorder interface {
+	RecordListenerRestart(upstream string)
+}
+
+// rebind binds the listener again after it failed retrying with backoff until it succeeds or ctx is done.
+// Inherited sockets can't be bound again so they are not retried.
+func (d *DownstreamListener) rebind(ctx context.Context) error {
+	if d.cfg.FD != 0 {
+		return fmt.Errorf("inherited listener %d can't be restarted", d.cfg.FD)
+	}
+	backoff := 100 * time.Millisecond
+	for {
+		socket, err := listen(d.cfg)
+		if err == nil {
+			d.mu.Lock()
+			d.socket = socket
+			d.listener = d.newTLSListener(socket)
+			d.mu.Unlock()
+			d.restarts.Add(1)
+			if r, ok := d.fwdr.(listenerRestartRecorder); ok {
+				r.RecordListenerRestart(d.Upstream)
+			}
+			return nil
+		}
+		d.logger.Error("listener_rebind_failed", "addr", d.cfg.Addr, "upstream", d.Upstream, "error", err.Error())
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 5*time.Second)
+	}
+}
+
+// failurePolicy returns the failure policy of a listener which defaults to the server wide policy
+func failurePolicy(cfg *config.Config, l *config.Listener) config.ListenerFailurePolicy {
+	if l.FailurePolicy != nil {
+		return *l.FailurePolicy
+	}
+	return cfg.ListenerFailurePolicy
+}
+
+// run serves the listener and applies its failure policy when it fails.
+// Only an error returned from here stops the other listeners.
+func (d *DownstreamListener) run(ctx context.Context) error {
+	for {
+		err := d.serve(ctx)
+		// Only a drained listener stops without an error
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		switch d.failurePolicy {
+		case config.RestartListener:
+			d.logger.Error("listener_failed", "addr", d.Addr().String(), "upstream", d.Upstream, "error", err.Error())
+			if err := d.rebind(ctx); err != nil {
+				return err
+			}
+			d.logger.Info("listener_restarted", "addr", d.Addr().String(), "upstream", d.Upstream)
+		case config.IsolateListener:
+			d.logger.Error("listener_stopped", "addr", d.Addr().String(), "upstream", d.Upstream, "error", err.Error())
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// ListenerRestarts is the number of times listeners were restarted after failing
+func (s *Server) ListenerRestarts() int64 {
+	var total int64
+	for _, d := range s.downstreams() {
+		total += d.restarts.Load()
+	}
+	return total
+}
+
+// ListenAndServe will start the server and forward connections that pass authn/authz.
+// It logs a listener_bound event for every listener followed by a single ready event.
+// It returns nil after Drain once every listener has drained.
 func (s *Server) ListenAndServe(ctx context.Context) error {
 	e, ctx := errgroup.WithContext(ctx)
+	logger := s.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	drain := s.drainChan()
+	// The debug and control listeners stay up while draining and stop once the listeners have drained
+	auxCtx, stopAux := context.WithCancel(ctx)
+	defer stopAux()
+	var listeners sync.WaitGroup
 
+	upstreams := map[string]struct{}{}
+	start := func(d *DownstreamListener) {
+		d.drain = drain
+		// The socket was bound when the listener was created so it already accepts connections
+		logger.Info("listener_bound", "addr", d.Addr().String(), "upstream", d.Upstream)
+		listeners.Add(1)
+		e.Go(func() error {
+			defer listeners.Done()
+			return d.run(ctx)
+		})
+	}
+	s.downstreamsMu.Lock()
 	for _, d := range s.Downstreams {
-		d := d
+		upstreams[d.Upstream] = struct{}{}
+		start(d)
+	}
+	s.startListener = start
+	s.downstreamsMu.Unlock()
+	defer func() {
+		s.downstreamsMu.Lock()
+		s.startListener = nil
+		s.downstreamsMu.Unlock()
+	}()
+	e.Go(func() error {
+		select {
+		case <-drain:
+			logger.Info("draining")
+			listeners.Wait()
+			logger.Info("drained")
+			stopAux()
+		case <-ctx.Done():
+		}
+		return nil
+	})
+
+	if s.debug != nil {
+		logger.Info("debug_listener_bound", "addr", s.debug.listener.Addr().String())
+		e.Go(func() error {
+			return s.serveDebug(auxCtx)
+		})
+	}
+	if s.control != nil {
+		logger.Info("control_socket_bound", "path", s.control.listener.Addr().String())
 		e.Go(func() error {
-			return d.serve(ctx)
+			return s.serveControl(auxCtx)
 		})
 	}
 
-	fmt.Printf("Load balancer ready for connections...\nListening on:\n")
+	logger.Info("ready", "listeners", len(s.downstreams()), "upstreams", len(upstreams))
 	return e.Wait()
 }
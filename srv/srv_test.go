@@ -2,16 +2,28 @@ package srv
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math/big"
 	"net"
 	"net/http"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/doggydogworld/gobalancer/config"
 	"github.com/doggydogworld/gobalancer/forwarder"
@@ -40,8 +52,7 @@ func LoadStaticConfig() (*config.Config, error) {
 		ServerCrt: crt,
 		ServerKey: key,
 		RateLimit: &config.RateLimit{
-			TokenRefillPerSecond: 0,
-			MaxTokens:            0,
+			Disabled: true,
 		},
 		Listeners: []*config.Listener{
 			{
@@ -113,11 +124,16 @@ func (d *dummyForwarder) Forward(ctx context.Context, info forwarder.FwdInfo) er
 
 // setup a server and fail the test if server cannot start
 func newTestServer(t *testing.T) (*Server, map[string]string) {
-	m := map[string]string{}
 	cfg, err := LoadStaticConfig()
 	if err != nil {
 		t.Fatal(err)
 	}
+	return newTestServerWithConfig(t, cfg)
+}
+
+// setup a server from a modified static config and fail the test if server cannot start
+func newTestServerWithConfig(t *testing.T, cfg *config.Config) (*Server, map[string]string) {
+	m := map[string]string{}
 	srv, err := NewServerFromCfg(cfg)
 	if err != nil {
 		t.Fatal(err)
@@ -351,3 +367,1834 @@ func TestAnonymousCertMustNotForward(t *testing.T) {
 		}
 	}
 }
+
+func TestRejections(t *testing.T) {
+	srv, m := newTestServer(t)
+	injectMustNotForwarder(t, srv)
+	go runTestServer(t, srv)
+	// dba is denied access to web by the policy and the self signed cert fails the handshake
+	if _, err := newUserClient(t, "dba.crt", "dba.key").Get("https://" + m["web"]); err == nil {
+		t.Fatal("dba should have been denied access to web")
+	}
+	if _, err := newUserClient(t, "selfsigned.crt", "selfsigned.key").Get("https://" + m["web"]); err == nil {
+		t.Fatal("a self signed cert should have failed the handshake")
+	}
+
+	// The client can see the failure before the server has counted it
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rejections := srv.Rejections()
+		if rejections[forwarder.AuthzDenied] == 1 && rejections[forwarder.HandshakeFailed] == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one authz_denied and one handshake_failed rejection got %v", rejections)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	srv, m := newTestServer(t)
+	injectMustNotForwarder(t, srv)
+	h := &recordingHandler{}
+	for _, d := range srv.Downstreams {
+		d.logger = slog.New(h)
+	}
+	go runTestServer(t, srv)
+
+	// Plain HTTP to a TLS port is never a TLS record
+	conn, err := net.Dial("tcp", m["web"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: web\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(conn)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.find("protocol_error")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a protocol_error event")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	event := h.find("protocol_error")[0]
+	if got := event["remote"].String(); got != conn.LocalAddr().String() {
+		t.Errorf("expected the remote address %s got %s", conn.LocalAddr(), got)
+	}
+	rejections := srv.Rejections()
+	if rejections[forwarder.ProtocolError] != 1 || rejections[forwarder.HandshakeFailed] != 0 {
+		t.Errorf("expected one protocol_error and no handshake_failed rejections got %v", rejections)
+	}
+	if errors := h.find("handleConn.error"); len(errors) != 0 {
+		t.Errorf("expected the protocol error to only be logged as protocol_error got %v", errors)
+	}
+}
+
+func TestAuthorizeMatchesDataPlane(t *testing.T) {
+	srv, m := newTestServer(t)
+	injectDummyForwarders(srv)
+	go runTestServer(t, srv)
+
+	// The test certs use the same name for the CN and OU
+	for _, user := range []string{"sre", "dba", "webdev"} {
+		client := newUserClient(t, user+".crt", user+".key")
+		for upstream, addr := range m {
+			resp, err := client.Get("https://" + addr)
+			connected := err == nil
+			if connected {
+				resp.Body.Close()
+			}
+			allowed, err := srv.Authorize(user, user, upstream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed != connected {
+				t.Errorf("%s accessing %s: Authorize returned %v but connecting returned %v", user, upstream, allowed, connected)
+			}
+		}
+	}
+
+	if _, err := srv.Authorize("sre", "sre", "missing"); err == nil {
+		t.Error("expected an error for an upstream no listener serves")
+	}
+	if allowed, _ := srv.Authorize("sre", "", "web"); allowed {
+		t.Error("expected a client without an OU to be denied")
+	}
+	// The current authorizer is used rather than the one the server was created with
+	srv.SetAuthorizer(&stubAuthorizer{allowUser: "dba", queries: make(chan PolicyQuery, 10)})
+	if allowed, _ := srv.Authorize("dba", "dba", "web"); !allowed {
+		t.Error("expected dba to be allowed by the replaced authorizer")
+	}
+	if allowed, _ := srv.Authorize("sre", "sre", "web"); allowed {
+		t.Error("expected sre to be denied by the replaced authorizer")
+	}
+}
+
+func TestReloadPolicy(t *testing.T) {
+	srv, m := newTestServer(t)
+	injectDummyForwarders(srv)
+	go runTestServer(t, srv)
+
+	sreClient := newUserClient(t, "sre.crt", "sre.key")
+	dbaClient := newUserClient(t, "dba.crt", "dba.key")
+	connects := func(client *http.Client) bool {
+		// A fresh connection is authorized every time
+		client.CloseIdleConnections()
+		resp, err := client.Get("https://" + m["web"])
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	}
+	if !connects(sreClient) || connects(dbaClient) {
+		t.Fatal("expected only sre to be allowed to web before the reload")
+	}
+
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// web is the first upstream of the static config
+	web := cfg.Upstreams[0]
+	web.Tags = []string{"dba"}
+	if err := srv.ReloadPolicy(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if connects(sreClient) {
+		t.Error("expected sre to be denied after the reload")
+	}
+	if !connects(dbaClient) {
+		t.Error("expected dba to be allowed after the reload")
+	}
+	for _, up := range srv.EffectiveConfig().Upstreams {
+		if up.Name == "web" && !slices.Equal(up.Tags, []string{"dba"}) {
+			t.Errorf("expected the effective config to have the reloaded tags got %v", up.Tags)
+		}
+	}
+
+	// An invalid policy changes nothing
+	web.Tags = []string{"sre"}
+	web.RequiredCertExtension = &config.CertExtension{OID: "not an oid"}
+	if err := srv.ReloadPolicy(cfg); err == nil {
+		t.Fatal("expected an invalid policy to fail the reload")
+	}
+	if connects(sreClient) || !connects(dbaClient) {
+		t.Error("expected a failed reload to keep the previous policy")
+	}
+}
+
+// stubAuthorizer records queries and allows only the configured user
+type stubAuthorizer struct {
+	allowUser string
+	queries   chan PolicyQuery
+}
+
+func (a *stubAuthorizer) Authorize(q PolicyQuery) (bool, error) {
+	a.queries <- q
+	return q.User == a.allowUser, nil
+}
+
+func TestCustomAuthorizer(t *testing.T) {
+	srv, m := newTestServer(t)
+	injectDummyForwarders(srv)
+	authz := &stubAuthorizer{
+		// dba is normally denied access to web
+		allowUser: "dba",
+		queries:   make(chan PolicyQuery, 10),
+	}
+	srv.SetAuthorizer(authz)
+	go runTestServer(t, srv)
+
+	dbaClient := newUserClient(t, "dba.crt", "dba.key")
+	resp, err := dbaClient.Get("https://" + m["web"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(body)) != "web" {
+		t.Fatalf("expected 'web' got %s", body)
+	}
+	q := <-authz.queries
+	if q.User != "dba" || q.Upstream != "web" || len(q.OUs) == 0 || q.OUs[0] != "dba" || q.RemoteAddr == nil {
+		t.Fatalf("unexpected query %+v", q)
+	}
+
+	// sre is normally allowed but the stub denies it
+	sreClient := newUserClient(t, "sre.crt", "sre.key")
+	if _, err := sreClient.Get("https://" + m["web"]); err == nil {
+		t.Fatalf("sre should have been denied by the custom authorizer")
+	}
+}
+
+// gatedListener holds on to the first accepted connection until the gate is done.
+// This simulates a connection that was accepted right as the server was shutting down.
+type gatedListener struct {
+	net.Listener
+	gate  context.Context
+	gated sync.Once
+	// accepted is closed once the first connection was accepted and is held at the gate
+	accepted chan struct{}
+}
+
+func (g *gatedListener) Accept() (net.Conn, error) {
+	conn, err := g.Listener.Accept()
+	g.gated.Do(func() {
+		close(g.accepted)
+		<-g.gate.Done()
+	})
+	return conn, err
+}
+
+// waitAccepted waits for the gated listener of d to accept a connection.
+// Shutting down before then would reset the connection from the backlog instead of queueing it.
+func waitAccepted(t *testing.T, d *DownstreamListener) {
+	select {
+	case <-d.listener.(*gatedListener).accepted:
+	case <-time.After(time.Second):
+		t.Fatal("connection was never accepted")
+	}
+}
+
+// newQueuedTestListener returns the web listener of a test server with its accept gated by ctx.
+// All other listeners are closed.
+func newQueuedTestListener(t *testing.T, ctx context.Context, policy config.QueuedConnPolicy) *DownstreamListener {
+	srv, _ := newTestServer(t)
+	injectDummyForwarders(srv)
+	var web *DownstreamListener
+	for _, d := range srv.Downstreams {
+		if d.Upstream == "web" {
+			web = d
+			continue
+		}
+		d.listener.Close()
+	}
+	web.queuedPolicy = policy
+	web.listener = &gatedListener{Listener: web.listener, gate: ctx, accepted: make(chan struct{})}
+	return web
+}
+
+func TestQueuedConnClosedOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := newQueuedTestListener(t, ctx, config.CloseQueued)
+	errc := make(chan error)
+	go func() { errc <- d.serve(ctx) }()
+
+	conn, err := net.Dial("tcp", d.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitAccepted(t, d)
+	cancel()
+	<-errc
+
+	// The queued connection should have been closed cleanly rather than abandoned
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected queued connection to be closed got %v", err)
+	}
+}
+
+func TestQueuedConnServedOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := newQueuedTestListener(t, ctx, config.ServeQueued)
+	errc := make(chan error)
+	go func() { errc <- d.serve(ctx) }()
+
+	conn, err := net.Dial("tcp", d.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitAccepted(t, d)
+	cancel()
+
+	// Reuse the connection that was queued during shutdown for the request
+	client := newUserClient(t, "sre.crt", "sre.key")
+	client.Transport.(*http.Transport).DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return conn, nil
+	}
+	resp, err := client.Get("https://" + d.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(body)) != "web" {
+		t.Fatalf("expected 'web' got %s", body)
+	}
+
+	client.CloseIdleConnections()
+	<-errc
+}
+
+func TestQueuedConnDrainTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := newQueuedTestListener(t, ctx, config.ServeQueued)
+	d.drainTimeout = 50 * time.Millisecond
+	errc := make(chan error)
+	go func() { errc <- d.serve(ctx) }()
+
+	// The queued connection never starts a handshake so only the drain timeout can end it
+	conn, err := net.Dial("tcp", d.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitAccepted(t, d)
+	cancel()
+	select {
+	case <-errc:
+	case <-time.After(time.Second):
+		t.Fatal("serve did not return after the drain timeout")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected queued connection to be closed got %v", err)
+	}
+}
+
+func TestHandshakeRateLimit(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Allow a burst of 2 handshakes with no refill
+	cfg.HandshakeRateLimit = &config.HandshakeRateLimit{
+		HandshakesPerSecond: 0,
+		Burst:               2,
+	}
+	srv, m := newTestServerWithConfig(t, cfg)
+	injectDummyForwarders(srv)
+	go runTestServer(t, srv)
+
+	// The limit is shared across listeners
+	for _, upstream := range []string{"web", "db"} {
+		client := newUserClient(t, "sre.crt", "sre.key")
+		resp, err := client.Get("https://" + m[upstream])
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	client := newUserClient(t, "sre.crt", "sre.key")
+	if _, err := client.Get("https://" + m["telemetry"]); err == nil {
+		t.Fatal("handshake should have been rejected by the handshake rate limit")
+	}
+	if got := srv.HandshakesRejected(); got != 1 {
+		t.Fatalf("expected 1 rejected handshake got %d", got)
+	}
+}
+
+func TestHandshakeRateLimitBurstDefault(t *testing.T) {
+	// A zero burst would reject everything so it defaults to the rate rounded up
+	l := newHandshakeLimiter(&config.HandshakeRateLimit{HandshakesPerSecond: 2.5}, slog.Default())
+	if l.limiter.Burst() != 3 {
+		t.Fatalf("expected a burst of 3 got %d", l.limiter.Burst())
+	}
+	l = newHandshakeLimiter(&config.HandshakeRateLimit{}, slog.Default())
+	if !l.allow() {
+		t.Fatal("expected at least one handshake to be allowed")
+	}
+	if l.allow() {
+		t.Fatal("expected the second handshake to be rejected")
+	}
+	if !l.limiting.Load() || l.rejected.Load() != 1 {
+		t.Fatalf("expected limiting with 1 rejection got %v %d", l.limiting.Load(), l.rejected.Load())
+	}
+}
+
+func TestHandshakeErrorLog(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Log 3 failures with no refill and report the rest once they have been dropped for a while
+	cfg.HandshakeErrorLog = &config.HandshakeErrorLog{Burst: 3, SummaryInterval: 200 * time.Millisecond}
+	srv, m := newTestServerWithConfig(t, cfg)
+	injectMustNotForwarder(t, srv)
+	h := &recordingHandler{}
+	for _, d := range srv.Downstreams {
+		d.logger = slog.New(h)
+		d.handshakeErrors.logger = slog.New(h)
+	}
+	go runTestServer(t, srv)
+
+	// The client can see the failure before the server has counted it
+	waitForFailures := func(n int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for srv.Rejections()[forwarder.HandshakeFailed] != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d failed handshakes got %v", n, srv.Rejections())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	scan := func(n int) {
+		for range n {
+			if _, err := newUserClient(t, "selfsigned.crt", "selfsigned.key").Get("https://" + m["web"]); err == nil {
+				t.Fatal("a self signed cert should have failed the handshake")
+			}
+		}
+	}
+	scan(20)
+	waitForFailures(20)
+	time.Sleep(200 * time.Millisecond)
+	scan(1)
+	waitForFailures(21)
+
+	// The summary is logged after the failure is counted
+	suppressed := func() int64 {
+		var n int64
+		for _, summary := range h.find("handshake_errors_suppressed") {
+			n += summary["suppressed"].Int64()
+		}
+		return n
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for suppressed() != 18 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the summaries to report 18 dropped failures got %d", suppressed())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if logged := len(h.find("handleConn.error")); logged != 3 {
+		t.Errorf("expected 3 of the failed handshakes to be logged got %d", logged)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	srv, _ := newTestServer(t)
+	d := srv.Downstreams[0]
+	// handshake runs the handshake of a client that never sends anything under ctx
+	handshake := func(ctx context.Context) (time.Duration, error) {
+		client, conn := net.Pipe()
+		defer client.Close()
+		start := time.Now()
+		_, _, err := d.verifyTLS(ctx, tls.Server(conn, d.tlsConf))
+		return time.Since(start), err
+	}
+
+	// A connection allowed to live for an hour still only gets the handshake timeout to handshake
+	d.handshakeTimeout = 100 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	took, err := handshake(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || took < 100*time.Millisecond || took > time.Second {
+		t.Errorf("expected the handshake to time out after 100ms got %v after %v", err, took)
+	}
+
+	// Nor does a connection with a short deadline get less
+	d.handshakeTimeout = 300 * time.Millisecond
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	took, err = handshake(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || took < 250*time.Millisecond {
+		t.Errorf("expected the handshake to time out after 300ms got %v after %v", err, took)
+	}
+
+	// Cancelling the connection still aborts the handshake
+	d.handshakeTimeout = time.Hour
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	took, err = handshake(ctx)
+	if !errors.Is(err, context.Canceled) || took > time.Second {
+		t.Errorf("expected cancelling the connection to abort the handshake got %v after %v", err, took)
+	}
+}
+
+func TestPartialBindClosesListeners(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reserve a free address for the first listener
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freeAddr := free.Addr().String()
+	free.Close()
+	// Occupy the address of the last listener
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	cfg.Listeners[0].Addr = freeAddr
+	cfg.Listeners[2].Addr = taken.Addr().String()
+
+	d, err := NewDownstreamListeners(cfg, &mustNotForwarder{t: t})
+	if err == nil {
+		t.Fatal("expected bind failure")
+	}
+	if len(d) != 0 {
+		t.Fatalf("expected no listeners got %d", len(d))
+	}
+	// The first listener must have been closed so its address can be bound again
+	l, err := net.Listen("tcp", freeAddr)
+	if err != nil {
+		t.Fatalf("listener was not closed after partial bind failure: %v", err)
+	}
+	l.Close()
+}
+
+// errAuthorizer never reaches a decision
+type errAuthorizer struct{}
+
+func (errAuthorizer) Authorize(q PolicyQuery) (bool, error) {
+	return false, errors.New("authorizer unavailable")
+}
+
+func TestListenerRestart(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ListenerFailurePolicy = config.RestartListener
+	srv, m := newTestServerWithConfig(t, cfg)
+	injectDummyForwarders(srv)
+	var web *DownstreamListener
+	for _, d := range srv.Downstreams {
+		if d.Upstream == "web" {
+			web = d
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(ctx) }()
+
+	// Closing the socket underneath the web listener makes its accept fail
+	web.mu.Lock()
+	web.socket.Close()
+	web.mu.Unlock()
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.ListenerRestarts() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("listener was not restarted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The other listeners kept serving and the restarted listener serves on its new socket
+	for upstream, addr := range map[string]string{"db": m["db"], "web": web.Addr().String()} {
+		client := newUserClient(t, "sre.crt", "sre.key")
+		resp, err := client.Get("https://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(body)) != upstream {
+			t.Fatalf("expected '%s' got %s", upstream, body)
+		}
+	}
+	select {
+	case err := <-errc:
+		t.Fatalf("server stopped after a listener failed: %v", err)
+	default:
+	}
+}
+
+func TestListenerRestartMetric(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ListenerFailurePolicy = config.RestartListener
+	srv, _ := newTestServerWithConfig(t, cfg)
+	fwdr := srv.Forwarder.(*forwarder.LeastConnections)
+	defer fwdr.Close(context.Background())
+	web := srv.Downstreams[0]
+	web.fwdr = fwdr
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(ctx) }()
+	defer func() {
+		cancel()
+		<-errc
+	}()
+
+	web.mu.Lock()
+	web.socket.Close()
+	web.mu.Unlock()
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.ListenerRestarts() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("listener was not restarted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The restart is published with the forwarder's other metrics
+	var published struct {
+		ListenerRestarts map[string]int64 `json:"listener_restarts"`
+	}
+	if err := json.Unmarshal([]byte(expvar.Get("upstreams").String()), &published); err != nil {
+		t.Fatal(err)
+	}
+	if got := published.ListenerRestarts["web"]; got != 1 {
+		t.Errorf("expected one restart of the web listener to be published got %v", published.ListenerRestarts)
+	}
+}
+
+func TestListenerFailurePolicies(t *testing.T) {
+	isolate := config.IsolateListener
+	tests := map[string]struct {
+		modify      func(cfg *config.Config)
+		stopsServer bool
+	}{
+		"fail server by default": {
+			modify:      func(cfg *config.Config) {},
+			stopsServer: true,
+		},
+		"isolate listener": {
+			modify:      func(cfg *config.Config) { cfg.ListenerFailurePolicy = config.IsolateListener },
+			stopsServer: false,
+		},
+		"isolate a single listener": {
+			modify:      func(cfg *config.Config) { cfg.Listeners[0].FailurePolicy = &isolate },
+			stopsServer: false,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := LoadStaticConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.modify(cfg)
+			srv, m := newTestServerWithConfig(t, cfg)
+			injectDummyForwarders(srv)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			errc := make(chan error, 1)
+			go func() { errc <- srv.ListenAndServe(ctx) }()
+
+			failed := srv.Downstreams[0]
+			failed.socket.Close()
+			if test.stopsServer {
+				select {
+				case err := <-errc:
+					if !errors.Is(err, net.ErrClosed) {
+						t.Fatalf("expected the accept error got %v", err)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatal("server did not stop after a listener failed")
+				}
+				return
+			}
+
+			// The other listeners keep serving
+			for _, d := range srv.Downstreams[1:] {
+				client := newUserClient(t, "sre.crt", "sre.key")
+				resp, err := client.Get("https://" + m[d.Upstream])
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+			}
+			select {
+			case err := <-errc:
+				t.Fatalf("server stopped after an isolated listener failed: %v", err)
+			default:
+			}
+		})
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	sreKey, err := CertsFS.ReadFile("testcerts/sre.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		modify func(cfg *config.Config)
+		expect string
+	}{
+		"mismatched key pair": {
+			modify: func(cfg *config.Config) { cfg.ServerKey = sreKey },
+			expect: "ServerCrt and ServerKey",
+		},
+		"malformed server key": {
+			modify: func(cfg *config.Config) { cfg.ServerKey = []byte("not a key") },
+			expect: "matching pair",
+		},
+		"malformed root CA": {
+			modify: func(cfg *config.Config) { cfg.RootCA = []byte("not a pem") },
+			expect: "RootCA is not valid PEM",
+		},
+		"root CA is not a certificate": {
+			modify: func(cfg *config.Config) { cfg.RootCA = sreKey },
+			expect: "RootCA is not a valid certificate",
+		},
+		"intermediate is not a certificate": {
+			modify: func(cfg *config.Config) { cfg.RootCA = append(cfg.RootCA, sreKey...) },
+			expect: "RootCA is not a valid certificate",
+		},
+		"intermediate without a root": {
+			modify: func(cfg *config.Config) { cfg.RootCA, _ = CertsFS.ReadFile("testcerts/intermediate.crt") },
+			expect: "RootCA has no self-signed root certificate",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := LoadStaticConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.modify(cfg)
+			_, err = newTLSConfig(cfg)
+			if err == nil || !strings.Contains(err.Error(), test.expect) {
+				t.Fatalf("expected error containing %q got %v", test.expect, err)
+			}
+		})
+	}
+}
+
+func TestListenerTagOverride(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An internal and an external listener for web where the external one only admits sre
+	cfg.Listeners = []*config.Listener{
+		{Addr: "127.0.0.1:0", Upstream: "web"},
+		{Addr: "127.0.0.1:0", Upstream: "web", Tags: []string{"sre"}},
+	}
+	srv, _ := newTestServerWithConfig(t, cfg)
+	injectDummyForwarders(srv)
+	internal := srv.Downstreams[0].listener.Addr().String()
+	external := srv.Downstreams[1].listener.Addr().String()
+	go runTestServer(t, srv)
+
+	tests := map[string]struct {
+		crt, key   string
+		addr       string
+		shouldFail bool
+	}{
+		"webdev allowed internally":   {crt: "webdev.crt", key: "webdev.key", addr: internal},
+		"webdev denied externally":    {crt: "webdev.crt", key: "webdev.key", addr: external, shouldFail: true},
+		"sre allowed externally":      {crt: "sre.crt", key: "sre.key", addr: external},
+		"sre allowed internally":      {crt: "sre.crt", key: "sre.key", addr: internal},
+		"dba still denied internally": {crt: "dba.crt", key: "dba.key", addr: internal, shouldFail: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := newUserClient(t, test.crt, test.key)
+			resp, err := client.Get("https://" + test.addr)
+			if test.shouldFail {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("connection should have been denied")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		})
+	}
+}
+
+func TestAuthorizerErrorPolicy(t *testing.T) {
+	tests := map[string]struct {
+		failOpen   bool
+		builtin    bool
+		shouldFail bool
+	}{
+		"fail closed denies on error":          {failOpen: false, shouldFail: true},
+		"fail open allows on error":            {failOpen: true, shouldFail: false},
+		"fail open ignores the builtin policy": {failOpen: true, builtin: true, shouldFail: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := LoadStaticConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.AuthorizerFailOpen = test.failOpen
+			srv, m := newTestServerWithConfig(t, cfg)
+			injectDummyForwarders(srv)
+			if test.builtin {
+				// The built-in policy errors for upstreams it doesn't know about
+				policy := srv.Downstreams[0].Authorizer.(*policyEnforcer)
+				delete(policy.upstreamTags, "web")
+			} else {
+				srv.SetAuthorizer(errAuthorizer{})
+			}
+			go runTestServer(t, srv)
+
+			client := newUserClient(t, "sre.crt", "sre.key")
+			resp, err := client.Get("https://" + m["web"])
+			if test.shouldFail {
+				if err == nil {
+					t.Fatal("connection should have been denied")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		})
+	}
+}
+
+// identityForwarder reports the identity found in the forwarding context
+type identityForwarder struct {
+	identities chan *forwarder.Identity
+}
+
+func (f *identityForwarder) Forward(ctx context.Context, info forwarder.FwdInfo) error {
+	id, _ := forwarder.IdentityFromContext(ctx)
+	f.identities <- id
+	return (&dummyForwarder{WithMsg: info.Upstream}).Forward(ctx, info)
+}
+
+func TestIdentityInForwardContext(t *testing.T) {
+	srv, m := newTestServer(t)
+	fwdr := &identityForwarder{identities: make(chan *forwarder.Identity, 1)}
+	for _, d := range srv.Downstreams {
+		d.fwdr = fwdr
+	}
+	go runTestServer(t, srv)
+
+	client := newUserClient(t, "webdev.crt", "webdev.key")
+	resp, err := client.Get("https://" + m["web"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	id := <-fwdr.identities
+	if id == nil {
+		t.Fatal("expected identity in forward context")
+	}
+	if id.User != "webdev" || len(id.OUs) != 1 || id.OUs[0] != "webdev" {
+		t.Fatalf("unexpected identity %+v", id)
+	}
+	if id.Certificate == nil || id.Certificate.Subject.CommonName != "webdev" {
+		t.Fatal("expected the client certificate in the identity")
+	}
+}
+
+// recordingHandler is a slog.Handler that keeps the records it handles
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordingHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+// find returns the attributes of the records with the given message
+func (h *recordingHandler) find(msg string) []map[string]slog.Value {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var found []map[string]slog.Value
+	for _, r := range h.records {
+		if r.Message != msg {
+			continue
+		}
+		attrs := map[string]slog.Value{}
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value
+			return true
+		})
+		found = append(found, attrs)
+	}
+	return found
+}
+
+func TestStartupEvents(t *testing.T) {
+	srv, m := newTestServer(t)
+	injectDummyForwarders(srv)
+	h := &recordingHandler{}
+	srv.Logger = slog.New(h)
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(ctx) }()
+	defer func() {
+		cancel()
+		<-errc
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for len(h.find("ready")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no ready event was logged")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ready := h.find("ready")
+	if len(ready) != 1 {
+		t.Fatalf("expected a single ready event got %d", len(ready))
+	}
+	if got := ready[0]["listeners"].Int64(); got != int64(len(srv.Downstreams)) {
+		t.Errorf("expected %d listeners got %d", len(srv.Downstreams), got)
+	}
+	if got := ready[0]["upstreams"].Int64(); got != int64(len(m)) {
+		t.Errorf("expected %d upstreams got %d", len(m), got)
+	}
+
+	bound := map[string]string{}
+	for _, attrs := range h.find("listener_bound") {
+		bound[attrs["upstream"].String()] = attrs["addr"].String()
+	}
+	for upstream, addr := range m {
+		if bound[upstream] != addr {
+			t.Errorf("expected upstream %s to be bound to %s got %q", upstream, addr, bound[upstream])
+		}
+	}
+}
+
+// routeRecorder records how every forwarded connection was routed and replies with its upstream
+type routeRecorder struct {
+	infos chan forwarder.FwdInfo
+}
+
+func (r *routeRecorder) Forward(ctx context.Context, info forwarder.FwdInfo) error {
+	defer info.Conn.Close()
+	r.infos <- info
+	_, err := fmt.Fprintln(info.Conn, info.Upstream)
+	return err
+}
+
+func TestALPNRouting(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listeners = []*config.Listener{
+		{Addr: "127.0.0.1:0", Upstream: "web", ALPN: []config.ALPNRoute{
+			{Protocol: "postgresql", Upstream: "db"},
+			{Protocol: "h2", Upstream: "web"},
+		}},
+	}
+	srv, _ := newTestServerWithConfig(t, cfg)
+	rec := &routeRecorder{infos: make(chan forwarder.FwdInfo, 1)}
+	srv.Downstreams[0].fwdr = rec
+	addr := srv.Downstreams[0].listener.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(ctx) }()
+	defer func() {
+		cancel()
+		<-errc
+	}()
+
+	tests := map[string]struct {
+		crt, key  string
+		protos    []string
+		negotiate string
+		upstream  string
+	}{
+		"routed by protocol":      {crt: "dba.crt", key: "dba.key", protos: []string{"postgresql"}, negotiate: "postgresql", upstream: "db"},
+		"default without alpn":    {crt: "webdev.crt", key: "webdev.key", upstream: "web"},
+		"other protocol":          {crt: "sre.crt", key: "sre.key", protos: []string{"h2"}, negotiate: "h2", upstream: "web"},
+		"listener preference":     {crt: "sre.crt", key: "sre.key", protos: []string{"h2", "postgresql"}, negotiate: "postgresql", upstream: "db"},
+		"authorized for resolved": {crt: "webdev.crt", key: "webdev.key", protos: []string{"postgresql"}, negotiate: "postgresql"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			tlsConf := newUserClient(t, test.crt, test.key).Transport.(*http.Transport).TLSClientConfig.Clone()
+			tlsConf.NextProtos = test.protos
+			conn, err := tls.Dial("tcp", addr, tlsConf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := conn.ConnectionState().NegotiatedProtocol; got != test.negotiate {
+				t.Fatalf("expected protocol %q got %q", test.negotiate, got)
+			}
+			resp, err := io.ReadAll(conn)
+			if test.upstream == "" {
+				// webdev may use web but not db
+				if err == nil && len(resp) > 0 {
+					t.Fatalf("expected the connection to be refused got %q", resp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := (<-rec.infos).Upstream; got != test.upstream {
+				t.Errorf("expected upstream %s got %s", test.upstream, got)
+			}
+			if strings.TrimSpace(string(resp)) != test.upstream {
+				t.Errorf("unexpected response %q", resp)
+			}
+		})
+	}
+	select {
+	case got := <-rec.infos:
+		t.Errorf("refused connection was forwarded to %s", got.Upstream)
+	default:
+	}
+}
+
+func TestListenerRateLimitOverride(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	external := &config.RateLimit{MaxTokens: 1}
+	cfg.Listeners = []*config.Listener{
+		{Addr: "127.0.0.1:0", Upstream: "web"},
+		{Addr: "127.0.0.1:0", Upstream: "web", RateLimit: external},
+	}
+	srv, _ := newTestServerWithConfig(t, cfg)
+	rec := &routeRecorder{infos: make(chan forwarder.FwdInfo, 1)}
+	for _, d := range srv.Downstreams {
+		d.fwdr = rec
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(ctx) }()
+	defer func() {
+		cancel()
+		<-errc
+	}()
+
+	tlsConf := newUserClient(t, "sre.crt", "sre.key").Transport.(*http.Transport).TLSClientConfig
+	for i, expect := range []*config.RateLimit{nil, external} {
+		conn, err := tls.Dial("tcp", srv.Downstreams[i].listener.Addr().String(), tlsConf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(conn)
+		conn.Close()
+		if got := (<-rec.infos).RateLimit; got != expect {
+			t.Errorf("listener %d: expected rate limit %v got %v", i, expect, got)
+		}
+	}
+}
+
+// budgetForwarder stands in for the forwarder's token buckets. Each client has MaxTokens connections per
+// rate limit it is forwarded with and connections over the budget are refused.
+type budgetForwarder struct {
+	mu   sync.Mutex
+	used map[*config.RateLimit]map[string]int
+}
+
+func (b *budgetForwarder) Forward(ctx context.Context, info forwarder.FwdInfo) error {
+	defer info.Conn.Close()
+	b.mu.Lock()
+	if b.used[info.RateLimit] == nil {
+		b.used[info.RateLimit] = map[string]int{}
+	}
+	used := b.used[info.RateLimit][info.RateLimiterKey]
+	if info.RateLimit != nil && used >= info.RateLimit.MaxTokens {
+		b.mu.Unlock()
+		return errors.New("rate limited")
+	}
+	b.used[info.RateLimit][info.RateLimiterKey]++
+	b.mu.Unlock()
+	_, err := fmt.Fprintln(info.Conn, "ok")
+	return err
+}
+
+func TestRateLimitTiers(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gold := &config.RateLimit{TokenRefillPerSecond: 0.001, MaxTokens: 3}
+	bronze := &config.RateLimit{TokenRefillPerSecond: 0.001, MaxTokens: 1}
+	cfg.RateLimitTiers = &config.RateLimitTiers{Tiers: map[string]*config.RateLimit{"sre": gold, "dba": bronze}}
+	cfg.Listeners = []*config.Listener{
+		{Addr: "127.0.0.1:0", Upstream: "db", RateLimit: &config.RateLimit{MaxTokens: 10}},
+	}
+	srv, addrs := newTestServerWithConfig(t, cfg)
+	fwdr := &budgetForwarder{used: map[*config.RateLimit]map[string]int{}}
+	for _, d := range srv.Downstreams {
+		d.fwdr = fwdr
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(ctx) }()
+	defer func() {
+		cancel()
+		<-errc
+	}()
+
+	// The tier of each client takes precedence over the listener's limit
+	for user, expect := range map[string]int{"sre": 3, "dba": 1} {
+		tlsConf := newUserClient(t, user+".crt", user+".key").Transport.(*http.Transport).TLSClientConfig
+		forwarded := 0
+		for range 5 {
+			conn, err := tls.Dial("tcp", addrs["db"], tlsConf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, _ := io.ReadAll(conn)
+			conn.Close()
+			if strings.TrimSpace(string(resp)) == "ok" {
+				forwarded++
+			}
+		}
+		if forwarded != expect {
+			t.Errorf("%s: expected %d connections within the tier's budget got %d", user, expect, forwarded)
+		}
+	}
+}
+
+func TestEmptyCommonNamePolicy(t *testing.T) {
+	tests := map[string]struct {
+		policy   config.EmptyCommonNamePolicy
+		crt, key string
+		// user is the expected rate limiter key, empty when the client should be refused
+		user string
+	}{
+		"rejected by default":          {crt: "nocn.crt", key: "nocn.key"},
+		"serial number fallback":       {policy: config.FallbackToSerialNumber, crt: "nocn.crt", key: "nocn.key", user: "serial:1717b2e0f9e9f50b1c7da9daeaf35fc0ecf595c5"},
+		"email fallback":               {policy: config.FallbackToEmail, crt: "nocn.crt", key: "nocn.key", user: "email:nocn@example.com"},
+		"email fallback without email": {policy: config.FallbackToEmail, crt: "nocn_noemail.crt", key: "nocn_noemail.key"},
+		"common name is preferred":     {policy: config.FallbackToSerialNumber, crt: "sre.crt", key: "sre.key", user: "sre"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := LoadStaticConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.EmptyCommonNamePolicy = test.policy
+			srv, upstream := newTestServerWithConfig(t, cfg)
+			rec := &routeRecorder{infos: make(chan forwarder.FwdInfo, 1)}
+			for _, d := range srv.Downstreams {
+				d.fwdr = rec
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			errc := make(chan error, 1)
+			go func() { errc <- srv.ListenAndServe(ctx) }()
+			defer func() {
+				cancel()
+				<-errc
+			}()
+
+			tlsConf := newUserClient(t, test.crt, test.key).Transport.(*http.Transport).TLSClientConfig
+			conn, err := tls.Dial("tcp", upstream["web"], tlsConf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.ReadAll(conn)
+			conn.Close()
+			// The connection is recorded before the reply so it is already there once the server closed it
+			select {
+			case info := <-rec.infos:
+				if info.RateLimiterKey != test.user {
+					t.Errorf("expected user %q got %q", test.user, info.RateLimiterKey)
+				}
+			default:
+				if test.user != "" {
+					t.Errorf("expected user %q to be forwarded", test.user)
+				}
+			}
+		})
+	}
+}
+
+func TestCertUserReservedPrefix(t *testing.T) {
+	tests := map[string]struct {
+		policy config.EmptyCommonNamePolicy
+		cn     string
+		ok     bool
+	}{
+		"serial prefix with serial fallback": {policy: config.FallbackToSerialNumber, cn: "serial:1a2b"},
+		"email prefix with serial fallback":  {policy: config.FallbackToSerialNumber, cn: "email:dave@example.com"},
+		"email prefix with email fallback":   {policy: config.FallbackToEmail, cn: "email:dave@example.com"},
+		"prefix without a fallback":          {cn: "serial:1a2b", ok: true},
+		"prefix later in the name":           {policy: config.FallbackToEmail, cn: "dave-email:x", ok: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cert := &x509.Certificate{Subject: pkix.Name{CommonName: test.cn}, SerialNumber: big.NewInt(0x1a2b)}
+			user, err := certUser(cert, test.policy)
+			if test.ok && (err != nil || user != test.cn) {
+				t.Errorf("expected user %q got %q %v", test.cn, user, err)
+			}
+			if !test.ok && err == nil {
+				t.Errorf("expected CN %q to be refused got user %q", test.cn, user)
+			}
+		})
+	}
+}
+
+func TestRequiredCertExtension(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, up := range cfg.Upstreams {
+		if up.Name == "db" {
+			up.RequiredCertExtension = &config.CertExtension{OID: "1.3.6.1.4.1.99999.1", Values: []string{"secret"}}
+		}
+	}
+	srv, upstream := newTestServerWithConfig(t, cfg)
+	injectDummyForwarders(srv)
+	go runTestServer(t, srv)
+
+	tests := map[string]struct {
+		crt, key   string
+		upstream   string
+		shouldFail bool
+	}{
+		"allowed value":                   {crt: "clearance_secret.crt", key: "clearance_secret.key", upstream: "db"},
+		"value not allowed":               {crt: "clearance_public.crt", key: "clearance_public.key", upstream: "db", shouldFail: true},
+		"extension missing":               {crt: "sre.crt", key: "sre.key", upstream: "db", shouldFail: true},
+		"not required by other upstreams": {crt: "sre.crt", key: "sre.key", upstream: "web"},
+		"extension ignored elsewhere":     {crt: "clearance_secret.crt", key: "clearance_secret.key", upstream: "web"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := newUserClient(t, test.crt, test.key)
+			resp, err := client.Get("https://" + upstream[test.upstream])
+			if test.shouldFail {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("connection should have been denied")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		})
+	}
+}
+
+func TestListenerAddrs(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range cfg.Listeners {
+		if l.Upstream == "web" {
+			l.Addr = ""
+			l.Addrs = []string{"127.0.0.1:0", "127.0.0.1:0"}
+		}
+	}
+	srv, _ := newTestServerWithConfig(t, cfg)
+	injectDummyForwarders(srv)
+	go runTestServer(t, srv)
+
+	var addrs []string
+	for _, d := range srv.Downstreams {
+		if d.Upstream == "web" {
+			addrs = append(addrs, d.Addr().String())
+		}
+	}
+	if len(addrs) != 2 || addrs[0] == addrs[1] {
+		t.Fatalf("expected the web listener to bind two addresses got %v", addrs)
+	}
+	client := newUserClient(t, "sre.crt", "sre.key")
+	for _, addr := range addrs {
+		resp, err := client.Get("https://" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(string(body)) != "web" {
+			t.Errorf("expected %s to forward to web got %s", addr, body)
+		}
+	}
+}
+
+func TestTLSResumption(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disabled=%v", disabled), func(t *testing.T) {
+			cfg, err := LoadStaticConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.DisableTLSResumption = disabled
+			srv, upstream := newTestServerWithConfig(t, cfg)
+			fwdr := &identityForwarder{identities: make(chan *forwarder.Identity, 2)}
+			for _, d := range srv.Downstreams {
+				d.fwdr = fwdr
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go srv.ListenAndServe(ctx)
+
+			client := newUserClient(t, "sre.crt", "sre.key")
+			tr := client.Transport.(*http.Transport)
+			tr.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+			// Every request is a new connection which resumes the session of the previous one when allowed
+			tr.DisableKeepAlives = true
+			var resumed []bool
+			for range 2 {
+				resp, err := client.Get("https://" + upstream["web"])
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if server := (<-fwdr.identities).Resumed; server != resp.TLS.DidResume {
+					t.Errorf("expected the identity to agree with the client about resumption got %v", server)
+				}
+				resumed = append(resumed, resp.TLS.DidResume)
+			}
+			if resumed[0] || resumed[1] == disabled {
+				t.Errorf("expected only the second connection to resume when resumption is allowed got %v", resumed)
+			}
+		})
+	}
+}
+
+// earlyDataConn adds the early_data extension to the ClientHello written through it, as a client resuming a
+// session with 0-RTT would
+type earlyDataConn struct {
+	net.Conn
+	sent bool
+}
+
+func (c *earlyDataConn) Write(b []byte) (int, error) {
+	if c.sent {
+		return c.Conn.Write(b)
+	}
+	c.sent = true
+	// The ClientHello is one record of a 5 byte record header, a 4 byte handshake header, the fixed fields and
+	// the extensions last. Without a pre_shared_key, which must stay last, the extension can go at the end.
+	hello := slices.Clone(b)
+	length := func(at int, width int) int {
+		n := 0
+		for _, octet := range hello[at : at+width] {
+			n = n<<8 | int(octet)
+		}
+		return n
+	}
+	// Each length covering the extensions grows by the 4 bytes of the new one
+	grow := func(at int, width int) {
+		n := length(at, width) + 4
+		for i := width - 1; i >= 0; i-- {
+			hello[at+i] = byte(n)
+			n >>= 8
+		}
+	}
+	// Skip the version, random, session ID, cipher suites and compression methods
+	pos := 9 + 2 + 32
+	pos += 1 + length(pos, 1)
+	pos += 2 + length(pos, 2)
+	pos += 1 + length(pos, 1)
+	grow(3, 2)
+	grow(6, 3)
+	grow(pos, 2)
+	hello = append(hello, 0x00, 0x2a, 0x00, 0x00)
+	if _, err := c.Conn.Write(hello); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func TestEarlyDataRefused(t *testing.T) {
+	srv, upstream := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(ctx) }()
+	defer func() {
+		cancel()
+		<-errc
+	}()
+
+	conn, err := net.Dial("tcp", upstream["web"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tlsConf := newUserClient(t, "sre.crt", "sre.key").Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsConf.MinVersion = tls.VersionTLS13
+	tlsConf.ServerName = "127.0.0.1"
+	client := tls.Client(&earlyDataConn{Conn: conn}, tlsConf)
+	// mustNotForwarder fails the test if the connection reaches the forwarder
+	if err := client.Handshake(); err == nil || !strings.Contains(err.Error(), "unsupported extension") {
+		t.Fatalf("expected the server to refuse early data got %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.Rejections()[forwarder.HandshakeFailed] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the handshake offering early data to be counted as failed got %v", srv.Rejections())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCertFingerprint(t *testing.T) {
+	fingerprint := func(name string) string {
+		t.Helper()
+		crt, err := CertsFS.ReadFile("testcerts/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(crt)
+		sum := sha256.Sum256(block.Bytes)
+		return hex.EncodeToString(sum[:])
+	}
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.LogCertFingerprints = true
+	srv, upstream := newTestServerWithConfig(t, cfg)
+	fwdr := &identityForwarder{identities: make(chan *forwarder.Identity, 1)}
+	h := &recordingHandler{}
+	for _, d := range srv.Downstreams {
+		d.fwdr = fwdr
+		d.Authorizer.(*policyEnforcer).logger = slog.New(h)
+	}
+	go runTestServer(t, srv)
+
+	resp, err := newUserClient(t, "sre.crt", "sre.key").Get("https://" + upstream["web"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, expected := (<-fwdr.identities).CertFingerprint, fingerprint("sre.crt"); got != expected {
+		t.Errorf("expected the identity to carry the fingerprint %s got %q", expected, got)
+	}
+
+	// dba isn't allowed on web so the denial is audited
+	if resp, err := newUserClient(t, "dba.crt", "dba.key").Get("https://" + upstream["web"]); err == nil {
+		resp.Body.Close()
+		t.Fatal("connection should have been denied")
+	}
+	denied := h.find("access_denied")
+	if len(denied) != 1 {
+		t.Fatalf("expected a single access_denied event got %d", len(denied))
+	}
+	if got, expected := denied[0]["cert_fingerprint"].String(), fingerprint("dba.crt"); got != expected {
+		t.Errorf("expected the audit log to carry the fingerprint %s got %q", expected, got)
+	}
+}
+
+func TestMaxClientCertAge(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// old_sre.crt was issued in 2000 and sre.crt well after 2010
+	cfg.MaxClientCertAge = 20 * 365 * 24 * time.Hour
+	for _, up := range cfg.Upstreams {
+		if up.Name == "db" {
+			up.MaxClientCertAge = 100 * 365 * 24 * time.Hour
+		}
+	}
+	srv, upstream := newTestServerWithConfig(t, cfg)
+	injectDummyForwarders(srv)
+	go runTestServer(t, srv)
+
+	tests := map[string]struct {
+		crt, key   string
+		upstream   string
+		shouldFail bool
+	}{
+		"recent certificate":       {crt: "sre.crt", key: "sre.key", upstream: "web"},
+		"old certificate":          {crt: "old_sre.crt", key: "old_sre.key", upstream: "web", shouldFail: true},
+		"overridden by upstream":   {crt: "old_sre.crt", key: "old_sre.key", upstream: "db"},
+		"recent with the override": {crt: "sre.crt", key: "sre.key", upstream: "db"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := newUserClient(t, test.crt, test.key)
+			resp, err := client.Get("https://" + upstream[test.upstream])
+			if test.shouldFail {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("connection should have been denied")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		})
+	}
+}
+
+func TestIntermediateCA(t *testing.T) {
+	readCert := func(name string) []byte {
+		crt, err := CertsFS.ReadFile("testcerts/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return crt
+	}
+	intermediate := readCert("intermediate.crt")
+	otherRoot, otherIntermediate := readCert("other_root.crt"), readCert("other_intermediate.crt")
+	tests := map[string]struct {
+		// extraCAs are appended to the root of the static config
+		extraCAs   [][]byte
+		client     string
+		shouldFail bool
+	}{
+		"root only":              {client: "intermediate_sre", shouldFail: true},
+		"root with intermediate": {client: "intermediate_sre", extraCAs: [][]byte{intermediate}},
+		// An intermediate isn't a trust anchor by itself, it has to chain to a configured root
+		"intermediate without its root": {
+			client:     "other_intermediate_sre",
+			extraCAs:   [][]byte{otherIntermediate},
+			shouldFail: true,
+		},
+		"intermediate with its root": {
+			client:   "other_intermediate_sre",
+			extraCAs: [][]byte{otherRoot, otherIntermediate},
+		},
+		"intermediate of a different root": {
+			client:     "intermediate_sre",
+			extraCAs:   [][]byte{otherRoot, otherIntermediate},
+			shouldFail: true,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := LoadStaticConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ca := range test.extraCAs {
+				cfg.RootCA = append(cfg.RootCA, ca...)
+			}
+			srv, upstream := newTestServerWithConfig(t, cfg)
+			injectDummyForwarders(srv)
+			go runTestServer(t, srv)
+
+			// The client only presents its leaf so the server has to know the intermediate
+			client := newUserClient(t, test.client+".crt", test.client+".key")
+			resp, err := client.Get("https://" + upstream["web"])
+			if test.shouldFail {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("connection should have been denied")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		})
+	}
+}
+
+func TestRequiredCertExtensionInvalidOID(t *testing.T) {
+	for _, oid := range []string{"", "1", "1.3.six", "1.-3"} {
+		cfg, err := LoadStaticConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Upstreams[0].RequiredCertExtension = &config.CertExtension{OID: oid}
+		if _, err := NewDownstreamListeners(cfg, &mustNotForwarder{t: t}); err == nil {
+			t.Errorf("expected OID %q to be rejected", oid)
+		}
+	}
+}
+
+func TestWildcardTags(t *testing.T) {
+	policy, err := newPolicyEnforcerFromConfig(&config.Config{
+		Upstreams: []*config.Upstream{
+			{Name: "web", Tags: []string{"team.web.*", "sre"}},
+			{Name: "literal", Tags: []string{"team*", "*"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		upstream string
+		ou       string
+		allow    bool
+	}{
+		"child of wildcard":           {upstream: "web", ou: "team.web.frontend", allow: true},
+		"grandchild of wildcard":      {upstream: "web", ou: "team.web.frontend.cdn", allow: true},
+		"sibling hierarchy":           {upstream: "web", ou: "team.db.x"},
+		"wildcard prefix itself":      {upstream: "web", ou: "team.web"},
+		"partial segment":             {upstream: "web", ou: "team.webhooks"},
+		"exact tag":                   {upstream: "web", ou: "sre", allow: true},
+		"exact tag prefix":            {upstream: "web", ou: "sres"},
+		"star without dot is literal": {upstream: "literal", ou: "teamx"},
+		"bare star is literal":        {upstream: "literal", ou: "sre"},
+		"literal star matches itself": {upstream: "literal", ou: "team*", allow: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			allow, err := policy.Authorize(PolicyQuery{User: "user", OUs: []string{test.ou}, Upstream: test.upstream})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allow != test.allow {
+				t.Errorf("expected allow %v for OU %q on %s", test.allow, test.ou, test.upstream)
+			}
+		})
+	}
+}
+
+func TestNegotiatedTLS(t *testing.T) {
+	srv, upstream := newTestServer(t)
+	fwdr := &identityForwarder{identities: make(chan *forwarder.Identity, 1)}
+	for _, d := range srv.Downstreams {
+		d.fwdr = fwdr
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(ctx) }()
+	defer func() {
+		cancel()
+		<-errc
+	}()
+
+	tlsConf := newUserClient(t, "sre.crt", "sre.key").Transport.(*http.Transport).TLSClientConfig
+	conn, err := tls.Dial("tcp", upstream["web"], tlsConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cipher := tls.CipherSuiteName(conn.ConnectionState().CipherSuite)
+	finishRequest(t, conn, "web")
+
+	id := <-fwdr.identities
+	if id.TLSVersion != tls.VersionTLS13 || tls.CipherSuiteName(id.CipherSuite) != cipher {
+		t.Errorf("expected TLS 1.3 with %s got %s with %s", cipher, tls.VersionName(id.TLSVersion), tls.CipherSuiteName(id.CipherSuite))
+	}
+	negotiated := srv.NegotiatedTLS()
+	if negotiated.Versions["TLS 1.3"] != 1 || negotiated.CipherSuites[cipher] != 1 {
+		t.Errorf("expected one TLS 1.3 handshake with %s got %+v", cipher, negotiated)
+	}
+}
+
+func TestForwarderMetadata(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listeners = []*config.Listener{
+		{Addr: "127.0.0.1:0", Upstream: "web", ALPN: []config.ALPNRoute{{Protocol: "h2", Upstream: "web"}}},
+	}
+	srv, _ := newTestServerWithConfig(t, cfg)
+	rec := &routeRecorder{infos: make(chan forwarder.FwdInfo, 1)}
+	srv.Downstreams[0].fwdr = rec
+	addr := srv.Downstreams[0].listener.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(ctx) }()
+	defer func() {
+		cancel()
+		<-errc
+	}()
+
+	tlsConf := newUserClient(t, "sre.crt", "sre.key").Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsConf.NextProtos = []string{"h2"}
+	// The server certificate is only valid for its IP so skip verifying it to send a server name
+	tlsConf.ServerName = "web.internal"
+	tlsConf.InsecureSkipVerify = true
+	conn, err := tls.Dial("tcp", addr, tlsConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(conn)
+	conn.Close()
+
+	metadata := (<-rec.infos).Metadata
+	if got := metadata[forwarder.MetadataListener]; got != addr {
+		t.Errorf("expected listener %s got %v", addr, got)
+	}
+	if got := metadata[forwarder.MetadataALPN]; got != "h2" {
+		t.Errorf("expected alpn h2 got %v", got)
+	}
+	if got := metadata[forwarder.MetadataSNI]; got != "web.internal" {
+		t.Errorf("expected sni web.internal got %v", got)
+	}
+	id, ok := metadata[forwarder.MetadataIdentity].(*forwarder.Identity)
+	if !ok || id.User != "sre" {
+		t.Errorf("expected the identity of sre got %v", metadata[forwarder.MetadataIdentity])
+	}
+}
+
+func TestRateLimitKeySNI(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RateLimitKey = config.RateLimitByUserAndSNI
+	srv, addrs := newTestServerWithConfig(t, cfg)
+	rec := &routeRecorder{infos: make(chan forwarder.FwdInfo, 1)}
+	for _, d := range srv.Downstreams {
+		d.fwdr = rec
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe(ctx) }()
+	defer func() {
+		cancel()
+		<-errc
+	}()
+
+	tlsConf := newUserClient(t, "sre.crt", "sre.key").Transport.(*http.Transport).TLSClientConfig.Clone()
+	for _, sni := range []string{"api.internal", "admin.internal", ""} {
+		conf := tlsConf.Clone()
+		if sni != "" {
+			// The server certificate is only valid for its IP so skip verifying it to send a server name
+			conf.ServerName = sni
+			conf.InsecureSkipVerify = true
+		}
+		conn, err := tls.Dial("tcp", addrs["web"], conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(conn)
+		conn.Close()
+		info := <-rec.infos
+		if expect := sni + "/sre"; info.RateLimiterKey != expect {
+			t.Errorf("expected rate limiter key %q got %q", expect, info.RateLimiterKey)
+		}
+		id := info.Metadata[forwarder.MetadataIdentity].(*forwarder.Identity)
+		if id.ServerName != sni || id.User != "sre" {
+			t.Errorf("expected the identity of sre with sni %q got %+v", sni, id)
+		}
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	cfg, err := LoadStaticConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listeners[1].Tags = []string{"dba"}
+	crt, err := CertsFS.ReadFile("testcerts/sre.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := CertsFS.ReadFile("testcerts/sre.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Upstreams[0].BackendTLS = &config.BackendTLS{ClientCrt: crt, ClientKey: key}
+	srv, _ := newTestServerWithConfig(t, cfg)
+	defer func() {
+		for _, d := range srv.Downstreams {
+			d.listener.Close()
+		}
+	}()
+	fwdr := srv.Forwarder.(*forwarder.LeastConnections)
+	defer fwdr.Close(context.Background())
+
+	// A backend added after startup e.g. by a reload
+	web := *cfg.Upstreams[0]
+	web.Backends = []string{"127.0.0.1:1"}
+	if err := fwdr.LoadUpstream(&web); err != nil {
+		t.Fatal(err)
+	}
+
+	effective := srv.EffectiveConfig()
+	if effective.ServerKey != nil {
+		t.Error("ServerKey wasn't redacted")
+	}
+	if len(cfg.ServerKey) == 0 || len(cfg.Upstreams[0].BackendTLS.ClientKey) == 0 {
+		t.Error("redacting modified the config the server was created from")
+	}
+	if effective.HandshakeTimeout != defaultHandshakeTimeout {
+		t.Errorf("expected the default handshake timeout got %s", effective.HandshakeTimeout)
+	}
+	if len(effective.Listeners) != len(srv.Downstreams) {
+		t.Fatalf("expected %d listeners got %d", len(srv.Downstreams), len(effective.Listeners))
+	}
+	for i, l := range effective.Listeners {
+		if l.Addr != srv.Downstreams[i].Addr().String() {
+			t.Errorf("expected listener %d at its bound address %s got %s", i, srv.Downstreams[i].Addr(), l.Addr)
+		}
+	}
+	if !slices.Equal(effective.Listeners[1].Tags, []string{"dba"}) {
+		t.Errorf("expected the listener tag override got %v", effective.Listeners[1].Tags)
+	}
+
+	var names []string
+	for _, up := range effective.Upstreams {
+		names = append(names, up.Name)
+	}
+	if !slices.Equal(names, []string{"db", "telemetry", "web"}) {
+		t.Fatalf("expected every upstream sorted by name got %v", names)
+	}
+	got := effective.Upstreams[2]
+	if !slices.Equal(got.Backends, []string{"127.0.0.1:1"}) {
+		t.Errorf("expected the backend added at runtime got %v", got.Backends)
+	}
+	if !slices.Equal(got.Tags, []string{"sre", "webdev"}) {
+		t.Errorf("expected the enforced tags got %v", got.Tags)
+	}
+	if got.BackendTLS == nil || got.BackendTLS.ClientKey != nil || len(got.BackendTLS.ClientCrt) == 0 {
+		t.Errorf("expected only the backend client key to be redacted got %+v", got.BackendTLS)
+	}
+	if len(cfg.Upstreams[0].Backends) != 0 {
+		t.Error("loading an upstream modified the config the server was created from")
+	}
+}
@@ -0,0 +1,48 @@
+package srv
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+
+	"github.com/doggydogworld/gobalancer/config"
+	"github.com/doggydogworld/gobalancer/forwarder"
+)
+
+// rateLimitTiers picks the rate limit of a client from the tier its certificate puts it in
+type rateLimitTiers struct {
+	// oid is the extension holding the tier, the primary OU is used when nil
+	oid   asn1.ObjectIdentifier
+	tiers map[string]*config.RateLimit
+}
+
+func newRateLimitTiers(cfg *config.RateLimitTiers) (*rateLimitTiers, error) {
+	t := &rateLimitTiers{tiers: cfg.Tiers}
+	if cfg.OID != "" {
+		oid, err := parseOID(cfg.OID)
+		if err != nil {
+			return nil, fmt.Errorf("RateLimitTiers %w", err)
+		}
+		t.oid = oid
+	}
+	return t, nil
+}
+
+// rateLimit returns the rate limit of the client's tier and false if the client isn't in a tier
+func (t *rateLimitTiers) rateLimit(crt *x509.Certificate, id *forwarder.Identity) (*config.RateLimit, bool) {
+	var tier string
+	switch {
+	case t.oid != nil:
+		value, ok := extensionValue(crt, t.oid)
+		if !ok {
+			return nil, false
+		}
+		tier = value
+	case len(id.OUs) > 0:
+		tier = id.OUs[0]
+	default:
+		return nil, false
+	}
+	rl, ok := t.tiers[tier]
+	return rl, ok
+}